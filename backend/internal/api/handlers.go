@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -18,6 +19,9 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/guoxudong/horcrux/internal/engine"
 	"github.com/guoxudong/horcrux/internal/vault"
 )
@@ -27,13 +31,17 @@ type Handler struct {
 	hub                *Hub
 	syncerFactory      func(ctx context.Context, progress chan<- engine.Progress) syncerRunner
 	activeTaskCancels  sync.Map
+	activeArchiveJobs  sync.Map
 	registryReposCache sync.Map
 	registryTagsCache  sync.Map
 	pipesMu            sync.Mutex
+
+	archiveImportPaths []string
 }
 
 type syncerRunner interface {
-	SyncManifestList(opts engine.SyncOptions) error
+	SyncManifestList(opts engine.SyncOptions) (string, error)
+	MergeManifests(opts engine.MergeOptions) (*engine.MergeReport, error)
 }
 
 func NewHandler(v *vault.Vault, hub *Hub) *Handler {
@@ -60,7 +68,7 @@ func (h *Handler) Health(c *gin.Context) {
 }
 
 func (h *Handler) ListCredentials(c *gin.Context) {
-	creds, err := h.vault.LoadCredentials()
+	creds, rev, err := h.vault.Snapshot()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -70,19 +78,31 @@ func (h *Handler) ListCredentials(c *gin.Context) {
 	needsSave := false
 	for i := range creds {
 		if isWeirdID(creds[i].ID) {
-			creds[i].ID = fmt.Sprintf("cred_%d_%d", time.Now().Unix(), i)
 			needsSave = true
 		}
 	}
 
 	if needsSave {
-		h.vault.SaveCredentials(creds)
+		rev, err = h.vault.Modify(rev, func(stored []vault.Credential) ([]vault.Credential, error) {
+			for i := range stored {
+				if isWeirdID(stored[i].ID) {
+					stored[i].ID = fmt.Sprintf("cred_%d_%d", time.Now().Unix(), i)
+				}
+			}
+			creds = stored
+			return stored, nil
+		})
+		if err != nil {
+			c.JSON(vaultErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
 	}
 
-	// Don't return passwords
+	// Don't return passwords or tokens
 	for i := range creds {
-		creds[i].Password = "********"
+		creds[i] = creds[i].Redacted()
 	}
+	setVaultRevision(c, rev)
 	c.JSON(http.StatusOK, creds)
 }
 
@@ -99,6 +119,48 @@ func isWeirdID(id string) bool {
 	return false
 }
 
+// setVaultRevision sets the ETag of a response to the vault revision, to be
+// sent back as If-Match by updates and deletes.
+func setVaultRevision(c *gin.Context, rev uint64) {
+	c.Header("ETag", fmt.Sprintf("%q", strconv.FormatUint(rev, 10)))
+}
+
+// ifMatchRevision parses the If-Match header of a request. A missing
+// header or "*" returns vault.AnyRevision, which skips the revision check.
+func ifMatchRevision(c *gin.Context) (uint64, error) {
+	v := strings.TrimSpace(c.GetHeader("If-Match"))
+	if v == "" || v == "*" {
+		return vault.AnyRevision, nil
+	}
+	v = strings.Trim(strings.TrimPrefix(v, "W/"), `"`)
+	rev, err := strconv.ParseUint(v, 10, 64)
+	if err != nil || rev == vault.AnyRevision {
+		return 0, fmt.Errorf("invalid If-Match header %q", c.GetHeader("If-Match"))
+	}
+	return rev, nil
+}
+
+// vaultErrorStatus maps errors of the vault credential methods to an HTTP
+// status.
+func vaultErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, vault.ErrCredentialNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, vault.ErrCredentialExists):
+		return http.StatusConflict
+	case errors.Is(err, vault.ErrConflict):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, vault.ErrLocked):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// errHelperArgs is returned for requests setting the arguments of a
+// credential helper. They are passed to a local executable, so only the
+// CLI and server configuration may set them.
+var errHelperArgs = errors.New("helper_args can only be set from the CLI or server configuration")
+
 func (h *Handler) AddCredential(c *gin.Context) {
 	var cred vault.Credential
 	if err := c.ShouldBindJSON(&cred); err != nil {
@@ -106,20 +168,19 @@ func (h *Handler) AddCredential(c *gin.Context) {
 		return
 	}
 
-	creds, err := h.vault.LoadCredentials()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if len(cred.HelperArgs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errHelperArgs.Error()})
 		return
 	}
-
-	// 使用纳秒级时间戳生成唯一 ID，避免删除后 ID 碰撞
-	if cred.ID == "" {
-		cred.ID = fmt.Sprintf("cred_%d", time.Now().UnixNano())
+	if err := cred.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	creds = append(creds, cred)
-	if err := h.vault.SaveCredentials(creds); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// 使用纳秒级时间戳生成唯一 ID，避免删除后 ID 碰撞
+	cred, err := h.vault.AddCredential(cred)
+	if err != nil {
+		c.JSON(vaultErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
@@ -133,34 +194,39 @@ func (h *Handler) UpdateCredential(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	creds, err := h.vault.LoadCredentials()
+	rev, err := ifMatchRevision(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	found := false
-	for i, cred := range creds {
-		if cred.ID == id {
-			// Update fields (keep original password if not provided or masked)
-			if updatedCred.Password == "********" || updatedCred.Password == "" {
-				updatedCred.Password = cred.Password
-			}
-			updatedCred.ID = id // Ensure ID doesn't change
-			creds[i] = updatedCred
-			found = true
-			break
+	var invalid error
+	_, err = h.vault.UpdateCredential(id, rev, func(cred *vault.Credential) error {
+		// Update fields (keep original password if not provided or masked)
+		if updatedCred.Password == vault.MaskedSecret || updatedCred.Password == "" {
+			updatedCred.Password = cred.Password
 		}
-	}
-
-	if !found {
-		c.JSON(http.StatusNotFound, gin.H{"error": "credential not found"})
+		if updatedCred.Token == vault.MaskedSecret || updatedCred.Token == "" {
+			updatedCred.Token = cred.Token
+		}
+		if updatedCred.HelperArgs == nil {
+			updatedCred.HelperArgs = cred.HelperArgs
+		} else if !slices.Equal(updatedCred.HelperArgs, cred.HelperArgs) {
+			invalid = errHelperArgs
+			return invalid
+		}
+		if invalid = updatedCred.Validate(); invalid != nil {
+			return invalid
+		}
+		*cred = updatedCred
+		return nil
+	})
+	if invalid != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": invalid.Error()})
 		return
 	}
-
-	if err := h.vault.SaveCredentials(creds); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err != nil {
+		c.JSON(vaultErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
@@ -169,30 +235,14 @@ func (h *Handler) UpdateCredential(c *gin.Context) {
 
 func (h *Handler) DeleteCredential(c *gin.Context) {
 	id := c.Param("id")
-
-	creds, err := h.vault.LoadCredentials()
+	rev, err := ifMatchRevision(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	newCreds := []vault.Credential{}
-	found := false
-	for _, cred := range creds {
-		if cred.ID == id {
-			found = true
-			continue
-		}
-		newCreds = append(newCreds, cred)
-	}
-
-	if !found {
-		c.JSON(http.StatusNotFound, gin.H{"error": "credential not found"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if err := h.vault.SaveCredentials(newCreds); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if _, err := h.vault.DeleteCredential(id, rev); err != nil {
+		c.JSON(vaultErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
@@ -239,6 +289,40 @@ func (h *Handler) VerifyCredential(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": "success"})
 }
 
+// RotateVaultKeyRequest is the body of RotateVaultKey.
+type RotateVaultKeyRequest struct {
+	OldPassphrase string `json:"old_passphrase" binding:"required"`
+	NewPassphrase string `json:"new_passphrase" binding:"required"`
+}
+
+// RotateVaultKey re-encrypts the vault with a new passphrase. The running
+// server switches to the new key at once; HORCRUX_SECRET must be updated
+// before the next start.
+func (h *Handler) RotateVaultKey(c *gin.Context) {
+	var req RotateVaultKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	backup, err := h.vault.RotatePassphrase(req.OldPassphrase, req.NewPassphrase)
+	if errors.Is(err, vault.ErrWrongPassphrase) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "old passphrase is wrong"})
+		return
+	}
+	if errors.Is(err, vault.ErrInvalidPassphrase) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	fmt.Printf("[API] Vault key rotated, backup %s\n", backup)
+	c.JSON(http.StatusOK, gin.H{"status": "rotated", "backup": backup})
+}
+
 type cachedStringList struct {
 	ExpiresAt time.Time
 	Values    []string
@@ -353,9 +437,11 @@ func (h *Handler) registryGet(ctx context.Context, baseURL string, path string,
 	}
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("User-Agent", "horcrux/registry-query")
-	if cred != nil && cred.Username != "" {
-		req.SetBasicAuth(cred.Username, cred.Password)
+	auth, err := cred.ResolveAuth(ctx)
+	if err != nil {
+		return nil, nil, 0, err
 	}
+	vault.SetRequestAuth(req, auth)
 	client := newRegistryHTTPClient()
 	resp, err := client.Do(req)
 	if err != nil {
@@ -374,10 +460,11 @@ func (h *Handler) registryGet(ctx context.Context, baseURL string, path string,
 	if readErr != nil {
 		return nil, resp.Header, resp.StatusCode, readErr
 	}
-	if resp.StatusCode == http.StatusUnauthorized {
+	// A rejected static bearer token cannot be exchanged for another one
+	if resp.StatusCode == http.StatusUnauthorized && auth.RegistryToken == "" {
 		ch := parseBearerChallenge(resp.Header.Get("Www-Authenticate"))
 		if ch.Realm != "" {
-			token, tokenErr := fetchBearerToken(ctx, ch, cred)
+			token, tokenErr := fetchBearerToken(ctx, ch, auth)
 			if tokenErr != nil {
 				return body, resp.Header, resp.StatusCode, tokenErr
 			}
@@ -409,7 +496,7 @@ func (h *Handler) registryGet(ctx context.Context, baseURL string, path string,
 	return body, resp.Header, resp.StatusCode, nil
 }
 
-func fetchBearerToken(ctx context.Context, ch bearerChallenge, cred *vault.Credential) (string, error) {
+func fetchBearerToken(ctx context.Context, ch bearerChallenge, auth authn.AuthConfig) (string, error) {
 	if ch.Realm == "" {
 		return "", errors.New("missing bearer realm")
 	}
@@ -424,17 +511,35 @@ func fetchBearerToken(ctx context.Context, ch bearerChallenge, cred *vault.Crede
 	if ch.Scope != "" {
 		q.Set("scope", ch.Scope)
 	}
-	u.RawQuery = q.Encode()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
-	if err != nil {
-		return "", err
+	var req *http.Request
+	if auth.IdentityToken != "" {
+		// OAuth2 refresh token grant, as docker does with identity tokens
+		form := url.Values{}
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", auth.IdentityToken)
+		form.Set("client_id", "horcrux")
+		if ch.Service != "" {
+			form.Set("service", ch.Service)
+		}
+		if ch.Scope != "" {
+			form.Set("scope", ch.Scope)
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		u.RawQuery = q.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		vault.SetRequestAuth(req, auth)
 	}
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("User-Agent", "horcrux/registry-query")
-	if cred != nil && cred.Username != "" {
-		req.SetBasicAuth(cred.Username, cred.Password)
-	}
 
 	resp, err := newRegistryHTTPClient().Do(req)
 	if err != nil {
@@ -572,7 +677,7 @@ func (h *Handler) ListRegistryRepositories(c *gin.Context) {
 		pass := strings.TrimSpace(cred.Password)
 		passMasked := cred.Password == "********"
 		log.Printf("[API][registry] repositories auth_check cred_id=%s registry=%s user_len=%d pass_len=%d masked=%t", credID, registry, len(user), len(pass), passMasked)
-		if user != "" && (pass == "" || passMasked) {
+		if cred.AuthKind() == vault.AuthBasic && (pass == "" || passMasked) {
 			c.JSON(http.StatusBadRequest, gin.H{
 				"error":           "Registry_Auth 密码为空或已被脱敏，请重新保存凭证密码后再试",
 				"upstream_status": 0,
@@ -843,7 +948,7 @@ func (h *Handler) ListRegistryTags(c *gin.Context) {
 		pass := strings.TrimSpace(cred.Password)
 		passMasked := cred.Password == "********"
 		log.Printf("[API][registry] tags auth_check cred_id=%s user_len=%d pass_len=%d masked=%t", credID, len(user), len(pass), passMasked)
-		if user != "" && (pass == "" || passMasked) {
+		if cred.AuthKind() == vault.AuthBasic && (pass == "" || passMasked) {
 			c.JSON(http.StatusBadRequest, gin.H{
 				"error":           "Registry_Auth 密码为空或已被脱敏，请重新保存凭证密码后再试",
 				"upstream_status": 0,
@@ -931,11 +1036,16 @@ func (h *Handler) ListRegistryTags(c *gin.Context) {
 
 type SyncTask struct {
 	ID              string            `json:"id"`
-	Mode            string            `json:"mode,omitempty"` // single, batch
+	Mode            string            `json:"mode,omitempty"` // single, batch, merge
 	SourceRef       string            `json:"source_ref"`
+	SourceDigest    string            `json:"source_digest,omitempty"` // pinned source digest
 	TargetRef       string            `json:"target_ref"`
 	SourceID        string            `json:"source_id"`
 	TargetID        string            `json:"target_id"`
+	Sources         []SyncSource      `json:"sources,omitempty"` // merge sources
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	Flatten         bool              `json:"flatten,omitempty"`
+	PlatformPolicy  string            `json:"platform_policy,omitempty"`
 	Targets         []TargetSyncState `json:"targets,omitempty"`
 	Status          string            `json:"status"` // pending, running, success, failed, canceled
 	FailFast        bool              `json:"fail_fast,omitempty"`
@@ -958,6 +1068,10 @@ type TargetSyncState struct {
 	Error     string     `json:"error,omitempty"`
 	StartedAt *time.Time `json:"started_at,omitempty"`
 	EndedAt   *time.Time `json:"ended_at,omitempty"`
+	// SyncedDigest is the digest of the manifest pushed to the target
+	SyncedDigest string `json:"synced_digest,omitempty"`
+	// MergeReport lists the source of each platform pushed by a merge task
+	MergeReport *engine.MergeReport `json:"merge_report,omitempty"`
 }
 
 func (h *Handler) getDataPath(sub ...string) string {
@@ -1130,7 +1244,8 @@ func (h *Handler) saveTask(task *SyncTask) {
 	tasksDir := h.getDataPath("tasks")
 	os.MkdirAll(tasksDir, 0755)
 	data, _ := json.MarshalIndent(task, "", "  ")
-	os.WriteFile(filepath.Join(tasksDir, task.ID+".json"), data, 0644)
+	// Replace atomically: GetTask/CancelTask may read while a sync is saving
+	_ = writeFileAtomic(filepath.Join(tasksDir, task.ID+".json"), data, 0644)
 }
 
 func writeTaskFile(taskPath string, task *SyncTask) error {
@@ -1138,7 +1253,7 @@ func writeTaskFile(taskPath string, task *SyncTask) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(taskPath, data, 0644)
+	return writeFileAtomic(taskPath, data, 0644)
 }
 
 func parseTaskCompat(data []byte, fallbackID string) (*SyncTask, bool, []string, error) {
@@ -1568,11 +1683,25 @@ type SyncTargetRequest struct {
 	TargetID  string `json:"target_id"`
 }
 
+// SyncSource is one source of a merge task: a registry reference with its
+// credential, or an archive:// reference.
+type SyncSource struct {
+	SourceRef string `json:"source_ref"`
+	SourceID  string `json:"source_id,omitempty"`
+}
+
+// SyncRequest starts a sync task. With sources instead of source_ref the
+// sources are merged into one manifest list pushed to every target.
 type SyncRequest struct {
 	SourceRef      string              `json:"source_ref"`
+	SourceDigest   string              `json:"source_digest"` // refuse to push another digest
 	TargetRef      string              `json:"target_ref"`
 	SourceID       string              `json:"source_id"`
 	TargetID       string              `json:"target_id"`
+	Sources        []SyncSource        `json:"sources"`
+	Annotations    map[string]string   `json:"annotations"`
+	Flatten        *bool               `json:"flatten"`         // merge platform images of multi-arch sources (default true)
+	PlatformPolicy string              `json:"platform_policy"` // error, first or newest
 	Targets        []SyncTargetRequest `json:"targets"`
 	Concurrency    *int                `json:"concurrency"`
 	MaxRetries     *int                `json:"max_retries"`
@@ -1627,6 +1756,27 @@ func refHasExplicitRegistry(ref string) bool {
 	return strings.Contains(first, ".") || strings.Contains(first, ":")
 }
 
+// sourceDigestPin returns the digest a sync of ref is pinned to: the
+// requested source_digest, or the digest of a repo@sha256: reference.
+func sourceDigestPin(ref, expected string) (string, error) {
+	expected = strings.TrimSpace(expected)
+	if expected != "" {
+		if _, err := v1.NewHash(expected); err != nil {
+			return "", fmt.Errorf("invalid source_digest: %v", err)
+		}
+	}
+	if strings.HasPrefix(ref, "archive://") {
+		return expected, nil
+	}
+	if d, err := name.NewDigest(ref); err == nil {
+		if expected != "" && expected != d.DigestStr() {
+			return "", fmt.Errorf("source_digest %s does not match source_ref %s", expected, ref)
+		}
+		return d.DigestStr(), nil
+	}
+	return expected, nil
+}
+
 func normalizeImageRef(ref string, cred *vault.Credential) (string, bool) {
 	r := strings.TrimSpace(ref)
 	if r == "" || cred == nil {
@@ -2362,10 +2512,18 @@ func (h *Handler) ExecuteSync(c *gin.Context) {
 	}
 
 	sourceRefRaw := strings.TrimSpace(req.SourceRef)
-	if sourceRefRaw == "" {
+	if sourceRefRaw != "" && len(req.Sources) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Specify either source_ref or sources, not both"})
+		return
+	}
+	if sourceRefRaw == "" && len(req.Sources) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "source_ref is required"})
 		return
 	}
+	if len(req.Sources) > 0 && strings.TrimSpace(req.SourceDigest) != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "source_digest applies to source_ref; pin merge sources with repo@sha256: references"})
+		return
+	}
 
 	targetsInput := req.Targets
 	if len(targetsInput) == 0 && strings.TrimSpace(req.TargetRef) != "" {
@@ -2380,11 +2538,30 @@ func (h *Handler) ExecuteSync(c *gin.Context) {
 	}
 
 	creds, _ := h.vault.LoadCredentials()
+	var sources []SyncSource
+	var platformPolicy string
+	if len(req.Sources) > 0 {
+		var err error
+		if sources, err = normalizeSyncSources(req.Sources, creds); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if platformPolicy, err = engine.ParsePlatformPolicy(req.PlatformPolicy); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		sourceRefRaw = mergeSourceSummary(sources)
+	}
 	srcAuth := findCredentialByID(creds, strings.TrimSpace(req.SourceID))
 	sourceRef := sourceRefRaw
 	if normalized, changed := normalizeImageRef(sourceRef, srcAuth); changed {
 		sourceRef = normalized
 	}
+	sourceDigest, err := sourceDigestPin(sourceRef, req.SourceDigest)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	seenTargets := make(map[string]bool, len(targetsInput))
 	deduped := make([]SyncTargetRequest, 0, len(targetsInput))
@@ -2438,6 +2615,7 @@ func (h *Handler) ExecuteSync(c *gin.Context) {
 		ID:             fmt.Sprintf("task_%d", time.Now().UnixNano()),
 		Mode:           "batch",
 		SourceRef:      sourceRef,
+		SourceDigest:   sourceDigest,
 		SourceID:       strings.TrimSpace(req.SourceID),
 		Status:         "running",
 		FailFast:       failFast,
@@ -2452,6 +2630,15 @@ func (h *Handler) ExecuteSync(c *gin.Context) {
 		task.TargetRef = deduped[0].TargetRef
 		task.TargetID = deduped[0].TargetID
 	}
+	if len(sources) > 0 {
+		task.Mode = "merge"
+		task.SourceID = ""
+		task.Sources = sources
+		task.Annotations = req.Annotations
+		// Nesting multi-arch sources is opt-in, as in the CLI
+		task.Flatten = req.Flatten == nil || *req.Flatten
+		task.PlatformPolicy = platformPolicy
+	}
 
 	task.Targets = make([]TargetSyncState, 0, len(deduped))
 	for _, t := range deduped {
@@ -2528,9 +2715,19 @@ func (h *Handler) RetryTask(c *gin.Context) {
 	}
 
 	req := SyncRequest{
-		SourceRef: orig.SourceRef,
-		SourceID:  orig.SourceID,
-		Targets:   targets,
+		SourceRef:    orig.SourceRef,
+		SourceDigest: orig.SourceDigest,
+		SourceID:     orig.SourceID,
+		Targets:      targets,
+	}
+	if len(orig.Sources) > 0 {
+		req.SourceRef = ""
+		req.SourceID = ""
+		req.Sources = orig.Sources
+		req.Annotations = orig.Annotations
+		flatten := orig.Flatten
+		req.Flatten = &flatten
+		req.PlatformPolicy = orig.PlatformPolicy
 	}
 	if orig.Concurrency > 0 {
 		req.Concurrency = &orig.Concurrency
@@ -2817,17 +3014,36 @@ func (h *Handler) runSingleTargetSync(
 			}
 		}(task.Targets[targetIdx].TargetRef)
 
-		layoutPath, _ := h.resolveArchiveRef(task.SourceRef)
-
-		opts := engine.SyncOptions{
-			SourceRef:        task.SourceRef,
-			TargetRef:        task.Targets[targetIdx].TargetRef,
-			SourceAuth:       srcAuth,
-			TargetAuth:       getTargetAuth(task.Targets[targetIdx].TargetID),
-			SourceLayoutPath: layoutPath,
+		var err error
+		var digest string
+		var report *engine.MergeReport
+		if len(task.Sources) > 0 {
+			var opts engine.MergeOptions
+			opts, err = h.mergeOptions(task, creds)
+			if err == nil {
+				opts.TargetRef = task.Targets[targetIdx].TargetRef
+				opts.TargetAuth = getTargetAuth(task.Targets[targetIdx].TargetID)
+				report, err = runner.MergeManifests(opts)
+				if report != nil {
+					digest = report.Digest
+				}
+			}
+		} else {
+			var layoutPath, layoutDigest string
+			layoutPath, layoutDigest, err = h.resolveArchiveRef(task.SourceRef)
+			if err == nil {
+				opts := engine.SyncOptions{
+					SourceRef:          task.SourceRef,
+					TargetRef:          task.Targets[targetIdx].TargetRef,
+					SourceAuth:         srcAuth,
+					TargetAuth:         getTargetAuth(task.Targets[targetIdx].TargetID),
+					SourceLayoutPath:   layoutPath,
+					SourceLayoutDigest: layoutDigest,
+					ExpectedDigest:     task.SourceDigest,
+				}
+				digest, err = runner.SyncManifestList(opts)
+			}
 		}
-
-		err := runner.SyncManifestList(opts)
 		close(progress)
 		<-done
 
@@ -2838,6 +3054,8 @@ func (h *Handler) runSingleTargetSync(
 				task.Targets[targetIdx].EndedAt = &now
 				task.Targets[targetIdx].Progress = 1
 				task.Targets[targetIdx].Error = ""
+				task.Targets[targetIdx].SyncedDigest = digest
+				task.Targets[targetIdx].MergeReport = report
 				h.saveTask(task)
 				h.broadcastTaskEvent(TaskEvent{
 					Type:         "target_update",
@@ -2937,7 +3155,7 @@ func (h *Handler) runSingleTargetSync(
 }
 
 func isRetryableError(err error) bool {
-	if err == nil {
+	if err == nil || errors.Is(err, engine.ErrDigestMismatch) {
 		return false
 	}
 	msg := strings.ToLower(err.Error())
@@ -2967,15 +3185,20 @@ func isRetryableError(err error) bool {
 	}
 }
 
-func (h *Handler) resolveArchiveRef(ref string) (string, error) {
+// resolveArchiveRef maps an archive:// reference to the OCI layout holding
+// the archive and the digest of its content within that layout: the
+// archive digest, which for a single image is the image under the store
+// root (empty for legacy per-archive layouts). Non-archive references
+// resolve to "".
+func (h *Handler) resolveArchiveRef(ref string) (string, string, error) {
 	if !strings.HasPrefix(ref, "archive://") {
-		return "", nil
+		return "", "", nil
 	}
 	id := strings.TrimPrefix(ref, "archive://")
 
 	// Ensure metadata is loaded
 	if err := h.loadArchivesMeta(); err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	archivesMu.Lock()
@@ -2983,11 +3206,17 @@ func (h *Handler) resolveArchiveRef(ref string) (string, error) {
 
 	for _, m := range archivesMeta {
 		if m.ID == id {
-			return m.Path, nil
+			if !m.IsReady() {
+				return "", "", fmt.Errorf("archive %s is not ready (status: %s)", id, m.Status)
+			}
+			if m.Root == "" || m.Digest == "" {
+				return m.Path, m.Root, nil
+			}
+			return m.Path, m.Digest, nil
 		}
 	}
 
-	return "", fmt.Errorf("archive not found: %s", id)
+	return "", "", fmt.Errorf("archive not found: %s", id)
 }
 
 func getDirSize(path string) (int64, error) {
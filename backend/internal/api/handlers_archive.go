@@ -1,11 +1,11 @@
 package api
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -15,10 +15,10 @@ import (
 
 	"github.com/gin-gonic/gin"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/layout"
-	"github.com/google/go-containerregistry/pkg/v1/mutate"
-	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/guoxudong/horcrux/internal/archive"
+	"github.com/guoxudong/horcrux/internal/engine"
+	"github.com/guoxudong/horcrux/internal/volume"
 )
 
 type ArchiveMeta struct {
@@ -26,17 +26,119 @@ type ArchiveMeta struct {
 	Name         string    `json:"name"`
 	Size         int64     `json:"size"`
 	CreatedAt    time.Time `json:"created_at"`
-	Path         string    `json:"path"`
+	Path         string    `json:"path"`           // OCI layout holding the archive
+	Root         string    `json:"root,omitempty"` // Index digest in the shared store; empty for legacy per-archive layouts
 	Ref          string    `json:"ref"`
 	Architecture string    `json:"architecture,omitempty"`
 	OS           string    `json:"os,omitempty"`
 	Tag          string    `json:"tag,omitempty"`
 	Digest       string    `json:"digest,omitempty"`
+	Status       string    `json:"status,omitempty"` // processing, ready, failed (empty means ready)
+	Error        string    `json:"error,omitempty"`
+	JobID        string    `json:"job_id,omitempty"`
+}
+
+// Archive statuses
+const (
+	ArchiveStatusProcessing = "processing"
+	ArchiveStatusReady      = "ready"
+	ArchiveStatusFailed     = "failed"
+)
+
+// IsReady reports whether the archive layout can be used as a sync source.
+func (m ArchiveMeta) IsReady() bool {
+	return m.Status == "" || m.Status == ArchiveStatusReady
+}
+
+// openArchiveIndex returns the image index of an archive, either from the
+// shared store or from a legacy per-archive layout.
+func openArchiveIndex(m ArchiveMeta) (v1.ImageIndex, error) {
+	l, err := layout.ImageIndexFromPath(m.Path)
+	if err != nil {
+		return nil, err
+	}
+	if m.Root == "" {
+		return l, nil
+	}
+	h, err := v1.NewHash(m.Root)
+	if err != nil {
+		return nil, err
+	}
+	return l.ImageIndex(h)
+}
+
+// archiveStore returns the blob store shared by all archives.
+func (h *Handler) archiveStore() (*archive.Store, error) {
+	return archive.OpenStore(h.getDataPath("archive_store"))
+}
+
+// MigrateLegacyArchives moves archives still kept in their own layout
+// directory into the shared store. The metadata is saved before the old
+// directories are removed, so an interrupted run never loses an archive.
+// It returns the number of migrated archives.
+func (h *Handler) MigrateLegacyArchives() (int, error) {
+	archivesWriteMu.Lock()
+	defer archivesWriteMu.Unlock()
+	return h.migrateLegacyArchives()
+}
+
+// migrateLegacyArchives is MigrateLegacyArchives for callers holding
+// archivesWriteMu.
+func (h *Handler) migrateLegacyArchives() (int, error) {
+	if err := h.loadArchivesMeta(); err != nil {
+		return 0, fmt.Errorf("failed to load archives metadata: %w", err)
+	}
+	store, err := h.archiveStore()
+	if err != nil {
+		return 0, err
+	}
+
+	var oldPaths []string
+	archivesMu.Lock()
+	for i := range archivesMeta {
+		m := &archivesMeta[i]
+		if !m.IsReady() || m.Root != "" {
+			continue
+		}
+		l, err := layout.ImageIndexFromPath(m.Path)
+		if err != nil {
+			fmt.Printf("[API] Failed to migrate archive %s into shared store: %v\n", m.ID, err)
+			continue
+		}
+		desc, err := store.Add(m.ID, l)
+		if err != nil {
+			fmt.Printf("[API] Failed to migrate archive %s into shared store: %v\n", m.ID, err)
+			continue
+		}
+		oldPaths = append(oldPaths, m.Path)
+		m.Path = store.Path()
+		m.Root = desc.Digest.String()
+	}
+	archivesMu.Unlock()
+
+	if len(oldPaths) == 0 {
+		return 0, nil
+	}
+	if err := h.saveArchivesMeta(); err != nil {
+		return 0, fmt.Errorf("failed to save archives metadata: %w", err)
+	}
+
+	// Only archives/<id>/layout directories are ours to remove
+	for _, oldPath := range oldPaths {
+		parent := filepath.Dir(oldPath)
+		if filepath.Base(oldPath) == "layout" && filepath.Base(filepath.Dir(parent)) == "archives" {
+			os.RemoveAll(parent)
+		}
+	}
+	return len(oldPaths), nil
 }
 
 var (
 	archivesMu   sync.Mutex
 	archivesMeta []ArchiveMeta
+
+	// archivesWriteMu serializes load-modify-save cycles on archives.json
+	archivesWriteMu sync.Mutex
 )
 
 func (h *Handler) loadArchivesMeta() error {
@@ -70,7 +172,74 @@ func (h *Handler) saveArchivesMeta() error {
 	return os.WriteFile(path, data, 0644)
 }
 
+// addArchives prepends new entries to the archive list and persists it.
+func (h *Handler) addArchives(metas ...ArchiveMeta) error {
+	archivesWriteMu.Lock()
+	defer archivesWriteMu.Unlock()
+	return h.addArchivesLocked(metas...)
+}
+
+// addArchivesLocked is addArchives for callers holding archivesWriteMu.
+func (h *Handler) addArchivesLocked(metas ...ArchiveMeta) error {
+	if err := h.loadArchivesMeta(); err != nil {
+		return err
+	}
+	archivesMu.Lock()
+	archivesMeta = append(append([]ArchiveMeta{}, metas...), archivesMeta...)
+	archivesMu.Unlock()
+	return h.saveArchivesMeta()
+}
+
+// removeArchive drops the entry with the given ID from the archive list and
+// persists it. Data on disk is left alone.
+func (h *Handler) removeArchive(id string) error {
+	archivesWriteMu.Lock()
+	defer archivesWriteMu.Unlock()
+
+	if err := h.loadArchivesMeta(); err != nil {
+		return err
+	}
+	archivesMu.Lock()
+	kept := []ArchiveMeta{}
+	for _, m := range archivesMeta {
+		if m.ID != id {
+			kept = append(kept, m)
+		}
+	}
+	archivesMeta = kept
+	archivesMu.Unlock()
+	return h.saveArchivesMeta()
+}
+
+// updateArchive applies fn to the archive entry with the given ID and persists
+// the list. It returns false if no such entry exists.
+func (h *Handler) updateArchive(id string, fn func(m *ArchiveMeta)) (bool, error) {
+	archivesWriteMu.Lock()
+	defer archivesWriteMu.Unlock()
+
+	if err := h.loadArchivesMeta(); err != nil {
+		return false, err
+	}
+	found := false
+	archivesMu.Lock()
+	for i := range archivesMeta {
+		if archivesMeta[i].ID == id {
+			fn(&archivesMeta[i])
+			found = true
+			break
+		}
+	}
+	archivesMu.Unlock()
+	if !found {
+		return false, nil
+	}
+	return true, h.saveArchivesMeta()
+}
+
 func (h *Handler) ListArchives(c *gin.Context) {
+	archivesWriteMu.Lock()
+	defer archivesWriteMu.Unlock()
+
 	if err := h.loadArchivesMeta(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load archives metadata"})
 		return
@@ -80,7 +249,17 @@ func (h *Handler) ListArchives(c *gin.Context) {
 	// Check if any repair is needed
 	var needsSave bool
 	for i := range archivesMeta {
-		if repairArchiveMeta(&archivesMeta[i]) {
+		m := &archivesMeta[i]
+		if m.Status == ArchiveStatusProcessing {
+			// The ingestion job died with a previous server process
+			if _, active := h.activeArchiveJobs.Load(m.JobID); !active {
+				m.Status = ArchiveStatusFailed
+				m.Error = "ingestion interrupted"
+				needsSave = true
+			}
+			continue
+		}
+		if m.IsReady() && repairArchiveMeta(m) {
 			needsSave = true
 		}
 	}
@@ -97,8 +276,15 @@ func (h *Handler) ListArchives(c *gin.Context) {
 }
 
 // UploadArchive handles uploading of one or multiple archives.
-// It parses each archive, converts it to OCI Layout, and stores metadata.
+// Each archive is stored and then converted to OCI Layout by a background
+// ingestion job; the entries are listed as "processing" until it finishes.
+// A JSON body (ArchiveImportRequest) imports from a URL or server path instead.
 func (h *Handler) UploadArchive(c *gin.Context) {
+	if c.ContentType() == "application/json" {
+		h.importArchive(c)
+		return
+	}
+
 	form, err := c.MultipartForm()
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid form data"})
@@ -112,166 +298,246 @@ func (h *Handler) UploadArchive(c *gin.Context) {
 	}
 
 	var uploadedArchives []ArchiveMeta
+	var jobs []*ArchiveJob
 	var errors []string
 
+	// A volume set is uploaded as its index together with the volumes it
+	// lists; the volumes are imported through the index only
+	byName := map[string]*multipart.FileHeader{}
 	for _, fileHeader := range files {
-		// Generate ID
-		id := fmt.Sprintf("archive_%d_%s", time.Now().UnixNano(), sanitizeName(fileHeader.Filename))
-		baseDir := h.getDataPath("archives", id)
-		if err := os.MkdirAll(baseDir, 0755); err != nil {
-			errors = append(errors, fmt.Sprintf("%s: Failed to create directory", fileHeader.Filename))
+		byName[filepath.Base(fileHeader.Filename)] = fileHeader
+	}
+	inSet := map[*multipart.FileHeader]bool{}
+	for _, fileHeader := range files {
+		if !volume.IsIndex(fileHeader.Filename) {
 			continue
 		}
-
-		// Save temp file
-		tmpPath := filepath.Join(baseDir, "temp.tar")
-		out, err := os.Create(tmpPath)
-		if err != nil {
-			errors = append(errors, fmt.Sprintf("%s: Failed to create temp file", fileHeader.Filename))
-			continue
+		if ix, _, err := readUploadedIndex(fileHeader); err == nil {
+			for _, v := range ix.Volumes {
+				if fh, ok := byName[v.Name]; ok {
+					inSet[fh] = true
+				}
+			}
 		}
+	}
 
-		src, err := fileHeader.Open()
-		if err != nil {
-			out.Close()
-			errors = append(errors, fmt.Sprintf("%s: Failed to open uploaded file", fileHeader.Filename))
+	for _, fileHeader := range files {
+		if inSet[fileHeader] {
 			continue
 		}
-
-		_, err = io.Copy(out, src)
-		src.Close()
-		out.Close()
-		if err != nil {
-			errors = append(errors, fmt.Sprintf("%s: Failed to save uploaded file", fileHeader.Filename))
-			continue
+		filename, size := fileHeader.Filename, fileHeader.Size
+		stage := func(dir string) (string, error) {
+			tmpPath := filepath.Join(dir, "temp.tar")
+			return tmpPath, saveUploadedFile(fileHeader, tmpPath)
 		}
-
-		// Parse Metadata from Docker Manifest inside tar
-		repoTags, err := extractRepoTags(tmpPath)
-		if err != nil {
-			// Non-fatal, just log
-			fmt.Printf("Warning: failed to extract repo tags from %s: %v\n", fileHeader.Filename, err)
+		if volume.IsIndex(fileHeader.Filename) {
+			ix, data, err := readUploadedIndex(fileHeader)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("%s: %v", fileHeader.Filename, err))
+				continue
+			}
+			var missing []string
+			for _, v := range ix.Volumes {
+				if _, ok := byName[v.Name]; !ok {
+					missing = append(missing, v.Name)
+				}
+			}
+			if len(missing) > 0 {
+				errors = append(errors, fmt.Sprintf("%s: volume(s) not uploaded: %s", fileHeader.Filename, strings.Join(missing, ", ")))
+				continue
+			}
+			filename = strings.TrimSuffix(filepath.Base(fileHeader.Filename), volume.IndexSuffix)
+			size = ix.Size
+			stage = func(dir string) (string, error) {
+				for _, v := range ix.Volumes {
+					if err := saveUploadedFile(byName[v.Name], filepath.Join(dir, v.Name)); err != nil {
+						return "", fmt.Errorf("%s: %v", v.Name, err)
+					}
+				}
+				indexPath := volume.IndexPath(filepath.Join(dir, filename))
+				if err := os.WriteFile(indexPath, data, 0644); err != nil {
+					return "", fmt.Errorf("Failed to save volume index")
+				}
+				return indexPath, nil
+			}
 		}
 
-		// Load as tarball image to get Config (Arch/OS)
-		img, err := tarball.ImageFromPath(tmpPath, nil)
+		// Generate ID
+		id := fmt.Sprintf("archive_%d_%s", time.Now().UnixNano(), sanitizeName(filename))
+		job, meta, err := h.startArchiveIngest(id, filename, size, stage)
 		if err != nil {
-			errors = append(errors, fmt.Sprintf("%s: Invalid image archive: %v", fileHeader.Filename, err))
-			os.RemoveAll(baseDir) // Cleanup
+			errors = append(errors, fmt.Sprintf("%s: %v", fileHeader.Filename, err))
 			continue
 		}
 
-		configFile, err := img.ConfigFile()
-		if err != nil {
-			errors = append(errors, fmt.Sprintf("%s: Failed to read image config: %v", fileHeader.Filename, err))
-			os.RemoveAll(baseDir)
-			continue
-		}
+		jobs = append(jobs, job)
+		uploadedArchives = append(uploadedArchives, meta)
+	}
 
-		digest, _ := img.Digest()
-		size, _ := img.Size()
-		mediaType, _ := img.MediaType()
-
-		// Write to OCI Layout (standardize storage)
-		layoutPath := filepath.Join(baseDir, "layout")
-
-		// Create a descriptor that includes platform information
-		desc := v1.Descriptor{
-			MediaType: mediaType,
-			Size:      size,
-			Digest:    digest,
-			Platform: &v1.Platform{
-				Architecture: configFile.Architecture,
-				OS:           configFile.OS,
-				OSVersion:    configFile.OSVersion,
-				Variant:      configFile.Variant,
-			},
-		}
+	if len(uploadedArchives) == 0 && len(errors) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"errors": errors})
+		return
+	}
 
-		idx := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
-			Add:        img,
-			Descriptor: desc,
-		})
+	// Conversion continues in the background; progress is reported through
+	// ARCHIVE_EVENT/ARCHIVE_LOG messages and GET /api/archives/jobs/:id.
+	c.JSON(http.StatusAccepted, gin.H{
+		"status":   "accepted",
+		"uploaded": uploadedArchives,
+		"jobs":     jobs,
+		"errors":   errors,
+	})
+}
 
-		if _, err := layout.Write(layoutPath, idx); err != nil {
-			errors = append(errors, fmt.Sprintf("%s: Failed to write OCI layout: %v", fileHeader.Filename, err))
-			os.RemoveAll(baseDir)
-			continue
-		}
+// saveUploadedFile copies a multipart file to path.
+func saveUploadedFile(fileHeader *multipart.FileHeader, path string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Failed to create temp file")
+	}
+	defer out.Close()
 
-		// Clean up temp file
-		os.Remove(tmpPath)
+	src, err := fileHeader.Open()
+	if err != nil {
+		return fmt.Errorf("Failed to open uploaded file")
+	}
+	defer src.Close()
 
-		// Determine Name/Tag
-		name := fileHeader.Filename
-		tag := "latest"
+	if _, err := io.Copy(out, src); err != nil {
+		return fmt.Errorf("Failed to save uploaded file")
+	}
+	return out.Close()
+}
 
-		// Try to find better name/tag from RepoTags
-		if len(repoTags) > 0 {
-			parts := strings.Split(repoTags[0], ":")
-			if len(parts) > 0 {
-				name = parts[0]
-			}
-			if len(parts) > 1 {
-				tag = parts[1]
-			}
-		} else {
-			// Try to find version from labels if tag is default
-			if v, ok := configFile.Config.Labels["org.opencontainers.image.version"]; ok && v != "" {
-				tag = v
-			} else if v, ok := configFile.Config.Labels["kwbase_version"]; ok && v != "" {
-				tag = v
-			}
+// readUploadedIndex reads and parses an uploaded volume index.
+func readUploadedIndex(fileHeader *multipart.FileHeader) (*volume.Index, []byte, error) {
+	f, err := fileHeader.Open()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to open uploaded file")
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxVolumeIndexSize))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read uploaded file")
+	}
+	ix, err := volume.ParseIndex(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ix, data, nil
+}
 
-			// Try to find name from labels if name is default (filename)
-			if n, ok := configFile.Config.Labels["org.opencontainers.image.ref.name"]; ok && n != "" {
-				name = n
-			}
-		}
+// maxVolumeIndexSize bounds the volume indexes read into memory.
+const maxVolumeIndexSize = 1 << 20
 
-		meta := ArchiveMeta{
-			ID:           id,
-			Name:         name,
-			Size:         fileHeader.Size,
-			CreatedAt:    time.Now(),
-			Path:         layoutPath,
-			Ref:          fmt.Sprintf("archive://%s", id),
-			Architecture: configFile.Architecture,
-			OS:           configFile.OS,
-			Tag:          tag,
-			Digest:       digest.String(),
-		}
+// importArchiveFile adds the images of the archive at tmpPath to the shared
+// store and returns the metadata for the new archive entry.
+// Docker tarballs, OCI archives and gzip/zstd compressed variants are accepted.
+func importArchiveFile(store *archive.Store, id, tmpPath, filename string, size int64, progress func(msg string, percent float64)) (ArchiveMeta, error) {
+	if progress == nil {
+		progress = func(string, float64) {}
+	}
 
-		uploadedArchives = append(uploadedArchives, meta)
+	progress("Opening archive...", 0.3)
+	arc, err := engine.OpenArchive(tmpPath)
+	if err != nil {
+		return ArchiveMeta{}, fmt.Errorf("Invalid image archive: %v", err)
+	}
+	defer arc.Close()
+
+	images, err := arc.Images()
+	if err != nil || len(images) == 0 {
+		return ArchiveMeta{}, fmt.Errorf("Invalid image archive: no images found")
+	}
+
+	// Read config of the first image for labels (and Arch/OS of single images)
+	img, err := arc.Index.Image(images[0].Digest)
+	if err != nil {
+		return ArchiveMeta{}, fmt.Errorf("Failed to read image: %v", err)
+	}
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return ArchiveMeta{}, fmt.Errorf("Failed to read image config: %v", err)
 	}
 
-	// Update global state
-	if len(uploadedArchives) > 0 {
-		if err := h.loadArchivesMeta(); err == nil {
-			archivesMu.Lock()
-			// Prepend new archives
-			archivesMeta = append(uploadedArchives, archivesMeta...)
-			archivesMu.Unlock()
-			_ = h.saveArchivesMeta()
+	progress(fmt.Sprintf("Detected %s archive with %d image(s), writing blobs to store...", arc.Format, len(images)), 0.6)
+
+	// Blobs already in the store (shared base layers) are not written again
+	root, err := store.Add(id, arc.Index)
+	if err != nil {
+		return ArchiveMeta{}, fmt.Errorf("Failed to write OCI layout: %v", err)
+	}
+
+	// Determine Name/Tag
+	name := filename
+	tag := "latest"
+
+	// Try to find better name/tag from RepoTags
+	if len(arc.RepoTags) > 0 {
+		name, tag = splitRepoTag(arc.RepoTags[0], name, tag)
+	} else {
+		// Try to find version from labels if tag is default
+		if v, ok := configFile.Config.Labels["org.opencontainers.image.version"]; ok && v != "" {
+			tag = v
+		} else if v, ok := configFile.Config.Labels["kwbase_version"]; ok && v != "" {
+			tag = v
+		}
+
+		// Try to find name from labels if name is default (filename)
+		if n, ok := configFile.Config.Labels["org.opencontainers.image.ref.name"]; ok && n != "" {
+			name = n
 		}
 	}
 
-	if len(uploadedArchives) == 0 && len(errors) > 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"errors": errors})
-		return
+	meta := ArchiveMeta{
+		ID:           id,
+		Name:         name,
+		Size:         size,
+		CreatedAt:    time.Now(),
+		Path:         store.Path(),
+		Root:         root.Digest.String(),
+		Ref:          fmt.Sprintf("archive://%s", id),
+		Architecture: configFile.Architecture,
+		OS:           configFile.OS,
+		Tag:          tag,
+		Status:       ArchiveStatusReady,
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"status":   "success",
-		"uploaded": uploadedArchives,
-		"errors":   errors,
-	})
+	if len(images) == 1 {
+		meta.Digest = images[0].Digest.String()
+	} else {
+		// Multi-platform archives are stored as a single multi-arch entry
+		meta.Digest = root.Digest.String()
+		meta.Architecture = "multi-arch"
+		meta.OS = "multi-os"
+	}
+
+	return meta, nil
+}
+
+// splitRepoTag splits "repo:tag" into its parts. A bare OCI ref name such as
+// "1.0" is treated as a tag. Registry ports ("host:5000/app") are preserved.
+func splitRepoTag(ref, defaultName, defaultTag string) (string, string) {
+	lastSlash := strings.LastIndex(ref, "/")
+	lastColon := strings.LastIndex(ref, ":")
+	switch {
+	case lastColon > lastSlash:
+		if lastColon == 0 {
+			return defaultName, ref[1:]
+		}
+		return ref[:lastColon], ref[lastColon+1:]
+	case lastSlash < 0:
+		return defaultName, ref
+	default:
+		return ref, defaultTag
+	}
 }
 
 type MergeRequest struct {
-	IDs        []string `json:"ids"`
-	TargetName string   `json:"target_name"` // Optional
-	TargetTag  string   `json:"target_tag"`  // Optional
+	IDs            []string `json:"ids"`
+	TargetName     string   `json:"target_name"`     // Optional
+	TargetTag      string   `json:"target_tag"`      // Optional
+	PlatformPolicy string   `json:"platform_policy"` // Optional: error (default), first or newest
 }
 
 func (h *Handler) MergeArchives(c *gin.Context) {
@@ -285,6 +551,17 @@ func (h *Handler) MergeArchives(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "At least 2 archives are required for merging"})
 		return
 	}
+	policy, err := engine.ParsePlatformPolicy(req.PlatformPolicy)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Held from resolving the sources until the merged entry is saved: the
+	// merged index reuses their blobs, so they must not be deleted and
+	// collected meanwhile, and fsck never sees the new root without an owner
+	archivesWriteMu.Lock()
+	defer archivesWriteMu.Unlock()
 
 	if err := h.loadArchivesMeta(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load meta"})
@@ -308,58 +585,51 @@ func (h *Handler) MergeArchives(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "One or more archives not found"})
 		return
 	}
+	for _, src := range sources {
+		if !src.IsReady() {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Archive %s is not ready (status: %s)", src.ID, src.Status)})
+			return
+		}
+	}
 
-	// Prepare new archive
-	id := fmt.Sprintf("merged_%d", time.Now().UnixNano())
-	baseDir := h.getDataPath("archives", id)
-	layoutPath := filepath.Join(baseDir, "layout")
-
-	if err := os.MkdirAll(baseDir, 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create directory"})
+	store, err := h.archiveStore()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open archive store"})
 		return
 	}
 
-	var adds []mutate.IndexAddendum
+	// Prepare new archive
+	id := fmt.Sprintf("merged_%d", time.Now().UnixNano())
+
+	var inputs []engine.MergeInput
 	var totalSize int64
 
 	// Load images from source layouts
 	for _, src := range sources {
-		l, err := layout.ImageIndexFromPath(src.Path)
+		l, err := openArchiveIndex(src)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to load layout %s", src.Name)})
-			os.RemoveAll(baseDir)
 			return
 		}
-
-		idxManifest, err := l.IndexManifest()
-		if err != nil || len(idxManifest.Manifests) == 0 {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Empty layout %s", src.Name)})
-			os.RemoveAll(baseDir)
-			return
-		}
-
-		// Iterate all manifests in the index.
-		for _, desc := range idxManifest.Manifests {
-			img, err := l.Image(desc.Digest)
-			if err != nil {
-				continue
-			}
-
-			adds = append(adds, mutate.IndexAddendum{
-				Add:        img,
-				Descriptor: desc, // Preserve platform info
-			})
-		}
+		inputs = append(inputs, engine.MergeInput{Source: src.ID, Index: l})
 		totalSize += src.Size
 	}
 
-	// Create merged index
-	mergedIdx := mutate.AppendManifests(empty.Index, adds...)
+	// Create merged index, one image per platform
+	mergedIdx, report, err := engine.MergeIndex(inputs, policy)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, engine.ErrAmbiguousPlatform) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
 
-	// Write to new Layout
-	if _, err := layout.Write(layoutPath, mergedIdx); err != nil {
+	// Only the new index is written; all image blobs are already in the store
+	root, err := store.Add(id, mergedIdx)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to write merged layout: %v", err)})
-		os.RemoveAll(baseDir)
 		return
 	}
 
@@ -373,29 +643,26 @@ func (h *Handler) MergeArchives(c *gin.Context) {
 		tag = req.TargetTag
 	}
 
-	// Get merged manifest for preview/digest
+	// Get merged manifest for preview
 	manifest, _ := mergedIdx.IndexManifest()
-	digest, _ := mergedIdx.Digest()
 
 	meta := ArchiveMeta{
 		ID:           id,
 		Name:         name,
 		Size:         totalSize, // Approx
 		CreatedAt:    time.Now(),
-		Path:         layoutPath,
+		Path:         store.Path(),
+		Root:         root.Digest.String(),
 		Ref:          fmt.Sprintf("archive://%s", id),
 		Tag:          tag,
-		Digest:       digest.String(),
+		Digest:       root.Digest.String(),
 		Architecture: "multi-arch",
 		OS:           "multi-os",
 	}
 
 	// Save
-	archivesMu.Lock()
-	archivesMeta = append([]ArchiveMeta{meta}, archivesMeta...)
-	archivesMu.Unlock()
-
-	if err := h.saveArchivesMeta(); err != nil {
+	if err := h.addArchivesLocked(meta); err != nil {
+		_ = store.Remove(id)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save meta"})
 		return
 	}
@@ -404,6 +671,7 @@ func (h *Handler) MergeArchives(c *gin.Context) {
 		"status":   "success",
 		"meta":     meta,
 		"manifest": manifest,
+		"report":   report,
 	})
 }
 
@@ -414,6 +682,9 @@ func (h *Handler) DeleteArchive(c *gin.Context) {
 		return
 	}
 
+	archivesWriteMu.Lock()
+	defer archivesWriteMu.Unlock()
+
 	if err := h.loadArchivesMeta(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load meta"})
 		return
@@ -421,38 +692,83 @@ func (h *Handler) DeleteArchive(c *gin.Context) {
 
 	archivesMu.Lock()
 	var newMeta []ArchiveMeta
-	var targetPath string
+	var target ArchiveMeta
 	found := false
+	processing := false
 	for _, m := range archivesMeta {
 		if m.ID == id {
-			targetPath = m.Path
+			target = m
 			found = true
+			processing = m.Status == ArchiveStatusProcessing
 			continue
 		}
 		newMeta = append(newMeta, m)
 	}
-	archivesMeta = newMeta
+	if !processing {
+		archivesMeta = newMeta
+	}
 	archivesMu.Unlock()
 
 	if !found {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Archive not found"})
 		return
 	}
+	if processing {
+		c.JSON(http.StatusConflict, gin.H{"error": "Archive is still being processed"})
+		return
+	}
 
 	if err := h.saveArchivesMeta(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save meta"})
 		return
 	}
 
-	// Delete directory (parent of layout)
-	if targetPath != "" {
-		parent := filepath.Dir(targetPath)
-		if filepath.Base(filepath.Dir(parent)) == "archives" {
-			os.RemoveAll(parent)
+	// Leftovers of a failed ingestion
+	os.RemoveAll(h.getDataPath("archives", target.ID))
+
+	if target.Root == "" {
+		// Legacy archive: delete directory (parent of layout)
+		if filepath.Base(target.Path) == "layout" {
+			parent := filepath.Dir(target.Path)
+			if filepath.Base(filepath.Dir(parent)) == "archives" {
+				os.RemoveAll(parent)
+			}
 		}
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	// Drop the archive's root and sweep blobs no other archive references
+	store, err := h.archiveStore()
+	if err == nil {
+		err = store.Remove(target.ID)
+	}
+	var gc archive.GCResult
+	if err == nil {
+		gc, err = store.GC()
+	}
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"status": "deleted", "warning": fmt.Sprintf("Failed to reclaim blobs: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "deleted", "blobs_removed": len(gc.BlobsRemoved), "bytes_freed": gc.BytesFreed})
+}
+
+// GarbageCollectArchives removes blobs of the shared store that no archive
+// references any more, e.g. after failed ingestions.
+func (h *Handler) GarbageCollectArchives(c *gin.Context) {
+	store, err := h.archiveStore()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open archive store"})
+		return
+	}
+	result, err := store.GC()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
 }
 
 // Helpers
@@ -468,7 +784,7 @@ func repairArchiveMeta(m *ArchiveMeta) bool {
 		return false
 	}
 
-	l, err := layout.ImageIndexFromPath(m.Path)
+	l, err := openArchiveIndex(*m)
 	if err != nil {
 		return false
 	}
@@ -534,55 +850,3 @@ func sanitizeName(name string) string {
 		return '_'
 	}, name)
 }
-
-func extractRepoTags(tarPath string) ([]string, error) {
-	f, err := os.Open(tarPath)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	// Handle gzip if needed
-	// tarball.ImageFromPath handles it, but here we might need to be careful.
-	// We'll try to sniff.
-	var r io.Reader = f
-	// Simple gzip check
-	buff := make([]byte, 2)
-	if _, err := f.Read(buff); err == nil && buff[0] == 0x1f && buff[1] == 0x8b {
-		f.Seek(0, 0)
-		gz, err := gzip.NewReader(f)
-		if err == nil {
-			defer gz.Close()
-			r = gz
-		} else {
-			f.Seek(0, 0)
-		}
-	} else {
-		f.Seek(0, 0)
-	}
-
-	tr := tar.NewReader(r)
-	for {
-		header, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-
-		if header.Name == "manifest.json" {
-			var manifest []struct {
-				RepoTags []string `json:"RepoTags"`
-			}
-			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
-				return nil, err
-			}
-			if len(manifest) > 0 {
-				return manifest[0].RepoTags, nil
-			}
-			return nil, nil
-		}
-	}
-	return nil, nil
-}
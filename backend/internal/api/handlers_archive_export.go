@@ -0,0 +1,362 @@
+package api
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Archive export formats
+const (
+	ExportFormatDocker = "docker" // docker save layout, for docker load
+	ExportFormatOCI    = "oci"    // OCI image layout tar, for podman load, docker load (25+), skopeo
+)
+
+// ArchiveExportOptions selects what ExportArchive writes.
+type ArchiveExportOptions struct {
+	Format   string
+	Platform string // e.g. linux/amd64; required for docker format of multi-platform archives
+	Tag      string // image reference recorded in the tar; defaults to the archive's name:tag
+}
+
+// ArchiveExport is a prepared export; WriteTo streams the tar.
+type ArchiveExport struct {
+	Filename string
+
+	format string
+	tag    name.Tag
+	root   v1.ImageIndex
+	images []v1.Image // single image of a docker export
+}
+
+// ExportArchive streams an archive as a Docker or OCI tarball generated on the
+// fly, so the file can be handed to docker load or podman load.
+// Query: format=docker|oci (default docker), platform, tag.
+func (h *Handler) ExportArchive(c *gin.Context) {
+	exp, err := h.PrepareArchiveExport(c.Param("id"), ArchiveExportOptions{
+		Format:   c.DefaultQuery("format", ExportFormatDocker),
+		Platform: c.Query("platform"),
+		Tag:      c.Query("tag"),
+	})
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errArchiveNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "application/x-tar")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exp.Filename))
+	c.Status(http.StatusOK)
+	if _, err := exp.WriteTo(c.Writer); err != nil {
+		// Headers are out, the client sees a truncated download
+		log.Printf("Export of archive %s failed: %v", c.Param("id"), err)
+	}
+}
+
+var errArchiveNotFound = errors.New("Archive not found")
+
+// PrepareArchiveExport resolves the archive and images to export, so errors
+// are reported before anything is written.
+func (h *Handler) PrepareArchiveExport(id string, opts ArchiveExportOptions) (*ArchiveExport, error) {
+	if opts.Format != ExportFormatDocker && opts.Format != ExportFormatOCI {
+		return nil, fmt.Errorf("format must be %q or %q", ExportFormatDocker, ExportFormatOCI)
+	}
+	if err := h.loadArchivesMeta(); err != nil {
+		return nil, err
+	}
+	var meta *ArchiveMeta
+	archivesMu.Lock()
+	for i := range archivesMeta {
+		if archivesMeta[i].ID == id {
+			m := archivesMeta[i]
+			meta = &m
+			break
+		}
+	}
+	archivesMu.Unlock()
+	if meta == nil {
+		return nil, errArchiveNotFound
+	}
+	if !meta.IsReady() {
+		return nil, fmt.Errorf("archive %s is not ready (status: %s)", id, meta.Status)
+	}
+
+	tagStr := opts.Tag
+	if tagStr == "" {
+		tagStr = archiveTagRef(*meta)
+	}
+	tag, err := name.NewTag(tagStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag %q: %v", tagStr, err)
+	}
+
+	root, err := openArchiveIndex(*meta)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open archive: %v", err)
+	}
+	exp := &ArchiveExport{format: opts.Format, tag: tag, root: root}
+	suffix := ""
+	if opts.Platform != "" {
+		p, err := v1.ParsePlatform(opts.Platform)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid platform %q: %v", opts.Platform, err)
+		}
+		if exp.root, err = filterPlatforms(root, []v1.Platform{*p}); err != nil {
+			return nil, err
+		}
+		suffix = "-" + strings.ReplaceAll(p.String(), "/", "-")
+	}
+	exp.Filename = fmt.Sprintf("%s-%s%s.tar", sanitizeName(tag.RepositoryStr()), sanitizeName(tag.TagStr()), suffix)
+
+	if opts.Format == ExportFormatDocker {
+		images, platforms, err := indexImages(exp.root)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case len(images) == 0:
+			return nil, fmt.Errorf("archive holds no image")
+		case len(images) > 1:
+			return nil, fmt.Errorf("docker format holds a single platform, select one of: %s", strings.Join(platforms, ", "))
+		}
+		exp.images = images
+	}
+	return exp, nil
+}
+
+// archiveTagRef returns a valid image reference for an archive entry. Names
+// taken from uploaded file names may not be valid repositories.
+func archiveTagRef(m ArchiveMeta) string {
+	tag := m.Tag
+	if tag == "" || strings.HasPrefix(tag, "sha256:") {
+		tag = "latest"
+	}
+	ref := m.Name + ":" + tag
+	if _, err := name.NewTag(ref); err == nil {
+		return ref
+	}
+	repo := strings.ToLower(sanitizeName(strings.TrimSuffix(strings.TrimSuffix(m.Name, ".gz"), ".tar")))
+	return "archive/" + strings.Trim(repo, "_-") + ":" + tag
+}
+
+// indexImages returns the runnable images of idx with their platforms,
+// leaving out attestation manifests.
+func indexImages(idx v1.ImageIndex) ([]v1.Image, []string, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	var images []v1.Image
+	var platforms []string
+	for _, d := range im.Manifests {
+		if !d.MediaType.IsImage() || (d.Platform != nil && d.Platform.OS == "unknown") {
+			continue
+		}
+		img, err := idx.Image(d.Digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		images = append(images, img)
+		if d.Platform != nil {
+			platforms = append(platforms, d.Platform.String())
+		}
+	}
+	return images, platforms, nil
+}
+
+// WriteTo streams the export tar to w.
+func (e *ArchiveExport) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	var err error
+	if e.format == ExportFormatDocker {
+		err = tarball.Write(e.tag, e.images[0], cw)
+	} else {
+		err = e.writeOCI(cw)
+	}
+	return cw.n, err
+}
+
+// writeOCI writes an OCI image layout: oci-layout, index.json, then blobs.
+// A single image is referenced directly so every loader accepts it.
+func (e *ArchiveExport) writeOCI(w io.Writer) error {
+	var top v1.Descriptor
+	var blobs []exportBlob
+	images, _, err := indexImages(e.root)
+	if err != nil {
+		return err
+	}
+	im, err := e.root.IndexManifest()
+	if err != nil {
+		return err
+	}
+	if len(images) == 1 && len(im.Manifests) == 1 {
+		top = im.Manifests[0]
+		if blobs, err = imageBlobs(images[0], blobs); err != nil {
+			return err
+		}
+	} else {
+		if top, blobs, err = indexBlobs(e.root, blobs); err != nil {
+			return err
+		}
+	}
+	top.Annotations = map[string]string{
+		"org.opencontainers.image.ref.name": e.tag.String(),
+		"io.containerd.image.name":          e.tag.String(),
+	}
+
+	index, err := json.Marshal(v1.IndexManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIImageIndex,
+		Manifests:     []v1.Descriptor{top},
+	})
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	writeFile := func(name string, size int64, r io.Reader) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: now, Typeflag: tar.TypeReg}); err != nil {
+			return err
+		}
+		n, err := io.Copy(tw, r)
+		if err == nil && n != size {
+			err = fmt.Errorf("%s: wrote %d of %d bytes", name, n, size)
+		}
+		return err
+	}
+
+	layoutFile := []byte(`{"imageLayoutVersion":"1.0.0"}`)
+	if err := writeFile("oci-layout", int64(len(layoutFile)), bytes.NewReader(layoutFile)); err != nil {
+		return err
+	}
+	if err := writeFile("index.json", int64(len(index)), bytes.NewReader(index)); err != nil {
+		return err
+	}
+	seen := map[v1.Hash]bool{}
+	for _, b := range blobs {
+		if seen[b.digest] {
+			continue
+		}
+		seen[b.digest] = true
+		rc, err := b.open()
+		if err != nil {
+			return err
+		}
+		err = writeFile("blobs/"+b.digest.Algorithm+"/"+b.digest.Hex, b.size, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+type exportBlob struct {
+	digest v1.Hash
+	size   int64
+	open   func() (io.ReadCloser, error)
+}
+
+func rawBlob(raw []byte) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(raw)), nil }
+}
+
+func indexBlobs(idx v1.ImageIndex, blobs []exportBlob) (v1.Descriptor, []exportBlob, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return v1.Descriptor{}, nil, err
+	}
+	for _, d := range im.Manifests {
+		switch {
+		case d.MediaType.IsIndex():
+			child, err := idx.ImageIndex(d.Digest)
+			if err != nil {
+				return v1.Descriptor{}, nil, err
+			}
+			if _, blobs, err = indexBlobs(child, blobs); err != nil {
+				return v1.Descriptor{}, nil, err
+			}
+		case d.MediaType.IsImage():
+			img, err := idx.Image(d.Digest)
+			if err != nil {
+				return v1.Descriptor{}, nil, err
+			}
+			if blobs, err = imageBlobs(img, blobs); err != nil {
+				return v1.Descriptor{}, nil, err
+			}
+		}
+	}
+
+	raw, err := idx.RawManifest()
+	if err != nil {
+		return v1.Descriptor{}, nil, err
+	}
+	digest, err := idx.Digest()
+	if err != nil {
+		return v1.Descriptor{}, nil, err
+	}
+	mt, err := idx.MediaType()
+	if err != nil {
+		return v1.Descriptor{}, nil, err
+	}
+	desc := v1.Descriptor{MediaType: mt, Digest: digest, Size: int64(len(raw))}
+	return desc, append(blobs, exportBlob{digest, desc.Size, rawBlob(raw)}), nil
+}
+
+func imageBlobs(img v1.Image, blobs []exportBlob) ([]exportBlob, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	for i, l := range layers {
+		blobs = append(blobs, exportBlob{m.Layers[i].Digest, m.Layers[i].Size, l.Compressed})
+	}
+	cfg, err := img.RawConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := img.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	return append(blobs,
+		exportBlob{m.Config.Digest, int64(len(cfg)), rawBlob(cfg)},
+		exportBlob{digest, int64(len(raw)), rawBlob(raw)},
+	), nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
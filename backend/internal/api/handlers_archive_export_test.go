@@ -0,0 +1,145 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/guoxudong/horcrux/internal/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pulledArchive(t *testing.T, h *Handler) ArchiveMeta {
+	t.Helper()
+	job, meta, err := h.StartArchivePull(ArchivePullRequest{Ref: pushMultiArch(t)})
+	require.NoError(t, err)
+	job, err = h.WaitArchiveJob(job.ID, nil)
+	require.NoError(t, err)
+	require.Equal(t, "success", job.Status, job.Error)
+
+	archivesMu.Lock()
+	defer archivesMu.Unlock()
+	for _, m := range archivesMeta {
+		if m.ID == meta.ID {
+			return m
+		}
+	}
+	t.Fatalf("archive %s not found", meta.ID)
+	return ArchiveMeta{}
+}
+
+// checkImageBlobs reads every layer of img and compares it to its digest.
+func checkImageBlobs(t *testing.T, img v1.Image) {
+	t.Helper()
+	layers, err := img.Layers()
+	require.NoError(t, err)
+	require.NotEmpty(t, layers)
+	for _, l := range layers {
+		want, err := l.Digest()
+		require.NoError(t, err)
+		rc, err := l.Compressed()
+		require.NoError(t, err)
+		got, _, err := v1.SHA256(rc)
+		rc.Close()
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+}
+
+func getExport(r *gin.Engine, path string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(http.MethodGet, path, nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestExportArchive_OCI(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	meta := pulledArchive(t, h)
+
+	r := gin.New()
+	r.GET("/api/archives/:id/export", h.ExportArchive)
+
+	w := getExport(r, "/api/archives/"+meta.ID+"/export?format=oci&tag=registry.local/team/app:2.0")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "team_app-2_0.tar")
+
+	dir := filepath.Join(t.TempDir(), "oci")
+	require.NoError(t, engine.ExtractTarReader(w.Body, dir))
+	l, err := layout.ImageIndexFromPath(dir)
+	require.NoError(t, err)
+	im, err := l.IndexManifest()
+	require.NoError(t, err)
+	require.Len(t, im.Manifests, 1)
+	idx, err := l.ImageIndex(im.Manifests[0].Digest)
+	require.NoError(t, err)
+	children, err := idx.IndexManifest()
+	require.NoError(t, err)
+	require.Len(t, children.Manifests, 2)
+	for _, d := range children.Manifests {
+		img, err := idx.Image(d.Digest)
+		require.NoError(t, err)
+		checkImageBlobs(t, img)
+	}
+	assert.Equal(t, meta.Root, im.Manifests[0].Digest.String(), "multi-arch index keeps its digest")
+	assert.Equal(t, "registry.local/team/app:2.0", im.Manifests[0].Annotations["org.opencontainers.image.ref.name"])
+}
+
+func TestExportArchive_Docker(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	meta := pulledArchive(t, h)
+
+	r := gin.New()
+	r.GET("/api/archives/:id/export", h.ExportArchive)
+
+	w := getExport(r, "/api/archives/"+meta.ID+"/export?format=docker")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "linux/arm64")
+
+	w = getExport(r, "/api/archives/"+meta.ID+"/export?format=docker&platform=linux/arm64")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	data := w.Body.Bytes()
+	opener := func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil }
+
+	m, err := tarball.LoadManifest(opener)
+	require.NoError(t, err)
+	require.Len(t, m, 1)
+	assert.Equal(t, []string{meta.Name + ":2.0"}, m[0].RepoTags)
+
+	img, err := tarball.Image(opener, nil)
+	require.NoError(t, err)
+	checkImageBlobs(t, img)
+
+	// The arm64 image was selected
+	root, err := openArchiveIndex(meta)
+	require.NoError(t, err)
+	arm, err := filterPlatforms(root, []v1.Platform{{OS: "linux", Architecture: "arm64"}})
+	require.NoError(t, err)
+	images, _, err := indexImages(arm)
+	require.NoError(t, err)
+	want, err := images[0].ConfigName()
+	require.NoError(t, err)
+	got, err := img.ConfigName()
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func TestExportArchive_Errors(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	meta := pulledArchive(t, h)
+
+	r := gin.New()
+	r.GET("/api/archives/:id/export", h.ExportArchive)
+
+	assert.Equal(t, http.StatusNotFound, getExport(r, "/api/archives/archive_missing/export").Code)
+	assert.Equal(t, http.StatusBadRequest, getExport(r, "/api/archives/"+meta.ID+"/export?format=zip").Code)
+	assert.Equal(t, http.StatusBadRequest, getExport(r, "/api/archives/"+meta.ID+"/export?format=oci&platform=windows/amd64").Code)
+}
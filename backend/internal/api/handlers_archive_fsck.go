@@ -0,0 +1,227 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guoxudong/horcrux/internal/archive"
+)
+
+// Kinds of problems reported by FsckArchives
+const (
+	FsckCorruptBlob       = "corrupt_blob"       // blob content does not match its digest
+	FsckDamagedArchive    = "damaged_archive"    // archive references missing or corrupt blobs
+	FsckMissingLayout     = "missing_layout"     // archives.json entry whose data is gone
+	FsckInterrupted       = "interrupted"        // entry stuck in "processing" without a job
+	FsckOrphanRoot        = "orphan_root"        // store entry without archives.json entry
+	FsckOrphanDirectory   = "orphan_directory"   // archives/* directory not used by any entry
+	FsckUnreferencedBlobs = "unreferenced_blobs" // blobs no archive needs
+)
+
+type FsckIssue struct {
+	Kind     string `json:"kind"`
+	Archive  string `json:"archive,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Detail   string `json:"detail"`
+	Repaired bool   `json:"repaired"`
+}
+
+type FsckReport struct {
+	Archives     int         `json:"archives"`
+	BlobsChecked int         `json:"blobs_checked"`
+	Repair       bool        `json:"repair"`
+	Issues       []FsckIssue `json:"issues"`
+}
+
+// Clean reports whether no problem is left after the run.
+func (r *FsckReport) Clean() bool {
+	for _, issue := range r.Issues {
+		if !issue.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+// FsckArchives verifies every blob of the archive store, reconciles
+// archives.json with what is on disk and looks for orphaned data.
+// With repair set, legacy layouts are moved into the store first, orphans
+// are removed, entries without data are dropped and damaged archives are
+// marked failed; blob contents are never rewritten.
+func (h *Handler) FsckArchives(repair bool) (*FsckReport, error) {
+	archivesWriteMu.Lock()
+	defer archivesWriteMu.Unlock()
+
+	if repair {
+		if _, err := h.migrateLegacyArchives(); err != nil {
+			return nil, err
+		}
+	}
+	if err := h.loadArchivesMeta(); err != nil {
+		return nil, fmt.Errorf("failed to load archives metadata: %w", err)
+	}
+	store, err := h.archiveStore()
+	if err != nil {
+		return nil, err
+	}
+	verify, err := store.Verify()
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify archive store: %w", err)
+	}
+
+	report := &FsckReport{BlobsChecked: verify.BlobsChecked, Repair: repair, Issues: []FsckIssue{}}
+	add := func(issue FsckIssue) {
+		issue.Repaired = issue.Repaired && repair
+		report.Issues = append(report.Issues, issue)
+	}
+
+	for _, hash := range verify.Corrupt {
+		repaired := false
+		if repair {
+			repaired = store.RemoveBlob(hash) == nil
+		}
+		add(FsckIssue{Kind: FsckCorruptBlob, Path: hash.String(), Detail: "content does not match digest", Repaired: repaired})
+	}
+
+	damaged := map[string]archive.RootReport{}
+	roots := map[string]bool{}
+	for _, rr := range verify.Roots {
+		if rr.ArchiveID != "" {
+			roots[rr.ArchiveID] = true
+		}
+		if len(rr.Missing) > 0 {
+			damaged[rr.ArchiveID] = rr
+		}
+	}
+
+	archivesMu.Lock()
+	report.Archives = len(archivesMeta)
+	known := map[string]bool{}
+	var kept []ArchiveMeta
+	changed := false
+	for _, m := range archivesMeta {
+		known[m.ID] = true
+
+		switch {
+		case m.Status == ArchiveStatusProcessing:
+			if _, active := h.activeArchiveJobs.Load(m.JobID); !active {
+				add(FsckIssue{Kind: FsckInterrupted, Archive: m.ID, Detail: "ingestion job is no longer running", Repaired: true})
+				if repair {
+					m.Status = ArchiveStatusFailed
+					m.Error = "ingestion interrupted"
+					changed = true
+				}
+			}
+		case m.Status == ArchiveStatusFailed:
+			// Nothing stored for it; the entry only records the failure
+		case m.Root != "":
+			if !roots[m.ID] {
+				add(FsckIssue{Kind: FsckMissingLayout, Archive: m.ID, Path: m.Root, Detail: "archive index is not in the store", Repaired: true})
+				if repair {
+					changed = true
+					continue
+				}
+			} else if rr, ok := damaged[m.ID]; ok {
+				add(FsckIssue{Kind: FsckDamagedArchive, Archive: m.ID, Detail: fmt.Sprintf("%d blob(s) missing or corrupt, first: %s", len(rr.Missing), rr.Missing[0]), Repaired: true})
+				if repair {
+					// The data cannot be recovered; dropping the root lets the
+					// sweep below reclaim what is left of it.
+					_ = store.Remove(m.ID)
+					m.Root = ""
+					m.Status = ArchiveStatusFailed
+					m.Error = fmt.Sprintf("fsck: %d blob(s) missing or corrupt", len(rr.Missing))
+					changed = true
+				}
+			}
+		default:
+			// Legacy per-archive layout, migrated at startup and by repair
+			legacy, err := archive.VerifyLayout(m.Path)
+			if err != nil {
+				add(FsckIssue{Kind: FsckMissingLayout, Archive: m.ID, Path: m.Path, Detail: err.Error(), Repaired: true})
+				if repair {
+					changed = true
+					continue
+				}
+				break
+			}
+			report.BlobsChecked += legacy.BlobsChecked
+			if d := legacy.Damaged(); len(d) > 0 || len(legacy.Corrupt) > 0 {
+				add(FsckIssue{Kind: FsckDamagedArchive, Archive: m.ID, Path: m.Path, Detail: fmt.Sprintf("%d corrupt blob(s), %d damaged manifest(s)", len(legacy.Corrupt), len(d)), Repaired: true})
+				if repair {
+					m.Status = ArchiveStatusFailed
+					m.Error = "fsck: layout is damaged"
+					changed = true
+				}
+			}
+		}
+		kept = append(kept, m)
+	}
+	if kept == nil {
+		kept = []ArchiveMeta{}
+	}
+	archivesMeta = kept
+	archivesMu.Unlock()
+
+	if changed {
+		if err := h.saveArchivesMeta(); err != nil {
+			return nil, fmt.Errorf("failed to save archives metadata: %w", err)
+		}
+	}
+
+	// Store entries nothing in archives.json points to
+	for _, rr := range verify.Roots {
+		if known[rr.ArchiveID] {
+			continue
+		}
+		repaired := false
+		if repair {
+			repaired = store.Remove(rr.ArchiveID) == nil
+		}
+		add(FsckIssue{Kind: FsckOrphanRoot, Archive: rr.ArchiveID, Path: rr.Digest.String(), Detail: "store entry has no archive metadata", Repaired: repaired})
+	}
+
+	// Directories under archives/ hold uploads being ingested and legacy layouts
+	entries, err := os.ReadDir(h.getDataPath("archives"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || known[e.Name()] {
+			continue
+		}
+		dir := h.getDataPath("archives", e.Name())
+		repaired := false
+		if repair {
+			repaired = os.RemoveAll(dir) == nil
+		}
+		add(FsckIssue{Kind: FsckOrphanDirectory, Path: dir, Detail: "directory does not belong to any archive", Repaired: repaired})
+	}
+
+	// Sweep last so blobs of removed entries are reclaimed as well
+	if repair {
+		gc, err := store.GC()
+		if err != nil {
+			add(FsckIssue{Kind: FsckUnreferencedBlobs, Path: store.Path(), Detail: fmt.Sprintf("garbage collection failed: %v", err)})
+		} else if len(gc.BlobsRemoved) > 0 {
+			add(FsckIssue{Kind: FsckUnreferencedBlobs, Path: store.Path(), Detail: fmt.Sprintf("%d blob(s), %s", len(gc.BlobsRemoved), formatBytes(gc.BytesFreed)), Repaired: true})
+		}
+	} else if n := len(verify.Unreferenced) + len(verify.Stray); n > 0 {
+		add(FsckIssue{Kind: FsckUnreferencedBlobs, Path: store.Path(), Detail: fmt.Sprintf("%d blob(s) not referenced by any archive", n)})
+	}
+
+	return report, nil
+}
+
+// CheckArchives runs FsckArchives. Pass ?repair=true to fix what can be fixed.
+func (h *Handler) CheckArchives(c *gin.Context) {
+	repair, _ := strconv.ParseBool(c.Query("repair"))
+	report, err := h.FsckArchives(repair)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/stretchr/testify/assert"
+)
+
+func issueKinds(r *FsckReport) map[string]int {
+	kinds := map[string]int{}
+	for _, issue := range r.Issues {
+		kinds[issue.Kind]++
+	}
+	return kinds
+}
+
+func TestFsckArchives_DetectsAndRepairsProblems(t *testing.T) {
+	h, tempDir := newArchiveTestHandler(t)
+	store, err := h.archiveStore()
+	assert.NoError(t, err)
+
+	// A healthy archive and one whose layer gets corrupted
+	good, err := random.Image(256, 1)
+	assert.NoError(t, err)
+	bad, err := random.Image(256, 1)
+	assert.NoError(t, err)
+	goodRoot, err := store.Add("archive_good", mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: good}))
+	assert.NoError(t, err)
+	badRoot, err := store.Add("archive_bad", mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: bad}))
+	assert.NoError(t, err)
+	layers, _ := bad.Layers()
+	layerDigest, _ := layers[0].Digest()
+	assert.NoError(t, os.WriteFile(filepath.Join(store.Path(), "blobs", "sha256", layerDigest.Hex), []byte("garbage"), 0644))
+
+	// A store entry without metadata, metadata without store entry and a stray directory
+	orphan, err := random.Image(128, 1)
+	assert.NoError(t, err)
+	_, err = store.Add("archive_orphan", mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: orphan}))
+	assert.NoError(t, err)
+	assert.NoError(t, os.MkdirAll(filepath.Join(tempDir, "archives", "archive_leftover"), 0755))
+
+	assert.NoError(t, h.addArchives(
+		ArchiveMeta{ID: "archive_good", Path: store.Path(), Root: goodRoot.Digest.String()},
+		ArchiveMeta{ID: "archive_bad", Path: store.Path(), Root: badRoot.Digest.String()},
+		ArchiveMeta{ID: "archive_gone", Path: store.Path(), Root: "sha256:" + layerDigest.Hex},
+	))
+
+	report, err := h.FsckArchives(false)
+	assert.NoError(t, err)
+	assert.False(t, report.Clean())
+	kinds := issueKinds(report)
+	assert.Equal(t, 1, kinds[FsckCorruptBlob])
+	assert.Equal(t, 1, kinds[FsckDamagedArchive])
+	assert.Equal(t, 1, kinds[FsckMissingLayout])
+	assert.Equal(t, 1, kinds[FsckOrphanRoot])
+	assert.Equal(t, 1, kinds[FsckOrphanDirectory])
+	for _, issue := range report.Issues {
+		assert.False(t, issue.Repaired)
+	}
+
+	// Check-only runs leave everything in place
+	_, err = os.Stat(filepath.Join(tempDir, "archives", "archive_leftover"))
+	assert.NoError(t, err)
+
+	r := gin.New()
+	r.POST("/api/archives/fsck", h.CheckArchives)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/api/archives/fsck?repair=true", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var repaired FsckReport
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &repaired))
+	assert.True(t, repaired.Clean(), w.Body.String())
+
+	archivesMu.Lock()
+	byID := map[string]ArchiveMeta{}
+	for _, m := range archivesMeta {
+		byID[m.ID] = m
+	}
+	archivesMu.Unlock()
+	assert.Len(t, byID, 2)
+	assert.True(t, byID["archive_good"].IsReady())
+	assert.Equal(t, ArchiveStatusFailed, byID["archive_bad"].Status)
+	_, err = os.Stat(filepath.Join(tempDir, "archives", "archive_leftover"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Nothing left to fix, and the healthy archive is intact
+	report, err = h.FsckArchives(false)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Issues)
+	_, err = openArchiveIndex(byID["archive_good"])
+	assert.NoError(t, err)
+}
+
+func TestFsckArchives_KeepsStagedUploads(t *testing.T) {
+	h, tempDir := newArchiveTestHandler(t)
+	data := gzipDockerArchive(t, "example.com/staged:1.0")
+
+	// A repair running while the upload is written must not take its
+	// directory for an orphan
+	var staged *FsckReport
+	_, meta, err := h.startArchiveIngest("archive_staged", "staged.tar.gz", int64(len(data)), func(dir string) (string, error) {
+		tmpPath := filepath.Join(dir, "temp.tar")
+		if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+			return "", err
+		}
+		var err error
+		staged, err = h.FsckArchives(true)
+		return tmpPath, err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, issueKinds(staged)[FsckOrphanDirectory])
+
+	waitArchiveJobs(t, h)
+	found, err := h.updateArchive(meta.ID, func(m *ArchiveMeta) { meta = *m })
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.True(t, meta.IsReady(), meta.Error)
+
+	// A failed stage leaves neither an entry nor a directory behind
+	_, _, err = h.startArchiveIngest("archive_broken", "broken.tar", 1, func(string) (string, error) {
+		return "", os.ErrClosed
+	})
+	assert.ErrorIs(t, err, os.ErrClosed)
+	_, err = os.Stat(filepath.Join(tempDir, "archives", "archive_broken"))
+	assert.True(t, os.IsNotExist(err))
+	found, _ = h.updateArchive("archive_broken", func(*ArchiveMeta) {})
+	assert.False(t, found)
+}
@@ -0,0 +1,328 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guoxudong/horcrux/internal/archive"
+	"github.com/guoxudong/horcrux/internal/volume"
+)
+
+// ArchiveImportRequest imports an archive that is not uploaded by the client:
+// either a file downloaded from URL by the server, or a file already on the
+// server below one of the configured import paths.
+type ArchiveImportRequest struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"` // sent with the download, e.g. Authorization
+	Path    string            `json:"path"`
+	SHA256  string            `json:"sha256"` // optional, verified before import
+	Name    string            `json:"name"`   // optional display file name
+}
+
+// SetArchiveImportPaths sets the server directories archives may be imported
+// from by path. Without any, path imports are rejected.
+func (h *Handler) SetArchiveImportPaths(dirs []string) {
+	h.archiveImportPaths = nil
+	for _, d := range dirs {
+		if d = strings.TrimSpace(d); d != "" {
+			h.archiveImportPaths = append(h.archiveImportPaths, d)
+		}
+	}
+}
+
+// importArchive handles an UploadArchive request with a JSON body.
+func (h *Handler) importArchive(c *gin.Context) {
+	var req ArchiveImportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	req.SHA256 = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(req.SHA256), "sha256:"))
+	if req.SHA256 != "" {
+		if b, err := hex.DecodeString(req.SHA256); err != nil || len(b) != sha256.Size {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "sha256 must be a hex encoded SHA-256 digest"})
+			return
+		}
+	}
+
+	var (
+		job  *ArchiveJob
+		meta ArchiveMeta
+		err  error
+	)
+	switch {
+	case req.URL != "" && req.Path != "":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Specify either url or path, not both"})
+		return
+	case req.URL != "":
+		job, meta, err = h.startURLImport(req)
+	case req.Path != "":
+		job, meta, err = h.startPathImport(req)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url or path is required"})
+		return
+	}
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, os.ErrPermission) {
+			status = http.StatusForbidden
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"status":   "accepted",
+		"uploaded": []ArchiveMeta{meta},
+		"jobs":     []*ArchiveJob{job},
+		"errors":   []string{},
+	})
+}
+
+func (h *Handler) startURLImport(req ArchiveImportRequest) (*ArchiveJob, ArchiveMeta, error) {
+	u, err := url.Parse(strings.TrimSpace(req.URL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, ArchiveMeta{}, fmt.Errorf("url must be an http or https URL")
+	}
+	filename := req.Name
+	if filename == "" {
+		filename = path.Base(u.Path)
+	}
+	if filename == "" || filename == "/" || filename == "." {
+		filename = u.Host
+	}
+
+	id := fmt.Sprintf("archive_%d_%s", time.Now().UnixNano(), sanitizeName(filename))
+	return h.startArchiveJob(id, filename, 0, func(store *archive.Store, progress func(string, float64)) (ArchiveMeta, error) {
+		baseDir := h.getDataPath("archives", id)
+		// The download directory only holds the temporary file
+		defer os.RemoveAll(baseDir)
+
+		if volume.IsIndex(u.Path) {
+			indexPath, size, err := downloadVolumeSet(u, req.Headers, baseDir, req.SHA256, progress)
+			if err != nil {
+				return ArchiveMeta{}, err
+			}
+			return importArchiveFile(store, id, indexPath, strings.TrimSuffix(filename, volume.IndexSuffix), size, progress)
+		}
+
+		tmpPath := filepath.Join(baseDir, "temp.tar")
+		size, err := downloadArchive(u, req.Headers, tmpPath, req.SHA256, progress)
+		if err != nil {
+			return ArchiveMeta{}, err
+		}
+		return importArchiveFile(store, id, tmpPath, filename, size, progress)
+	})
+}
+
+func (h *Handler) startPathImport(req ArchiveImportRequest) (*ArchiveJob, ArchiveMeta, error) {
+	src, err := h.resolveImportPath(req.Path)
+	if err != nil {
+		return nil, ArchiveMeta{}, err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, ArchiveMeta{}, fmt.Errorf("Failed to read %s: %v", req.Path, err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, ArchiveMeta{}, fmt.Errorf("%s is not a regular file", req.Path)
+	}
+	filename := req.Name
+	if filename == "" {
+		filename = filepath.Base(src)
+	}
+	size := info.Size()
+
+	// A volume set is imported through its index or first volume; every
+	// volume must lie in an import directory as well
+	if indexPath, ok := volume.IndexFor(src); ok {
+		ix, err := volume.ReadIndex(indexPath)
+		if err != nil {
+			return nil, ArchiveMeta{}, err
+		}
+		for _, v := range ix.Volumes {
+			if _, err := h.resolveImportPath(filepath.Join(filepath.Dir(indexPath), v.Name)); err != nil {
+				return nil, ArchiveMeta{}, err
+			}
+		}
+		if req.Name == "" && ix.Name != "" {
+			filename = ix.Name
+		}
+		size = ix.Size
+	}
+
+	id := fmt.Sprintf("archive_%d_%s", time.Now().UnixNano(), sanitizeName(filename))
+	return h.startArchiveJob(id, filename, size, func(store *archive.Store, progress func(string, float64)) (ArchiveMeta, error) {
+		// The file is read in place and left untouched
+		if req.SHA256 != "" {
+			progress("Verifying checksum...", 0.1)
+			sum, err := volume.SHA256File(src)
+			if err != nil {
+				return ArchiveMeta{}, err
+			}
+			if sum != req.SHA256 {
+				return ArchiveMeta{}, fmt.Errorf("sha256 mismatch: expected %s, got %s", req.SHA256, sum)
+			}
+		}
+		return importArchiveFile(store, id, src, filename, size, progress)
+	})
+}
+
+// resolveImportPath returns the real path of p if it lies below one of the
+// configured import directories. Symlinks are resolved first, so a link
+// inside an import directory cannot point outside of it.
+func (h *Handler) resolveImportPath(p string) (string, error) {
+	if len(h.archiveImportPaths) == 0 {
+		return "", fmt.Errorf("importing from server paths is disabled: %w", os.ErrPermission)
+	}
+	if !filepath.IsAbs(p) {
+		return "", fmt.Errorf("path must be absolute")
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(p))
+	if err != nil {
+		return "", fmt.Errorf("Failed to read %s: %v", p, err)
+	}
+	for _, dir := range h.archiveImportPaths {
+		root, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(root, resolved)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("%s is outside the allowed import paths: %w", p, os.ErrPermission)
+}
+
+// downloadArchive fetches u into dst, checking sha256 (when set) while the
+// data streams in. It returns the number of bytes written.
+func downloadArchive(u *url.URL, headers map[string]string, dst, wantSHA256 string, progress func(string, float64)) (int64, error) {
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	progress(fmt.Sprintf("Downloading %s://%s%s...", u.Scheme, u.Host, u.Path), 0)
+	resp, err := archiveDownloadClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("download failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("download failed: %s", resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, hasher), &downloadProgressReader{
+		r:        resp.Body,
+		total:    resp.ContentLength,
+		progress: progress,
+	})
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("download failed: %v", err)
+	}
+
+	if err := checkDownloadSum(hasher, wantSHA256); err != nil {
+		return 0, err
+	}
+	progress(fmt.Sprintf("Downloaded %s", formatBytes(n)), 0.3)
+	return n, nil
+}
+
+// downloadVolumeSet downloads the volume index at u and every volume it
+// lists from the same location into dir. wantSHA256 applies to the index.
+// It returns the local index path and the size of the reassembled archive.
+func downloadVolumeSet(u *url.URL, headers map[string]string, dir, wantSHA256 string, progress func(string, float64)) (string, int64, error) {
+	indexPath := filepath.Join(dir, "temp.tar"+volume.IndexSuffix)
+	if _, err := downloadArchive(u, headers, indexPath, wantSHA256, progress); err != nil {
+		return "", 0, err
+	}
+	ix, err := volume.ReadIndex(indexPath)
+	if err != nil {
+		return "", 0, err
+	}
+	for i, v := range ix.Volumes {
+		progress(fmt.Sprintf("Downloading volume %d of %d...", i+1, len(ix.Volumes)), 0)
+		vu := u.ResolveReference(&url.URL{Path: v.Name})
+		if _, err := downloadArchive(vu, headers, filepath.Join(dir, v.Name), "", progress); err != nil {
+			return "", 0, fmt.Errorf("%s: %v", v.Name, err)
+		}
+	}
+	return indexPath, ix.Size, nil
+}
+
+func checkDownloadSum(hasher hash.Hash, want string) error {
+	if want == "" {
+		return nil
+	}
+	if got := hex.EncodeToString(hasher.Sum(nil)); got != want {
+		return fmt.Errorf("sha256 mismatch: expected %s, got %s", want, got)
+	}
+	return nil
+}
+
+// archiveDownloadClient has no overall timeout: release artifacts can take
+// long to download, only an unresponsive server is given up on.
+var archiveDownloadClient = &http.Client{
+	Transport: func() http.RoundTripper {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.ResponseHeaderTimeout = 60 * time.Second
+		return t
+	}(),
+}
+
+// downloadProgressReader reports download progress as 0-30% of the job,
+// at most every 5%, or every 64MB when the size is unknown.
+type downloadProgressReader struct {
+	r        io.Reader
+	total    int64
+	read     int64
+	reported int64
+	progress func(string, float64)
+}
+
+func (p *downloadProgressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+
+	step := int64(64 << 20)
+	if p.total > 0 {
+		step = max(p.total/20, 1)
+	}
+	if p.read-p.reported >= step {
+		p.reported = p.read
+		if p.total > 0 {
+			frac := float64(p.read) / float64(p.total)
+			p.progress(fmt.Sprintf("Downloaded %s of %s (%.0f%%)", formatBytes(p.read), formatBytes(p.total), frac*100), 0.3*frac)
+		} else {
+			p.progress(fmt.Sprintf("Downloaded %s", formatBytes(p.read)), 0.1)
+		}
+	}
+	return n, err
+}
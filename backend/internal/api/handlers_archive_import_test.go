@@ -0,0 +1,200 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guoxudong/horcrux/internal/volume"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func postImport(t *testing.T, h *Handler, body ArchiveImportRequest) (*httptest.ResponseRecorder, *ArchiveJob) {
+	t.Helper()
+	r := gin.New()
+	r.POST("/api/archives/upload", h.UploadArchive)
+
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest(http.MethodPost, "/api/archives/upload", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted {
+		return w, nil
+	}
+
+	var resp struct {
+		Jobs []*ArchiveJob `json:"jobs"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Jobs, 1)
+	job, err := h.WaitArchiveJob(resp.Jobs[0].ID, nil)
+	require.NoError(t, err)
+	return w, job
+}
+
+func TestImportArchive_FromURL(t *testing.T) {
+	h, tempDir := newArchiveTestHandler(t)
+	data := gzipDockerArchive(t, "registry.local:5000/team/app:3.1")
+	sum := sha256.Sum256(data)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write(data)
+	}))
+	defer srv.Close()
+
+	_, job := postImport(t, h, ArchiveImportRequest{
+		URL:     srv.URL + "/releases/app.tar.gz",
+		Headers: map[string]string{"Authorization": "Bearer s3cret"},
+		SHA256:  "sha256:" + hex.EncodeToString(sum[:]),
+	})
+	require.NotNil(t, job)
+	require.Equal(t, "success", job.Status, job.Error)
+	assert.Equal(t, "app.tar.gz", job.Filename)
+
+	archivesMu.Lock()
+	meta := archivesMeta[0]
+	archivesMu.Unlock()
+	assert.Equal(t, ArchiveStatusReady, meta.Status)
+	assert.Equal(t, "3.1", meta.Tag)
+	assert.Equal(t, int64(len(data)), meta.Size)
+	_, err := os.Stat(filepath.Join(tempDir, "archives", meta.ID))
+	assert.True(t, os.IsNotExist(err), "download directory should be removed")
+
+	// Missing header
+	_, job = postImport(t, h, ArchiveImportRequest{URL: srv.URL + "/releases/app.tar.gz"})
+	require.NotNil(t, job)
+	assert.Equal(t, "failed", job.Status)
+	assert.Contains(t, job.Error, "401")
+}
+
+func TestImportArchive_URLChecksumMismatch(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(gzipDockerArchive(t, "app:1"))
+	}))
+	defer srv.Close()
+
+	_, job := postImport(t, h, ArchiveImportRequest{URL: srv.URL + "/app.tar.gz", SHA256: hex.EncodeToString(make([]byte, 32))})
+	require.NotNil(t, job)
+	assert.Equal(t, "failed", job.Status)
+	assert.Contains(t, job.Error, "sha256 mismatch")
+
+	w, _ := postImport(t, h, ArchiveImportRequest{URL: "ftp://example.com/app.tar"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestImportArchive_FromServerPath(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	allowed := t.TempDir()
+	outside := t.TempDir()
+
+	src := filepath.Join(allowed, "app.tar.gz")
+	require.NoError(t, os.WriteFile(src, gzipDockerArchive(t, "app:1"), 0644))
+	secret := filepath.Join(outside, "app.tar.gz")
+	require.NoError(t, os.WriteFile(secret, []byte("x"), 0644))
+	require.NoError(t, os.Symlink(secret, filepath.Join(allowed, "link.tar.gz")))
+
+	// Disabled until import paths are configured
+	w, _ := postImport(t, h, ArchiveImportRequest{Path: src})
+	assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+
+	h.SetArchiveImportPaths([]string{allowed})
+	for _, p := range []string{secret, filepath.Join(allowed, "link.tar.gz"), filepath.Join(allowed, "..", filepath.Base(outside), "app.tar.gz")} {
+		w, _ := postImport(t, h, ArchiveImportRequest{Path: p})
+		assert.Equal(t, http.StatusForbidden, w.Code, p)
+	}
+
+	_, job := postImport(t, h, ArchiveImportRequest{Path: src})
+	require.NotNil(t, job)
+	require.Equal(t, "success", job.Status, job.Error)
+	_, err := os.Stat(src)
+	assert.NoError(t, err, "imported file must be left in place")
+}
+
+func TestImportArchive_VolumeSet(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	data := gzipDockerArchive(t, "example.com/split:2.0")
+
+	// As written by "archive export --volume-size"
+	setDir := t.TempDir()
+	vw, err := volume.Create(filepath.Join(setDir, "split.tar.gz"), int64(len(data)/3+1))
+	require.NoError(t, err)
+	_, _ = vw.Write(data)
+	require.NoError(t, vw.Close())
+	ix := vw.Index()
+	require.Len(t, ix.Volumes, 3)
+	indexPath := volume.IndexPath(filepath.Join(setDir, "split.tar.gz"))
+
+	checkImported := func(job *ArchiveJob) {
+		t.Helper()
+		require.NotNil(t, job)
+		require.Equal(t, "success", job.Status, job.Error)
+		found, err := h.updateArchive(job.ArchiveID, func(m *ArchiveMeta) {
+			assert.Equal(t, "2.0", m.Tag)
+			assert.Equal(t, int64(len(data)), m.Size)
+		})
+		assert.NoError(t, err)
+		assert.True(t, found)
+	}
+
+	// Multipart: the index and its volumes form one archive
+	upload := func(names ...string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for _, name := range names {
+			content, err := os.ReadFile(filepath.Join(setDir, name))
+			require.NoError(t, err)
+			fw, _ := mw.CreateFormFile("files", name)
+			_, _ = fw.Write(content)
+		}
+		require.NoError(t, mw.Close())
+		req, _ := http.NewRequest(http.MethodPost, "/api/archives/upload", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		r := gin.New()
+		r.POST("/api/archives/upload", h.UploadArchive)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	w := upload(ix.Volumes[0].Name, filepath.Base(indexPath), ix.Volumes[1].Name, ix.Volumes[2].Name)
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	var resp struct {
+		Jobs []*ArchiveJob `json:"jobs"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Jobs, 1)
+	job, err := h.WaitArchiveJob(resp.Jobs[0].ID, nil)
+	require.NoError(t, err)
+	checkImported(job)
+	assert.Equal(t, "split.tar.gz", job.Filename)
+
+	w = upload(filepath.Base(indexPath), ix.Volumes[0].Name)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), ix.Volumes[2].Name)
+
+	// Server path: the first volume finds the rest of the set
+	h.SetArchiveImportPaths([]string{setDir})
+	_, job = postImport(t, h, ArchiveImportRequest{Path: filepath.Join(setDir, ix.Volumes[0].Name)})
+	checkImported(job)
+
+	// URL: volumes are fetched next to the index
+	srv := httptest.NewServer(http.StripPrefix("/releases/", http.FileServer(http.Dir(setDir))))
+	defer srv.Close()
+	_, job = postImport(t, h, ArchiveImportRequest{URL: srv.URL + "/releases/" + filepath.Base(indexPath)})
+	checkImported(job)
+	assert.Equal(t, filepath.Base(indexPath), job.Filename)
+}
@@ -0,0 +1,338 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guoxudong/horcrux/internal/archive"
+)
+
+// ArchiveJob tracks the background conversion of an uploaded archive into
+// the archive library.
+type ArchiveJob struct {
+	ID        string     `json:"id"`
+	ArchiveID string     `json:"archive_id"`
+	Filename  string     `json:"filename"`
+	Status    string     `json:"status"` // running, success, failed
+	Progress  float64    `json:"progress"`
+	Error     string     `json:"error,omitempty"`
+	Logs      []string   `json:"logs"`
+	CreatedAt time.Time  `json:"created_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+
+	mu sync.Mutex
+}
+
+type ArchiveJobEvent struct {
+	Type      string  `json:"type"`
+	JobID     string  `json:"job_id"`
+	ArchiveID string  `json:"archive_id"`
+	Status    string  `json:"status,omitempty"`
+	Progress  float64 `json:"progress,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// archiveImporter adds the images of a job to the store and returns the
+// finished archive entry.
+type archiveImporter func(store *archive.Store, progress func(msg string, percent float64)) (ArchiveMeta, error)
+
+// startArchiveIngest registers a "processing" archive entry, lets stage
+// write the archive into archives/<id> and converts it in the background.
+// stage returns the file to import: the archive itself or a volume index.
+// The entry exists before anything is written, so fsck never takes the
+// directory for an orphan; it is dropped again if stage fails.
+func (h *Handler) startArchiveIngest(archiveID, filename string, size int64, stage func(dir string) (string, error)) (*ArchiveJob, ArchiveMeta, error) {
+	job, meta, store, err := h.registerArchiveJob(archiveID, filename, size)
+	if err != nil {
+		return nil, ArchiveMeta{}, err
+	}
+
+	baseDir := h.getDataPath("archives", archiveID)
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		h.unregisterArchiveJob(job)
+		return nil, ArchiveMeta{}, fmt.Errorf("Failed to create directory")
+	}
+	tmpPath, err := stage(baseDir)
+	if err != nil {
+		os.RemoveAll(baseDir)
+		h.unregisterArchiveJob(job)
+		return nil, ArchiveMeta{}, err
+	}
+
+	snapshot := job.snapshot()
+	go h.runArchiveJob(store, job, func(store *archive.Store, progress func(string, float64)) (ArchiveMeta, error) {
+		meta, err := importArchiveFile(store, archiveID, tmpPath, filename, size, progress)
+		// The upload directory only held the temporary files
+		os.RemoveAll(baseDir)
+		return meta, err
+	})
+	return snapshot, meta, nil
+}
+
+// startArchiveJob registers a "processing" archive entry and runs importer
+// for it in the background.
+func (h *Handler) startArchiveJob(archiveID, filename string, size int64, importer archiveImporter) (*ArchiveJob, ArchiveMeta, error) {
+	job, meta, store, err := h.registerArchiveJob(archiveID, filename, size)
+	if err != nil {
+		return nil, ArchiveMeta{}, err
+	}
+	snapshot := job.snapshot()
+	go h.runArchiveJob(store, job, importer)
+	return snapshot, meta, nil
+}
+
+// registerArchiveJob saves a new job and its "processing" archive entry.
+func (h *Handler) registerArchiveJob(archiveID, filename string, size int64) (*ArchiveJob, ArchiveMeta, *archive.Store, error) {
+	job := &ArchiveJob{
+		ID:        fmt.Sprintf("archivejob_%d", time.Now().UnixNano()),
+		ArchiveID: archiveID,
+		Filename:  filename,
+		Status:    "running",
+		Logs:      []string{},
+		CreatedAt: time.Now(),
+	}
+	store, err := h.archiveStore()
+	if err != nil {
+		return nil, ArchiveMeta{}, nil, fmt.Errorf("Failed to open archive store: %v", err)
+	}
+	meta := ArchiveMeta{
+		ID:        archiveID,
+		Name:      filename,
+		Size:      size,
+		CreatedAt: job.CreatedAt,
+		Path:      store.Path(),
+		Ref:       fmt.Sprintf("archive://%s", archiveID),
+		Status:    ArchiveStatusProcessing,
+		JobID:     job.ID,
+	}
+
+	if err := h.saveArchiveJob(job); err != nil {
+		return nil, ArchiveMeta{}, nil, fmt.Errorf("Failed to save job: %v", err)
+	}
+	h.activeArchiveJobs.Store(job.ID, job)
+	if err := h.addArchives(meta); err != nil {
+		h.activeArchiveJobs.Delete(job.ID)
+		_ = os.Remove(h.getDataPath("archive_jobs", job.ID+".json"))
+		return nil, ArchiveMeta{}, nil, fmt.Errorf("Failed to save meta: %v", err)
+	}
+	return job, meta, store, nil
+}
+
+// unregisterArchiveJob drops a job that never started and its archive entry.
+func (h *Handler) unregisterArchiveJob(job *ArchiveJob) {
+	_ = h.removeArchive(job.ArchiveID)
+	h.activeArchiveJobs.Delete(job.ID)
+	_ = os.Remove(h.getDataPath("archive_jobs", job.ID+".json"))
+}
+
+func (h *Handler) runArchiveJob(store *archive.Store, job *ArchiveJob, importer archiveImporter) {
+	defer h.activeArchiveJobs.Delete(job.ID)
+
+	h.logArchiveJob(job, fmt.Sprintf("Ingesting %s", job.Filename))
+	h.broadcastArchiveJobEvent(job, "job_start")
+
+	meta, err := importer(store, func(msg string, percent float64) {
+		job.mu.Lock()
+		job.Progress = percent
+		job.mu.Unlock()
+		h.logArchiveJob(job, msg)
+		h.broadcastArchiveJobEvent(job, "job_progress")
+	})
+
+	if err == nil {
+		meta.JobID = job.ID
+		var found bool
+		found, err = h.updateArchive(job.ArchiveID, func(m *ArchiveMeta) {
+			// Keep the upload time so the list order does not jump
+			meta.CreatedAt = m.CreatedAt
+			*m = meta
+		})
+		if err == nil && !found {
+			// Deleted while processing
+			err = fmt.Errorf("archive entry was removed during ingestion")
+		}
+		if err != nil {
+			_ = store.Remove(job.ArchiveID)
+		}
+	}
+
+	now := time.Now()
+	job.mu.Lock()
+	job.EndedAt = &now
+	if err != nil {
+		job.Status = "failed"
+		job.Error = err.Error()
+	} else {
+		job.Status = "success"
+		job.Progress = 1
+	}
+	job.mu.Unlock()
+
+	if err != nil {
+		// Keep the entry so the failure is visible; blobs written before the
+		// failure are unreferenced and reclaimed by the next GC.
+		_, _ = h.updateArchive(job.ArchiveID, func(m *ArchiveMeta) {
+			m.Status = ArchiveStatusFailed
+			m.Error = err.Error()
+		})
+		h.logArchiveJob(job, fmt.Sprintf("Ingestion failed: %v", err))
+		h.broadcastArchiveJobEvent(job, "job_end")
+		h.hub.Broadcast(fmt.Sprintf("ARCHIVE_FAILED:%s:%s", job.ID, err.Error()))
+		return
+	}
+
+	h.logArchiveJob(job, fmt.Sprintf("Archive %s:%s is ready", meta.Name, meta.Tag))
+	h.broadcastArchiveJobEvent(job, "job_end")
+	h.hub.Broadcast(fmt.Sprintf("ARCHIVE_SUCCESS:%s", job.ID))
+}
+
+// WaitArchiveJob blocks until the job id has finished and returns its final
+// state. onLog, if set, receives every log line as it is written.
+func (h *Handler) WaitArchiveJob(id string, onLog func(line string)) (*ArchiveJob, error) {
+	printed := 0
+	emit := func(job *ArchiveJob) {
+		for ; printed < len(job.Logs); printed++ {
+			if onLog != nil {
+				onLog(job.Logs[printed])
+			}
+		}
+	}
+	for {
+		v, ok := h.activeArchiveJobs.Load(id)
+		if !ok {
+			break
+		}
+		emit(v.(*ArchiveJob).snapshot())
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	job, err := h.loadArchiveJob(id)
+	if err != nil {
+		return nil, err
+	}
+	emit(job)
+	return job, nil
+}
+
+func (j *ArchiveJob) snapshot() *ArchiveJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return &ArchiveJob{
+		ID:        j.ID,
+		ArchiveID: j.ArchiveID,
+		Filename:  j.Filename,
+		Status:    j.Status,
+		Progress:  j.Progress,
+		Error:     j.Error,
+		Logs:      append([]string{}, j.Logs...),
+		CreatedAt: j.CreatedAt,
+		EndedAt:   j.EndedAt,
+	}
+}
+
+func (h *Handler) logArchiveJob(job *ArchiveJob, msg string) {
+	formattedMsg := fmt.Sprintf("%s %s", time.Now().Format("15:04:05"), msg)
+	job.mu.Lock()
+	job.Logs = append(job.Logs, formattedMsg)
+	job.mu.Unlock()
+	_ = h.saveArchiveJob(job)
+	h.hub.Broadcast(fmt.Sprintf("ARCHIVE_LOG:%s:%s", job.ID, formattedMsg))
+}
+
+func (h *Handler) broadcastArchiveJobEvent(job *ArchiveJob, eventType string) {
+	if h == nil || h.hub == nil {
+		return
+	}
+	s := job.snapshot()
+	data, err := json.Marshal(ArchiveJobEvent{
+		Type:      eventType,
+		JobID:     s.ID,
+		ArchiveID: s.ArchiveID,
+		Status:    s.Status,
+		Progress:  s.Progress,
+		Error:     s.Error,
+	})
+	if err != nil {
+		return
+	}
+	h.hub.Broadcast(fmt.Sprintf("ARCHIVE_EVENT:%s:%s", s.ID, string(data)))
+}
+
+func (h *Handler) saveArchiveJob(job *ArchiveJob) error {
+	dir := h.getDataPath("archive_jobs")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(job.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, job.ID+".json"), data, 0644)
+}
+
+func (h *Handler) loadArchiveJob(id string) (*ArchiveJob, error) {
+	if v, ok := h.activeArchiveJobs.Load(id); ok {
+		return v.(*ArchiveJob).snapshot(), nil
+	}
+	data, err := os.ReadFile(h.getDataPath("archive_jobs", id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var job ArchiveJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, err
+	}
+	if job.Status == "running" {
+		// The server stopped before the job finished
+		job.Status = "failed"
+		job.Error = "ingestion interrupted"
+	}
+	return &job, nil
+}
+
+// ListArchiveJobs returns all ingestion jobs, newest first.
+func (h *Handler) ListArchiveJobs(c *gin.Context) {
+	jobs := []*ArchiveJob{}
+	files, err := os.ReadDir(h.getDataPath("archive_jobs"))
+	if err != nil && !os.IsNotExist(err) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		job, err := h.loadArchiveJob(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+	})
+	c.JSON(http.StatusOK, gin.H{"jobs": jobs})
+}
+
+// GetArchiveJob returns a single ingestion job including its logs.
+func (h *Handler) GetArchiveJob(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	if !isSafePipeID(id) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid job id"})
+		return
+	}
+	job, err := h.loadArchiveJob(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
@@ -0,0 +1,261 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/guoxudong/horcrux/internal/archive"
+	"github.com/guoxudong/horcrux/internal/engine"
+	"github.com/guoxudong/horcrux/internal/vault"
+)
+
+// ArchivePullRequest pulls an image from a registry into the archive library.
+type ArchivePullRequest struct {
+	Ref          string   `json:"ref"`
+	CredentialID string   `json:"credential_id"`
+	Platforms    []string `json:"platforms"` // e.g. linux/amd64; empty keeps all platforms
+}
+
+// PullArchive stages a remote image as a new archive:// entry. The pull runs
+// as a background archive job like an upload.
+func (h *Handler) PullArchive(c *gin.Context) {
+	var req ArchivePullRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	job, meta, err := h.StartArchivePull(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"status":  "accepted",
+		"archive": meta,
+		"job":     job,
+	})
+}
+
+// StartArchivePull validates req and starts pulling it into the archive
+// library. Use WaitArchiveJob to wait for the returned job.
+func (h *Handler) StartArchivePull(req ArchivePullRequest) (*ArchiveJob, ArchiveMeta, error) {
+	req.Ref = strings.TrimSpace(req.Ref)
+	ref, err := name.ParseReference(req.Ref)
+	if err != nil {
+		return nil, ArchiveMeta{}, fmt.Errorf("Invalid image reference: %v", err)
+	}
+
+	var platforms []v1.Platform
+	for _, p := range req.Platforms {
+		if strings.TrimSpace(p) == "" {
+			continue
+		}
+		platform, err := v1.ParsePlatform(strings.TrimSpace(p))
+		if err != nil {
+			return nil, ArchiveMeta{}, fmt.Errorf("Invalid platform %q: %v", p, err)
+		}
+		platforms = append(platforms, *platform)
+	}
+
+	var cred *vault.Credential
+	if req.CredentialID != "" {
+		cred, err = h.findCredentialByID(req.CredentialID)
+		if err != nil {
+			return nil, ArchiveMeta{}, fmt.Errorf("Failed to load credentials: %v", err)
+		}
+		if cred == nil {
+			return nil, ArchiveMeta{}, fmt.Errorf("Credential not found: %s", req.CredentialID)
+		}
+	}
+
+	id := fmt.Sprintf("archive_%d_%s", time.Now().UnixNano(), sanitizeName(ref.Context().RepositoryStr()))
+	return h.startArchiveJob(id, req.Ref, 0, func(store *archive.Store, progress func(string, float64)) (ArchiveMeta, error) {
+		return pullArchiveImage(store, id, ref, cred, platforms, progress)
+	})
+}
+
+// pullArchiveImage fetches ref and adds it to the store. Multi-platform images
+// keep their index (and digest) unless platforms narrows them down; single
+// images are wrapped in an index like uploaded archives.
+func pullArchiveImage(store *archive.Store, id string, ref name.Reference, cred *vault.Credential, platforms []v1.Platform, progress func(string, float64)) (ArchiveMeta, error) {
+	syncer := engine.NewSyncer(nil)
+
+	progress(fmt.Sprintf("Fetching manifest of %s...", ref), 0.1)
+	idx, img, err := syncer.Fetch(ref.String(), cred)
+	if err != nil {
+		return ArchiveMeta{}, err
+	}
+
+	var root v1.ImageIndex
+	if idx != nil {
+		if root, err = filterPlatforms(idx, platforms); err != nil {
+			return ArchiveMeta{}, err
+		}
+	} else {
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return ArchiveMeta{}, fmt.Errorf("Failed to read image config: %v", err)
+		}
+		platform := cfg.Platform()
+		if platform == nil {
+			platform = &v1.Platform{OS: cfg.OS, Architecture: cfg.Architecture}
+		}
+		if !matchesPlatforms(*platform, platforms) {
+			return ArchiveMeta{}, fmt.Errorf("%s is %s only", ref, platform)
+		}
+		root = mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: platform},
+		})
+	}
+
+	im, err := root.IndexManifest()
+	if err != nil {
+		return ArchiveMeta{}, err
+	}
+	progress(fmt.Sprintf("Downloading %d image(s) into the archive store...", len(im.Manifests)), 0.3)
+	desc, err := store.Add(id, root)
+	if err != nil {
+		return ArchiveMeta{}, fmt.Errorf("Failed to write OCI layout: %v", err)
+	}
+
+	progress("Reading image metadata...", 0.9)
+	size, err := indexSize(root)
+	if err != nil {
+		return ArchiveMeta{}, err
+	}
+
+	repo, tag := ref.Context().RepositoryStr(), ref.Identifier()
+	if ref.Context().RegistryStr() != name.DefaultRegistry {
+		repo = ref.Context().Name()
+	}
+	meta := ArchiveMeta{
+		ID:        id,
+		Name:      strings.TrimPrefix(repo, "library/"),
+		Size:      size,
+		CreatedAt: time.Now(),
+		Path:      store.Path(),
+		Root:      desc.Digest.String(),
+		Ref:       fmt.Sprintf("archive://%s", id),
+		Tag:       tag,
+		Status:    ArchiveStatusReady,
+	}
+	if len(im.Manifests) == 1 {
+		meta.Digest = im.Manifests[0].Digest.String()
+		if p := im.Manifests[0].Platform; p != nil {
+			meta.Architecture, meta.OS = p.Architecture, p.OS
+		}
+	} else {
+		meta.Digest = desc.Digest.String()
+		meta.Architecture = "multi-arch"
+		meta.OS = "multi-os"
+	}
+	return meta, nil
+}
+
+// filterPlatforms returns idx without the manifests not matching platforms.
+// Without platforms idx is returned unchanged.
+func filterPlatforms(idx v1.ImageIndex, platforms []v1.Platform) (v1.ImageIndex, error) {
+	if len(platforms) == 0 {
+		return idx, nil
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	var adds []mutate.IndexAddendum
+	for _, d := range im.Manifests {
+		if d.Platform == nil || !matchesPlatforms(*d.Platform, platforms) {
+			continue
+		}
+		var add mutate.Appendable
+		if d.MediaType.IsIndex() {
+			add, err = idx.ImageIndex(d.Digest)
+		} else {
+			add, err = idx.Image(d.Digest)
+		}
+		if err != nil {
+			return nil, err
+		}
+		adds = append(adds, mutate.IndexAddendum{Add: add, Descriptor: d})
+	}
+	if len(adds) == 0 {
+		return nil, fmt.Errorf("no manifest matches platform(s) %s", platformList(platforms))
+	}
+	return mutate.IndexMediaType(mutate.AppendManifests(empty.Index, adds...), im.MediaType), nil
+}
+
+func matchesPlatforms(p v1.Platform, platforms []v1.Platform) bool {
+	if len(platforms) == 0 {
+		return true
+	}
+	for _, spec := range platforms {
+		if p.Satisfies(spec) {
+			return true
+		}
+	}
+	return false
+}
+
+func platformList(platforms []v1.Platform) string {
+	s := make([]string, len(platforms))
+	for i, p := range platforms {
+		s[i] = p.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// indexSize sums the manifests, configs and layers reachable from idx,
+// counting shared blobs once.
+func indexSize(idx v1.ImageIndex) (int64, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return 0, err
+	}
+	seen := map[v1.Hash]bool{}
+	var size int64
+	add := func(d v1.Descriptor) {
+		if !seen[d.Digest] {
+			seen[d.Digest] = true
+			size += d.Size
+		}
+	}
+	for _, d := range im.Manifests {
+		add(d)
+		switch {
+		case d.MediaType.IsIndex():
+			child, err := idx.ImageIndex(d.Digest)
+			if err != nil {
+				return 0, err
+			}
+			n, err := indexSize(child)
+			if err != nil {
+				return 0, err
+			}
+			size += n
+		case d.MediaType.IsImage():
+			img, err := idx.Image(d.Digest)
+			if err != nil {
+				return 0, err
+			}
+			m, err := img.Manifest()
+			if err != nil {
+				return 0, err
+			}
+			add(m.Config)
+			for _, l := range m.Layers {
+				add(l)
+			}
+		}
+	}
+	return size, nil
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pushMultiArch pushes a linux/amd64 + linux/arm64 index to a fresh registry.
+func pushMultiArch(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(registry.New())
+	t.Cleanup(srv.Close)
+
+	var adds []mutate.IndexAddendum
+	for _, arch := range []string{"amd64", "arm64"} {
+		img, err := random.Image(256, 1)
+		require.NoError(t, err)
+		adds = append(adds, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: arch}},
+		})
+	}
+	ref := strings.TrimPrefix(srv.URL, "http://") + "/team/app:2.0"
+	r, err := name.ParseReference(ref)
+	require.NoError(t, err)
+	require.NoError(t, remote.WriteIndex(r, mutate.AppendManifests(empty.Index, adds...)))
+	return ref
+}
+
+func postPull(t *testing.T, r *gin.Engine, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest(http.MethodPost, "/api/archives/pull", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestPullArchive_SelectedPlatform(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	ref := pushMultiArch(t)
+
+	r := gin.New()
+	r.POST("/api/archives/pull", h.PullArchive)
+
+	w := postPull(t, r, ArchivePullRequest{Ref: ref, Platforms: []string{"linux/arm64"}})
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	var resp struct {
+		Archive ArchiveMeta `json:"archive"`
+		Job     ArchiveJob  `json:"job"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, ArchiveStatusProcessing, resp.Archive.Status)
+
+	job, err := h.WaitArchiveJob(resp.Job.ID, nil)
+	require.NoError(t, err)
+	require.Equal(t, "success", job.Status, job.Error)
+
+	archivesMu.Lock()
+	meta := archivesMeta[0]
+	archivesMu.Unlock()
+	idx, err := openArchiveIndex(meta)
+	require.NoError(t, err)
+	im, err := idx.IndexManifest()
+	require.NoError(t, err)
+	require.Len(t, im.Manifests, 1)
+	assert.Equal(t, "arm64", im.Manifests[0].Platform.Architecture)
+
+	// Syncs read the arm64 image the archive lists, not the store root
+	_, digest, err := h.resolveArchiveRef(resp.Archive.Ref)
+	require.NoError(t, err)
+	assert.Equal(t, im.Manifests[0].Digest.String(), digest)
+	assert.Equal(t, meta.Digest, digest)
+	assert.Equal(t, "arm64", meta.Architecture)
+	assert.Equal(t, "2.0", meta.Tag)
+	assert.True(t, strings.HasSuffix(meta.Name, "/team/app"), meta.Name)
+	assert.Positive(t, meta.Size)
+}
+
+func TestPullArchive_KeepsIndexDigest(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	ref := pushMultiArch(t)
+
+	job, meta, err := h.StartArchivePull(ArchivePullRequest{Ref: ref})
+	require.NoError(t, err)
+	job, err = h.WaitArchiveJob(job.ID, nil)
+	require.NoError(t, err)
+	require.Equal(t, "success", job.Status, job.Error)
+
+	r, err := name.ParseReference(ref)
+	require.NoError(t, err)
+	desc, err := remote.Head(r)
+	require.NoError(t, err)
+	_, root, err := h.resolveArchiveRef(meta.Ref)
+	require.NoError(t, err)
+	assert.Equal(t, desc.Digest.String(), root)
+}
+
+func TestPullArchive_RejectsInvalidRequests(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	r := gin.New()
+	r.POST("/api/archives/pull", h.PullArchive)
+
+	for _, body := range []ArchivePullRequest{
+		{Ref: "not a ref"},
+		{Ref: "example.com/app:1", Platforms: []string{"linux/amd64/v8/extra"}},
+		{Ref: "example.com/app:1", CredentialID: "cred_missing"},
+	} {
+		w := postPull(t, r, body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	}
+	assert.Empty(t, archivesMeta)
+}
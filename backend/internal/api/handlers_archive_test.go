@@ -0,0 +1,404 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/guoxudong/horcrux/internal/engine"
+	"github.com/guoxudong/horcrux/internal/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newArchiveTestHandler(t *testing.T) (*Handler, string) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	tempDir := t.TempDir()
+	v, err := vault.NewVault(filepath.Join(tempDir, "vault.enc"), "12345678901234567890123456789012")
+	assert.NoError(t, err)
+
+	archivesMu.Lock()
+	archivesMeta = nil
+	archivesMu.Unlock()
+
+	return NewHandler(v, NewHub()), tempDir
+}
+
+// waitArchiveJobs blocks until no ingestion job is running on h.
+func waitArchiveJobs(t *testing.T, h *Handler) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		running := false
+		h.activeArchiveJobs.Range(func(_, _ any) bool {
+			running = true
+			return false
+		})
+		if !running {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for archive jobs")
+}
+
+func gzipDockerArchive(t *testing.T, ref string) []byte {
+	t.Helper()
+	img, err := random.Image(512, 2)
+	assert.NoError(t, err)
+	tag, err := name.NewTag(ref)
+	assert.NoError(t, err)
+
+	var raw bytes.Buffer
+	assert.NoError(t, tarball.Write(tag, img, &raw))
+
+	var out bytes.Buffer
+	gz := gzip.NewWriter(&out)
+	_, _ = gz.Write(raw.Bytes())
+	assert.NoError(t, gz.Close())
+	return out.Bytes()
+}
+
+// uploadImageArchive uploads img as a docker tarball tagged ref and returns
+// the archive once it is ready.
+func uploadImageArchive(t *testing.T, h *Handler, ref string, img v1.Image) ArchiveMeta {
+	t.Helper()
+	tag, err := name.NewTag(ref)
+	require.NoError(t, err)
+	var raw bytes.Buffer
+	require.NoError(t, tarball.Write(tag, img, &raw))
+
+	r := gin.New()
+	r.POST("/api/archives/upload", h.UploadArchive)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, multipartArchiveRequest(t, "app.tar", raw.Bytes()))
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	var resp struct {
+		Uploaded []ArchiveMeta `json:"uploaded"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Uploaded, 1)
+	waitArchiveJobs(t, h)
+
+	archivesMu.Lock()
+	defer archivesMu.Unlock()
+	for _, m := range archivesMeta {
+		if m.ID == resp.Uploaded[0].ID {
+			require.Equal(t, ArchiveStatusReady, m.Status, m.Error)
+			return m
+		}
+	}
+	t.Fatalf("archive %s not found", resp.Uploaded[0].ID)
+	return ArchiveMeta{}
+}
+
+func multipartArchiveRequest(t *testing.T, filename string, data []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("files", filename)
+	assert.NoError(t, err)
+	_, _ = fw.Write(data)
+	assert.NoError(t, mw.Close())
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/archives/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestUploadArchive_GzipDockerTarball(t *testing.T) {
+	h, tempDir := newArchiveTestHandler(t)
+
+	r := gin.New()
+	r.POST("/api/archives/upload", h.UploadArchive)
+	r.GET("/api/archives", h.ListArchives)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, multipartArchiveRequest(t, "app.tar.gz", gzipDockerArchive(t, "registry.local:5000/team/app:1.0")))
+	assert.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+
+	var resp struct {
+		Uploaded []ArchiveMeta `json:"uploaded"`
+		Jobs     []*ArchiveJob `json:"jobs"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	if assert.Len(t, resp.Uploaded, 1) && assert.Len(t, resp.Jobs, 1) {
+		assert.Equal(t, ArchiveStatusProcessing, resp.Uploaded[0].Status)
+		assert.Equal(t, resp.Uploaded[0].ID, resp.Jobs[0].ArchiveID)
+	}
+	waitArchiveJobs(t, h)
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/api/archives", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var list []ArchiveMeta
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, "registry.local:5000/team/app", list[0].Name)
+		assert.Equal(t, "1.0", list[0].Tag)
+		assert.Equal(t, ArchiveStatusReady, list[0].Status)
+		assert.NotEmpty(t, list[0].Digest)
+		_, err := os.Stat(filepath.Join(list[0].Path, "index.json"))
+		assert.NoError(t, err)
+		_, err = os.Stat(filepath.Join(tempDir, "archives", list[0].ID, "temp.tar"))
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestUploadArchive_InvalidArchiveFailsJob(t *testing.T) {
+	h, tempDir := newArchiveTestHandler(t)
+
+	r := gin.New()
+	r.POST("/api/archives/upload", h.UploadArchive)
+	r.GET("/api/archives", h.ListArchives)
+	r.GET("/api/archives/jobs/:id", h.GetArchiveJob)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, multipartArchiveRequest(t, "junk.tar", []byte("not a tar at all")))
+	assert.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+
+	var resp struct {
+		Jobs []*ArchiveJob `json:"jobs"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	if !assert.Len(t, resp.Jobs, 1) {
+		return
+	}
+	waitArchiveJobs(t, h)
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/api/archives/jobs/"+resp.Jobs[0].ID, nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var job ArchiveJob
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+	assert.Equal(t, "failed", job.Status)
+	assert.Contains(t, job.Error, "Invalid image archive")
+	assert.NotEmpty(t, job.Logs)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/api/archives", nil)
+	r.ServeHTTP(w, req)
+	var list []ArchiveMeta
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, ArchiveStatusFailed, list[0].Status)
+		assert.NotEmpty(t, list[0].Error)
+		_, err := os.Stat(filepath.Join(tempDir, "archives", list[0].ID, "layout"))
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestListArchives_MarksInterruptedIngestionFailed(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	assert.NoError(t, h.addArchives(ArchiveMeta{
+		ID:     "archive_stale",
+		Name:   "stale.tar",
+		Status: ArchiveStatusProcessing,
+		JobID:  "archivejob_gone",
+	}))
+
+	r := gin.New()
+	r.GET("/api/archives", h.ListArchives)
+	r.DELETE("/api/archives/:id", h.DeleteArchive)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/api/archives", nil)
+	r.ServeHTTP(w, req)
+	var list []ArchiveMeta
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, ArchiveStatusFailed, list[0].Status)
+		assert.Equal(t, "ingestion interrupted", list[0].Error)
+	}
+
+	// Failed entries can be deleted
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodDelete, "/api/archives/archive_stale", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestDeleteArchive_KeepsBlobsSharedWithOtherArchives(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+
+	r := gin.New()
+	r.POST("/api/archives/upload", h.UploadArchive)
+	r.GET("/api/archives", h.ListArchives)
+	r.DELETE("/api/archives/:id", h.DeleteArchive)
+
+	// The same image uploaded twice shares every blob
+	data := gzipDockerArchive(t, "example.com/shared:1.0")
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, multipartArchiveRequest(t, "shared.tar.gz", data))
+		assert.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+		waitArchiveJobs(t, h)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/api/archives", nil)
+	r.ServeHTTP(w, req)
+	var list []ArchiveMeta
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	if !assert.Len(t, list, 2) {
+		return
+	}
+	assert.Equal(t, list[0].Path, list[1].Path)
+	assert.Equal(t, list[0].Root, list[1].Root)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodDelete, "/api/archives/"+list[0].ID, nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The remaining archive is still complete
+	idx, err := openArchiveIndex(list[1])
+	if !assert.NoError(t, err) {
+		return
+	}
+	m, err := idx.IndexManifest()
+	assert.NoError(t, err)
+	img, err := idx.Image(m.Manifests[0].Digest)
+	assert.NoError(t, err)
+	layers, err := img.Layers()
+	assert.NoError(t, err)
+	for _, l := range layers {
+		rc, err := l.Compressed()
+		if assert.NoError(t, err) {
+			rc.Close()
+		}
+	}
+
+	// Deleting the last reference reclaims the blobs
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodDelete, "/api/archives/"+list[1].ID, nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		BlobsRemoved int `json:"blobs_removed"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Greater(t, resp.BlobsRemoved, 0)
+}
+
+func TestMigrateLegacyArchives(t *testing.T) {
+	h, tempDir := newArchiveTestHandler(t)
+
+	img, err := random.Image(256, 1)
+	assert.NoError(t, err)
+	legacyDir := filepath.Join(tempDir, "archives", "archive_legacy")
+	_, err = layout.Write(filepath.Join(legacyDir, "layout"), mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: img}))
+	assert.NoError(t, err)
+	assert.NoError(t, h.addArchives(ArchiveMeta{
+		ID:   "archive_legacy",
+		Name: "legacy",
+		Tag:  "1.0",
+		Path: filepath.Join(legacyDir, "layout"),
+		Ref:  "archive://archive_legacy",
+	}))
+
+	// Listing only reports what is stored
+	r := gin.New()
+	r.GET("/api/archives", h.ListArchives)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/api/archives", nil)
+	r.ServeHTTP(w, req)
+	_, err = os.Stat(legacyDir)
+	assert.NoError(t, err)
+
+	n, err := h.MigrateLegacyArchives()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// The saved metadata points into the store
+	assert.NoError(t, h.loadArchivesMeta())
+	list := append([]ArchiveMeta{}, archivesMeta...)
+	if assert.Len(t, list, 1) {
+		assert.NotEmpty(t, list[0].Root)
+		assert.Equal(t, h.getDataPath("archive_store"), list[0].Path)
+
+		path, digest, err := h.resolveArchiveRef("archive://archive_legacy")
+		assert.NoError(t, err)
+		assert.Equal(t, list[0].Path, path)
+		assert.Equal(t, list[0].Digest, digest)
+	}
+	_, err = os.Stat(legacyDir)
+	assert.True(t, os.IsNotExist(err))
+
+	n, err = h.MigrateLegacyArchives()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestMergeArchives_DuplicatePlatforms(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	// Both archives hold different linux/amd64 and linux/arm64 images
+	first := pulledArchive(t, h)
+	second := pulledArchive(t, h)
+
+	r := gin.New()
+	r.POST("/api/archives/merge", h.MergeArchives)
+	merge := func(policy string) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(MergeRequest{IDs: []string{first.ID, second.ID}, PlatformPolicy: policy})
+		req, _ := http.NewRequest(http.MethodPost, "/api/archives/merge", bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := merge("")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "linux/amd64")
+	assert.Equal(t, http.StatusBadRequest, merge("last").Code)
+
+	w = merge(engine.PlatformPolicyFirst)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Report engine.MergeReport `json:"report"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Report.Platforms, 2)
+	require.Len(t, resp.Report.Dropped, 2)
+	for _, p := range resp.Report.Platforms {
+		assert.Equal(t, first.ID, p.Source)
+	}
+	for _, p := range resp.Report.Dropped {
+		assert.Equal(t, second.ID, p.Source)
+	}
+}
+
+func TestSplitRepoTag(t *testing.T) {
+	cases := []struct {
+		ref, name, tag string
+	}{
+		{"nginx:1.25", "nginx", "1.25"},
+		{"registry.local:5000/team/app:1.0", "registry.local:5000/team/app", "1.0"},
+		{"registry.local:5000/team/app", "registry.local:5000/team/app", "latest"},
+		{"2.0", "file.tar", "2.0"},
+	}
+	for _, tc := range cases {
+		name, tag := splitRepoTag(tc.ref, "file.tar", "latest")
+		assert.Equal(t, tc.name, name, tc.ref)
+		assert.Equal(t, tc.tag, tag, tc.ref)
+	}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guoxudong/horcrux/internal/vault"
+)
+
+// maxDockerConfigSize bounds an uploaded docker config.json.
+const maxDockerConfigSize = 1 << 20
+
+// ImportDockerConfig creates credentials from an uploaded docker
+// config.json, sent as the "file" form field or as a JSON body. credHelpers
+// and credsStore entries are stored as helper credentials, never resolved
+// on the server; helper values that are paths rather than names are
+// skipped.
+func (h *Handler) ImportDockerConfig(c *gin.Context) {
+	var data []byte
+	var err error
+	if c.ContentType() == "application/json" {
+		data, err = io.ReadAll(io.LimitReader(c.Request.Body, maxDockerConfigSize+1))
+	} else {
+		var fh *multipart.FileHeader
+		if fh, err = c.FormFile("file"); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No config file uploaded"})
+			return
+		}
+		var f multipart.File
+		if f, err = fh.Open(); err == nil {
+			data, err = io.ReadAll(io.LimitReader(f, maxDockerConfigSize+1))
+			f.Close()
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(data) > maxDockerConfigSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "docker config is too large"})
+		return
+	}
+	cfg, err := vault.ParseDockerConfig(data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Helpers are linked, never run: running them here would copy the
+	// server host's own registry secrets into the vault.
+	res, err := h.vault.ImportDockerConfig(c.Request.Context(), cfg, vault.DockerImportOptions{LinkHelpers: true})
+	if err != nil {
+		c.JSON(vaultErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	// Don't return secrets
+	for i := range res.Added {
+		res.Added[i] = res.Added[i].Redacted()
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guoxudong/horcrux/internal/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDockerConfigImport(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	v, err := vault.NewVault(filepath.Join(t.TempDir(), "vault.enc"), "12345678901234567890123456789012")
+	require.NoError(t, err)
+	require.NoError(t, v.SaveCredentials([]vault.Credential{
+		{ID: "cred_hub", Name: "hub", Registry: "docker.io", Username: "alice", Password: "secret"},
+	}))
+	h := NewHandler(v, NewHub())
+	r := gin.New()
+	r.POST("/api/vault/credentials/import", h.ImportDockerConfig)
+
+	config := `{"auths": {
+		"https://index.docker.io/v1/": {"auth": "` + base64.StdEncoding.EncodeToString([]byte("alice:secret")) + `"},
+		"ghcr.io": {"auth": "` + base64.StdEncoding.EncodeToString([]byte("octo:token")) + `"}
+	}}`
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", "config.json")
+	require.NoError(t, err)
+	_, _ = fw.Write([]byte(config))
+	require.NoError(t, mw.Close())
+	req, _ := http.NewRequest(http.MethodPost, "/api/vault/credentials/import", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var res vault.DockerImportResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	require.Len(t, res.Added, 1)
+	assert.Equal(t, "ghcr.io", res.Added[0].Registry)
+	assert.Equal(t, "********", res.Added[0].Password)
+	require.Len(t, res.Skipped, 1)
+	assert.Equal(t, "duplicate of hub", res.Skipped[0].Reason)
+
+	creds, err := v.LoadCredentials()
+	require.NoError(t, err)
+	require.Len(t, creds, 2)
+	assert.Equal(t, "token", creds[1].Password)
+
+	// A JSON body works too; an invalid one is rejected
+	w = postSync(t, r, "/api/vault/credentials/import", json.RawMessage(config))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	req, _ = http.NewRequest(http.MethodPost, "/api/vault/credentials/import", bytes.NewReader([]byte("[")))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Helpers are linked without running them on the server
+	w = postSync(t, r, "/api/vault/credentials/import", json.RawMessage(`{"auths": {"registry.local": {}}, "credsStore": "desktop"}`))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	require.Len(t, res.Added, 1)
+	assert.Equal(t, vault.AuthHelper, res.Added[0].AuthKind())
+	assert.Equal(t, "desktop", res.Added[0].Helper)
+
+	// There is no HTTP export of the vault secrets
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/vault/credentials/export", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/guoxudong/horcrux/internal/engine"
+	"github.com/guoxudong/horcrux/internal/vault"
+)
+
+// InspectRef describes the image or index at ref, which is a registry
+// reference or an archive:// ref. Registry refs are qualified with the
+// registry of cred like sync sources.
+func (h *Handler) InspectRef(ref string, cred *vault.Credential) (*engine.Inspection, error) {
+	opts, err := h.sourceOptions(ref, cred)
+	if err != nil {
+		return nil, err
+	}
+	return engine.NewSyncer(nil).Inspect(opts)
+}
+
+// sourceOptions resolves a registry or archive:// ref to the source fields
+// of engine.SyncOptions. A single-image archive resolves to its image, so
+// it inspects like the registry image it was saved from.
+func (h *Handler) sourceOptions(ref string, cred *vault.Credential) (engine.SyncOptions, error) {
+	ref = strings.TrimSpace(ref)
+	opts := engine.SyncOptions{SourceRef: ref, SourceAuth: cred}
+	if strings.HasPrefix(ref, "archive://") {
+		path, root, err := h.resolveArchiveRef(ref)
+		if err != nil {
+			return opts, err
+		}
+		opts.SourceLayoutPath, opts.SourceLayoutDigest = path, root
+		return opts, nil
+	}
+	if normalized, changed := normalizeImageRef(ref, cred); changed {
+		opts.SourceRef = normalized
+	}
+	if _, err := name.ParseReference(opts.SourceRef); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// InspectImage returns the manifest, config, layers and history of a
+// registry or archive:// image, so both can be checked before a sync.
+func (h *Handler) InspectImage(c *gin.Context) {
+	ref := strings.TrimSpace(c.Query("ref"))
+	if ref == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ref is required"})
+		return
+	}
+	cred, err := h.findCredentialByID(strings.TrimSpace(c.Query("cred_id")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "vault load failed"})
+		return
+	}
+
+	if status, err := h.checkInspectRef(ref, cred); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	inspection, err := h.InspectRef(ref, cred)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, inspection)
+}
+
+// DiffRefs inspects two registry or archive:// refs and compares them.
+func (h *Handler) DiffRefs(left, right string, leftCred, rightCred *vault.Credential) (*engine.ImageDiff, error) {
+	l, err := h.InspectRef(left, leftCred)
+	if err != nil {
+		return nil, fmt.Errorf("left: %w", err)
+	}
+	r, err := h.InspectRef(right, rightCred)
+	if err != nil {
+		return nil, fmt.Errorf("right: %w", err)
+	}
+	return engine.DiffInspections(l, r), nil
+}
+
+// DiffImages compares the manifests, configs, layers and platforms of two
+// registry or archive:// refs, e.g. a source and its mirror.
+func (h *Handler) DiffImages(c *gin.Context) {
+	left := strings.TrimSpace(c.Query("left"))
+	right := strings.TrimSpace(c.Query("right"))
+	if left == "" || right == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "left and right are required"})
+		return
+	}
+	leftCred, err := h.findCredentialByID(strings.TrimSpace(c.Query("left_cred_id")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "vault load failed"})
+		return
+	}
+	rightCred, err := h.findCredentialByID(strings.TrimSpace(c.Query("right_cred_id")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "vault load failed"})
+		return
+	}
+	for _, side := range []struct {
+		name string
+		ref  string
+		cred *vault.Credential
+	}{{"left", left, leftCred}, {"right", right, rightCred}} {
+		if status, err := h.checkInspectRef(side.ref, side.cred); err != nil {
+			c.JSON(status, gin.H{"error": side.name + ": " + err.Error()})
+			return
+		}
+	}
+
+	diff, err := h.DiffRefs(left, right, leftCred, rightCred)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, diff)
+}
+
+// checkInspectRef validates ref before it is fetched, returning the HTTP
+// status for an unknown archive or a malformed reference.
+func (h *Handler) checkInspectRef(ref string, cred *vault.Credential) (int, error) {
+	if strings.HasPrefix(ref, "archive://") {
+		if _, _, err := h.resolveArchiveRef(ref); err != nil {
+			return http.StatusNotFound, err
+		}
+		return http.StatusOK, nil
+	}
+	normalized, _ := normalizeImageRef(ref, cred)
+	if _, err := name.ParseReference(normalized); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid ref: %w", err)
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/guoxudong/horcrux/internal/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getInspect(t *testing.T, r *gin.Engine, ref string) *httptest.ResponseRecorder {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, "/api/registry/inspect?ref="+url.QueryEscape(ref), nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestInspectImage_RegistryAndArchive(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	r := gin.New()
+	r.GET("/api/registry/inspect", h.InspectImage)
+
+	ref := pushMultiArch(t)
+	w := getInspect(t, r, ref)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var remote engine.Inspection
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &remote))
+	assert.Equal(t, ref, remote.Ref)
+	require.Len(t, remote.Platforms, 2)
+	assert.Equal(t, "linux/amd64", remote.Platforms[0].Platform)
+	require.NotNil(t, remote.Platforms[1].Image)
+	assert.Len(t, remote.Platforms[1].Image.Layers, 1)
+	assert.Positive(t, remote.Size)
+
+	// The archive of the same image describes the same index
+	job, meta, err := h.StartArchivePull(ArchivePullRequest{Ref: ref})
+	require.NoError(t, err)
+	job, err = h.WaitArchiveJob(job.ID, nil)
+	require.NoError(t, err)
+	require.Equal(t, "success", job.Status, job.Error)
+
+	w = getInspect(t, r, meta.Ref)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var local engine.Inspection
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &local))
+	assert.Equal(t, remote.Digest, local.Digest)
+	assert.Equal(t, remote.Size, local.Size)
+	assert.Equal(t, remote.Platforms, local.Platforms)
+
+	assert.Equal(t, http.StatusBadRequest, getInspect(t, r, "").Code)
+	assert.Equal(t, http.StatusBadRequest, getInspect(t, r, "Invalid Ref!").Code)
+	assert.Equal(t, http.StatusNotFound, getInspect(t, r, "archive://missing").Code)
+}
+
+func TestDiffImages_RegistryAgainstArchive(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	meta := pulledArchive(t, h)
+	other := pushMultiArch(t)
+
+	r := gin.New()
+	r.GET("/api/images/diff", h.DiffImages)
+	get := func(query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodGet, "/api/images/diff?"+query, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("left=" + url.QueryEscape(meta.Ref) + "&right=" + url.QueryEscape(meta.Ref))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var same engine.ImageDiff
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &same))
+	assert.True(t, same.Identical)
+
+	w = get("left=" + url.QueryEscape(meta.Ref) + "&right=" + url.QueryEscape(other))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var diff engine.ImageDiff
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &diff))
+	assert.False(t, diff.Identical)
+	require.NotNil(t, diff.Platforms)
+	assert.Equal(t, []string{"linux/amd64", "linux/arm64"}, diff.Platforms.Common)
+	require.Len(t, diff.Images, 2)
+	assert.Zero(t, diff.Images[0].SharedLayers)
+	assert.Len(t, diff.Images[0].OnlyRightLayers, 1)
+
+	assert.Equal(t, http.StatusBadRequest, get("left="+url.QueryEscape(meta.Ref)).Code)
+	assert.Equal(t, http.StatusNotFound, get("left=archive://missing&right="+url.QueryEscape(other)).Code)
+}
+
+func TestDiffImages_SingleImageAgainstArchive(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	srv := httptest.NewServer(registry.New())
+	t.Cleanup(srv.Close)
+	img, err := random.Image(256, 2)
+	require.NoError(t, err)
+	ref := strings.TrimPrefix(srv.URL, "http://") + "/team/app:1.0"
+	tag, err := name.ParseReference(ref)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(tag, img))
+	meta := uploadImageArchive(t, h, "registry.local/team/app:1.0", img)
+
+	// The archived copy of an image is inspected as that image, not as the
+	// store index wrapping it
+	r := gin.New()
+	r.GET("/api/registry/inspect", h.InspectImage)
+	r.GET("/api/images/diff", h.DiffImages)
+	w := getInspect(t, r, meta.Ref)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var local engine.Inspection
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &local))
+	assert.Equal(t, meta.Digest, local.Digest)
+
+	req, _ := http.NewRequest(http.MethodGet, "/api/images/diff?left="+url.QueryEscape(ref)+"&right="+url.QueryEscape(meta.Ref), nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var diff engine.ImageDiff
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &diff))
+	assert.True(t, diff.Identical, w.Body.String())
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/guoxudong/horcrux/internal/engine"
+	"github.com/guoxudong/horcrux/internal/inventory"
+	"github.com/guoxudong/horcrux/internal/vault"
+)
+
+// InventoryRequest selects the image analyzed by ImageInventory.
+type InventoryRequest struct {
+	Ref      string `json:"ref"` // registry or archive:// ref
+	CredID   string `json:"cred_id"`
+	Platform string `json:"platform"` // empty analyzes every platform
+	Format   string `json:"format"`   // cyclonedx (default) or spdx
+	// Attach pushes each document to the registry as an OCI referrer of
+	// its image.
+	Attach bool `json:"attach"`
+}
+
+// RunInventory analyzes the layers of req.Ref and renders one document per
+// platform image.
+func (h *Handler) RunInventory(req InventoryRequest, cred *vault.Credential) ([]engine.InventoryResult, error) {
+	src, err := h.sourceOptions(req.Ref, cred)
+	if err != nil {
+		return nil, err
+	}
+	return engine.NewSyncer(nil).Inventory(src, engine.InventoryOptions{
+		Platform: strings.TrimSpace(req.Platform),
+		Format:   req.Format,
+		Attach:   req.Attach,
+	})
+}
+
+// ImageInventory lists the OS packages and locked dependencies of a
+// registry or archive image as CycloneDX or SPDX documents.
+func (h *Handler) ImageInventory(c *gin.Context) {
+	var req InventoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	req.Ref = strings.TrimSpace(req.Ref)
+	if req.Ref == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ref is required"})
+		return
+	}
+	if _, err := inventory.ParseFormat(req.Format); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if p := strings.TrimSpace(req.Platform); p != "" {
+		if _, err := v1.ParsePlatform(p); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid platform: " + err.Error()})
+			return
+		}
+	}
+	if req.Attach && strings.HasPrefix(req.Ref, "archive://") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "documents can only be attached to registry images"})
+		return
+	}
+	cred, err := h.findCredentialByID(strings.TrimSpace(req.CredID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "vault load failed"})
+		return
+	}
+	if status, err := h.checkInspectRef(req.Ref, cred); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	results, err := h.RunInventory(req, cred)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ref": req.Ref, "results": results})
+}
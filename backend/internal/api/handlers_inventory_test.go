@@ -0,0 +1,53 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guoxudong/horcrux/internal/engine"
+	"github.com/guoxudong/horcrux/internal/inventory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageInventory_Archive(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	meta := pulledArchive(t, h) // linux/amd64 + linux/arm64
+
+	r := gin.New()
+	r.POST("/api/images/inventory", h.ImageInventory)
+
+	w := postSync(t, r, "/api/images/inventory", InventoryRequest{Ref: meta.Ref})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Results []engine.InventoryResult `json:"results"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Results, 2)
+	assert.Equal(t, "linux/amd64", resp.Results[0].Platform)
+	assert.Equal(t, inventory.MediaTypeCycloneDX, resp.Results[0].MediaType)
+	assert.Empty(t, resp.Results[0].Inventory.Packages)
+	var doc map[string]any
+	require.NoError(t, json.Unmarshal(resp.Results[0].Document, &doc))
+	assert.Equal(t, "CycloneDX", doc["bomFormat"])
+
+	w = postSync(t, r, "/api/images/inventory", InventoryRequest{Ref: meta.Ref, Platform: "linux/arm64", Format: "spdx"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Results, 1)
+	assert.Equal(t, inventory.MediaTypeSPDX, resp.Results[0].MediaType)
+
+	for _, req := range []InventoryRequest{
+		{},
+		{Ref: meta.Ref, Format: "xml"},
+		{Ref: meta.Ref, Platform: "linux/amd64/v1/x"},
+		{Ref: meta.Ref, Attach: true},
+	} {
+		w = postSync(t, r, "/api/images/inventory", req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "%+v", req)
+	}
+	w = postSync(t, r, "/api/images/inventory", InventoryRequest{Ref: "archive://missing"})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/guoxudong/horcrux/internal/engine"
+	"github.com/guoxudong/horcrux/internal/vault"
+)
+
+// normalizeSyncSources trims the sources of a merge request and qualifies
+// their references with the registry of their credential, like source_ref.
+func normalizeSyncSources(in []SyncSource, creds []vault.Credential) ([]SyncSource, error) {
+	out := make([]SyncSource, 0, len(in))
+	for i, src := range in {
+		ref := strings.TrimSpace(src.SourceRef)
+		if ref == "" {
+			return nil, fmt.Errorf("sources[%d]: source_ref is required", i)
+		}
+		id := strings.TrimSpace(src.SourceID)
+		if !strings.HasPrefix(ref, "archive://") {
+			if normalized, changed := normalizeImageRef(ref, findCredentialByID(creds, id)); changed {
+				ref = normalized
+			}
+		}
+		out = append(out, SyncSource{SourceRef: ref, SourceID: id})
+	}
+	return out, nil
+}
+
+// mergeSourceSummary is the source_ref shown for a merge task in history.
+func mergeSourceSummary(sources []SyncSource) string {
+	refs := make([]string, len(sources))
+	for i, src := range sources {
+		refs[i] = src.SourceRef
+	}
+	return strings.Join(refs, " + ")
+}
+
+// mergeOptions resolves the sources of a merge task, reading archive://
+// sources from their local layout. Target fields are left to the caller.
+func (h *Handler) mergeOptions(task *SyncTask, creds []vault.Credential) (engine.MergeOptions, error) {
+	opts := engine.MergeOptions{
+		Annotations:    task.Annotations,
+		Flatten:        task.Flatten,
+		PlatformPolicy: task.PlatformPolicy,
+	}
+	for _, src := range task.Sources {
+		layoutPath, layoutDigest, err := h.resolveArchiveRef(src.SourceRef)
+		if err != nil {
+			return engine.MergeOptions{}, err
+		}
+		opts.Sources = append(opts.Sources, engine.MergeSource{
+			Ref:          src.SourceRef,
+			Auth:         findCredentialByID(creds, src.SourceID),
+			LayoutPath:   layoutPath,
+			LayoutDigest: layoutDigest,
+		})
+	}
+	return opts, nil
+}
@@ -0,0 +1,294 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/guoxudong/horcrux/internal/engine"
+	"github.com/guoxudong/horcrux/internal/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func postSync(t *testing.T, r *gin.Engine, path string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestExecuteSync_MergeTaskRetries(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tempDir := t.TempDir()
+	v, err := vault.NewVault(filepath.Join(tempDir, "vault.enc"), "12345678901234567890123456789012")
+	require.NoError(t, err)
+	require.NoError(t, v.SaveCredentials([]vault.Credential{
+		{ID: "cred_arm", Name: "arm", Registry: "arm.registry.local", Username: "u", Password: "p"},
+	}))
+
+	behaviors := &fakeSyncerBehaviors{
+		errorsByTargetRef: map[string][]error{
+			"dst.local/app:1.0": {errors.New("connection reset by peer")},
+		},
+	}
+	h := NewHandlerWithSyncerFactory(v, NewHub(), func(ctx context.Context, progress chan<- engine.Progress) syncerRunner {
+		return &fakeSyncerRunner{ctx: ctx, progress: progress, behaviors: behaviors}
+	})
+	r := gin.New()
+	r.POST("/api/tasks/sync", h.ExecuteSync)
+	r.POST("/api/tasks/:id/retry", h.RetryTask)
+
+	w := postSync(t, r, "/api/tasks/sync", SyncRequest{
+		Sources: []SyncSource{
+			{SourceRef: "amd.registry.local/app:1.0-amd64"},
+			{SourceRef: "team/app:1.0-arm64", SourceID: "cred_arm"},
+		},
+		Annotations: map[string]string{"org.opencontainers.image.version": "1.0"},
+		TargetRef:   "dst.local/app:1.0",
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var created SyncTask
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, "merge", created.Mode)
+
+	task := waitTaskDone(t, h, created.ID, 5*time.Second)
+	require.Equal(t, "success", task.Status, task.ErrorSummary)
+	assert.Equal(t, 2, task.Targets[0].Attempts)
+	assert.Equal(t, "amd.registry.local/app:1.0-amd64 + arm.registry.local/team/app:1.0-arm64", task.SourceRef)
+	require.Len(t, task.Sources, 2)
+	assert.Equal(t, "cred_arm", task.Sources[1].SourceID)
+
+	behaviors.mu.Lock()
+	require.Len(t, behaviors.merges, 2)
+	opts := behaviors.merges[1]
+	behaviors.mu.Unlock()
+	require.Len(t, opts.Sources, 2)
+	assert.Nil(t, opts.Sources[0].Auth)
+	require.NotNil(t, opts.Sources[1].Auth)
+	assert.Equal(t, "u", opts.Sources[1].Auth.Username)
+	assert.True(t, opts.Flatten, "merge sources are flattened by default")
+	assert.Equal(t, "1.0", opts.Annotations["org.opencontainers.image.version"])
+
+	// A retry runs the same merge
+	w = postSync(t, r, "/api/tasks/"+task.ID+"/retry", retryRequest{FailedOnly: new(bool)})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var retried SyncTask
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &retried))
+	assert.Equal(t, "merge", retried.Mode)
+	assert.Equal(t, task.Sources, retried.Sources)
+	assert.True(t, retried.Flatten)
+	waitTaskDone(t, h, retried.ID, 5*time.Second)
+
+	// Nesting is kept when asked for, also on retries
+	nest := false
+	w = postSync(t, r, "/api/tasks/sync", SyncRequest{
+		Sources:   []SyncSource{{SourceRef: "amd.registry.local/app:1.0-amd64"}},
+		Flatten:   &nest,
+		TargetRef: "dst.local/app:1.0",
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var nested SyncTask
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &nested))
+	assert.False(t, nested.Flatten)
+	waitTaskDone(t, h, nested.ID, 5*time.Second)
+	w = postSync(t, r, "/api/tasks/"+nested.ID+"/retry", retryRequest{FailedOnly: new(bool)})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var nestedRetry SyncTask
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &nestedRetry))
+	assert.False(t, nestedRetry.Flatten)
+	waitTaskDone(t, h, nestedRetry.ID, 5*time.Second)
+
+	w = postSync(t, r, "/api/tasks/sync", SyncRequest{
+		SourceRef: "app:1.0",
+		Sources:   []SyncSource{{SourceRef: "app:1.0-amd64"}},
+		TargetRef: "dst.local/app:1.0",
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = postSync(t, r, "/api/tasks/sync", SyncRequest{Sources: []SyncSource{{SourceRef: " "}}, TargetRef: "dst.local/app:1.0"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestExecuteSync_MergeArchiveAndRegistry(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	meta := pulledArchive(t, h) // linux/amd64 + linux/arm64
+
+	srv := httptest.NewServer(registry.New())
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	img, err := random.Image(256, 1)
+	require.NoError(t, err)
+	cfg, err := img.ConfigFile()
+	require.NoError(t, err)
+	cfg = cfg.DeepCopy()
+	cfg.OS, cfg.Architecture = "linux", "s390x"
+	img, err = mutate.ConfigFile(img, cfg)
+	require.NoError(t, err)
+	single, err := name.ParseReference(host + "/team/tool:1.0")
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(single, img))
+
+	r := gin.New()
+	r.POST("/api/tasks/sync", h.ExecuteSync)
+
+	for _, tc := range []struct {
+		flatten bool
+		want    int
+	}{{true, 3}, {false, 2}} {
+		target := host + "/team/merged:1.0"
+		w := postSync(t, r, "/api/tasks/sync", SyncRequest{
+			Sources:     []SyncSource{{SourceRef: meta.Ref}, {SourceRef: single.String()}},
+			Annotations: map[string]string{"com.example.merged": "yes"},
+			Flatten:     &tc.flatten,
+			TargetRef:   target,
+		})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var created SyncTask
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+		task := waitTaskDone(t, h, created.ID, 10*time.Second)
+		require.Equal(t, "success", task.Status, task.ErrorSummary)
+
+		ref, err := name.ParseReference(target)
+		require.NoError(t, err)
+		idx, err := remote.Index(ref)
+		require.NoError(t, err)
+		im, err := idx.IndexManifest()
+		require.NoError(t, err)
+		assert.Equal(t, "yes", im.Annotations["com.example.merged"])
+		require.Len(t, im.Manifests, tc.want, "flatten=%v", tc.flatten)
+		report := task.Targets[0].MergeReport
+		require.NotNil(t, report)
+		require.Len(t, report.Platforms, tc.want)
+		assert.Equal(t, "linux/s390x", im.Manifests[tc.want-1].Platform.String(), "platform filled from the image config")
+		assert.Equal(t, single.String(), report.Platforms[tc.want-1].Source)
+		if tc.flatten {
+			assert.Equal(t, "amd64", im.Manifests[0].Platform.Architecture)
+			assert.Equal(t, "arm64", im.Manifests[1].Platform.Architecture)
+			assert.Equal(t, meta.Ref, report.Platforms[0].Source)
+		} else {
+			assert.True(t, im.Manifests[0].MediaType.IsIndex(), "the archive index is nested")
+			assert.True(t, report.Platforms[0].Nested)
+			assert.Equal(t, "linux/amd64,linux/arm64", report.Platforms[0].Platform)
+		}
+	}
+}
+
+func TestExecuteSync_PinnedSourceDigest(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	src := pushMultiArch(t)
+	srcRef, err := name.ParseReference(src)
+	require.NoError(t, err)
+	desc, err := remote.Head(srcRef)
+	require.NoError(t, err)
+	digest := desc.Digest.String()
+	host := srcRef.Context().RegistryStr()
+
+	r := gin.New()
+	r.POST("/api/tasks/sync", h.ExecuteSync)
+
+	// A repo@sha256: source promotes exactly that manifest to a tag
+	w := postSync(t, r, "/api/tasks/sync", SyncRequest{
+		SourceRef: srcRef.Context().Digest(digest).String(),
+		Targets:   []SyncTargetRequest{{TargetRef: host + "/prod/app:2.0"}, {TargetRef: host + "/prod/app:stable"}},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var created SyncTask
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, digest, created.SourceDigest)
+	task := waitTaskDone(t, h, created.ID, 10*time.Second)
+	require.Equal(t, "success", task.Status, task.ErrorSummary)
+	for _, target := range task.Targets {
+		assert.Equal(t, digest, target.SyncedDigest, target.TargetRef)
+	}
+
+	// A tag that no longer matches source_digest fails without retries
+	w = postSync(t, r, "/api/tasks/sync", SyncRequest{
+		SourceRef:    src,
+		SourceDigest: "sha256:" + strings.Repeat("0", 64),
+		TargetRef:    host + "/prod/app:moved",
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	task = waitTaskDone(t, h, created.ID, 10*time.Second)
+	assert.Equal(t, "failed", task.Status)
+	assert.Equal(t, 1, task.Targets[0].Attempts)
+	assert.Contains(t, task.Targets[0].Error, "digest mismatch")
+	assert.Empty(t, task.Targets[0].SyncedDigest)
+	moved, err := name.ParseReference(host + "/prod/app:moved")
+	require.NoError(t, err)
+	_, err = remote.Head(moved)
+	assert.Error(t, err, "nothing should be pushed on a mismatch")
+
+	for _, req := range []SyncRequest{
+		{SourceRef: src, SourceDigest: "sha256:abc", TargetRef: host + "/prod/app:x"},
+		{SourceRef: srcRef.Context().Digest(digest).String(), SourceDigest: "sha256:" + strings.Repeat("0", 64), TargetRef: host + "/prod/app:x"},
+		{Sources: []SyncSource{{SourceRef: src}}, SourceDigest: digest, TargetRef: host + "/prod/app:x"},
+	} {
+		w = postSync(t, r, "/api/tasks/sync", req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	}
+}
+
+func TestExecuteSync_PinnedArchiveDigest(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	srv := httptest.NewServer(registry.New())
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	img, err := random.Image(256, 1)
+	require.NoError(t, err)
+	imgDigest, err := img.Digest()
+	require.NoError(t, err)
+	meta := uploadImageArchive(t, h, "registry.local/team/app:1.0", img)
+	require.Equal(t, imgDigest.String(), meta.Digest)
+
+	r := gin.New()
+	r.POST("/api/tasks/sync", h.ExecuteSync)
+
+	// The digest the archive list shows pins a sync of the archive
+	w := postSync(t, r, "/api/tasks/sync", SyncRequest{
+		SourceRef:    meta.Ref,
+		SourceDigest: meta.Digest,
+		TargetRef:    host + "/prod/app:1.0",
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var created SyncTask
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	task := waitTaskDone(t, h, created.ID, 10*time.Second)
+	require.Equal(t, "success", task.Status, task.ErrorSummary)
+	assert.Equal(t, meta.Digest, task.Targets[0].SyncedDigest)
+
+	pushed, err := name.ParseReference(host + "/prod/app:1.0")
+	require.NoError(t, err)
+	desc, err := remote.Head(pushed)
+	require.NoError(t, err)
+	assert.Equal(t, meta.Digest, desc.Digest.String())
+
+	// Any other digest still fails
+	w = postSync(t, r, "/api/tasks/sync", SyncRequest{
+		SourceRef:    meta.Ref,
+		SourceDigest: meta.Root,
+		TargetRef:    host + "/prod/app:root",
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	task = waitTaskDone(t, h, created.ID, 10*time.Second)
+	assert.Equal(t, "failed", task.Status)
+	assert.Contains(t, task.Targets[0].Error, "digest mismatch")
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -36,9 +37,45 @@ type fakeSyncerBehaviors struct {
 	blockUntilCanceled bool
 	currentConcurrent  atomic.Int64
 	maxConcurrent      atomic.Int64
+	merges             []engine.MergeOptions
+	syncs              []engine.SyncOptions
 }
 
-func (r *fakeSyncerRunner) SyncManifestList(opts engine.SyncOptions) error {
+// MergeManifests records opts and behaves like SyncManifestList for the target.
+func (r *fakeSyncerRunner) MergeManifests(opts engine.MergeOptions) (*engine.MergeReport, error) {
+	if r.behaviors != nil {
+		r.behaviors.mu.Lock()
+		r.behaviors.merges = append(r.behaviors.merges, opts)
+		r.behaviors.mu.Unlock()
+	}
+	if err := r.run(engine.SyncOptions{TargetRef: opts.TargetRef, TargetAuth: opts.TargetAuth}); err != nil {
+		return nil, err
+	}
+	return &engine.MergeReport{Policy: opts.PlatformPolicy, Digest: fakeDigest(opts.TargetRef)}, nil
+}
+
+// SyncManifestList records opts and returns the expected digest, or a digest
+// derived from the source reference.
+func (r *fakeSyncerRunner) SyncManifestList(opts engine.SyncOptions) (string, error) {
+	if r.behaviors != nil {
+		r.behaviors.mu.Lock()
+		r.behaviors.syncs = append(r.behaviors.syncs, opts)
+		r.behaviors.mu.Unlock()
+	}
+	if err := r.run(opts); err != nil {
+		return "", err
+	}
+	if opts.ExpectedDigest != "" {
+		return opts.ExpectedDigest, nil
+	}
+	return fakeDigest(opts.SourceRef), nil
+}
+
+func fakeDigest(ref string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(ref)))
+}
+
+func (r *fakeSyncerRunner) run(opts engine.SyncOptions) error {
 	if r.behaviors != nil {
 		now := r.behaviors.currentConcurrent.Add(1)
 		for {
@@ -1415,6 +1452,86 @@ func TestRegistryQueryEndpoints(t *testing.T) {
 	assert.Equal(t, true, tagsResp2["cached"])
 }
 
+func TestRegistryQueryEndpoints_TokenCredentials(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var registryServer *httptest.Server
+	registryServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			// Only the OAuth2 refresh token grant is accepted
+			if r.Method != http.MethodPost || r.PostFormValue("grant_type") != "refresh_token" ||
+				r.PostFormValue("refresh_token") != "refresh-1" || r.PostFormValue("scope") != "repository:ns/repo1:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"access_token": "access-1"})
+			return
+		}
+		switch r.Header.Get("Authorization") {
+		case "Bearer static-1", "Bearer access-1":
+		default:
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:ns/repo1:pull"`, registryServer.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"name": "ns/repo1", "tags": []string{"v1"}})
+	}))
+	defer registryServer.Close()
+
+	// A docker credential helper handing out the refresh token
+	binDir := t.TempDir()
+	helper := filepath.Join(binDir, "docker-credential-stub")
+	assert.NoError(t, os.WriteFile(helper, []byte("#!/bin/sh\ncat >/dev/null\necho '{\"Username\":\"<token>\",\"Secret\":\"refresh-1\"}'\n"), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	v, err := vault.NewVault(filepath.Join(t.TempDir(), "vault.enc"), "12345678901234567890123456789012")
+	assert.NoError(t, err)
+	h := NewHandler(v, NewHub())
+	r := gin.New()
+	r.GET("/api/vault/credentials", h.ListCredentials)
+	r.POST("/api/vault/credentials", h.AddCredential)
+	r.GET("/api/registry/tags", h.ListRegistryTags)
+
+	for _, cred := range []vault.Credential{
+		{ID: "cred_bearer", Registry: registryServer.URL, AuthType: vault.AuthBearer, Token: "static-1"},
+		{ID: "cred_identity", Registry: registryServer.URL, Username: "<token>", AuthType: vault.AuthIdentityToken, Token: "refresh-1"},
+		{ID: "cred_stale", Registry: registryServer.URL, AuthType: vault.AuthBearer, Token: "expired"},
+		{ID: "cred_helper", Registry: registryServer.URL, AuthType: vault.AuthHelper, Helper: "stub"},
+	} {
+		w := postSync(t, r, "/api/vault/credentials", cred)
+		assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	}
+	for _, cred := range []vault.Credential{
+		{Registry: registryServer.URL, AuthType: vault.AuthBearer},
+		{Registry: registryServer.URL, AuthType: "oauth"},
+		{Registry: registryServer.URL, AuthType: vault.AuthHelper},
+		{Registry: registryServer.URL, AuthType: vault.AuthHelper, Helper: helper},
+		{Registry: registryServer.URL, AuthType: vault.AuthHelper, Helper: "stub", HelperArgs: []string{"--debug"}},
+	} {
+		w := postSync(t, r, "/api/vault/credentials", cred)
+		assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	}
+
+	for id, want := range map[string]int{"cred_bearer": http.StatusOK, "cred_identity": http.StatusOK, "cred_stale": http.StatusBadGateway, "cred_helper": http.StatusOK} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/api/registry/tags?cred_id="+id+"&repo=ns/repo1", nil)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, want, w.Code, "%s: %s", id, w.Body.String())
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/api/vault/credentials", nil)
+	r.ServeHTTP(w, req)
+	var listed []vault.Credential
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	assert.Len(t, listed, 4)
+	for _, cred := range listed {
+		if cred.AuthType != vault.AuthHelper {
+			assert.Equal(t, "********", cred.Token)
+		}
+	}
+}
+
 func TestGetStatsDataThroughput(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	tempDir, err := os.MkdirTemp("", "horcrux-stats-test-*")
@@ -1449,3 +1566,122 @@ func TestGetStatsDataThroughput(t *testing.T) {
 	assert.True(t, ok)
 	assert.Equal(t, "1.00 KB", val)
 }
+
+func TestRotateVaultKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	path := filepath.Join(t.TempDir(), "vault.enc")
+	v, err := vault.NewVault(path, "old passphrase")
+	assert.NoError(t, err)
+	assert.NoError(t, v.SaveCredentials([]vault.Credential{{ID: "cred_1", Name: "hub", Registry: "docker.io", Username: "alice", Password: "secret"}}))
+	h := NewHandler(v, NewHub())
+	r := gin.New()
+	r.POST("/api/vault/rotate-key", h.RotateVaultKey)
+	r.GET("/api/vault/credentials", h.ListCredentials)
+
+	rotate := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/vault/rotate-key", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusBadRequest, rotate(`{"old_passphrase": "old passphrase"}`).Code)
+	assert.Equal(t, http.StatusForbidden, rotate(`{"old_passphrase": "wrong", "new_passphrase": "new passphrase"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, rotate(`{"old_passphrase": "old passphrase", "new_passphrase": "old passphrase"}`).Code)
+
+	w := rotate(`{"old_passphrase": "old passphrase", "new_passphrase": "new passphrase"}`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Backup string `json:"backup"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.FileExists(t, resp.Backup)
+
+	// The server keeps serving the vault with the new key
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/vault/credentials", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "cred_1")
+
+	reopened, _ := vault.NewVault(path, "new passphrase")
+	creds, err := reopened.LoadCredentials()
+	assert.NoError(t, err)
+	assert.Len(t, creds, 1)
+}
+
+func TestCredentials_IfMatchRevision(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	v, err := vault.NewVault(filepath.Join(t.TempDir(), "vault.enc"), "12345678901234567890123456789012")
+	assert.NoError(t, err)
+	hub, err := v.AddCredential(vault.Credential{Name: "hub", Registry: "docker.io", Username: "alice", Password: "secret"})
+	assert.NoError(t, err)
+	h := NewHandler(v, NewHub())
+	r := gin.New()
+	r.GET("/api/vault/credentials", h.ListCredentials)
+	r.PUT("/api/vault/credentials/:id", h.UpdateCredential)
+	r.DELETE("/api/vault/credentials/:id", h.DeleteCredential)
+
+	list := func() string {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/vault/credentials", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		return w.Header().Get("ETag")
+	}
+	send := func(method, etag, body string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/api/vault/credentials/"+hub.ID, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		if etag != "" {
+			req.Header.Set("If-Match", etag)
+		}
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	etag := list()
+	assert.Equal(t, `"1"`, etag)
+	body := `{"name": "hub", "registry": "docker.io", "username": "bob", "password": "********"}`
+	assert.Equal(t, http.StatusOK, send(http.MethodPut, etag, body))
+	assert.Equal(t, http.StatusPreconditionFailed, send(http.MethodPut, etag, body))
+	assert.Equal(t, http.StatusPreconditionFailed, send(http.MethodDelete, etag, ""))
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodDelete, "not-a-revision", ""))
+
+	cred, err := v.GetCredential(hub.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", cred.Username)
+	assert.Equal(t, "secret", cred.Password)
+
+	assert.Equal(t, http.StatusOK, send(http.MethodDelete, list(), ""))
+	assert.Equal(t, http.StatusNotFound, send(http.MethodDelete, "", ""))
+}
+
+func TestUpdateCredential_KeepsHelperArgs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	v, err := vault.NewVault(filepath.Join(t.TempDir(), "vault.enc"), "12345678901234567890123456789012")
+	assert.NoError(t, err)
+	eks, err := v.AddCredential(vault.Credential{Name: "eks", Registry: "example.com", AuthType: vault.AuthHelper,
+		Helper: "ecr-credential-provider", HelperProtocol: "kubelet", HelperArgs: []string{"--region", "us-east-1"}})
+	assert.NoError(t, err)
+	h := NewHandler(v, NewHub())
+	r := gin.New()
+	r.PUT("/api/vault/credentials/:id", h.UpdateCredential)
+
+	send := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, "/api/vault/credentials/"+eks.ID, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send(`{"name": "eks", "registry": "example.com", "auth_type": "helper", "helper": "ecr-credential-provider", "helper_protocol": "kubelet", "helper_args": ["--config", "/tmp/evil"]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	w = send(`{"name": "renamed", "registry": "example.com", "auth_type": "helper", "helper": "ecr-credential-provider", "helper_protocol": "kubelet"}`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	cred, err := v.GetCredential(eks.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "renamed", cred.Name)
+	assert.Equal(t, []string{"--region", "us-east-1"}, cred.HelperArgs)
+}
@@ -0,0 +1,399 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UploadSession tracks a resumable, chunked archive upload.
+// The received bytes live in data/uploads/<id>/data.part; the current offset is
+// always the size of that file, so a session survives restarts and dropped
+// connections.
+type UploadSession struct {
+	ID        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Offset    int64     `json:"offset"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// The SHA-256 is computed as chunks arrive: HashState is the marshaled
+	// hash of the first HashedBytes bytes of data.part.
+	HashState   []byte `json:"hash_state,omitempty"`
+	HashedBytes int64  `json:"hashed_bytes,omitempty"`
+}
+
+type createUploadRequest struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+var uploadLocks sync.Map // session id -> *sync.Mutex
+
+func lockUpload(id string) func() {
+	v, _ := uploadLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// CreateUpload starts a resumable upload session.
+func (h *Handler) CreateUpload(c *gin.Context) {
+	var req createUploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	req.Filename = strings.TrimSpace(req.Filename)
+	req.SHA256 = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(req.SHA256), "sha256:"))
+	if req.Filename == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "filename is required"})
+		return
+	}
+	if req.Size <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "size must be positive"})
+		return
+	}
+	if b, err := hex.DecodeString(req.SHA256); err != nil || len(b) != sha256.Size {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sha256 must be a hex encoded SHA-256 digest"})
+		return
+	}
+
+	now := time.Now()
+	session := &UploadSession{
+		ID:        fmt.Sprintf("upload_%d", now.UnixNano()),
+		Filename:  req.Filename,
+		Size:      req.Size,
+		SHA256:    req.SHA256,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	dir := h.getDataPath("uploads", session.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload directory"})
+		return
+	}
+	if err := os.WriteFile(filepath.Join(dir, "data.part"), nil, 0644); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload file"})
+		return
+	}
+	if err := h.saveUploadSession(session); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save upload session"})
+		return
+	}
+
+	c.Header("Location", "/api/archives/uploads/"+session.ID)
+	c.JSON(http.StatusCreated, session)
+}
+
+// GetUpload reports the current offset of an upload session.
+// HEAD requests only receive the Upload-Offset / Upload-Length headers.
+func (h *Handler) GetUpload(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	if !isSafePipeID(id) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid upload id"})
+		return
+	}
+
+	unlock := lockUpload(id)
+	session, err := h.loadUploadSession(id)
+	unlock()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load upload: " + err.Error()})
+		return
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(session.Size, 10))
+	c.Header("Cache-Control", "no-store")
+	if c.Request.Method == http.MethodHead {
+		c.Status(http.StatusOK)
+		return
+	}
+	c.JSON(http.StatusOK, session)
+}
+
+// PutUploadChunk appends a byte range to an upload session.
+// The start offset comes from the Upload-Offset header or from Content-Range
+// ("bytes <start>-<end>/<total>") and must equal the current offset.
+func (h *Handler) PutUploadChunk(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	if !isSafePipeID(id) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid upload id"})
+		return
+	}
+
+	start, err := parseChunkOffset(c.Request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	unlock := lockUpload(id)
+	defer unlock()
+
+	session, err := h.loadUploadSession(id)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load upload: " + err.Error()})
+		return
+	}
+
+	if start != session.Offset {
+		c.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		c.JSON(http.StatusConflict, gin.H{"error": "offset mismatch", "offset": session.Offset})
+		return
+	}
+
+	partPath := h.getDataPath("uploads", id, "data.part")
+	hasher, err := uploadHasher(session, partPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash upload: " + err.Error()})
+		return
+	}
+	f, err := os.OpenFile(partPath, os.O_WRONLY, 0644)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open upload file"})
+		return
+	}
+	if _, err := f.Seek(session.Offset, io.SeekStart); err != nil {
+		f.Close()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to seek upload file"})
+		return
+	}
+
+	remaining := session.Size - session.Offset
+	written, copyErr := io.Copy(&hashingWriter{w: f, h: hasher}, io.LimitReader(c.Request.Body, remaining+1))
+	hashed := true
+	if written > remaining {
+		// Never keep bytes past the declared size
+		_ = f.Truncate(session.Size)
+		written = remaining
+		copyErr = errors.New("chunk exceeds declared upload size")
+		hashed = false // the hash saw the extra bytes
+	}
+	closeErr := f.Close()
+
+	// Whatever reached the disk counts, even if the client went away mid-chunk
+	session.Offset += written
+	session.UpdatedAt = time.Now()
+	session.HashState, session.HashedBytes = nil, 0
+	if hashed {
+		if state, err := hasher.(encoding.BinaryMarshaler).MarshalBinary(); err == nil {
+			session.HashState, session.HashedBytes = state, session.Offset
+		}
+	}
+	_ = h.saveUploadSession(session)
+	c.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+
+	if copyErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": copyErr.Error(), "offset": session.Offset})
+		return
+	}
+	if closeErr != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write upload file", "offset": session.Offset})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"offset": session.Offset, "size": session.Size})
+}
+
+// CompleteUpload verifies the received bytes against the declared SHA-256,
+// which was computed while the chunks arrived, and hands the file to a
+// background ingestion job.
+func (h *Handler) CompleteUpload(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	if !isSafePipeID(id) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid upload id"})
+		return
+	}
+
+	unlock := lockUpload(id)
+	defer unlock()
+
+	session, err := h.loadUploadSession(id)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load upload: " + err.Error()})
+		return
+	}
+	if session.Offset != session.Size {
+		c.JSON(http.StatusConflict, gin.H{"error": "upload incomplete", "offset": session.Offset, "size": session.Size})
+		return
+	}
+
+	partPath := h.getDataPath("uploads", id, "data.part")
+	hasher, err := uploadHasher(session, partPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash upload: " + err.Error()})
+		return
+	}
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	if sum != session.SHA256 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "sha256 mismatch", "expected": session.SHA256, "actual": sum})
+		return
+	}
+
+	archiveID := fmt.Sprintf("archive_%d_%s", time.Now().UnixNano(), sanitizeName(session.Filename))
+	job, meta, err := h.startArchiveIngest(archiveID, session.Filename, session.Size, func(dir string) (string, error) {
+		tmpPath := filepath.Join(dir, "temp.tar")
+		if err := os.Rename(partPath, tmpPath); err != nil {
+			return "", fmt.Errorf("Failed to move upload: %v", err)
+		}
+		return tmpPath, nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("%s: %v", session.Filename, err)})
+		return
+	}
+	_ = os.RemoveAll(h.getDataPath("uploads", id))
+	uploadLocks.Delete(id)
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"status":   "accepted",
+		"uploaded": []ArchiveMeta{meta},
+		"jobs":     []*ArchiveJob{job},
+	})
+}
+
+// DeleteUpload aborts an upload session and discards received bytes.
+func (h *Handler) DeleteUpload(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	if !isSafePipeID(id) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid upload id"})
+		return
+	}
+
+	unlock := lockUpload(id)
+	defer unlock()
+
+	dir := h.getDataPath("uploads", id)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete upload: " + err.Error()})
+		return
+	}
+	uploadLocks.Delete(id)
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+func (h *Handler) saveUploadSession(s *UploadSession) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(h.getDataPath("uploads", s.ID, "session.json"), data, 0644)
+}
+
+func (h *Handler) loadUploadSession(id string) (*UploadSession, error) {
+	data, err := os.ReadFile(h.getDataPath("uploads", id, "session.json"))
+	if err != nil {
+		return nil, err
+	}
+	var s UploadSession
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+
+	// The part file is the source of truth for the offset
+	info, err := os.Stat(h.getDataPath("uploads", id, "data.part"))
+	if err != nil {
+		return nil, err
+	}
+	s.Offset = info.Size()
+	return &s, nil
+}
+
+// uploadHasher returns the SHA-256 of the received bytes of session. The
+// hash state saved with the last chunk is reused; the part file is only read
+// again when that state is missing or stale, e.g. after a crash.
+func uploadHasher(session *UploadSession, partPath string) (hash.Hash, error) {
+	hasher := sha256.New()
+	if session.HashState != nil && session.HashedBytes == session.Offset {
+		if err := hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(session.HashState); err == nil {
+			return hasher, nil
+		}
+		hasher.Reset()
+	}
+	f, err := os.Open(partPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(hasher, io.LimitReader(f, session.Offset)); err != nil {
+		return nil, err
+	}
+	return hasher, nil
+}
+
+// hashingWriter hashes exactly the bytes written to w.
+type hashingWriter struct {
+	w io.Writer
+	h hash.Hash
+}
+
+func (hw *hashingWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.h.Write(p[:n])
+	return n, err
+}
+
+func parseChunkOffset(r *http.Request) (int64, error) {
+	if v := strings.TrimSpace(r.Header.Get("Upload-Offset")); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return 0, errors.New("invalid Upload-Offset header")
+		}
+		return n, nil
+	}
+
+	cr := strings.TrimSpace(r.Header.Get("Content-Range"))
+	if cr == "" {
+		return 0, errors.New("Upload-Offset or Content-Range header is required")
+	}
+	spec, ok := strings.CutPrefix(cr, "bytes ")
+	if !ok {
+		return 0, errors.New("invalid Content-Range header")
+	}
+	rng, _, _ := strings.Cut(spec, "/")
+	startRaw, _, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, errors.New("invalid Content-Range header")
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(startRaw), 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid Content-Range header")
+	}
+	return n, nil
+}
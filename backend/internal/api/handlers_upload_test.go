@@ -0,0 +1,180 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func newUploadRouter(h *Handler) *gin.Engine {
+	r := gin.New()
+	archives := r.Group("/api/archives")
+	archives.GET("", h.ListArchives)
+	archives.DELETE("/:id", h.DeleteArchive)
+	archives.POST("/uploads", h.CreateUpload)
+	archives.GET("/uploads/:id", h.GetUpload)
+	archives.HEAD("/uploads/:id", h.GetUpload)
+	archives.PUT("/uploads/:id", h.PutUploadChunk)
+	archives.POST("/uploads/:id/complete", h.CompleteUpload)
+	archives.DELETE("/uploads/:id", h.DeleteUpload)
+	return r
+}
+
+func createUploadSession(t *testing.T, r *gin.Engine, data []byte, sum string) UploadSession {
+	t.Helper()
+	if sum == "" {
+		raw := sha256.Sum256(data)
+		sum = hex.EncodeToString(raw[:])
+	}
+	body, _ := json.Marshal(createUploadRequest{Filename: "app.tar.gz", Size: int64(len(data)), SHA256: sum})
+	req, _ := http.NewRequest(http.MethodPost, "/api/archives/uploads", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var session UploadSession
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+	return session
+}
+
+func putChunk(r *gin.Engine, id string, data []byte, start, total int) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(http.MethodPut, "/api/archives/uploads/"+id, bytes.NewReader(data))
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+len(data)-1, total))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestChunkedUpload_ResumeAndComplete(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	r := newUploadRouter(h)
+
+	data := gzipDockerArchive(t, "example.com/app:2.1")
+	session := createUploadSession(t, r, data, "")
+	half := len(data) / 2
+
+	w := putChunk(r, session.ID, data[:half], 0, len(data))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// Query current offset as a client would after a dropped connection
+	req, _ := http.NewRequest(http.MethodHead, "/api/archives/uploads/"+session.ID, nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, fmt.Sprint(half), w.Header().Get("Upload-Offset"))
+
+	// Completing early is rejected
+	req, _ = http.NewRequest(http.MethodPost, "/api/archives/uploads/"+session.ID+"/complete", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// Re-sending an old range reports the real offset
+	w = putChunk(r, session.ID, data[:10], 0, len(data))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, fmt.Sprint(half), w.Header().Get("Upload-Offset"))
+
+	w = putChunk(r, session.ID, data[half:], half, len(data))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	req, _ = http.NewRequest(http.MethodPost, "/api/archives/uploads/"+session.ID+"/complete", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	waitArchiveJobs(t, h)
+
+	req, _ = http.NewRequest(http.MethodGet, "/api/archives", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var list []ArchiveMeta
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, "example.com/app", list[0].Name)
+		assert.Equal(t, "2.1", list[0].Tag)
+		assert.True(t, list[0].IsReady())
+	}
+
+	// Session is gone once finalized
+	req, _ = http.NewRequest(http.MethodGet, "/api/archives/uploads/"+session.ID, nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestChunkedUpload_ChecksumMismatch(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	r := newUploadRouter(h)
+
+	data := gzipDockerArchive(t, "example.com/app:2.2")
+	wrong := sha256.Sum256([]byte("something else"))
+	session := createUploadSession(t, r, data, hex.EncodeToString(wrong[:]))
+
+	w := putChunk(r, session.ID, data, 0, len(data))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/archives/uploads/"+session.ID+"/complete", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	archivesMu.Lock()
+	defer archivesMu.Unlock()
+	assert.Len(t, archivesMeta, 0)
+}
+
+func TestChunkedUpload_RejectsOversizedChunk(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	r := newUploadRouter(h)
+
+	data := []byte("0123456789")
+	session := createUploadSession(t, r, data, "")
+
+	w := putChunk(r, session.ID, append(data, 'x'), 0, len(data))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, fmt.Sprint(len(data)), w.Header().Get("Upload-Offset"))
+}
+
+func TestChunkedUpload_RunningHash(t *testing.T) {
+	h, _ := newArchiveTestHandler(t)
+	r := newUploadRouter(h)
+
+	data := gzipDockerArchive(t, "example.com/app:2.3")
+	session := createUploadSession(t, r, data, "")
+	third := len(data) / 3
+
+	w := putChunk(r, session.ID, data[:third], 0, len(data))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	saved, err := h.loadUploadSession(session.ID)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, saved.HashState)
+	assert.Equal(t, int64(third), saved.HashedBytes)
+
+	w = putChunk(r, session.ID, data[third:2*third], third, len(data))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// A lost hash state, as after a crash between writing and saving, is
+	// rebuilt from the part file
+	saved, _ = h.loadUploadSession(session.ID)
+	saved.HashState, saved.HashedBytes = nil, 0
+	assert.NoError(t, h.saveUploadSession(saved))
+
+	w = putChunk(r, session.ID, data[2*third:], 2*third, len(data))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	saved, _ = h.loadUploadSession(session.ID)
+	assert.Equal(t, int64(len(data)), saved.HashedBytes)
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/archives/uploads/"+session.ID+"/complete", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	waitArchiveJobs(t, h)
+}
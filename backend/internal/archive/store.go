@@ -0,0 +1,313 @@
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+)
+
+// AnnotationArchiveID marks the root index entry owned by an archive.
+const AnnotationArchiveID = "io.horcrux.archive.id"
+
+// Store is a content-addressed blob store shared by all archives.
+// It is a single OCI image layout: every archive is one entry in the root
+// index.json (annotated with its ID) pointing at an image index blob, and
+// blobs are written once no matter how many archives reference them.
+type Store struct {
+	path layout.Path
+
+	// mu is held shared while blobs or root entries are written and
+	// exclusively while garbage is collected, so a sweep never removes blobs
+	// of an archive that is still being added.
+	mu sync.RWMutex
+	// indexMu serializes read-modify-write cycles on index.json.
+	indexMu sync.Mutex
+}
+
+// GCResult summarizes a garbage collection pass.
+type GCResult struct {
+	Roots        int      `json:"roots"`
+	BlobsKept    int      `json:"blobs_kept"`
+	BlobsRemoved []string `json:"blobs_removed"`
+	BytesFreed   int64    `json:"bytes_freed"`
+}
+
+var (
+	storesMu sync.Mutex
+	stores   = map[string]*Store{}
+)
+
+// OpenStore returns the store rooted at dir, creating an empty layout if
+// needed. Stores are cached per directory so all callers share its locks.
+func OpenStore(dir string) (*Store, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	if s, ok := stores[abs]; ok {
+		return s, nil
+	}
+
+	p, err := layout.FromPath(abs)
+	if err != nil {
+		p, err = layout.Write(abs, empty.Index)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize archive store: %w", err)
+		}
+	}
+	s := &Store{path: p}
+	stores[abs] = s
+	return s, nil
+}
+
+// Path returns the directory of the underlying OCI layout.
+func (s *Store) Path() string {
+	return string(s.path)
+}
+
+// Add writes all blobs of idx into the store and records idx as the root of
+// archive id, replacing any previous root of that archive. Blobs that are
+// already present are not written again.
+func (s *Store) Add(id string, idx v1.ImageIndex) (v1.Descriptor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.path.WriteIndex(idx); err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to write blobs: %w", err)
+	}
+	desc, err := partial.Descriptor(idx)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	desc.Annotations = map[string]string{AnnotationArchiveID: id}
+
+	err = s.updateRoots(func(roots []v1.Descriptor) []v1.Descriptor {
+		return append(withoutArchive(roots, id), *desc)
+	})
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	return *desc, nil
+}
+
+// Remove drops the root entry of archive id. Its blobs stay on disk until
+// the next GC, and only if no other archive references them.
+func (s *Store) Remove(id string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.updateRoots(func(roots []v1.Descriptor) []v1.Descriptor {
+		return withoutArchive(roots, id)
+	})
+}
+
+// Index returns the image index stored under digest.
+func (s *Store) Index(digest string) (v1.ImageIndex, error) {
+	h, err := v1.NewHash(digest)
+	if err != nil {
+		return nil, err
+	}
+	root, err := s.path.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	return root.ImageIndex(h)
+}
+
+// Roots returns the root entries of all archives.
+func (s *Store) Roots() ([]v1.Descriptor, error) {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	return s.readRoots()
+}
+
+// RefCounts returns, for every blob reachable from a root, the number of
+// archives referencing it. A blob used twice by the same archive counts once.
+func (s *Store) RefCounts() (map[v1.Hash]int, error) {
+	roots, err := s.Roots()
+	if err != nil {
+		return nil, err
+	}
+	root, err := s.path.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[v1.Hash]int{}
+	for _, desc := range roots {
+		blobs := map[v1.Hash]bool{}
+		if err := markIndex(root, desc, blobs); err != nil {
+			return nil, fmt.Errorf("archive %s: %w", desc.Annotations[AnnotationArchiveID], err)
+		}
+		for h := range blobs {
+			counts[h]++
+		}
+	}
+	return counts, nil
+}
+
+// GC removes every blob that is not referenced by any archive root.
+// Marking aborts on the first unreadable manifest so that a damaged store
+// never loses blobs that might still be needed.
+func (s *Store) GC() (GCResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := GCResult{BlobsRemoved: []string{}}
+	counts, err := s.RefCounts()
+	if err != nil {
+		return result, fmt.Errorf("mark phase failed: %w", err)
+	}
+	roots, _ := s.Roots()
+	result.Roots = len(roots)
+
+	blobsDir := filepath.Join(s.Path(), "blobs")
+	err = filepath.WalkDir(blobsDir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(blobsDir, p)
+		if err != nil {
+			return err
+		}
+		// Leftovers of interrupted writes are not valid digests
+		h, err := v1.NewHash(strings.Replace(filepath.ToSlash(rel), "/", ":", 1))
+		if err == nil && counts[h] > 0 {
+			result.BlobsKept++
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		result.BlobsRemoved = append(result.BlobsRemoved, filepath.ToSlash(rel))
+		result.BytesFreed += info.Size()
+		return nil
+	})
+	return result, err
+}
+
+func (s *Store) readRoots() ([]v1.Descriptor, error) {
+	root, err := s.path.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	m, err := root.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	return m.Manifests, nil
+}
+
+// updateRoots rewrites index.json with the entries returned by fn. The file
+// is replaced atomically so readers never see a partial index.
+func (s *Store) updateRoots(fn func([]v1.Descriptor) []v1.Descriptor) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	root, err := s.path.ImageIndex()
+	if err != nil {
+		return err
+	}
+	m, err := root.IndexManifest()
+	if err != nil {
+		return err
+	}
+	m = m.DeepCopy()
+	m.Manifests = fn(m.Manifests)
+	if m.Manifests == nil {
+		m.Manifests = []v1.Descriptor{}
+	}
+
+	data, err := json.MarshalIndent(m, "", "   ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.Path(), ".index-*.json")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, filepath.Join(s.Path(), "index.json"))
+}
+
+func withoutArchive(roots []v1.Descriptor, id string) []v1.Descriptor {
+	out := make([]v1.Descriptor, 0, len(roots))
+	for _, d := range roots {
+		if d.Annotations[AnnotationArchiveID] == id {
+			continue
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+// markIndex records desc and every blob reachable from it.
+func markIndex(parent v1.ImageIndex, desc v1.Descriptor, blobs map[v1.Hash]bool) error {
+	blobs[desc.Digest] = true
+
+	switch {
+	case desc.MediaType.IsIndex():
+		idx, err := parent.ImageIndex(desc.Digest)
+		if err != nil {
+			return err
+		}
+		m, err := idx.IndexManifest()
+		if err != nil {
+			return err
+		}
+		for _, child := range m.Manifests {
+			if err := markIndex(idx, child, blobs); err != nil {
+				return err
+			}
+		}
+	case desc.MediaType.IsImage():
+		img, err := parent.Image(desc.Digest)
+		if err != nil {
+			return err
+		}
+		m, err := img.Manifest()
+		if err != nil {
+			return err
+		}
+		blobs[m.Config.Digest] = true
+		for _, l := range m.Layers {
+			blobs[l.Digest] = true
+		}
+	}
+	return nil
+}
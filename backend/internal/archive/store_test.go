@@ -0,0 +1,148 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func blobPath(s *Store, h v1.Hash) string {
+	return filepath.Join(s.Path(), "blobs", h.Algorithm, h.Hex)
+}
+
+func blobExists(s *Store, h v1.Hash) bool {
+	_, err := os.Stat(blobPath(s, h))
+	return err == nil
+}
+
+// sharedBaseImages returns two images that have their first layer in common.
+func sharedBaseImages(t *testing.T) (v1.Image, v1.Image, v1.Layer) {
+	t.Helper()
+	base, err := random.Layer(512, "application/vnd.oci.image.layer.v1.tar+gzip")
+	if err != nil {
+		t.Fatalf("random layer: %v", err)
+	}
+	var imgs []v1.Image
+	for i := 0; i < 2; i++ {
+		top, err := random.Layer(256, "application/vnd.oci.image.layer.v1.tar+gzip")
+		if err != nil {
+			t.Fatalf("random layer: %v", err)
+		}
+		img, err := mutate.AppendLayers(empty.Image, base, top)
+		if err != nil {
+			t.Fatalf("append layers: %v", err)
+		}
+		imgs = append(imgs, img)
+	}
+	return imgs[0], imgs[1], base
+}
+
+func TestStore_SharedBlobsSurviveUntilLastReference(t *testing.T) {
+	s, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	a, b, base := sharedBaseImages(t)
+	baseDigest, _ := base.Digest()
+
+	if _, err := s.Add("a", mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: a})); err != nil {
+		t.Fatalf("add a: %v", err)
+	}
+	if _, err := s.Add("b", mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: b})); err != nil {
+		t.Fatalf("add b: %v", err)
+	}
+
+	counts, err := s.RefCounts()
+	if err != nil {
+		t.Fatalf("refcounts: %v", err)
+	}
+	if counts[baseDigest] != 2 {
+		t.Fatalf("expected shared layer to be referenced twice, got %d", counts[baseDigest])
+	}
+
+	aLayers, _ := a.Layers()
+	aTop, _ := aLayers[1].Digest()
+
+	if err := s.Remove("a"); err != nil {
+		t.Fatalf("remove a: %v", err)
+	}
+	res, err := s.GC()
+	if err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	if res.Roots != 1 || len(res.BlobsRemoved) == 0 {
+		t.Fatalf("unexpected gc result: %+v", res)
+	}
+	if !blobExists(s, baseDigest) {
+		t.Fatalf("shared layer removed while still referenced")
+	}
+	if blobExists(s, aTop) {
+		t.Fatalf("layer only used by a was not collected")
+	}
+
+	if err := s.Remove("b"); err != nil {
+		t.Fatalf("remove b: %v", err)
+	}
+	if _, err := s.GC(); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	if blobExists(s, baseDigest) {
+		t.Fatalf("layer not collected after last reference was removed")
+	}
+}
+
+func TestStore_AddReplacesRootOfSameArchive(t *testing.T) {
+	s, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	a, b, _ := sharedBaseImages(t)
+
+	if _, err := s.Add("x", mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: a})); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	desc, err := s.Add("x", mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: b}))
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	roots, _ := s.Roots()
+	if len(roots) != 1 || roots[0].Digest != desc.Digest || roots[0].Annotations[AnnotationArchiveID] != "x" {
+		t.Fatalf("unexpected roots: %+v", roots)
+	}
+	idx, err := s.Index(desc.Digest.String())
+	if err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	m, _ := idx.IndexManifest()
+	bDigest, _ := b.Digest()
+	if len(m.Manifests) != 1 || m.Manifests[0].Digest != bDigest {
+		t.Fatalf("unexpected index content: %+v", m.Manifests)
+	}
+}
+
+func TestStore_GCAbortsOnMissingManifest(t *testing.T) {
+	s, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	a, _, base := sharedBaseImages(t)
+	if _, err := s.Add("a", mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: a})); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	aDigest, _ := a.Digest()
+	os.Remove(blobPath(s, aDigest))
+
+	if _, err := s.GC(); err == nil {
+		t.Fatalf("expected gc to fail on a damaged store")
+	}
+	baseDigest, _ := base.Digest()
+	if !blobExists(s, baseDigest) {
+		t.Fatalf("gc removed blobs despite failing to mark")
+	}
+}
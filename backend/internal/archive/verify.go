@@ -0,0 +1,177 @@
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/guoxudong/horcrux/internal/volume"
+)
+
+// RootReport lists the blobs an index.json entry needs but cannot get.
+type RootReport struct {
+	ArchiveID string    `json:"archive_id,omitempty"`
+	Digest    v1.Hash   `json:"digest"`
+	Missing   []v1.Hash `json:"missing,omitempty"` // absent or corrupt
+}
+
+// VerifyReport is the result of checking every blob of an OCI layout.
+type VerifyReport struct {
+	BlobsChecked int          `json:"blobs_checked"`
+	Corrupt      []v1.Hash    `json:"corrupt,omitempty"`      // content does not match the file name
+	Unreferenced []v1.Hash    `json:"unreferenced,omitempty"` // not reachable from any root
+	Stray        []string     `json:"stray,omitempty"`        // files under blobs/ that are not digests
+	Roots        []RootReport `json:"roots"`
+}
+
+// Damaged returns the reports of roots with missing or corrupt blobs.
+func (r *VerifyReport) Damaged() []RootReport {
+	var out []RootReport
+	for _, root := range r.Roots {
+		if len(root.Missing) > 0 {
+			out = append(out, root)
+		}
+	}
+	return out
+}
+
+// VerifyLayout re-hashes every blob of the layout at dir and walks each
+// index.json entry, reporting blobs that are corrupt, missing or unused.
+func VerifyLayout(dir string) (*VerifyReport, error) {
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{Roots: []RootReport{}}
+
+	// Hash pass
+	valid := map[v1.Hash]bool{}
+	blobsDir := filepath.Join(dir, "blobs")
+	err = filepath.WalkDir(blobsDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(blobsDir, path)
+		if err != nil {
+			return err
+		}
+		h, err := v1.NewHash(strings.Replace(filepath.ToSlash(rel), "/", ":", 1))
+		if err != nil || h.Algorithm != "sha256" {
+			report.Stray = append(report.Stray, filepath.ToSlash(rel))
+			return nil
+		}
+		report.BlobsChecked++
+		sum, err := volume.SHA256File(path)
+		if err != nil {
+			return err
+		}
+		if sum != h.Hex {
+			report.Corrupt = append(report.Corrupt, h)
+			return nil
+		}
+		valid[h] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Reachability pass
+	root, err := p.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	m, err := root.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	reachable := map[v1.Hash]bool{}
+	for _, desc := range m.Manifests {
+		rr := RootReport{ArchiveID: desc.Annotations[AnnotationArchiveID], Digest: desc.Digest}
+		seen := map[v1.Hash]bool{}
+		walkDescriptor(root, desc, valid, seen, &rr.Missing)
+		for h := range seen {
+			reachable[h] = true
+		}
+		report.Roots = append(report.Roots, rr)
+	}
+	for h := range valid {
+		if !reachable[h] {
+			report.Unreferenced = append(report.Unreferenced, h)
+		}
+	}
+	return report, nil
+}
+
+// walkDescriptor marks desc and its children as seen and records children
+// that are not valid blobs. Unlike markIndex it keeps going after a missing
+// blob so that every problem is reported.
+func walkDescriptor(parent v1.ImageIndex, desc v1.Descriptor, valid, seen map[v1.Hash]bool, missing *[]v1.Hash) {
+	if seen[desc.Digest] {
+		return
+	}
+	seen[desc.Digest] = true
+	if !valid[desc.Digest] {
+		*missing = append(*missing, desc.Digest)
+		return
+	}
+
+	switch {
+	case desc.MediaType.IsIndex():
+		idx, err := parent.ImageIndex(desc.Digest)
+		if err != nil {
+			return
+		}
+		m, err := idx.IndexManifest()
+		if err != nil {
+			return
+		}
+		for _, child := range m.Manifests {
+			walkDescriptor(idx, child, valid, seen, missing)
+		}
+	case desc.MediaType.IsImage():
+		img, err := parent.Image(desc.Digest)
+		if err != nil {
+			return
+		}
+		m, err := img.Manifest()
+		if err != nil {
+			return
+		}
+		for _, d := range append([]v1.Descriptor{m.Config}, m.Layers...) {
+			if seen[d.Digest] {
+				continue
+			}
+			seen[d.Digest] = true
+			if !valid[d.Digest] {
+				*missing = append(*missing, d.Digest)
+			}
+		}
+	}
+}
+
+// Verify checks the store like VerifyLayout while no blobs are written.
+func (s *Store) Verify() (*VerifyReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return VerifyLayout(s.Path())
+}
+
+// RemoveBlob deletes a single blob, e.g. one found corrupt by Verify.
+func (s *Store) RemoveBlob(h v1.Hash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.path.RemoveBlob(h); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove blob %s: %w", h, err)
+	}
+	return nil
+}
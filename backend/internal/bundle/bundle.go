@@ -0,0 +1,384 @@
+package bundle
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/guoxudong/horcrux/internal/engine"
+	"github.com/guoxudong/horcrux/internal/volume"
+)
+
+// A Horcrux bundle is a directory (or a tar of that directory, optionally
+// split into volumes) containing
+//
+//	oci-layout, index.json, blobs/   one OCI image layout shared by all images
+//	bundle.json                      the bundle manifest (Manifest)
+//	SHA256SUMS                       sha256sum(1) compatible checksums of every other file
+//
+// Each image is one index.json entry, annotated with its original reference.
+const (
+	ManifestFile  = "bundle.json"
+	ChecksumFile  = "SHA256SUMS"
+	FormatVersion = 1
+)
+
+const (
+	annotationRefName        = "org.opencontainers.image.ref.name"
+	annotationContainerdName = "io.containerd.image.name"
+)
+
+// Manifest describes the content of a bundle.
+type Manifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Images    []Image   `json:"images"`
+	Blobs     []Blob    `json:"blobs"` // every blob in the layout
+	// Base is the sha256 of the bundle.json a delta bundle was built against.
+	Base string `json:"base,omitempty"`
+	// External lists layers the images need but a delta bundle leaves out,
+	// because the receiving site already got them with an earlier bundle.
+	External []Blob `json:"external,omitempty"`
+}
+
+// IsDelta reports whether the bundle relies on blobs shipped earlier.
+func (m *Manifest) IsDelta() bool {
+	return m.Base != "" || len(m.External) > 0
+}
+
+// knownBlobs returns every blob a site has once it imported the bundle,
+// including the ones a delta relied on.
+func (m *Manifest) knownBlobs() map[v1.Hash]bool {
+	known := map[v1.Hash]bool{}
+	for _, list := range [][]Blob{m.Blobs, m.External} {
+		for _, b := range list {
+			if h, err := v1.NewHash(b.Digest); err == nil {
+				known[h] = true
+			}
+		}
+	}
+	return known
+}
+
+// Image is an image as it was pulled into the bundle.
+type Image struct {
+	Ref       string   `json:"ref"`
+	Digest    string   `json:"digest"`
+	MediaType string   `json:"media_type"`
+	Platforms []string `json:"platforms,omitempty"`
+}
+
+type Blob struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// Bundle is a bundle opened for reading.
+type Bundle struct {
+	Dir      string
+	Manifest *Manifest
+
+	tmpDir string
+}
+
+// Open reads a bundle directory, a bundle tar or a bundle split into volumes
+// (path is then the volume index, or the tar name the volumes reassemble to).
+// Tars are extracted next to path; the copy is removed by Close. Missing or
+// corrupt volumes are reported as a *volume.CheckError.
+func Open(path string) (*Bundle, error) {
+	if !volume.IsIndex(path) {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) && volume.Exists(path) {
+			path = volume.IndexPath(path)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Bundle{Dir: path}
+	if !info.IsDir() {
+		tmp, err := os.MkdirTemp(filepath.Dir(path), ".bundle-*")
+		if err != nil {
+			return nil, err
+		}
+		b.tmpDir = tmp
+		b.Dir = tmp
+		if err := extract(path, tmp); err != nil {
+			b.Close()
+			return nil, err
+		}
+	}
+
+	m, err := ReadManifest(filepath.Join(b.Dir, ManifestFile))
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	b.Manifest = m
+	return b, nil
+}
+
+func extract(path, dst string) error {
+	if !volume.IsIndex(path) {
+		if err := engine.ExtractTar(path, dst); err != nil {
+			return fmt.Errorf("failed to extract bundle: %w", err)
+		}
+		return nil
+	}
+
+	r, _, err := volume.Open(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := engine.ExtractTarReader(r, dst); err != nil {
+		return fmt.Errorf("failed to extract bundle: %w", err)
+	}
+	return nil
+}
+
+// Close removes files extracted by Open.
+func (b *Bundle) Close() error {
+	if b == nil || b.tmpDir == "" {
+		return nil
+	}
+	return os.RemoveAll(b.tmpDir)
+}
+
+// ReadManifest loads a bundle manifest from a file.
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle manifest: %w", err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid bundle manifest: %w", err)
+	}
+	if m.Version != FormatVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", m.Version)
+	}
+	return &m, nil
+}
+
+// VerifyResult lists every problem found by Verify.
+type VerifyResult struct {
+	FilesChecked int      `json:"files_checked"`
+	Corrupt      []string `json:"corrupt,omitempty"`  // checksum mismatch
+	Missing      []string `json:"missing,omitempty"`  // listed in SHA256SUMS or referenced by an image but absent
+	Unlisted     []string `json:"unlisted,omitempty"` // present but not covered by SHA256SUMS
+}
+
+// OK reports whether the bundle is complete and intact.
+func (r *VerifyResult) OK() bool {
+	return len(r.Corrupt) == 0 && len(r.Missing) == 0 && len(r.Unlisted) == 0
+}
+
+// Verify checks every file against SHA256SUMS and makes sure all blobs of
+// every image in the manifest are present.
+func (b *Bundle) Verify() (*VerifyResult, error) {
+	res := &VerifyResult{}
+
+	sums, err := readChecksums(filepath.Join(b.Dir, ChecksumFile))
+	if err != nil {
+		return nil, err
+	}
+	files, err := listFiles(b.Dir)
+	if err != nil {
+		return nil, err
+	}
+	present := map[string]bool{}
+	for _, f := range files {
+		present[f] = true
+		if _, ok := sums[f]; !ok && f != ChecksumFile {
+			res.Unlisted = append(res.Unlisted, f)
+		}
+	}
+
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !present[name] {
+			res.Missing = append(res.Missing, name)
+			continue
+		}
+		sum, err := volume.SHA256File(filepath.Join(b.Dir, filepath.FromSlash(name)))
+		if err != nil {
+			return nil, err
+		}
+		res.FilesChecked++
+		if sum != sums[name] {
+			res.Corrupt = append(res.Corrupt, name)
+		}
+	}
+
+	// A bundle can be internally consistent yet lack blobs an image needs
+	l, err := layout.ImageIndexFromPath(b.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle layout: %w", err)
+	}
+	// Layers left out of a delta are checked against the registry on push
+	seen := map[string]bool{}
+	for _, ext := range b.Manifest.External {
+		if h, err := v1.NewHash(ext.Digest); err == nil {
+			seen[blobPath(h)] = true
+		}
+	}
+	for _, img := range b.Manifest.Images {
+		blobs, err := ReferencedBlobs(l, img.Digest)
+		if err != nil {
+			res.Missing = append(res.Missing, fmt.Sprintf("%s (%s): %v", img.Ref, img.Digest, err))
+			continue
+		}
+		for _, d := range blobs {
+			p := blobPath(d.Digest)
+			if !present[p] && !seen[p] {
+				seen[p] = true
+				res.Missing = append(res.Missing, p)
+			}
+		}
+	}
+	return res, nil
+}
+
+// ReferencedBlobs returns the descriptors of the manifests, configs and
+// layers reachable from the entry digest of the layout's index.
+func ReferencedBlobs(root v1.ImageIndex, digest string) ([]v1.Descriptor, error) {
+	h, err := v1.NewHash(digest)
+	if err != nil {
+		return nil, err
+	}
+	m, err := root.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range m.Manifests {
+		if desc.Digest == h {
+			var out []v1.Descriptor
+			err := collectBlobs(root, desc, map[v1.Hash]bool{}, &out)
+			return out, err
+		}
+	}
+	return nil, fmt.Errorf("digest %s not found in index.json", digest)
+}
+
+func collectBlobs(parent v1.ImageIndex, desc v1.Descriptor, seen map[v1.Hash]bool, out *[]v1.Descriptor) error {
+	if seen[desc.Digest] {
+		return nil
+	}
+	seen[desc.Digest] = true
+	*out = append(*out, desc)
+
+	switch {
+	case desc.MediaType.IsIndex():
+		idx, err := parent.ImageIndex(desc.Digest)
+		if err != nil {
+			return err
+		}
+		m, err := idx.IndexManifest()
+		if err != nil {
+			return err
+		}
+		for _, child := range m.Manifests {
+			if err := collectBlobs(idx, child, seen, out); err != nil {
+				return err
+			}
+		}
+	case desc.MediaType.IsImage():
+		img, err := parent.Image(desc.Digest)
+		if err != nil {
+			return err
+		}
+		m, err := img.Manifest()
+		if err != nil {
+			return err
+		}
+		for _, d := range append([]v1.Descriptor{m.Config}, m.Layers...) {
+			if !seen[d.Digest] {
+				seen[d.Digest] = true
+				*out = append(*out, d)
+			}
+		}
+	}
+	return nil
+}
+
+func blobPath(h v1.Hash) string {
+	return "blobs/" + h.Algorithm + "/" + h.Hex
+}
+
+// listFiles returns the slash-separated paths of all regular files under dir.
+func listFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// writeChecksums hashes every file under dir into SHA256SUMS.
+func writeChecksums(dir string) error {
+	files, err := listFiles(dir)
+	if err != nil {
+		return err
+	}
+	var sb strings.Builder
+	for _, f := range files {
+		if f == ChecksumFile {
+			continue
+		}
+		sum, err := volume.SHA256File(filepath.Join(dir, filepath.FromSlash(f)))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&sb, "%s  %s\n", sum, f)
+	}
+	return os.WriteFile(filepath.Join(dir, ChecksumFile), []byte(sb.String()), 0644)
+}
+
+func readChecksums(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checksums: %w", err)
+	}
+	defer f.Close()
+
+	sums := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		sum, name, ok := strings.Cut(line, "  ")
+		if !ok || len(sum) != 64 {
+			return nil, fmt.Errorf("malformed checksum line: %q", line)
+		}
+		sums[strings.TrimPrefix(name, "*")] = sum
+	}
+	return sums, sc.Err()
+}
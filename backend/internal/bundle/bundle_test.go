@@ -0,0 +1,327 @@
+package bundle
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/guoxudong/horcrux/internal/engine"
+	"github.com/guoxudong/horcrux/internal/volume"
+)
+
+func mustRef(t *testing.T, s string) name.Reference {
+	t.Helper()
+	r, err := name.ParseReference(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func newTestSyncer() *engine.Syncer {
+	progress := make(chan engine.Progress, 100)
+	go func() {
+		for range progress {
+		}
+	}()
+	return engine.NewSyncer(progress)
+}
+
+// seedRegistry pushes a multi-arch index and a single image to a fresh
+// in-memory registry and returns their references and digests.
+func seedRegistry(t *testing.T) (host string, refs []string, digests []v1.Hash) {
+	t.Helper()
+	srv := httptest.NewServer(registry.New())
+	t.Cleanup(srv.Close)
+	host = strings.TrimPrefix(srv.URL, "http://")
+
+	idx, err := random.Index(256, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idxRef := host + "/library/app:1.0"
+	imgRef := host + "/tools/cli:latest"
+	if err := remote.WriteIndex(mustRef(t, idxRef), idx); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(mustRef(t, imgRef), img); err != nil {
+		t.Fatal(err)
+	}
+	idxDigest, _ := idx.Digest()
+	imgDigest, _ := img.Digest()
+	return host, []string{idxRef, imgRef}, []v1.Hash{idxDigest, imgDigest}
+}
+
+func TestCreateVerifyPush(t *testing.T) {
+	host, refs, digests := seedRegistry(t)
+	out := filepath.Join(t.TempDir(), "images.tar")
+
+	m, err := Create(newTestSyncer(), CreateOptions{Refs: append(refs, refs[0]), Output: out})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if len(m.Images) != 2 {
+		t.Fatalf("expected 2 images (duplicates skipped), got %d", len(m.Images))
+	}
+	for i, img := range m.Images {
+		if img.Digest != digests[i].String() {
+			t.Errorf("image %s: digest %s, want %s", img.Ref, img.Digest, digests[i])
+		}
+	}
+
+	b, err := Open(out)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer b.Close()
+
+	res, err := b.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if !res.OK() || res.FilesChecked == 0 {
+		t.Fatalf("expected a clean bundle, got %+v", res)
+	}
+
+	rm, err := ParseRegistryMap([]string{host + "/library=" + host + "/mirror"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm["*"] = host + "/other"
+	results, err := Push(newTestSyncer(), b, PushOptions{RegistryMap: rm})
+	if err != nil {
+		t.Fatalf("Push failed: %v (%+v)", err, results)
+	}
+
+	want := map[string]v1.Hash{
+		host + "/mirror/app:1.0":         digests[0],
+		host + "/other/tools/cli:latest": digests[1],
+	}
+	for ref, digest := range want {
+		desc, err := remote.Head(mustRef(t, ref))
+		if err != nil {
+			t.Fatalf("%s not pushed: %v", ref, err)
+		}
+		if desc.Digest != digest {
+			t.Errorf("%s: digest %s, want %s", ref, desc.Digest, digest)
+		}
+	}
+}
+
+func TestVerifyDetectsCorruption(t *testing.T) {
+	_, refs, _ := seedRegistry(t)
+	dir := filepath.Join(t.TempDir(), "bundle")
+
+	if _, err := Create(newTestSyncer(), CreateOptions{Refs: refs, Output: dir}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	b, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := b.Manifest.Blobs
+	corrupt := filepath.Join(dir, "blobs", strings.Replace(blobs[0].Digest, ":", "/", 1))
+	if err := os.WriteFile(corrupt, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "blobs", strings.Replace(blobs[1].Digest, ":", "/", 1))
+	if err := os.Remove(missing); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := b.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if res.OK() {
+		t.Fatal("expected verification to fail")
+	}
+	if len(res.Corrupt) != 1 || !strings.HasSuffix(corrupt, filepath.FromSlash(res.Corrupt[0])) {
+		t.Errorf("expected %s to be reported corrupt, got %v", corrupt, res.Corrupt)
+	}
+	if len(res.Missing) == 0 {
+		t.Errorf("expected missing blob to be reported, got %+v", res)
+	}
+}
+
+func TestRegistryMapRewrite(t *testing.T) {
+	m, err := ParseRegistryMap([]string{
+		"docker.io=registry.local/mirror, ghcr.io/org/team=registry.local/team",
+		"ghcr.io=registry.local/ghcr",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{"nginx:1.25", "registry.local/mirror/library/nginx:1.25"},
+		{"docker.io/bitnami/redis:7", "registry.local/mirror/bitnami/redis:7"},
+		{"ghcr.io/org/team/app:v1", "registry.local/team/app:v1"},
+		{"ghcr.io/org/other:v1", "registry.local/ghcr/org/other:v1"},
+		{"ghcr.io/org/other@sha256:" + strings.Repeat("a", 64), "registry.local/ghcr/org/other@sha256:" + strings.Repeat("a", 64)},
+	}
+	for _, tt := range tests {
+		got, err := m.Rewrite(tt.ref)
+		if err != nil {
+			t.Errorf("Rewrite(%s) failed: %v", tt.ref, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Rewrite(%s) = %s, want %s", tt.ref, got, tt.want)
+		}
+	}
+
+	if _, err := m.Rewrite("quay.io/coreos/etcd:v3"); err == nil {
+		t.Error("expected an error for an unmapped registry")
+	}
+	if _, err := ParseRegistryMap([]string{"quay.io"}); err == nil {
+		t.Error("expected an error for a mapping without '='")
+	}
+}
+
+func TestDeltaBundle(t *testing.T) {
+	host, refs, _ := seedRegistry(t)
+	dir := t.TempDir()
+
+	full := filepath.Join(dir, "full")
+	if _, err := Create(newTestSyncer(), CreateOptions{Refs: refs[1:], Output: full}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	// Next release: the same image plus one layer
+	base, err := remote.Image(mustRef(t, refs[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := random.Layer(256, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := mutate.AppendLayers(base, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextRef := host + "/tools/cli:next"
+	if err := remote.Write(mustRef(t, nextRef), next); err != nil {
+		t.Fatal(err)
+	}
+
+	delta := filepath.Join(dir, "delta.tar")
+	m, err := Create(newTestSyncer(), CreateOptions{Refs: []string{nextRef}, Output: delta, Since: full})
+	if err != nil {
+		t.Fatalf("Create delta failed: %v", err)
+	}
+	if !m.IsDelta() || len(m.External) != 1 {
+		t.Fatalf("expected one external layer, got %+v", m.External)
+	}
+	layerDigest, _ := layer.Digest()
+	for _, b := range m.Blobs {
+		if b.Digest == m.External[0].Digest {
+			t.Fatalf("external blob %s shipped in delta", b.Digest)
+		}
+	}
+	found := false
+	for _, b := range m.Blobs {
+		found = found || b.Digest == layerDigest.String()
+	}
+	if !found {
+		t.Fatalf("new layer %s missing from delta", layerDigest)
+	}
+
+	b, err := Open(delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if res, err := b.Verify(); err != nil || !res.OK() {
+		t.Fatalf("expected delta to verify, got %+v, %v", res, err)
+	}
+
+	// The site registry has not received the full bundle yet
+	site := httptest.NewServer(registry.New())
+	defer site.Close()
+	siteHost := strings.TrimPrefix(site.URL, "http://")
+	rm := RegistryMap{"*": siteHost + "/site"}
+	if _, err := Push(newTestSyncer(), b, PushOptions{RegistryMap: rm}); err == nil || !strings.Contains(err.Error(), m.External[0].Digest) {
+		t.Fatalf("expected push to name the missing blob, got %v", err)
+	}
+	if _, err := remote.Head(mustRef(t, siteHost+"/site/tools/cli:next")); err == nil {
+		t.Fatal("manifest pushed although blobs are missing")
+	}
+
+	fb, err := Open(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Push(newTestSyncer(), fb, PushOptions{RegistryMap: rm}); err != nil {
+		t.Fatalf("Push full failed: %v", err)
+	}
+	if _, err := Push(newTestSyncer(), b, PushOptions{RegistryMap: rm}); err != nil {
+		t.Fatalf("Push delta failed: %v", err)
+	}
+	desc, err := remote.Head(mustRef(t, siteHost+"/site/tools/cli:next"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := next.Digest(); desc.Digest != want {
+		t.Errorf("pushed digest %s, want %s", desc.Digest, want)
+	}
+}
+
+func TestVolumeBundle(t *testing.T) {
+	_, refs, _ := seedRegistry(t)
+	dir := t.TempDir()
+	out := filepath.Join(dir, "images.tar")
+
+	if _, err := Create(newTestSyncer(), CreateOptions{Refs: refs, Output: out, VolumeSize: 2048}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Fatalf("expected only volumes to be written, got %v", err)
+	}
+	ix, err := volume.ReadIndex(volume.IndexPath(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ix.Volumes) < 2 {
+		t.Fatalf("expected several volumes, got %d", len(ix.Volumes))
+	}
+
+	b, err := Open(out)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	res, err := b.Verify()
+	b.Close()
+	if err != nil || !res.OK() {
+		t.Fatalf("expected bundle to verify, got %+v, %v", res, err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, ix.Volumes[1].Name)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(volume.IndexPath(out))
+	var cerr *volume.CheckError
+	if !errors.As(err, &cerr) || len(cerr.Missing) != 1 || cerr.Missing[0] != ix.Volumes[1].Name {
+		t.Fatalf("expected %s to be reported missing, got %v", ix.Volumes[1].Name, err)
+	}
+}
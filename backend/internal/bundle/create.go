@@ -0,0 +1,332 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/guoxudong/horcrux/internal/engine"
+	"github.com/guoxudong/horcrux/internal/vault"
+	"github.com/guoxudong/horcrux/internal/volume"
+)
+
+// CreateOptions configures Create.
+type CreateOptions struct {
+	Refs []string
+	// Output is a directory, or a file ending in .tar for a single-file bundle.
+	Output string
+	// Auth returns the credential for pulling ref; nil means anonymous.
+	Auth func(ref string) *vault.Credential
+	// Since is the bundle.json (or a bundle directory holding it) of a bundle
+	// the receiving site already imported. Layers it shipped are left out.
+	Since string
+	// VolumeSize splits a .tar output into numbered volumes of at most this
+	// many bytes, see package volume. Zero writes a single file.
+	VolumeSize int64
+}
+
+// ReadImageList parses an image list: one reference per line, blank lines
+// and lines starting with # are ignored.
+func ReadImageList(r io.Reader) ([]string, error) {
+	var refs []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := name.ParseReference(line); err != nil {
+			return nil, fmt.Errorf("invalid reference %q: %w", line, err)
+		}
+		refs = append(refs, line)
+	}
+	return refs, sc.Err()
+}
+
+// IsTarOutput reports whether a bundle path names a single-file bundle.
+func IsTarOutput(path string) bool {
+	return strings.HasSuffix(path, ".tar")
+}
+
+// Create pulls every image into a new bundle at opts.Output.
+func Create(s *engine.Syncer, opts CreateOptions) (*Manifest, error) {
+	if len(opts.Refs) == 0 {
+		return nil, fmt.Errorf("no images to bundle")
+	}
+	if _, err := os.Stat(opts.Output); err == nil || volume.Exists(opts.Output) {
+		return nil, fmt.Errorf("%s already exists", opts.Output)
+	}
+	if opts.VolumeSize > 0 && !IsTarOutput(opts.Output) {
+		return nil, fmt.Errorf("volumes require a .tar output")
+	}
+
+	dir := opts.Output
+	if IsTarOutput(opts.Output) {
+		tmp, err := os.MkdirTemp(filepath.Dir(opts.Output), ".bundle-*")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	}
+
+	m, err := writeBundleDir(s, dir, opts)
+	if err != nil {
+		if dir == opts.Output {
+			os.RemoveAll(dir)
+		}
+		return nil, err
+	}
+
+	if IsTarOutput(opts.Output) {
+		if err := writeTarFile(dir, opts.Output, opts.VolumeSize); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// ReadBaseManifest loads the manifest a delta bundle is built against and
+// returns it with its sha256. path is a bundle.json or a bundle directory.
+func ReadBaseManifest(path string) (*Manifest, string, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, ManifestFile)
+	}
+	m, err := ReadManifest(path)
+	if err != nil {
+		return nil, "", err
+	}
+	sum, err := volume.SHA256File(path)
+	if err != nil {
+		return nil, "", err
+	}
+	return m, "sha256:" + sum, nil
+}
+
+func writeBundleDir(s *engine.Syncer, dir string, opts CreateOptions) (*Manifest, error) {
+	m := &Manifest{Version: FormatVersion, CreatedAt: time.Now().UTC(), Images: []Image{}}
+
+	var skip func(v1.Hash) bool
+	if opts.Since != "" {
+		base, sum, err := ReadBaseManifest(opts.Since)
+		if err != nil {
+			return nil, err
+		}
+		known := base.knownBlobs()
+		skip = func(h v1.Hash) bool { return known[h] }
+		m.Base = sum
+	}
+
+	l, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, ref := range opts.Refs {
+		if seen[ref] {
+			continue
+		}
+		seen[ref] = true
+
+		var auth *vault.Credential
+		if opts.Auth != nil {
+			auth = opts.Auth(ref)
+		}
+		desc, err := s.PullToLayout(ref, auth, l, refAnnotations(ref), skip)
+		if err != nil {
+			return nil, err
+		}
+		img := Image{Ref: ref, Digest: desc.Digest.String(), MediaType: string(desc.MediaType)}
+		img.Platforms = platformsOf(l, desc)
+		m.Images = append(m.Images, img)
+	}
+
+	if m.Blobs, err = listBlobs(dir); err != nil {
+		return nil, err
+	}
+	if skip != nil {
+		if m.External, err = externalBlobs(l, m); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeManifest(dir, m); err != nil {
+		return nil, err
+	}
+	if err := writeChecksums(dir); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// refAnnotations records the original reference the way containerd and
+// skopeo do, so the layout is also usable by other OCI tools.
+func refAnnotations(ref string) map[string]string {
+	ann := map[string]string{annotationContainerdName: ref}
+	if r, err := name.ParseReference(ref); err == nil {
+		ann[annotationRefName] = r.Identifier()
+	}
+	return ann
+}
+
+func platformsOf(l layout.Path, desc v1.Descriptor) []string {
+	if !desc.MediaType.IsIndex() {
+		return nil
+	}
+	idx, err := l.ImageIndex()
+	if err != nil {
+		return nil
+	}
+	child, err := idx.ImageIndex(desc.Digest)
+	if err != nil {
+		return nil
+	}
+	im, err := child.IndexManifest()
+	if err != nil {
+		return nil
+	}
+	var out []string
+	for _, d := range im.Manifests {
+		if d.Platform != nil && d.Platform.OS != "unknown" {
+			out = append(out, d.Platform.String())
+		}
+	}
+	return out
+}
+
+// externalBlobs lists the blobs the images of m reference but the layout at
+// l does not hold.
+func externalBlobs(l layout.Path, m *Manifest) ([]Blob, error) {
+	idx, err := l.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	present := map[string]bool{}
+	for _, b := range m.Blobs {
+		present[b.Digest] = true
+	}
+
+	external := []Blob{}
+	for _, img := range m.Images {
+		descs, err := ReferencedBlobs(idx, img.Digest)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range descs {
+			digest := d.Digest.String()
+			if !present[digest] {
+				present[digest] = true
+				external = append(external, Blob{Digest: digest, Size: d.Size})
+			}
+		}
+	}
+	return external, nil
+}
+
+func listBlobs(dir string) ([]Blob, error) {
+	files, err := listFiles(filepath.Join(dir, "blobs"))
+	if err != nil {
+		return nil, err
+	}
+	blobs := []Blob{}
+	for _, f := range files {
+		info, err := os.Stat(filepath.Join(dir, "blobs", filepath.FromSlash(f)))
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, Blob{Digest: strings.Replace(f, "/", ":", 1), Size: info.Size()})
+	}
+	return blobs, nil
+}
+
+func writeManifest(dir string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, ManifestFile), data, 0644)
+}
+
+// writeTarFile packs dir into a tar at path, metadata files before blobs.
+// With a volumeSize the tar is written as volumes of path instead.
+func writeTarFile(dir, path string, volumeSize int64) error {
+	if volumeSize > 0 {
+		vw, err := volume.Create(path, volumeSize)
+		if err != nil {
+			return err
+		}
+		if err := writeTar(dir, vw); err != nil {
+			vw.Abort()
+			return err
+		}
+		if err := vw.Close(); err != nil {
+			vw.Abort()
+			return err
+		}
+		return nil
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeTar(dir, out); err != nil {
+		out.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+func writeTar(dir string, w io.Writer) error {
+	files, err := listFiles(dir)
+	if err != nil {
+		return err
+	}
+	// Metadata first, so a reader sees what the bundle holds before its blobs
+	sort.SliceStable(files, func(i, j int) bool {
+		return !strings.HasPrefix(files[i], "blobs/") && strings.HasPrefix(files[j], "blobs/")
+	})
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		p := filepath.Join(dir, filepath.FromSlash(f))
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    f,
+			Mode:    0644,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Format:  tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, in)
+		in.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
@@ -0,0 +1,190 @@
+package bundle
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/guoxudong/horcrux/internal/engine"
+	"github.com/guoxudong/horcrux/internal/vault"
+)
+
+// RegistryMap rewrites image references from their original registry to the
+// registry they are pushed to, e.g. "docker.io=registry.local:5000/mirror".
+// Keys match a registry or a registry/repository prefix; "*" matches any
+// reference not covered by another key.
+type RegistryMap map[string]string
+
+// ParseRegistryMap parses "src=dst" pairs, each entry may hold several pairs
+// separated by commas.
+func ParseRegistryMap(entries []string) (RegistryMap, error) {
+	m := RegistryMap{}
+	for _, entry := range entries {
+		for _, pair := range strings.Split(entry, ",") {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+			src, dst, ok := strings.Cut(pair, "=")
+			src, dst = strings.TrimSpace(src), strings.TrimSuffix(strings.TrimSpace(dst), "/")
+			if !ok || src == "" || dst == "" {
+				return nil, fmt.Errorf("invalid registry mapping %q, expected src=dst", pair)
+			}
+			m[normalizeRegistry(src)] = dst
+		}
+	}
+	return m, nil
+}
+
+// Rewrite returns the target reference for ref, keeping its tag or digest.
+func (m RegistryMap) Rewrite(ref string) (string, error) {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return "", err
+	}
+	repo := r.Context().Name() // registry/repository, docker.io normalized
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	// Longest prefix wins
+	sort.Slice(keys, func(i, j int) bool { return len(keys[i]) > len(keys[j]) })
+
+	target := ""
+	for _, k := range keys {
+		if k == "*" {
+			continue
+		}
+		if repo == k || strings.HasPrefix(repo, k+"/") {
+			target = m[k] + strings.TrimPrefix(repo, k)
+			break
+		}
+	}
+	if target == "" {
+		dst, ok := m["*"]
+		if !ok {
+			return "", fmt.Errorf("no registry mapping for %s", ref)
+		}
+		target = dst + "/" + r.Context().RepositoryStr()
+	}
+
+	if _, ok := r.(name.Digest); ok {
+		return target + "@" + r.Identifier(), nil
+	}
+	return target + ":" + r.Identifier(), nil
+}
+
+func normalizeRegistry(s string) string {
+	if s == "docker.io" || strings.HasPrefix(s, "docker.io/") {
+		return name.DefaultRegistry + strings.TrimPrefix(s, "docker.io")
+	}
+	return s
+}
+
+// PushOptions configures Push.
+type PushOptions struct {
+	RegistryMap RegistryMap
+	// Auth returns the credential for pushing to target; nil means anonymous.
+	Auth func(target string) *vault.Credential
+}
+
+// PushResult records where an image of the bundle was pushed.
+type PushResult struct {
+	Ref    string `json:"ref"`
+	Target string `json:"target"`
+	Digest string `json:"digest"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Push uploads every image of the bundle to the registry its reference maps
+// to. All targets are resolved, and every referenced blob is checked to be in
+// either the bundle or the target repository, before anything is pushed; a
+// failed image does not stop the remaining ones.
+func Push(s *engine.Syncer, b *Bundle, opts PushOptions) ([]PushResult, error) {
+	results := make([]PushResult, 0, len(b.Manifest.Images))
+	for _, img := range b.Manifest.Images {
+		target, err := opts.RegistryMap.Rewrite(img.Ref)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, PushResult{Ref: img.Ref, Target: target, Digest: img.Digest})
+	}
+
+	auth := func(target string) *vault.Credential {
+		if opts.Auth == nil {
+			return nil
+		}
+		return opts.Auth(target)
+	}
+	if err := checkBlobs(s, b, results, auth); err != nil {
+		return results, err
+	}
+
+	var failed int
+	for i := range results {
+		res := &results[i]
+		_, err := s.SyncManifestList(engine.SyncOptions{
+			SourceRef:          res.Ref,
+			TargetRef:          res.Target,
+			TargetAuth:         auth(res.Target),
+			SourceLayoutPath:   b.Dir,
+			SourceLayoutDigest: res.Digest,
+		})
+		if err != nil {
+			res.Error = err.Error()
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d image(s) failed to push", failed, len(results))
+	}
+	return results, nil
+}
+
+// checkBlobs makes sure no manifest is pushed whose blobs would be missing
+// at the target: blobs a delta bundle left out must already be in the
+// target repository.
+func checkBlobs(s *engine.Syncer, b *Bundle, results []PushResult, auth func(string) *vault.Credential) error {
+	l, err := layout.ImageIndexFromPath(b.Dir)
+	if err != nil {
+		return fmt.Errorf("invalid bundle layout: %w", err)
+	}
+
+	var missing []string
+	for _, res := range results {
+		descs, err := ReferencedBlobs(l, res.Digest)
+		if err != nil {
+			return fmt.Errorf("%s: %w", res.Ref, err)
+		}
+		var repo string
+		for _, d := range descs {
+			if _, err := os.Stat(filepath.Join(b.Dir, filepath.FromSlash(blobPath(d.Digest)))); err == nil {
+				continue
+			}
+			if repo == "" {
+				r, err := name.ParseReference(res.Target)
+				if err != nil {
+					return err
+				}
+				repo = r.Context().Name()
+			}
+			ok, err := s.BlobExists(repo, d.Digest, auth(res.Target))
+			if err != nil {
+				return fmt.Errorf("failed to check %s in %s: %w", d.Digest, repo, err)
+			}
+			if !ok {
+				missing = append(missing, repo+"@"+d.Digest.String())
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%d blob(s) are neither in the bundle nor in the target registry, push the bundle they came with first: %s",
+			len(missing), strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/guoxudong/horcrux/internal/api"
+	"github.com/guoxudong/horcrux/internal/vault"
+	"github.com/guoxudong/horcrux/internal/volume"
+	"github.com/spf13/cobra"
+)
+
+var (
+	fsckRepair bool
+	fsckJSON   bool
+
+	pullCred      string
+	pullPlatforms []string
+
+	exportOutput     string
+	exportFormat     string
+	exportPlatform   string
+	exportTag        string
+	exportVolumeSize string
+)
+
+var archiveCmd = &cobra.Command{
+	Use:   "archive",
+	Short: "Manage the local image archive library",
+}
+
+var archiveFsckCmd = &cobra.Command{
+	Use:   "fsck",
+	Short: "Verify archive blobs and metadata",
+	Long: `Verify the archive library.
+
+Every blob in the archive store is re-hashed, archives.json is reconciled with
+the data on disk and orphaned store entries, directories and blobs are
+reported. With --repair orphans are removed, entries whose data is gone are
+dropped and damaged archives are marked failed.
+
+Run it while the server is stopped, or use POST /api/archives/fsck instead.
+--repair refuses to run while a server uses the same data directory.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if fsckRepair {
+			if addr, ok := runningServer(filepath.Dir(resolveVaultPath())); ok {
+				log.Fatalf("A Horcrux server is running on %s with this data directory: stop it first, or repair through POST %s/api/archives/fsck?repair=true", addr, addr)
+			}
+		}
+		h := newOfflineHandler()
+
+		report, err := h.FsckArchives(fsckRepair)
+		if err != nil {
+			log.Fatalf("fsck failed: %v", err)
+		}
+
+		if fsckJSON {
+			data, _ := json.MarshalIndent(report, "", "  ")
+			fmt.Println(string(data))
+		} else {
+			fmt.Printf("Checked %d archive(s), %d blob(s)\n", report.Archives, report.BlobsChecked)
+			for _, issue := range report.Issues {
+				status := "FOUND"
+				if issue.Repaired {
+					status = "FIXED"
+				}
+				target := issue.Archive
+				if target == "" {
+					target = issue.Path
+				}
+				fmt.Printf("[%s] %-18s %s: %s\n", status, issue.Kind, target, issue.Detail)
+			}
+			if len(report.Issues) == 0 {
+				fmt.Println("No problems found")
+			}
+		}
+
+		if !report.Clean() {
+			os.Exit(1)
+		}
+	},
+}
+
+var archivePullCmd = &cobra.Command{
+	Use:   "pull <ref>",
+	Short: "Pull an image from a registry into the archive library",
+	Long: `Pull an image from a registry into the archive library.
+
+The image becomes a new archive:// entry that any pipe can use as a source,
+e.g. to stage images on a DMZ host before a maintenance window. Without
+--platform all platforms of a multi-arch image are kept.
+
+It refuses to run while a server uses the same data directory; use
+POST /api/archives/pull instead.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if addr, ok := runningServer(filepath.Dir(resolveVaultPath())); ok {
+			log.Fatalf("A Horcrux server is running on %s with this data directory: stop it first, or pull through POST %s/api/archives/pull", addr, addr)
+		}
+		h := newOfflineHandler()
+
+		req := api.ArchivePullRequest{Ref: args[0], Platforms: pullPlatforms}
+		if cred := lookupCredential(loadCLICredentials(), pullCred, args[0]); cred != nil {
+			req.CredentialID = cred.ID
+		} else if pullCred != "" {
+			log.Fatalf("Credential not found: %s", pullCred)
+		}
+
+		job, meta, err := h.StartArchivePull(req)
+		if err != nil {
+			log.Fatalf("Pull failed: %v", err)
+		}
+		job, err = h.WaitArchiveJob(job.ID, func(line string) { fmt.Println(line) })
+		if err != nil {
+			log.Fatalf("Pull failed: %v", err)
+		}
+		if job.Status != "success" {
+			fmt.Printf("ERROR: %s\n", job.Error)
+			os.Exit(1)
+		}
+		fmt.Printf("Archived %s as %s\n", args[0], meta.Ref)
+	},
+}
+
+var archiveExportCmd = &cobra.Command{
+	Use:   "export <archive-id>",
+	Short: "Write an archive as a Docker or OCI tarball",
+	Long: `Write an archive as a tarball for docker load or podman load.
+
+The docker format holds a single platform; select one with --platform for
+multi-platform archives. With --volume-size the tarball is split into
+numbered volumes (see "horcrux bundle --help"); upload, import or sync-tar
+the .volumes.json index, or its first volume, to read them back.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if exportOutput == "" {
+			fmt.Println("Error: output (-o) is required")
+			cmd.Help()
+			os.Exit(1)
+		}
+		var volumeSize int64
+		if exportVolumeSize != "" {
+			var err error
+			if volumeSize, err = volume.ParseSize(exportVolumeSize); err != nil {
+				log.Fatalf("%v", err)
+			}
+		}
+
+		h := newOfflineHandler()
+		exp, err := h.PrepareArchiveExport(args[0], api.ArchiveExportOptions{
+			Format:   exportFormat,
+			Platform: exportPlatform,
+			Tag:      exportTag,
+		})
+		if err != nil {
+			log.Fatalf("Export failed: %v", err)
+		}
+
+		if _, err := os.Stat(exportOutput); err == nil || volume.Exists(exportOutput) {
+			log.Fatalf("%s already exists", exportOutput)
+		}
+		var n int64
+		if volumeSize > 0 {
+			vw, err := volume.Create(exportOutput, volumeSize)
+			if err != nil {
+				log.Fatalf("Export failed: %v", err)
+			}
+			if n, err = exp.WriteTo(vw); err == nil {
+				err = vw.Close()
+			}
+			if err != nil {
+				vw.Abort()
+				log.Fatalf("Export failed: %v", err)
+			}
+			for _, v := range vw.Index().Volumes {
+				fmt.Printf("  %s  %d bytes  sha256:%s\n", v.Name, v.Size, v.SHA256)
+			}
+		} else {
+			out, err := os.Create(exportOutput)
+			if err != nil {
+				log.Fatalf("Export failed: %v", err)
+			}
+			if n, err = exp.WriteTo(out); err == nil {
+				err = out.Close()
+			} else {
+				out.Close()
+			}
+			if err != nil {
+				os.Remove(exportOutput)
+				log.Fatalf("Export failed: %v", err)
+			}
+		}
+		fmt.Printf("Exported %s to %s (%d bytes)\n", args[0], exportOutput, n)
+	},
+}
+
+// newOfflineHandler builds an API handler for commands that work on the data
+// directory directly, without a running server.
+func newOfflineHandler() *api.Handler {
+	key := vaultPassphrase()
+
+	v, err := vault.NewVault(resolveVaultPath(), key)
+	if err != nil {
+		log.Fatalf("Failed to initialize vault: %v", err)
+	}
+	return api.NewHandler(v, api.NewHub())
+}
+
+func init() {
+	archiveCmd.PersistentFlags().StringVar(&serverDataDir, "data-dir", "", "Directory to store data")
+
+	archiveFsckCmd.Flags().BoolVar(&fsckRepair, "repair", false, "Remove orphans and mark damaged archives as failed")
+	archiveFsckCmd.Flags().BoolVar(&fsckJSON, "json", false, "Print the report as JSON")
+
+	archivePullCmd.Flags().StringVar(&pullCred, "cred", "", "Credential name or ID (default: match by registry)")
+	archivePullCmd.Flags().StringSliceVar(&pullPlatforms, "platform", nil, "Platforms to keep, e.g. linux/amd64,linux/arm64")
+
+	archiveExportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "Output tar file")
+	archiveExportCmd.Flags().StringVar(&exportFormat, "format", api.ExportFormatDocker, "Tarball format: docker or oci")
+	archiveExportCmd.Flags().StringVar(&exportPlatform, "platform", "", "Platform to export, e.g. linux/amd64")
+	archiveExportCmd.Flags().StringVar(&exportTag, "tag", "", "Image reference recorded in the tarball (default: archive name:tag)")
+	archiveExportCmd.Flags().StringVar(&exportVolumeSize, "volume-size", "", "Split the output into volumes of this size (e.g. 4GB)")
+
+	archiveCmd.AddCommand(archiveFsckCmd, archivePullCmd, archiveExportCmd)
+	rootCmd.AddCommand(archiveCmd)
+}
@@ -0,0 +1,293 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/guoxudong/horcrux/internal/bundle"
+	"github.com/guoxudong/horcrux/internal/engine"
+	"github.com/guoxudong/horcrux/internal/vault"
+	"github.com/guoxudong/horcrux/internal/volume"
+	"github.com/spf13/cobra"
+)
+
+var (
+	bundleImageList   string
+	bundleOutput      string
+	bundleSrcCred     string
+	bundleDstCred     string
+	bundleRegistryMap []string
+	bundleSkipVerify  bool
+	bundleSince       string
+	bundleVolumeSize  string
+)
+
+var bundleCmd = &cobra.Command{
+	Use:   "bundle",
+	Short: "Create and push offline multi-image bundles",
+	Long: `Bundles carry many images to disconnected sites.
+
+A bundle is a directory, or a single .tar of it, holding one OCI layout shared
+by all images (common layers are stored once), a bundle.json manifest listing
+the original references and digests, and SHA256SUMS checksums.
+
+With --volume-size the .tar is split into numbered volumes (images.tar.001,
+...) described by images.tar.volumes.json; verify and push accept that index
+or the .tar name and report exactly which volumes are missing or corrupt.`,
+}
+
+var bundleCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Pull the images of a list into a new bundle",
+	Run: func(cmd *cobra.Command, args []string) {
+		if bundleImageList == "" || bundleOutput == "" {
+			fmt.Println("Error: image list (-f) and output (-o) are required")
+			cmd.Help()
+			return
+		}
+
+		f, err := os.Open(bundleImageList)
+		if err != nil {
+			log.Fatalf("Failed to open image list: %v", err)
+		}
+		refs, err := bundle.ReadImageList(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Failed to read image list: %v", err)
+		}
+
+		var volumeSize int64
+		if bundleVolumeSize != "" {
+			if volumeSize, err = volume.ParseSize(bundleVolumeSize); err != nil {
+				log.Fatalf("%v", err)
+			}
+		}
+
+		creds := loadCLICredentials()
+		syncer, done := newPrintingSyncer()
+		m, err := bundle.Create(syncer, bundle.CreateOptions{
+			Refs:   refs,
+			Output: bundleOutput,
+			Auth: func(ref string) *vault.Credential {
+				return lookupCredential(creds, bundleSrcCred, ref)
+			},
+			Since:      bundleSince,
+			VolumeSize: volumeSize,
+		})
+		done()
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			os.Exit(1)
+		}
+
+		var size int64
+		for _, b := range m.Blobs {
+			size += b.Size
+		}
+		fmt.Printf("Bundle %s created: %d image(s), %d blob(s), %d bytes\n", bundleOutput, len(m.Images), len(m.Blobs), size)
+		if m.IsDelta() {
+			fmt.Printf("Delta against %s: %d blob(s) left out, the target registry must already hold them\n", m.Base, len(m.External))
+		}
+		if volumeSize > 0 {
+			ix, err := volume.ReadIndex(volume.IndexPath(bundleOutput))
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			for _, v := range ix.Volumes {
+				fmt.Printf("  %s  %d bytes  sha256:%s\n", v.Name, v.Size, v.SHA256)
+			}
+			fmt.Printf("%d volume(s), index %s\n", len(ix.Volumes), volume.IndexPath(bundleOutput))
+		}
+	},
+}
+
+var bundleVerifyCmd = &cobra.Command{
+	Use:   "verify <bundle>",
+	Short: "Check bundle checksums and completeness",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		b := openBundle(args[0])
+		defer b.Close()
+
+		if !verifyBundle(b) {
+			b.Close()
+			os.Exit(1)
+		}
+	},
+}
+
+var bundlePushCmd = &cobra.Command{
+	Use:   "push <bundle>",
+	Short: "Push all images of a bundle to a registry",
+	Long: `Push all images of a bundle.
+
+Target references are derived from the original references with
+--registry-map, for example:
+
+  --registry-map docker.io=registry.local:5000/mirror,ghcr.io=registry.local:5000/ghcr
+  --registry-map '*=registry.local:5000'`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		registryMap, err := bundle.ParseRegistryMap(bundleRegistryMap)
+		if err != nil || len(registryMap) == 0 {
+			fmt.Println("Error: a valid --registry-map is required")
+			cmd.Help()
+			os.Exit(1)
+		}
+
+		b := openBundle(args[0])
+		defer b.Close()
+
+		if !bundleSkipVerify && !verifyBundle(b) {
+			b.Close()
+			os.Exit(1)
+		}
+
+		creds := loadCLICredentials()
+		syncer, done := newPrintingSyncer()
+		results, err := bundle.Push(syncer, b, bundle.PushOptions{
+			RegistryMap: registryMap,
+			Auth: func(target string) *vault.Credential {
+				return lookupCredential(creds, bundleDstCred, target)
+			},
+		})
+		done()
+
+		for _, r := range results {
+			status := "OK"
+			if r.Error != "" {
+				status = "FAILED: " + r.Error
+			}
+			fmt.Printf("%s -> %s %s\n", r.Ref, r.Target, status)
+		}
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			b.Close()
+			os.Exit(1)
+		}
+	},
+}
+
+// openBundle opens a bundle, listing each volume to supply again when a
+// volume set is incomplete.
+func openBundle(path string) *bundle.Bundle {
+	b, err := bundle.Open(path)
+	if err == nil {
+		return b
+	}
+
+	var cerr *volume.CheckError
+	if errors.As(err, &cerr) {
+		for _, v := range cerr.Missing {
+			fmt.Printf("MISSING VOLUME  %s\n", v)
+		}
+		for _, v := range cerr.Corrupt {
+			fmt.Printf("CORRUPT VOLUME  %s\n", v)
+		}
+	}
+	log.Fatalf("Failed to open bundle: %v", err)
+	return nil
+}
+
+func verifyBundle(b *bundle.Bundle) bool {
+	res, err := b.Verify()
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		return false
+	}
+	for _, f := range res.Corrupt {
+		fmt.Printf("CORRUPT  %s\n", f)
+	}
+	for _, f := range res.Missing {
+		fmt.Printf("MISSING  %s\n", f)
+	}
+	for _, f := range res.Unlisted {
+		fmt.Printf("UNLISTED %s\n", f)
+	}
+	if !res.OK() {
+		fmt.Println("Bundle verification failed")
+		return false
+	}
+	fmt.Printf("Bundle OK: %d image(s), %d file(s) verified\n", len(b.Manifest.Images), res.FilesChecked)
+	if b.Manifest.IsDelta() {
+		fmt.Printf("Delta bundle: %d blob(s) must already be in the target registry\n", len(b.Manifest.External))
+	}
+	return true
+}
+
+// newPrintingSyncer returns a syncer whose progress is printed to stdout and
+// a function that stops printing once the syncer is no longer used.
+func newPrintingSyncer() (*engine.Syncer, func()) {
+	progress := make(chan engine.Progress)
+	finished := make(chan struct{})
+	go func() {
+		for p := range progress {
+			fmt.Printf("[%s] %s\n", p.Level, p.Message)
+		}
+		close(finished)
+	}()
+	return engine.NewSyncer(progress), func() {
+		close(progress)
+		<-finished
+	}
+}
+
+func loadCLICredentials() []vault.Credential {
+	key := vaultPassphrase()
+
+	v, err := vault.NewVault(resolveVaultPath(), key)
+	if err != nil {
+		log.Fatalf("Failed to initialize vault: %v", err)
+	}
+	creds, _ := v.LoadCredentials()
+	return creds
+}
+
+// lookupCredential returns the credential named nameOrID, or when that is
+// empty the first credential whose registry matches the one of ref.
+func lookupCredential(creds []vault.Credential, nameOrID, ref string) *vault.Credential {
+	if nameOrID != "" {
+		for i := range creds {
+			if creds[i].Name == nameOrID || creds[i].ID == nameOrID {
+				return &creds[i]
+			}
+		}
+		return nil
+	}
+
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return nil
+	}
+	registry := r.Context().RegistryStr()
+	for i := range creds {
+		credRegistry := strings.TrimPrefix(strings.TrimPrefix(creds[i].Registry, "https://"), "http://")
+		credRegistry = strings.TrimSuffix(credRegistry, "/")
+		if credRegistry == "docker.io" {
+			credRegistry = name.DefaultRegistry
+		}
+		if credRegistry == registry {
+			return &creds[i]
+		}
+	}
+	return nil
+}
+
+func init() {
+	bundleCreateCmd.Flags().StringVarP(&bundleImageList, "file", "f", "", "File listing one image reference per line")
+	bundleCreateCmd.Flags().StringVarP(&bundleOutput, "output", "o", "", "Bundle directory, or a .tar file")
+	bundleCreateCmd.Flags().StringVar(&bundleSince, "since", "", "bundle.json of a previously shipped bundle; only layers it lacks are included")
+	bundleCreateCmd.Flags().StringVar(&bundleVolumeSize, "volume-size", "", "Split a .tar output into volumes of this size (e.g. 4GB, 700MB, 2GiB)")
+	bundleCreateCmd.Flags().StringVar(&bundleSrcCred, "src-cred", "", "Source credential name or ID (default: match by registry)")
+
+	bundlePushCmd.Flags().StringSliceVar(&bundleRegistryMap, "registry-map", nil, "Registry rewrite rules, src=dst")
+	bundlePushCmd.Flags().StringVar(&bundleDstCred, "dst-cred", "", "Target credential name or ID (default: match by registry)")
+	bundlePushCmd.Flags().BoolVar(&bundleSkipVerify, "skip-verify", false, "Push without verifying checksums first")
+
+	bundleCmd.AddCommand(bundleCreateCmd, bundleVerifyCmd, bundlePushCmd)
+	rootCmd.AddCommand(bundleCmd)
+}
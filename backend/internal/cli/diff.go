@@ -0,0 +1,113 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/guoxudong/horcrux/internal/engine"
+	"github.com/spf13/cobra"
+)
+
+var (
+	diffLeftCred  string
+	diffRightCred string
+	diffJSON      bool
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff <left> <right>",
+	Short: "Compare two images, e.g. a source and its mirror",
+	Long: `Compare the manifests, configs, layers and platforms of two images
+without pulling their layers. Both refs may be registry references or
+archive://<id> refs of the local archive library.
+
+Exits with status 1 when the images differ.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		h := newOfflineHandler()
+		creds := loadCLICredentials()
+		leftCred := lookupCredential(creds, diffLeftCred, args[0])
+		rightCred := lookupCredential(creds, diffRightCred, args[1])
+		if leftCred == nil && diffLeftCred != "" {
+			log.Fatalf("Credential not found: %s", diffLeftCred)
+		}
+		if rightCred == nil && diffRightCred != "" {
+			log.Fatalf("Credential not found: %s", diffRightCred)
+		}
+
+		diff, err := h.DiffRefs(args[0], args[1], leftCred, rightCred)
+		if err != nil {
+			log.Fatalf("Diff failed: %v", err)
+		}
+
+		if diffJSON {
+			data, _ := json.MarshalIndent(diff, "", "  ")
+			fmt.Println(string(data))
+		} else {
+			printImageDiff(diff)
+		}
+		if !diff.Identical {
+			os.Exit(1)
+		}
+	},
+}
+
+func printImageDiff(d *engine.ImageDiff) {
+	fmt.Printf("--- %s  %s\n", d.Left, d.LeftDigest)
+	fmt.Printf("+++ %s  %s\n", d.Right, d.RightDigest)
+	if d.Identical {
+		fmt.Println("Identical")
+		return
+	}
+	fmt.Printf("Size: %+d bytes\n", d.SizeDelta)
+	printFieldChanges(d.Manifest, "")
+	if p := d.Platforms; p != nil {
+		for _, platform := range p.OnlyLeft {
+			fmt.Printf("- platform %s\n", platform)
+		}
+		for _, platform := range p.OnlyRight {
+			fmt.Printf("+ platform %s\n", platform)
+		}
+	}
+	for _, img := range d.Images {
+		platform := img.Platform
+		if platform == "" {
+			platform = "image"
+		}
+		if img.Identical {
+			fmt.Printf("\n%s: identical (%s)\n", platform, img.LeftDigest)
+			continue
+		}
+		fmt.Printf("\n%s: %s -> %s (%+d bytes)\n", platform, img.LeftDigest, img.RightDigest, img.SizeDelta)
+		printFieldChanges(img.Changes, "  ")
+		fmt.Printf("  layers: %d shared, %d only left, %d only right\n", img.SharedLayers, len(img.OnlyLeftLayers), len(img.OnlyRightLayers))
+		for _, l := range img.OnlyLeftLayers {
+			fmt.Printf("  - %s  %d\n", l.Digest, l.Size)
+		}
+		for _, l := range img.OnlyRightLayers {
+			fmt.Printf("  + %s  %d\n", l.Digest, l.Size)
+		}
+	}
+}
+
+func printFieldChanges(changes []engine.FieldChange, indent string) {
+	for _, c := range changes {
+		if c.Left != "" {
+			fmt.Printf("%s- %s: %s\n", indent, c.Field, c.Left)
+		}
+		if c.Right != "" {
+			fmt.Printf("%s+ %s: %s\n", indent, c.Field, c.Right)
+		}
+	}
+}
+
+func init() {
+	diffCmd.Flags().StringVar(&serverDataDir, "data-dir", "", "Directory to store data")
+	diffCmd.Flags().StringVar(&diffLeftCred, "left-cred", "", "Credential name or ID for <left> (default: match by registry)")
+	diffCmd.Flags().StringVar(&diffRightCred, "right-cred", "", "Credential name or ID for <right> (default: match by registry)")
+	diffCmd.Flags().BoolVar(&diffJSON, "json", false, "Print the diff as JSON")
+
+	rootCmd.AddCommand(diffCmd)
+}
@@ -0,0 +1,120 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/guoxudong/horcrux/internal/engine"
+	"github.com/spf13/cobra"
+)
+
+var (
+	inspectCred string
+	inspectJSON bool
+)
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect <ref>",
+	Short: "Show the manifest, config and layers of an image",
+	Long: `Show the manifest, config, layers and history of an image without
+pulling its layers. <ref> is a registry reference or an archive://<id> ref
+of the local archive library, so both ends of a sync can be checked first.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		h := newOfflineHandler()
+		cred := lookupCredential(loadCLICredentials(), inspectCred, args[0])
+		if cred == nil && inspectCred != "" {
+			log.Fatalf("Credential not found: %s", inspectCred)
+		}
+
+		inspection, err := h.InspectRef(args[0], cred)
+		if err != nil {
+			log.Fatalf("Inspect failed: %v", err)
+		}
+
+		if inspectJSON {
+			data, _ := json.MarshalIndent(inspection, "", "  ")
+			fmt.Println(string(data))
+			return
+		}
+		fmt.Printf("Ref:        %s\n", inspection.Ref)
+		fmt.Printf("Media type: %s\n", inspection.MediaType)
+		fmt.Printf("Digest:     %s\n", inspection.Digest)
+		fmt.Printf("Size:       %d bytes\n", inspection.Size)
+		if inspection.Image != nil {
+			printImageInspection(inspection.Image, "")
+			return
+		}
+		for _, p := range inspection.Platforms {
+			platform := p.Platform
+			if platform == "" {
+				platform = "-"
+			}
+			fmt.Printf("\n%s  %s  %s\n", platform, p.Digest, p.MediaType)
+			if p.Image != nil {
+				printImageInspection(p.Image, "  ")
+			}
+		}
+	},
+}
+
+func printImageInspection(img *engine.ImageInspection, indent string) {
+	cfg := img.Config
+	if !cfg.Created.IsZero() {
+		fmt.Printf("%sCreated:    %s\n", indent, cfg.Created.Format("2006-01-02 15:04:05 MST"))
+	}
+	if img.Platform != "" {
+		fmt.Printf("%sPlatform:   %s\n", indent, img.Platform)
+	}
+	if len(cfg.Entrypoint) > 0 {
+		fmt.Printf("%sEntrypoint: %s\n", indent, strings.Join(cfg.Entrypoint, " "))
+	}
+	if len(cfg.Cmd) > 0 {
+		fmt.Printf("%sCmd:        %s\n", indent, strings.Join(cfg.Cmd, " "))
+	}
+	if cfg.WorkingDir != "" {
+		fmt.Printf("%sWorkdir:    %s\n", indent, cfg.WorkingDir)
+	}
+	if cfg.User != "" {
+		fmt.Printf("%sUser:       %s\n", indent, cfg.User)
+	}
+	if len(cfg.ExposedPorts) > 0 {
+		fmt.Printf("%sPorts:      %s\n", indent, strings.Join(cfg.ExposedPorts, ", "))
+	}
+	for _, env := range cfg.Env {
+		fmt.Printf("%sEnv:        %s\n", indent, env)
+	}
+	keys := make([]string, 0, len(cfg.Labels))
+	for k := range cfg.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("%sLabel:      %s=%s\n", indent, k, cfg.Labels[k])
+	}
+	fmt.Printf("%sLayers:     %d (%d bytes)\n", indent, len(img.Layers), img.Size)
+	for _, l := range img.Layers {
+		fmt.Printf("%s  %s  %10d  %s\n", indent, l.Digest, l.Size, l.MediaType)
+	}
+	if len(img.History) > 0 {
+		fmt.Printf("%sHistory:\n", indent)
+		for _, hist := range img.History {
+			step := hist.CreatedBy
+			if hist.EmptyLayer {
+				step += " (empty)"
+			}
+			fmt.Printf("%s  %s\n", indent, step)
+		}
+	}
+}
+
+func init() {
+	inspectCmd.Flags().StringVar(&serverDataDir, "data-dir", "", "Directory to store data")
+	inspectCmd.Flags().StringVar(&inspectCred, "cred", "", "Credential name or ID (default: match by registry)")
+	inspectCmd.Flags().BoolVar(&inspectJSON, "json", false, "Print the inspection as JSON")
+
+	rootCmd.AddCommand(inspectCmd)
+}
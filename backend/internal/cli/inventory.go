@@ -0,0 +1,87 @@
+package cli
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/guoxudong/horcrux/internal/api"
+	"github.com/guoxudong/horcrux/internal/inventory"
+	"github.com/spf13/cobra"
+)
+
+var (
+	inventoryCred     string
+	inventoryPlatform string
+	inventoryFormat   string
+	inventoryAttach   bool
+	inventoryOutput   string
+)
+
+var inventoryCmd = &cobra.Command{
+	Use:   "inventory <ref>",
+	Short: "List the packages of an image as a CycloneDX or SPDX document",
+	Long: `List what an image contains without running it: the distribution from
+/etc/os-release, the packages of the dpkg, apk and rpm (ndb) databases and
+the dependencies of language lockfiles (package-lock.json, yarn.lock, go.mod,
+Cargo.lock, poetry.lock, requirements.txt, Pipfile.lock, composer.lock,
+Gemfile.lock). <ref> is a registry reference or an archive://<id> ref.
+
+Each platform of a multi-arch image gets its own document; with --output
+they are written to one file per platform. --attach pushes each document
+to the registry as an OCI referrer of its image.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		h := newOfflineHandler()
+		cred := lookupCredential(loadCLICredentials(), inventoryCred, args[0])
+		if cred == nil && inventoryCred != "" {
+			log.Fatalf("Credential not found: %s", inventoryCred)
+		}
+
+		results, err := h.RunInventory(api.InventoryRequest{
+			Ref:      args[0],
+			Platform: inventoryPlatform,
+			Format:   inventoryFormat,
+			Attach:   inventoryAttach,
+		}, cred)
+		if err != nil {
+			log.Fatalf("Inventory failed: %v", err)
+		}
+
+		for _, r := range results {
+			if inventoryOutput == "" {
+				fmt.Println(string(r.Document))
+				continue
+			}
+			out := inventoryOutput
+			if len(results) > 1 {
+				ext := filepath.Ext(out)
+				out = strings.TrimSuffix(out, ext) + "-" + strings.ReplaceAll(r.Platform, "/", "-") + ext
+			}
+			if err := os.WriteFile(out, r.Document, 0644); err != nil {
+				log.Fatalf("Failed to write %s: %v", out, err)
+			}
+			line := fmt.Sprintf("%-16s %s  %d package(s) -> %s", r.Platform, r.Digest, len(r.Inventory.Packages), out)
+			if r.Referrer != "" {
+				line += ", attached as " + r.Referrer
+			}
+			fmt.Println(line)
+			for _, note := range r.Inventory.Notes {
+				fmt.Printf("  NOTE: %s\n", note)
+			}
+		}
+	},
+}
+
+func init() {
+	inventoryCmd.Flags().StringVar(&serverDataDir, "data-dir", "", "Directory to store data")
+	inventoryCmd.Flags().StringVar(&inventoryCred, "cred", "", "Credential name or ID (default: match by registry)")
+	inventoryCmd.Flags().StringVar(&inventoryPlatform, "platform", "", "Platform to analyze, e.g. linux/amd64 (default: all)")
+	inventoryCmd.Flags().StringVar(&inventoryFormat, "format", inventory.FormatCycloneDX, "Document format: cyclonedx or spdx")
+	inventoryCmd.Flags().BoolVar(&inventoryAttach, "attach", false, "Push each document to the registry as an OCI referrer of its image")
+	inventoryCmd.Flags().StringVarP(&inventoryOutput, "output", "o", "", "Write the document to a file instead of stdout")
+
+	rootCmd.AddCommand(inventoryCmd)
+}
@@ -4,14 +4,20 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/guoxudong/horcrux/internal/credhelper"
 	"github.com/spf13/cobra"
 )
 
+var credentialProviderDir string
+
 var rootCmd = &cobra.Command{
 	Use:   "horcrux",
 	Short: "Horcrux is a container image multi-source synchronization tool",
 	Long: `A robust tool for synchronizing container images across different registries,
 supporting multi-arch manifest merging and secure credential management.`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		credhelper.SetKubeletPluginDir(resolveCredentialProviderDir())
+	},
 }
 
 func Execute() {
@@ -22,5 +28,15 @@ func Execute() {
 }
 
 func init() {
-	// Root flags if needed
+	rootCmd.PersistentFlags().StringVar(&credentialProviderDir, "credential-provider-dir", "", "Directory of kubelet credential provider plugins (or HORCRUX_CREDENTIAL_PROVIDER_DIR)")
+}
+
+// resolveCredentialProviderDir returns the directory kubelet credential
+// providers are run from, from --credential-provider-dir or
+// HORCRUX_CREDENTIAL_PROVIDER_DIR. Empty disables kubelet providers.
+func resolveCredentialProviderDir() string {
+	if credentialProviderDir != "" {
+		return credentialProviderDir
+	}
+	return os.Getenv("HORCRUX_CREDENTIAL_PROVIDER_DIR")
 }
@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"encoding/json"
 	"log"
 	"net/http"
 	"net/http/httputil"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/gin-contrib/static"
 	"github.com/gin-gonic/gin"
@@ -17,8 +19,9 @@ import (
 )
 
 var (
-	serverPort    string
-	serverDataDir string
+	serverPort        string
+	serverDataDir     string
+	serverImportPaths []string
 )
 
 var serveCmd = &cobra.Command{
@@ -32,13 +35,15 @@ var serveCmd = &cobra.Command{
 func init() {
 	serveCmd.Flags().StringVar(&serverPort, "port", "", "Port to run the server on")
 	serveCmd.Flags().StringVar(&serverDataDir, "data-dir", "", "Directory to store data")
+	serveCmd.Flags().StringSliceVar(&serverImportPaths, "archive-import-path", nil, "Server directory archives may be imported from by path (repeatable, or HORCRUX_ARCHIVE_IMPORT_PATHS)")
 	rootCmd.AddCommand(serveCmd)
 }
 
 func startServer() {
-	key := os.Getenv("HORCRUX_SECRET")
-	if key == "" {
-		key = "12345678901234567890123456789012"
+	key := vaultPassphrase()
+	if key == vault.DefaultPassphrase && os.Getenv("HORCRUX_ALLOW_DEFAULT_SECRET") != "1" {
+		log.Fatalf("HORCRUX_SECRET is not set: refusing to serve a vault encrypted with the built-in passphrase. " +
+			"Set HORCRUX_SECRET to a passphrase, or HORCRUX_ALLOW_DEFAULT_SECRET=1 to accept the default")
 	}
 
 	vaultPath := resolveVaultPath()
@@ -51,6 +56,12 @@ func startServer() {
 	go hub.Run()
 
 	h := api.NewHandler(v, hub)
+	h.SetArchiveImportPaths(resolveArchiveImportPaths())
+	if n, err := h.MigrateLegacyArchives(); err != nil {
+		log.Printf("Failed to migrate legacy archives: %v", err)
+	} else if n > 0 {
+		log.Printf("Migrated %d legacy archive(s) into the shared store", n)
+	}
 
 	r := gin.New()
 	r.Use(gin.Logger())
@@ -87,8 +98,9 @@ func startServer() {
 
 	r.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, HEAD, OPTIONS, PUT, PATCH, DELETE")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Content-Range, Upload-Offset, Accept-Encoding, X-CSRF-Token, Authorization, If-Match")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "Upload-Offset, Upload-Length, Location, ETag")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
 			return
@@ -106,9 +118,11 @@ func startServer() {
 		{
 			vaultGroup.GET("/credentials", h.ListCredentials)
 			vaultGroup.POST("/credentials", h.AddCredential)
+			vaultGroup.POST("/credentials/import", h.ImportDockerConfig)
 			vaultGroup.PUT("/credentials/:id", h.UpdateCredential)
 			vaultGroup.DELETE("/credentials/:id", h.DeleteCredential)
 			vaultGroup.POST("/credentials/:id/verify", h.VerifyCredential)
+			vaultGroup.POST("/rotate-key", h.RotateVaultKey)
 		}
 
 		tasksGroup := apiGroup.Group("/tasks")
@@ -137,18 +151,45 @@ func startServer() {
 		{
 			registryGroup.GET("/repositories", h.ListRegistryRepositories)
 			registryGroup.GET("/tags", h.ListRegistryTags)
+			registryGroup.GET("/inspect", h.InspectImage)
+		}
+
+		imagesGroup := apiGroup.Group("/images")
+		{
+			imagesGroup.GET("/diff", h.DiffImages)
+			imagesGroup.POST("/inventory", h.ImageInventory)
 		}
 
 		archivesGroup := apiGroup.Group("/archives")
 		{
 			archivesGroup.GET("", h.ListArchives)
 			archivesGroup.POST("/upload", h.UploadArchive)
+			archivesGroup.POST("/pull", h.PullArchive)
 			archivesGroup.POST("/merge", h.MergeArchives)
+			archivesGroup.POST("/gc", h.GarbageCollectArchives)
+			archivesGroup.POST("/fsck", h.CheckArchives)
 			archivesGroup.DELETE("/:id", h.DeleteArchive)
+			archivesGroup.GET("/:id/export", h.ExportArchive)
+
+			// Resumable chunked uploads
+			archivesGroup.POST("/uploads", h.CreateUpload)
+			archivesGroup.GET("/uploads/:id", h.GetUpload)
+			archivesGroup.HEAD("/uploads/:id", h.GetUpload)
+			archivesGroup.PUT("/uploads/:id", h.PutUploadChunk)
+			archivesGroup.PATCH("/uploads/:id", h.PutUploadChunk)
+			archivesGroup.POST("/uploads/:id/complete", h.CompleteUpload)
+			archivesGroup.DELETE("/uploads/:id", h.DeleteUpload)
+
+			// Background ingestion jobs
+			archivesGroup.GET("/jobs", h.ListArchiveJobs)
+			archivesGroup.GET("/jobs/:id", h.GetArchiveJob)
 		}
 	}
 
 	port := resolvePort()
+	if err := writeServerInfo(v.StorageDir(), port); err != nil {
+		log.Printf("Failed to record server info: %v", err)
+	}
 
 	log.Printf("Horcrux backend starting on :%s", port)
 	if err := r.Run(":" + port); err != nil {
@@ -156,6 +197,44 @@ func startServer() {
 	}
 }
 
+// serverInfoFile records the port of the server using a data directory, so
+// offline vault commands can tell whether it is running.
+const serverInfoFile = "server.json"
+
+type serverInfo struct {
+	PID  int    `json:"pid"`
+	Port string `json:"port"`
+}
+
+func writeServerInfo(dataDir, port string) error {
+	data, err := json.Marshal(serverInfo{PID: os.Getpid(), Port: port})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dataDir, serverInfoFile), data, 0644)
+}
+
+// runningServer returns the address of a server using dataDir that answers
+// its health check. Info left behind by a stopped server is ignored.
+func runningServer(dataDir string) (string, bool) {
+	data, err := os.ReadFile(filepath.Join(dataDir, serverInfoFile))
+	if err != nil {
+		return "", false
+	}
+	var info serverInfo
+	if err := json.Unmarshal(data, &info); err != nil || info.Port == "" {
+		return "", false
+	}
+	addr := "http://127.0.0.1:" + info.Port
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(addr + "/api/health")
+	if err != nil {
+		return "", false
+	}
+	resp.Body.Close()
+	return addr, resp.StatusCode == http.StatusOK
+}
+
 func resolvePort() string {
 	if serverPort != "" {
 		return serverPort
@@ -192,6 +271,19 @@ func createViteProxy() *httputil.ReverseProxy {
 	return proxy
 }
 
+// resolveArchiveImportPaths returns the directories archives may be imported
+// from by server path, from --archive-import-path or
+// HORCRUX_ARCHIVE_IMPORT_PATHS (a list separated like PATH).
+func resolveArchiveImportPaths() []string {
+	if len(serverImportPaths) > 0 {
+		return serverImportPaths
+	}
+	if env := os.Getenv("HORCRUX_ARCHIVE_IMPORT_PATHS"); env != "" {
+		return filepath.SplitList(env)
+	}
+	return nil
+}
+
 func resolveVaultPath() string {
 	if serverDataDir != "" {
 		// Ensure directory exists
@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/guoxudong/horcrux/internal/engine"
+	"github.com/spf13/cobra"
+)
+
+var (
+	splitTo       string
+	splitTemplate string
+	splitSrcCred  string
+	splitDstCred  string
+)
+
+var splitCmd = &cobra.Command{
+	Use:   "split <ref>",
+	Short: "Push each platform of a multi-arch image as its own tag",
+	Long: `Push each platform image of a manifest list as its own tag, for runtimes
+and scanners that cannot handle indexes. This is the reverse of merging
+several sources with sync.
+
+Tags are named by --template; placeholders are {tag}, {os}, {arch},
+{variant} and {platform} (os-arch[-variant]). {tag} is the tag of --to, or
+else the source tag:
+
+  horcrux split registry.local/team/app:1.0
+      -> app:1.0-amd64, app:1.0-arm64
+  horcrux split docker.io/library/alpine:3.20 --to registry.local/legacy/alpine --template '{tag}-{arch}{variant}'
+      -> alpine:3.20-amd64, alpine:3.20-armv7, alpine:3.20-arm64v8, ...`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		creds := loadCLICredentials()
+		target := splitTo
+		if target == "" {
+			target = args[0]
+		}
+
+		syncer, done := newPrintingSyncer()
+		results, err := syncer.SplitManifestList(engine.SyncOptions{
+			SourceRef:  args[0],
+			TargetRef:  splitTo,
+			SourceAuth: lookupCredential(creds, splitSrcCred, args[0]),
+			TargetAuth: lookupCredential(creds, splitDstCred, target),
+		}, splitTemplate)
+		done()
+
+		for _, r := range results {
+			fmt.Printf("%-16s %s -> %s\n", r.Platform, r.Digest, r.Ref)
+		}
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	splitCmd.Flags().StringVarP(&splitTo, "to", "t", "", "Target repository, optionally with the tag used for {tag} (default: source repository)")
+	splitCmd.Flags().StringVar(&splitTemplate, "template", engine.DefaultSplitTemplate, "Tag naming template")
+	splitCmd.Flags().StringVar(&splitSrcCred, "src-cred", "", "Source credential name or ID (default: matched by registry)")
+	splitCmd.Flags().StringVar(&splitDstCred, "dst-cred", "", "Target credential name or ID (default: matched by registry)")
+
+	rootCmd.AddCommand(splitCmd)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/guoxudong/horcrux/internal/engine"
 	"github.com/guoxudong/horcrux/internal/vault"
@@ -15,6 +16,13 @@ var (
 	dstRef   string
 	srcCreds []string
 	dstCred  string
+
+	syncAnnotations []string
+	syncFlatten     bool
+
+	syncPlatformPolicy string
+
+	syncExpectDigest string
 )
 
 var syncCmd = &cobra.Command{
@@ -27,10 +35,7 @@ var syncCmd = &cobra.Command{
 			return
 		}
 
-		key := os.Getenv("HORCRUX_SECRET")
-		if key == "" {
-			key = "12345678901234567890123456789012"
-		}
+		key := vaultPassphrase()
 
 		v, err := vault.NewVault("data/vault.enc", key)
 		if err != nil {
@@ -49,11 +54,16 @@ var syncCmd = &cobra.Command{
 			credMap[c.ID] = c
 		}
 
+		if syncExpectDigest != "" && len(srcRefs) > 1 {
+			log.Fatalf("--expect-digest applies to a single source; pin merge sources with repo@sha256: references")
+		}
+
 		var dstAuth *vault.Credential
 		if c, ok := credMap[dstCred]; ok {
 			dstAuth = &c
 		}
 
+		var digest string
 		progress := make(chan engine.Progress)
 		syncer := engine.NewSyncer(progress)
 
@@ -66,20 +76,38 @@ var syncCmd = &cobra.Command{
 		if len(srcRefs) > 1 {
 			// Multi-source merge
 			fmt.Printf("Merging %d sources into %s...\n", len(srcRefs), dstRef)
-			var srcAuths []*vault.Credential
-			for _, sc := range srcCreds {
-				if c, ok := credMap[sc]; ok {
-					srcAuths = append(srcAuths, &c)
-				} else {
-					srcAuths = append(srcAuths, nil)
-				}
+			annotations, parseErr := parseAnnotations(syncAnnotations)
+			if parseErr != nil {
+				log.Fatalf("%v", parseErr)
+			}
+			opts := engine.MergeOptions{
+				TargetRef:      dstRef,
+				TargetAuth:     dstAuth,
+				Annotations:    annotations,
+				Flatten:        syncFlatten,
+				PlatformPolicy: syncPlatformPolicy,
 			}
-			// Pad srcAuths if needed
-			for len(srcAuths) < len(srcRefs) {
-				srcAuths = append(srcAuths, nil)
+			for i, ref := range srcRefs {
+				src := engine.MergeSource{Ref: ref}
+				if i < len(srcCreds) {
+					if c, ok := credMap[srcCreds[i]]; ok {
+						src.Auth = &c
+					}
+				}
+				opts.Sources = append(opts.Sources, src)
 			}
 
-			err = syncer.MergeManifests(srcRefs, dstRef, srcAuths, dstAuth)
+			var report *engine.MergeReport
+			report, err = syncer.MergeManifests(opts)
+			if report != nil {
+				digest = report.Digest
+				for _, p := range report.Platforms {
+					fmt.Printf("%-24s %s (%s)\n", p.Platform, p.Source, p.Digest)
+				}
+				for _, p := range report.Dropped {
+					fmt.Printf("%-24s %s (%s) DROPPED\n", p.Platform, p.Source, p.Digest)
+				}
+			}
 		} else {
 			// Single source sync
 			var srcAuth *vault.Credential
@@ -90,12 +118,13 @@ var syncCmd = &cobra.Command{
 			}
 
 			opts := engine.SyncOptions{
-				SourceRef:  srcRefs[0],
-				TargetRef:  dstRef,
-				SourceAuth: srcAuth,
-				TargetAuth: dstAuth,
+				SourceRef:      srcRefs[0],
+				TargetRef:      dstRef,
+				SourceAuth:     srcAuth,
+				TargetAuth:     dstAuth,
+				ExpectedDigest: syncExpectDigest,
 			}
-			err = syncer.SyncManifestList(opts)
+			digest, err = syncer.SyncManifestList(opts)
 		}
 
 		close(progress)
@@ -103,15 +132,38 @@ var syncCmd = &cobra.Command{
 			fmt.Printf("ERROR: %v\n", err)
 			os.Exit(1)
 		}
+		if digest != "" {
+			fmt.Printf("Synced %s\n", digest)
+		}
 		fmt.Println("Operation completed successfully!")
 	},
 }
 
+// parseAnnotations parses key=value pairs.
+func parseAnnotations(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	out := make(map[string]string, len(pairs))
+	for _, p := range pairs {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("invalid annotation %q, expected key=value", p)
+		}
+		out[strings.TrimSpace(k)] = v
+	}
+	return out, nil
+}
+
 func init() {
 	syncCmd.Flags().StringSliceVarP(&srcRefs, "from", "f", []string{}, "Source image references (can be multiple for merging)")
 	syncCmd.Flags().StringVarP(&dstRef, "to", "t", "", "Target image reference")
 	syncCmd.Flags().StringSliceVar(&srcCreds, "src-cred", []string{}, "Source credential names or IDs (comma separated)")
 	syncCmd.Flags().StringVar(&dstCred, "dst-cred", "", "Target credential name or ID")
+	syncCmd.Flags().StringSliceVar(&syncAnnotations, "annotation", []string{}, "Annotation key=value set on the merged index (can be repeated)")
+	syncCmd.Flags().StringVar(&syncPlatformPolicy, "platform-policy", engine.PlatformPolicyError, "When several sources provide a platform: error, first or newest")
+	syncCmd.Flags().StringVar(&syncExpectDigest, "expect-digest", "", "Refuse to push unless the source resolves to this digest")
+	syncCmd.Flags().BoolVar(&syncFlatten, "flatten", true, "Merge the platform images of multi-arch sources; --flatten=false nests their indexes instead")
 
 	rootCmd.AddCommand(syncCmd)
 }
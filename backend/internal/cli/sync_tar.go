@@ -18,7 +18,13 @@ var (
 
 var syncTarCmd = &cobra.Command{
 	Use:   "sync-tar",
-	Short: "Push a local Docker tarball to a remote registry",
+	Short: "Push a local image archive to a remote registry",
+	Long: `Push a local image archive to a remote registry.
+
+Docker tarballs (docker save), OCI archives (skopeo/buildah oci-archive) and
+their gzip or zstd compressed variants are accepted. Archives containing
+several platforms are pushed as a multi-arch manifest list. An archive split
+into volumes is read through its .volumes.json index or first volume.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if tarPath == "" || tarDst == "" {
 			fmt.Println("Error: tarball path and destination reference are required")
@@ -26,10 +32,7 @@ var syncTarCmd = &cobra.Command{
 			return
 		}
 
-		key := os.Getenv("HORCRUX_SECRET")
-		if key == "" {
-			key = "12345678901234567890123456789012"
-		}
+		key := vaultPassphrase()
 
 		v, err := vault.NewVault("data/vault.enc", key)
 		if err != nil {
@@ -67,7 +70,7 @@ var syncTarCmd = &cobra.Command{
 }
 
 func init() {
-	syncTarCmd.Flags().StringVarP(&tarPath, "file", "p", "", "Path to the Docker tarball")
+	syncTarCmd.Flags().StringVarP(&tarPath, "file", "p", "", "Path to the image archive (.tar, .tar.gz, .tar.zst or a .volumes.json index)")
 	syncTarCmd.Flags().StringVarP(&tarDst, "to", "t", "", "Target image reference")
 	syncTarCmd.Flags().StringVar(&tarCred, "dst-cred", "", "Target credential name or ID")
 
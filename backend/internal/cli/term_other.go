@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package cli
+
+import "errors"
+
+// isTerminal reports whether fd is a terminal. Prompts are not supported
+// on this platform, so secrets must come from stdin.
+func isTerminal(fd int) bool {
+	return false
+}
+
+func readPassword(fd int) ([]byte, error) {
+	return nil, errors.New("password prompts are not supported on this platform")
+}
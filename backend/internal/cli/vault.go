@@ -1,10 +1,18 @@
 package cli
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/guoxudong/horcrux/internal/credhelper"
+	"github.com/guoxudong/horcrux/internal/engine"
 	"github.com/guoxudong/horcrux/internal/vault"
 	"github.com/spf13/cobra"
 )
@@ -14,6 +22,21 @@ var (
 	credRegistry string
 	credUser     string
 	credPass     string
+	credAuthType string
+	credToken    string
+
+	credPasswordStdin  bool
+	credPromptPassword bool
+	vaultOutput        string
+
+	credHelper         string
+	credHelperProtocol string
+	credHelperArgs     []string
+
+	dockerConfigPath  string
+	importLinkHelpers bool
+	vaultExportOutput string
+	newSecretFile     string
 )
 
 var vaultCmd = &cobra.Command{
@@ -24,36 +47,47 @@ var vaultCmd = &cobra.Command{
 var vaultAddCmd = &cobra.Command{
 	Use:   "add",
 	Short: "Add a new credential",
+	Long: "Add a new credential. Its password, or the token of bearer and identity_token\n" +
+		"credentials, is read from stdin with --password-stdin or prompted for on a terminal.",
 	Run: func(cmd *cobra.Command, args []string) {
-		if credName == "" || credRegistry == "" || credUser == "" || credPass == "" {
-			fmt.Println("Error: all flags are required (name, registry, user, pass)")
+		checkVaultOutput()
+		if credName == "" || credRegistry == "" {
+			fmt.Println("Error: name and registry are required")
 			return
 		}
 
-		key := os.Getenv("HORCRUX_SECRET")
-		if key == "" {
-			key = "12345678901234567890123456789012"
-		}
-
-		v, err := vault.NewVault("data/vault.enc", key)
-		if err != nil {
-			log.Fatalf("Failed to initialize vault: %v", err)
-		}
+		v := openCLIVault()
 
-		creds, _ := v.LoadCredentials()
 		newCred := vault.Credential{
-			ID:       fmt.Sprintf("cred_%d", len(creds)+1),
 			Name:     credName,
 			Registry: credRegistry,
 			Username: credUser,
 			Password: credPass,
+			AuthType: credAuthType,
+			Token:    credToken,
+
+			Helper:         credHelper,
+			HelperProtocol: credHelperProtocol,
+			HelperArgs:     credHelperArgs,
+		}
+		prompt := !cmd.Flags().Changed("pass") && !cmd.Flags().Changed("token")
+		if err := readCredentialSecret(&newCred, prompt); err != nil {
+			log.Fatalf("%v", err)
+		}
+		if err := newCred.Validate(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
 		}
 
-		creds = append(creds, newCred)
-		if err := v.SaveCredentials(creds); err != nil {
+		newCred, err := v.AddCredential(newCred)
+		if err != nil {
 			log.Fatalf("Failed to save credentials: %v", err)
 		}
 
+		if vaultOutput == "json" {
+			printVaultJSON(map[string]string{"status": "created", "id": newCred.ID})
+			return
+		}
 		fmt.Printf("Successfully added credential: %s (%s)\n", credName, credRegistry)
 	},
 }
@@ -62,36 +96,476 @@ var vaultListCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List all credentials",
 	Run: func(cmd *cobra.Command, args []string) {
-		key := os.Getenv("HORCRUX_SECRET")
-		if key == "" {
-			key = "12345678901234567890123456789012"
+		checkVaultOutput()
+		v := openCLIVault()
+
+		creds, err := v.LoadCredentials()
+		if err != nil {
+			log.Fatalf("Failed to load credentials: %v", err)
 		}
 
-		v, err := vault.NewVault("data/vault.enc", key)
+		if vaultOutput == "json" {
+			redacted := make([]vault.Credential, len(creds))
+			for i := range creds {
+				redacted[i] = creds[i].Redacted()
+			}
+			printVaultJSON(redacted)
+			return
+		}
+		fmt.Printf("%-32s %-20s %-30s %-20s %-16s\n", "ID", "NAME", "REGISTRY", "USERNAME", "AUTH")
+		fmt.Println("-----------------------------------------------------------------------------------------------------------------------")
+		for _, c := range creds {
+			fmt.Printf("%-32s %-20s %-30s %-20s %-16s\n", c.ID, c.Name, c.Registry, c.Username, c.AuthKind())
+		}
+	},
+}
+
+var vaultShowCmd = &cobra.Command{
+	Use:   "show <name|id>",
+	Short: "Show a credential without its secrets",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		checkVaultOutput()
+		_, creds, _ := loadVaultCredentials()
+		i, err := findCLICredential(creds, args[0])
 		if err != nil {
-			log.Fatalf("Failed to initialize vault: %v", err)
+			log.Fatalf("%v", err)
 		}
+		c := creds[i]
 
-		creds, err := v.LoadCredentials()
+		if vaultOutput == "json" {
+			printVaultJSON(c.Redacted())
+			return
+		}
+		mask := func(secret string) string {
+			if secret == "" {
+				return ""
+			}
+			return vault.MaskedSecret
+		}
+		fmt.Printf("ID:        %s\n", c.ID)
+		fmt.Printf("Name:      %s\n", c.Name)
+		fmt.Printf("Registry:  %s\n", c.Registry)
+		fmt.Printf("Auth:      %s\n", c.AuthKind())
+		switch c.AuthKind() {
+		case vault.AuthBasic:
+			fmt.Printf("Username:  %s\n", c.Username)
+			fmt.Printf("Password:  %s\n", mask(c.Password))
+		case vault.AuthBearer:
+			fmt.Printf("Token:     %s\n", mask(c.Token))
+		case vault.AuthIdentityToken:
+			fmt.Printf("Username:  %s\n", c.Username)
+			fmt.Printf("Token:     %s\n", mask(c.Token))
+		case vault.AuthHelper:
+			protocol, _ := credhelper.ParseProtocol(c.HelperProtocol)
+			fmt.Printf("Helper:    %s\n", c.Helper)
+			fmt.Printf("Protocol:  %s\n", protocol)
+			if len(c.HelperArgs) > 0 {
+				fmt.Printf("Args:      %s\n", strings.Join(c.HelperArgs, " "))
+			}
+		}
+	},
+}
+
+var vaultUpdateCmd = &cobra.Command{
+	Use:   "update <name|id>",
+	Short: "Update a credential",
+	Long: "Update the fields of a credential given as flags. The password or token is kept\n" +
+		"unless a new one is read with --password-stdin or --prompt-password.",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		checkVaultOutput()
+		v, creds, rev := loadVaultCredentials()
+		i, err := findCLICredential(creds, args[0])
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+
+		c := creds[i]
+		flags := cmd.Flags()
+		if flags.Changed("name") {
+			c.Name = credName
+		}
+		if flags.Changed("registry") {
+			c.Registry = credRegistry
+		}
+		if flags.Changed("user") {
+			c.Username = credUser
+		}
+		if flags.Changed("pass") {
+			c.Password = credPass
+		}
+		if flags.Changed("auth-type") {
+			c.AuthType = credAuthType
+		}
+		if flags.Changed("token") {
+			c.Token = credToken
+		}
+		if flags.Changed("helper") {
+			c.Helper = credHelper
+		}
+		if flags.Changed("helper-protocol") {
+			c.HelperProtocol = credHelperProtocol
+		}
+		if flags.Changed("helper-arg") {
+			c.HelperArgs = credHelperArgs
+		}
+		// Switching to a token auth type needs a token
+		needsToken := (c.AuthKind() == vault.AuthBearer || c.AuthKind() == vault.AuthIdentityToken) && c.Token == ""
+		if err := readCredentialSecret(&c, credPromptPassword || needsToken); err != nil {
+			log.Fatalf("%v", err)
+		}
+		if err := c.Validate(); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		// Fails if the credentials changed since they were loaded, e.g.
+		// while prompting
+		_, err = v.UpdateCredential(c.ID, rev, func(stored *vault.Credential) error {
+			*stored = c
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("Failed to save credentials: %v", err)
+		}
+		if vaultOutput == "json" {
+			printVaultJSON(map[string]string{"status": "updated", "id": c.ID})
+			return
+		}
+		fmt.Printf("Updated credential: %s (%s)\n", c.Name, c.ID)
+	},
+}
+
+var vaultDeleteCmd = &cobra.Command{
+	Use:   "delete <name|id>",
+	Short: "Delete a credential",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		checkVaultOutput()
+		v, creds, rev := loadVaultCredentials()
+		i, err := findCLICredential(creds, args[0])
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+
+		deleted, err := v.DeleteCredential(creds[i].ID, rev)
+		if err != nil {
+			log.Fatalf("Failed to save credentials: %v", err)
+		}
+		if vaultOutput == "json" {
+			printVaultJSON(map[string]string{"status": "deleted", "id": deleted.ID})
+			return
+		}
+		fmt.Printf("Deleted credential: %s (%s)\n", deleted.Name, deleted.ID)
+	},
+}
+
+var vaultVerifyCmd = &cobra.Command{
+	Use:   "verify <name|id>",
+	Short: "Check that a credential can log in to its registry",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		checkVaultOutput()
+		_, creds, _ := loadVaultCredentials()
+		i, err := findCLICredential(creds, args[0])
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+
+		target := creds[i]
+		err = engine.NewSyncer(nil).VerifyAuth(target.Registry, &target)
+		if vaultOutput == "json" {
+			if err != nil {
+				printVaultJSON(map[string]string{"status": "error", "message": err.Error()})
+				os.Exit(1)
+			}
+			printVaultJSON(map[string]string{"status": "success"})
+			return
+		}
+		if err != nil {
+			log.Fatalf("Verification failed for %s: %v", target.Name, err)
+		}
+		fmt.Printf("Credential %s is valid for %s\n", target.Name, target.Registry)
+	},
+}
+
+var vaultImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import credentials from a docker config.json",
+	Run: func(cmd *cobra.Command, args []string) {
+		path := dockerConfigPath
+		if path == "" {
+			path = defaultDockerConfigPath()
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Failed to read docker config: %v", err)
+		}
+		cfg, err := vault.ParseDockerConfig(data)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+
+		res, err := openCLIVault().ImportDockerConfig(context.Background(), cfg, vault.DockerImportOptions{LinkHelpers: importLinkHelpers})
+		if err != nil {
+			log.Fatalf("Failed to save credentials: %v", err)
+		}
+		for _, c := range res.Added {
+			fmt.Printf("added    %-30s %-20s %s\n", c.Registry, c.Username, c.AuthKind())
+		}
+		for _, s := range res.Skipped {
+			fmt.Printf("skipped  %-30s %-20s %s\n", s.Registry, s.Username, s.Reason)
+		}
+		fmt.Printf("Imported %d credential(s) from %s\n", len(res.Added), path)
+	},
+}
+
+var vaultExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export credentials as a docker config.json",
+	Run: func(cmd *cobra.Command, args []string) {
+		creds, err := openCLIVault().LoadCredentials()
 		if err != nil {
 			log.Fatalf("Failed to load credentials: %v", err)
 		}
+		cfg, skipped := vault.ExportDockerConfig(creds)
+		for _, s := range skipped {
+			fmt.Fprintf(os.Stderr, "skipped  %-30s %-20s %s\n", s.Registry, s.Username, s.Reason)
+		}
+		data, err := json.MarshalIndent(cfg, "", "\t")
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		data = append(data, '\n')
+		if vaultExportOutput == "" || vaultExportOutput == "-" {
+			os.Stdout.Write(data)
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(vaultExportOutput), 0700); err != nil {
+			log.Fatalf("%v", err)
+		}
+		if err := os.WriteFile(vaultExportOutput, data, 0600); err != nil {
+			log.Fatalf("Failed to write docker config: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %s\n", vaultExportOutput)
+	},
+}
 
-		fmt.Printf("%-20s %-30s %-20s\n", "NAME", "REGISTRY", "USERNAME")
-		fmt.Println("----------------------------------------------------------------------")
-		for _, c := range creds {
-			fmt.Printf("%-20s %-30s %-20s\n", c.Name, c.Registry, c.Username)
+var vaultRotateKeyCmd = &cobra.Command{
+	Use:   "rotate-key",
+	Short: "Re-encrypt the vault with a new passphrase",
+	Long: "Re-encrypt the vault with a new passphrase, keeping a backup of the previous file.\n" +
+		"The current passphrase is read from HORCRUX_SECRET, the new one from HORCRUX_NEW_SECRET\n" +
+		"or --new-secret-file. Stop the server first, or use POST /api/vault/rotate-key.",
+	Run: func(cmd *cobra.Command, args []string) {
+		newKey, err := newVaultPassphrase()
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+
+		v := openCLIVault()
+		if addr, ok := runningServer(v.StorageDir()); ok {
+			log.Fatalf("A Horcrux server is running on %s with this vault: stop it first, or rotate through POST %s/api/vault/rotate-key", addr, addr)
 		}
+
+		backup, err := v.RotatePassphrase(vaultPassphrase(), newKey)
+		if errors.Is(err, vault.ErrWrongPassphrase) {
+			log.Fatalf("Failed to rotate vault key: HORCRUX_SECRET does not decrypt the vault")
+		}
+		if err != nil {
+			log.Fatalf("Failed to rotate vault key: %v", err)
+		}
+		if backup != "" {
+			fmt.Printf("Previous vault saved to %s\n", backup)
+		}
+		fmt.Println("Vault key rotated. Set HORCRUX_SECRET to the new passphrase before starting the server.")
 	},
 }
 
+// newVaultPassphrase reads the passphrase of vault rotate-key from
+// --new-secret-file or HORCRUX_NEW_SECRET. A trailing newline of the file
+// is ignored.
+func newVaultPassphrase() (string, error) {
+	if newSecretFile != "" {
+		data, err := os.ReadFile(newSecretFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read new passphrase: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	if key := os.Getenv("HORCRUX_NEW_SECRET"); key != "" {
+		return key, nil
+	}
+	return "", errors.New("set HORCRUX_NEW_SECRET or --new-secret-file to the new passphrase")
+}
+
+// loadVaultCredentials opens the vault and loads its credentials and
+// their revision.
+func loadVaultCredentials() (*vault.Vault, []vault.Credential, uint64) {
+	v := openCLIVault()
+	creds, rev, err := v.Snapshot()
+	if err != nil {
+		log.Fatalf("Failed to load credentials: %v", err)
+	}
+	return v, creds, rev
+}
+
+// findCLICredential returns the index of the credential with ID nameOrID,
+// or else of the only credential named nameOrID.
+func findCLICredential(creds []vault.Credential, nameOrID string) (int, error) {
+	for i := range creds {
+		if creds[i].ID == nameOrID {
+			return i, nil
+		}
+	}
+	match := -1
+	for i := range creds {
+		if creds[i].Name == nameOrID {
+			if match >= 0 {
+				return -1, fmt.Errorf("more than one credential is named %q, use its ID", nameOrID)
+			}
+			match = i
+		}
+	}
+	if match < 0 {
+		return -1, fmt.Errorf("credential %q not found", nameOrID)
+	}
+	return match, nil
+}
+
+func checkVaultOutput() {
+	switch vaultOutput {
+	case "", "table", "json":
+	default:
+		log.Fatalf("Unknown output format %q, expected table or json", vaultOutput)
+	}
+}
+
+func printVaultJSON(v any) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	fmt.Println(string(data))
+}
+
+// readCredentialSecret sets the password of cred, or the token of bearer
+// and identity_token credentials. It is read from stdin with
+// --password-stdin, or when prompt is set from a terminal without echo.
+func readCredentialSecret(cred *vault.Credential, prompt bool) error {
+	field, label := &cred.Password, "Password"
+	switch cred.AuthKind() {
+	case vault.AuthBasic:
+		if cred.Username == "" {
+			return nil // rejected by Validate
+		}
+	case vault.AuthBearer, vault.AuthIdentityToken:
+		field, label = &cred.Token, "Token"
+	default:
+		if credPasswordStdin {
+			return fmt.Errorf("%s credentials have no password or token", cred.AuthKind())
+		}
+		return nil
+	}
+
+	if credPasswordStdin {
+		secret, err := readSecret(os.Stdin)
+		if err != nil {
+			return err
+		}
+		*field = secret
+		return nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !prompt || !isTerminal(fd) {
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "%s: ", label)
+	secret, err := readPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", strings.ToLower(label), err)
+	}
+	*field = string(secret)
+	return nil
+}
+
+// readSecret reads a secret piped to stdin, ignoring the trailing newline.
+func readSecret(r io.Reader) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(r, 64<<10))
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret from stdin: %w", err)
+	}
+	secret := strings.TrimRight(string(data), "\r\n")
+	if secret == "" {
+		return "", errors.New("no secret on stdin")
+	}
+	return secret, nil
+}
+
+// vaultPassphrase returns the vault passphrase from HORCRUX_SECRET, or the
+// built-in default when it is unset.
+func vaultPassphrase() string {
+	if key := os.Getenv("HORCRUX_SECRET"); key != "" {
+		return key
+	}
+	return vault.DefaultPassphrase
+}
+
+// openCLIVault opens the vault of the data directory.
+func openCLIVault() *vault.Vault {
+	key := vaultPassphrase()
+
+	v, err := vault.NewVault(resolveVaultPath(), key)
+	if err != nil {
+		log.Fatalf("Failed to initialize vault: %v", err)
+	}
+	return v
+}
+
+// defaultDockerConfigPath returns the config.json docker itself uses.
+func defaultDockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".docker", "config.json")
+}
+
 func init() {
-	vaultAddCmd.Flags().StringVarP(&credName, "name", "n", "", "Credential name")
-	vaultAddCmd.Flags().StringVarP(&credRegistry, "registry", "r", "", "Registry URL")
-	vaultAddCmd.Flags().StringVarP(&credUser, "user", "u", "", "Username")
-	vaultAddCmd.Flags().StringVarP(&credPass, "pass", "p", "", "Password")
+	for _, cmd := range []*cobra.Command{vaultAddCmd, vaultUpdateCmd} {
+		cmd.Flags().StringVarP(&credName, "name", "n", "", "Credential name")
+		cmd.Flags().StringVarP(&credRegistry, "registry", "r", "", "Registry URL")
+		cmd.Flags().StringVarP(&credUser, "user", "u", "", "Username")
+		cmd.Flags().StringVarP(&credPass, "pass", "p", "", "Password")
+		cmd.Flags().StringVar(&credAuthType, "auth-type", "", "Auth type: basic, bearer, identity_token, helper or anonymous (default basic with --user)")
+		cmd.Flags().StringVar(&credToken, "token", "", "Bearer or identity token")
+		cmd.Flags().BoolVar(&credPasswordStdin, "password-stdin", false, "Read the password or token from stdin")
+		cmd.Flags().StringVar(&credHelper, "helper", "", "Credential helper name for --auth-type helper, e.g. ecr-login (docker-credential-ecr-login on PATH) or a plugin in --credential-provider-dir")
+		cmd.Flags().StringVar(&credHelperProtocol, "helper-protocol", "", "Credential helper protocol: docker (default) or kubelet")
+		cmd.Flags().StringSliceVar(&credHelperArgs, "helper-arg", []string{}, "Argument passed to a kubelet credential provider (can be repeated)")
+		cmd.Flags().MarkDeprecated("pass", "use --password-stdin or the prompt instead")
+		cmd.Flags().MarkDeprecated("token", "use --password-stdin or the prompt instead")
+	}
+	vaultUpdateCmd.Flags().BoolVar(&credPromptPassword, "prompt-password", false, "Prompt for a new password or token")
+	for _, cmd := range []*cobra.Command{vaultAddCmd, vaultListCmd, vaultShowCmd, vaultUpdateCmd, vaultDeleteCmd, vaultVerifyCmd} {
+		cmd.Flags().StringVarP(&vaultOutput, "output", "o", "table", "Output format: table or json")
+	}
+
+	vaultImportCmd.Flags().StringVar(&dockerConfigPath, "docker-config", "", "Path of the docker config.json (default $DOCKER_CONFIG/config.json or ~/.docker/config.json)")
+	vaultImportCmd.Flags().BoolVar(&importLinkHelpers, "link-helpers", false, "Store credHelpers and credsStore entries as helper credentials instead of their current secrets")
+	vaultExportCmd.Flags().StringVarP(&vaultExportOutput, "output", "o", "", "Output file (default stdout)")
+	vaultRotateKeyCmd.Flags().StringVar(&newSecretFile, "new-secret-file", "", "File holding the new passphrase (default HORCRUX_NEW_SECRET)")
+	vaultCmd.PersistentFlags().StringVar(&serverDataDir, "data-dir", "", "Directory to store data")
 
 	vaultCmd.AddCommand(vaultAddCmd)
 	vaultCmd.AddCommand(vaultListCmd)
+	vaultCmd.AddCommand(vaultShowCmd)
+	vaultCmd.AddCommand(vaultUpdateCmd)
+	vaultCmd.AddCommand(vaultDeleteCmd)
+	vaultCmd.AddCommand(vaultVerifyCmd)
+	vaultCmd.AddCommand(vaultImportCmd)
+	vaultCmd.AddCommand(vaultExportCmd)
+	vaultCmd.AddCommand(vaultRotateKeyCmd)
 	rootCmd.AddCommand(vaultCmd)
 }
@@ -0,0 +1,47 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/guoxudong/horcrux/internal/vault"
+)
+
+func TestFindCLICredential(t *testing.T) {
+	creds := []vault.Credential{
+		{ID: "cred_1", Name: "hub"},
+		{ID: "cred_2", Name: "mirror"},
+		{ID: "cred_3", Name: "mirror"},
+		{ID: "mirror", Name: "other"},
+	}
+	for _, tc := range []struct {
+		arg  string
+		want int
+	}{
+		{"cred_2", 1},
+		{"hub", 0},
+		{"mirror", 3}, // IDs win over names
+	} {
+		if got, err := findCLICredential(creds, tc.arg); err != nil || got != tc.want {
+			t.Fatalf("find %q = %d, %v, want %d", tc.arg, got, err, tc.want)
+		}
+	}
+	if _, err := findCLICredential(creds[:3], "mirror"); err == nil {
+		t.Fatalf("an ambiguous name should be rejected")
+	}
+	if _, err := findCLICredential(creds, "nope"); err == nil {
+		t.Fatalf("an unknown credential should be rejected")
+	}
+}
+
+func TestReadSecret(t *testing.T) {
+	if got, err := readSecret(strings.NewReader("s3cret\r\n")); err != nil || got != "s3cret" {
+		t.Fatalf("readSecret = %q, %v", got, err)
+	}
+	if got, _ := readSecret(strings.NewReader(" pass word ")); got != " pass word " {
+		t.Fatalf("spaces should be kept, got %q", got)
+	}
+	if _, err := readSecret(strings.NewReader("\n")); err == nil {
+		t.Fatalf("an empty secret should be rejected")
+	}
+}
@@ -0,0 +1,215 @@
+// Package credhelper runs external credential helpers for registries that
+// issue short-lived tokens, such as ECR, GCR and ACR. Two protocols are
+// supported: docker-credential-helpers and the kubelet credential provider
+// exec plugin protocol. Results are cached until they expire.
+//
+// Helpers are always named, never given as paths: docker helpers are looked
+// up in PATH as docker-credential-<name>, kubelet plugins in the directory
+// set by SetKubeletPluginDir.
+package credhelper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+// Helper protocols.
+const (
+	// ProtocolDocker runs docker-credential-<helper> get.
+	ProtocolDocker = "docker"
+	// ProtocolKubelet runs a kubelet credential provider plugin.
+	ProtocolKubelet = "kubelet"
+)
+
+// DefaultTTL is how long credentials are cached when the helper does not
+// say when they expire.
+const DefaultTTL = 5 * time.Minute
+
+// Timeout bounds a single helper run.
+const Timeout = 30 * time.Second
+
+// Spec describes a helper and the registry it provides credentials for.
+type Spec struct {
+	Helper   string   // helper name, e.g. "ecr-login"
+	Protocol string   // docker (default) or kubelet
+	Args     []string // extra arguments of kubelet plugins
+	Registry string   // registry host, optionally with a repository path
+}
+
+// ParseProtocol validates a protocol name, defaulting to ProtocolDocker.
+func ParseProtocol(p string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(p)) {
+	case "", ProtocolDocker:
+		return ProtocolDocker, nil
+	case ProtocolKubelet:
+		return ProtocolKubelet, nil
+	}
+	return "", fmt.Errorf("unknown helper protocol %q, expected %s or %s", p, ProtocolDocker, ProtocolKubelet)
+}
+
+// helperName matches the names helpers are looked up by.
+var helperName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// ValidateHelperName checks that name is a bare helper name such as
+// "ecr-login". Paths are rejected, so a credential can only select one of
+// the helpers the operator installed.
+func ValidateHelperName(name string) error {
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "":
+		return errors.New("helper is required")
+	case strings.ContainsAny(name, `/\`):
+		return fmt.Errorf("helper %q must be a name, not a path", name)
+	case !helperName.MatchString(name):
+		return fmt.Errorf("invalid helper name %q", name)
+	}
+	return nil
+}
+
+// Validate checks that spec can be run.
+func (spec Spec) Validate() error {
+	if err := ValidateHelperName(spec.Helper); err != nil {
+		return err
+	}
+	if registryHost(spec.Registry) == "" {
+		return errors.New("registry is required for helper credentials")
+	}
+	_, err := ParseProtocol(spec.Protocol)
+	return err
+}
+
+func (spec Spec) cacheKey() string {
+	protocol, _ := ParseProtocol(spec.Protocol)
+	return strings.Join(append([]string{protocol, spec.Helper, spec.Registry}, spec.Args...), "\x00")
+}
+
+// result is the output of one helper run.
+type result struct {
+	config authn.AuthConfig
+	ttl    time.Duration // zero disables caching
+}
+
+type cacheEntry struct {
+	mu        sync.Mutex
+	config    authn.AuthConfig
+	expiresAt time.Time
+}
+
+// Provider runs helpers and caches their credentials.
+type Provider struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	now     func() time.Time
+}
+
+// NewProvider returns a Provider with an empty cache.
+func NewProvider() *Provider {
+	return &Provider{entries: map[string]*cacheEntry{}, now: time.Now}
+}
+
+// Default is the Provider shared by credentials of the process.
+var Default = NewProvider()
+
+// Get returns the credentials of spec, running the helper when the cached
+// ones are missing or expired. Concurrent callers of one spec share a run.
+func (p *Provider) Get(ctx context.Context, spec Spec) (authn.AuthConfig, error) {
+	if err := spec.Validate(); err != nil {
+		return authn.AuthConfig{}, err
+	}
+	key := spec.cacheKey()
+	p.mu.Lock()
+	entry, ok := p.entries[key]
+	if !ok {
+		entry = &cacheEntry{}
+		p.entries[key] = entry
+	}
+	p.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if p.now().Before(entry.expiresAt) {
+		return entry.config, nil
+	}
+	res, err := run(ctx, spec)
+	if err != nil {
+		return authn.AuthConfig{}, err
+	}
+	entry.config = res.config
+	entry.expiresAt = p.now().Add(res.ttl)
+	return res.config, nil
+}
+
+func run(ctx context.Context, spec Spec) (result, error) {
+	protocol, _ := ParseProtocol(spec.Protocol)
+	if protocol == ProtocolKubelet {
+		return runKubelet(ctx, spec)
+	}
+	return runDocker(ctx, spec)
+}
+
+// execHelper runs name with stdin and returns its stdout. stderr, or stdout
+// for docker helpers which report errors there, is included in errors.
+func execHelper(ctx context.Context, name string, args []string, stdin []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = strings.TrimSpace(stdout.String())
+		}
+		if msg != "" {
+			return nil, fmt.Errorf("credential helper %s failed: %v: %s", name, err, msg)
+		}
+		return nil, fmt.Errorf("credential helper %s failed: %w", name, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// registryHost strips the scheme and repository path of a registry.
+func registryHost(registry string) string {
+	r := strings.TrimSpace(registry)
+	r = strings.TrimPrefix(r, "https://")
+	r = strings.TrimPrefix(r, "http://")
+	if idx := strings.IndexByte(r, '/'); idx >= 0 {
+		r = r[:idx]
+	}
+	return strings.ToLower(r)
+}
+
+// Authenticator resolves the credentials of a helper on each use.
+type Authenticator struct {
+	Provider *Provider
+	Spec     Spec
+}
+
+// Authorization implements authn.Authenticator.
+func (a *Authenticator) Authorization() (*authn.AuthConfig, error) {
+	return a.AuthorizationContext(context.Background())
+}
+
+// AuthorizationContext implements authn.ContextAuthenticator.
+func (a *Authenticator) AuthorizationContext(ctx context.Context) (*authn.AuthConfig, error) {
+	p := a.Provider
+	if p == nil {
+		p = Default
+	}
+	cfg, err := p.Get(ctx, a.Spec)
+	if err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,181 @@
+package credhelper
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+// stubHelper writes a shell script helper that appends its stdin and
+// arguments to a log file and prints output. Its directory is put in front
+// of PATH and used as the kubelet plugin directory.
+func stubHelper(t *testing.T, name, output string) (path, logFile string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("stub helpers are shell scripts")
+	}
+	dir := t.TempDir()
+	path = filepath.Join(dir, name)
+	logFile = filepath.Join(dir, "calls.log")
+	script := "#!/bin/sh\necho \"$@ $(cat)\" >> " + logFile + "\ncat <<'EOF'\n" + output + "\nEOF\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("write helper: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	SetKubeletPluginDir(dir)
+	t.Cleanup(func() { SetKubeletPluginDir("") })
+	return path, logFile
+}
+
+func calls(t *testing.T, logFile string) []string {
+	t.Helper()
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestProvider_DockerHelperIsCached(t *testing.T) {
+	_, logFile := stubHelper(t, "docker-credential-stub", `{"ServerURL":"registry.local","Username":"AWS","Secret":"s3cret"}`)
+	p := NewProvider()
+	now := time.Now()
+	p.now = func() time.Time { return now }
+
+	spec := Spec{Helper: "stub", Registry: "https://registry.local/team"}
+	for i := 0; i < 2; i++ {
+		cfg, err := p.Get(context.Background(), spec)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if cfg != (authn.AuthConfig{Username: "AWS", Password: "s3cret"}) {
+			t.Fatalf("unexpected config %+v", cfg)
+		}
+	}
+	if got := calls(t, logFile); len(got) != 1 || got[0] != "get registry.local" {
+		t.Fatalf("expected one cached run, got %q", got)
+	}
+
+	now = now.Add(DefaultTTL)
+	if _, err := p.Get(context.Background(), spec); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if got := calls(t, logFile); len(got) != 2 {
+		t.Fatalf("expired credentials should rerun the helper, got %q", got)
+	}
+}
+
+func TestProvider_DockerHelperIdentityTokenAndErrors(t *testing.T) {
+	helper, logFile := stubHelper(t, "docker-credential-stub", `{"Username":"<token>","Secret":"refresh"}`)
+	cfg, err := NewProvider().Get(context.Background(), Spec{Helper: "docker-credential-stub", Registry: "docker.io"})
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if cfg != (authn.AuthConfig{IdentityToken: "refresh"}) {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	if got := calls(t, logFile); got[0] != "get "+dockerHubServer {
+		t.Fatalf("docker hub should use the legacy server URL, got %q", got)
+	}
+
+	failing := filepath.Join(filepath.Dir(helper), "docker-credential-missing")
+	if err := os.WriteFile(failing, []byte("#!/bin/sh\necho 'credentials not found in native keychain'\nexit 1\n"), 0755); err != nil {
+		t.Fatalf("write helper: %v", err)
+	}
+	_, err = NewProvider().Get(context.Background(), Spec{Helper: "missing", Registry: "registry.local"})
+	if err == nil || !strings.Contains(err.Error(), "credentials not found") {
+		t.Fatalf("expected the helper output in the error, got %v", err)
+	}
+	if _, err := NewProvider().Get(context.Background(), Spec{Helper: "stub", Registry: "registry.local", Protocol: "exec"}); err == nil {
+		t.Fatalf("expected an unknown protocol error")
+	}
+	if path, err := dockerHelperPath("stub"); err != nil || path != helper {
+		t.Fatalf("helper names should get the docker-credential- prefix: %q, %v", path, err)
+	}
+}
+
+func TestProvider_RejectsHelperPaths(t *testing.T) {
+	helper, _ := stubHelper(t, "docker-credential-stub", `{"Username":"AWS","Secret":"s3cret"}`)
+	for _, spec := range []Spec{
+		{Helper: helper, Registry: "registry.local"},
+		{Helper: "../docker-credential-stub", Registry: "registry.local"},
+		{Helper: `..\stub`, Registry: "registry.local"},
+		{Helper: "..", Registry: "registry.local"},
+		{Helper: helper, Protocol: ProtocolKubelet, Registry: "registry.local"},
+	} {
+		if _, err := NewProvider().Get(context.Background(), spec); err == nil {
+			t.Fatalf("%q should be rejected", spec.Helper)
+		}
+	}
+
+	// Kubelet plugins only run from the configured directory
+	SetKubeletPluginDir("")
+	_, err := NewProvider().Get(context.Background(), Spec{Helper: "docker-credential-stub", Protocol: ProtocolKubelet, Registry: "registry.local"})
+	if err == nil || !strings.Contains(err.Error(), "disabled") {
+		t.Fatalf("expected kubelet plugins to be disabled, got %v", err)
+	}
+}
+
+func TestProvider_KubeletPlugin(t *testing.T) {
+	_, logFile := stubHelper(t, "ecr-credential-provider", `{
+  "apiVersion": "credentialprovider.kubelet.k8s.io/v1",
+  "kind": "CredentialProviderResponse",
+  "cacheKeyType": "Registry",
+  "cacheDuration": "0s",
+  "auth": {
+    "*.dkr.ecr.*.amazonaws.com": {"username": "AWS", "password": "host"},
+    "123.dkr.ecr.us-east-1.amazonaws.com/team": {"username": "AWS", "password": "team"}
+  }
+}`)
+	p := NewProvider()
+	for _, tc := range []struct{ registry, password string }{
+		{"123.dkr.ecr.us-east-1.amazonaws.com/team/app", "team"},
+		{"123.dkr.ecr.us-east-1.amazonaws.com", "host"},
+	} {
+		cfg, err := p.Get(context.Background(), Spec{Helper: "ecr-credential-provider", Protocol: ProtocolKubelet, Args: []string{"--v=2"}, Registry: tc.registry})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.registry, err)
+		}
+		if cfg.Password != tc.password {
+			t.Fatalf("%s: expected %s, got %+v", tc.registry, tc.password, cfg)
+		}
+	}
+	// A zero cacheDuration disables caching
+	if _, err := p.Get(context.Background(), Spec{Helper: "ecr-credential-provider", Protocol: ProtocolKubelet, Args: []string{"--v=2"}, Registry: "123.dkr.ecr.us-east-1.amazonaws.com"}); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	got := calls(t, logFile)
+	if len(got) != 3 || !strings.HasPrefix(got[0], `--v=2 {"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderRequest","image":"123.dkr.ecr.us-east-1.amazonaws.com/team/app"}`) {
+		t.Fatalf("unexpected plugin calls %q", got)
+	}
+
+	if _, err := p.Get(context.Background(), Spec{Helper: "ecr-credential-provider", Protocol: ProtocolKubelet, Registry: "gcr.io"}); err == nil {
+		t.Fatalf("expected an error when no auth entry matches")
+	}
+}
+
+func TestMatchImage(t *testing.T) {
+	cases := []struct {
+		pattern, image string
+		want           bool
+	}{
+		{"*.dkr.ecr.*.amazonaws.com", "123.dkr.ecr.eu-west-1.amazonaws.com/app", true},
+		{"*.dkr.ecr.*.amazonaws.com", "dkr.ecr.eu-west-1.amazonaws.com/app", false},
+		{"*.azurecr.io", "team.azurecr.io", true},
+		{"registry.local:5000", "registry.local/app", false},
+		{"registry.local:5000", "registry.local:5000/app", true},
+		{"https://gcr.io/project", "gcr.io/project/app", true},
+		{"gcr.io/project", "gcr.io/project-2/app", false},
+	}
+	for _, tc := range cases {
+		if got := matchImage(tc.pattern, tc.image); got != tc.want {
+			t.Fatalf("matchImage(%q, %q) = %v, want %v", tc.pattern, tc.image, got, tc.want)
+		}
+	}
+}
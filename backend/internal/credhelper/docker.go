@@ -0,0 +1,73 @@
+package credhelper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+// dockerHubServer is the server URL docker uses for Docker Hub credentials.
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// dockerTokenUsername marks an identity token in helper output.
+const dockerTokenUsername = "<token>"
+
+// dockerCredentials is the output of a docker credential helper.
+type dockerCredentials struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// dockerHelperPath looks up the docker-credential-<helper> binary in PATH.
+// The prefix may be included in helper already.
+func dockerHelperPath(helper string) (string, error) {
+	if err := ValidateHelperName(helper); err != nil {
+		return "", err
+	}
+	name := "docker-credential-" + strings.TrimPrefix(strings.TrimSpace(helper), "docker-credential-")
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("credential helper %s not found: %w", name, err)
+	}
+	return path, nil
+}
+
+// dockerServerURL returns the server URL a docker helper is asked for.
+func dockerServerURL(registry string) string {
+	switch host := registryHost(registry); host {
+	case "docker.io", "index.docker.io", "registry-1.docker.io":
+		return dockerHubServer
+	default:
+		return host
+	}
+}
+
+// runDocker runs `<helper> get` with the server URL on stdin. Docker
+// helpers do not report expiry, so results are cached for DefaultTTL.
+func runDocker(ctx context.Context, spec Spec) (result, error) {
+	helper, err := dockerHelperPath(spec.Helper)
+	if err != nil {
+		return result{}, err
+	}
+	out, err := execHelper(ctx, helper, []string{"get"}, []byte(dockerServerURL(spec.Registry)))
+	if err != nil {
+		return result{}, err
+	}
+	var creds dockerCredentials
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return result{}, fmt.Errorf("invalid credential helper output: %v", err)
+	}
+	if creds.Secret == "" {
+		return result{}, errors.New("credential helper returned no secret")
+	}
+	if creds.Username == dockerTokenUsername {
+		return result{config: authn.AuthConfig{IdentityToken: creds.Secret}, ttl: DefaultTTL}, nil
+	}
+	return result{config: authn.AuthConfig{Username: creds.Username, Password: creds.Secret}, ttl: DefaultTTL}, nil
+}
@@ -0,0 +1,155 @@
+package credhelper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+const kubeletAPIVersion = "credentialprovider.kubelet.k8s.io/v1"
+
+type kubeletRequest struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Image      string `json:"image"`
+}
+
+type kubeletAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type kubeletResponse struct {
+	APIVersion    string                 `json:"apiVersion"`
+	Kind          string                 `json:"kind"`
+	CacheKeyType  string                 `json:"cacheKeyType"`
+	CacheDuration string                 `json:"cacheDuration"`
+	Auth          map[string]kubeletAuth `json:"auth"`
+}
+
+var (
+	pluginDirMu sync.RWMutex
+	pluginDir   string
+)
+
+// SetKubeletPluginDir sets the directory kubelet credential provider
+// plugins are run from, like the kubelet's
+// --image-credential-provider-bin-dir. Without one, kubelet helpers fail.
+func SetKubeletPluginDir(dir string) {
+	pluginDirMu.Lock()
+	defer pluginDirMu.Unlock()
+	pluginDir = strings.TrimSpace(dir)
+}
+
+// kubeletPluginPath returns the plugin named helper in the plugin directory.
+func kubeletPluginPath(helper string) (string, error) {
+	pluginDirMu.RLock()
+	dir := pluginDir
+	pluginDirMu.RUnlock()
+	if dir == "" {
+		return "", errors.New("kubelet credential providers are disabled: no plugin directory is configured")
+	}
+	if err := ValidateHelperName(helper); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, strings.TrimSpace(helper))
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("credential provider %s not found in %s", strings.TrimSpace(helper), dir)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("credential provider %s is not a regular file", path)
+	}
+	return path, nil
+}
+
+// runKubelet sends a CredentialProviderRequest for the registry and picks
+// the most specific auth entry matching it. The response's cacheDuration
+// sets the cache TTL; an explicit zero disables caching.
+func runKubelet(ctx context.Context, spec Spec) (result, error) {
+	image := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(spec.Registry), "https://"), "http://"), "/")
+	req, _ := json.Marshal(kubeletRequest{APIVersion: kubeletAPIVersion, Kind: "CredentialProviderRequest", Image: image})
+	plugin, err := kubeletPluginPath(spec.Helper)
+	if err != nil {
+		return result{}, err
+	}
+	out, err := execHelper(ctx, plugin, spec.Args, req)
+	if err != nil {
+		return result{}, err
+	}
+	var resp kubeletResponse
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return result{}, fmt.Errorf("invalid credential provider output: %v", err)
+	}
+	if resp.Kind != "CredentialProviderResponse" {
+		return result{}, fmt.Errorf("unexpected credential provider response kind %q", resp.Kind)
+	}
+
+	ttl := DefaultTTL
+	if resp.CacheDuration != "" {
+		if ttl, err = time.ParseDuration(resp.CacheDuration); err != nil {
+			return result{}, fmt.Errorf("invalid cacheDuration %q: %v", resp.CacheDuration, err)
+		}
+	}
+
+	// Longer patterns are more specific, e.g. a repository path over a host
+	patterns := make([]string, 0, len(resp.Auth))
+	for p := range resp.Auth {
+		patterns = append(patterns, p)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+	for _, p := range patterns {
+		if matchImage(p, image) {
+			auth := resp.Auth[p]
+			return result{config: authn.AuthConfig{Username: auth.Username, Password: auth.Password}, ttl: ttl}, nil
+		}
+	}
+	return result{}, fmt.Errorf("credential provider returned no auth matching %s", image)
+}
+
+// matchImage reports whether a kubelet auth key matches image. Host labels
+// may be globs like *.dkr.ecr.*.amazonaws.com, ports must be equal and the
+// key's path must be a prefix of the image path.
+func matchImage(pattern, image string) bool {
+	pattern = strings.TrimPrefix(strings.TrimPrefix(pattern, "https://"), "http://")
+	pHost, pPath, _ := strings.Cut(pattern, "/")
+	iHost, iPath, _ := strings.Cut(image, "/")
+
+	pHost, pPort, _ := strings.Cut(strings.ToLower(pHost), ":")
+	iHost, iPort, _ := strings.Cut(strings.ToLower(iHost), ":")
+	if pPort != iPort {
+		return false
+	}
+	pLabels := strings.Split(pHost, ".")
+	iLabels := strings.Split(iHost, ".")
+	if len(pLabels) != len(iLabels) {
+		return false
+	}
+	for i := range pLabels {
+		if ok, err := path.Match(pLabels[i], iLabels[i]); err != nil || !ok {
+			return false
+		}
+	}
+
+	pPath = strings.Trim(pPath, "/")
+	if pPath == "" {
+		return true
+	}
+	iPath = strings.Trim(iPath, "/")
+	return iPath == pPath || strings.HasPrefix(iPath, pPath+"/")
+}
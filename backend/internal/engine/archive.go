@@ -0,0 +1,518 @@
+package engine
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/guoxudong/horcrux/internal/volume"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Archive formats recognised by OpenArchive
+const (
+	ArchiveFormatDocker = "docker" // docker save / tarball.Write output
+	ArchiveFormatOCI    = "oci"    // OCI image layout packed into a tar (oci-archive)
+)
+
+// Archive compressions recognised by OpenArchive
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+const (
+	annotationRefName        = "org.opencontainers.image.ref.name"
+	annotationContainerdName = "io.containerd.image.name"
+	annotationReferenceType  = "vnd.docker.reference.type"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Archive is an image archive opened from a local file.
+// All images found in the archive are exposed through Index, one manifest per
+// platform, regardless of the on-disk format.
+type Archive struct {
+	Format      string
+	Compression string
+	RepoTags    []string // Docker RepoTags or OCI ref names found in the archive
+	Index       v1.ImageIndex
+
+	workDir string
+}
+
+// Close removes any temporary files created while opening the archive.
+// Index must not be used after Close.
+func (a *Archive) Close() error {
+	if a == nil || a.workDir == "" {
+		return nil
+	}
+	return os.RemoveAll(a.workDir)
+}
+
+// Images returns the descriptors of all images in the archive.
+func (a *Archive) Images() ([]v1.Descriptor, error) {
+	m, err := a.Index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	return m.Manifests, nil
+}
+
+// OpenArchive loads a docker-save tarball, an OCI archive (OCI image layout
+// packed into a tar) or a gzip/zstd compressed variant of either.
+// An archive split into volumes is opened through its volume index, its
+// first volume or the name the volumes reassemble to; missing or corrupt
+// volumes are reported as a *volume.CheckError.
+// Temporary files are created next to path and removed by Archive.Close.
+func OpenArchive(path string) (*Archive, error) {
+	workDir, err := os.MkdirTemp(filepath.Dir(path), ".archive-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create work directory: %w", err)
+	}
+	a := &Archive{workDir: workDir}
+
+	if err := a.open(path); err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *Archive) open(path string) error {
+	if indexPath, ok := volume.IndexFor(path); ok {
+		joined := filepath.Join(a.workDir, "archive.joined")
+		if err := joinVolumes(indexPath, joined); err != nil {
+			return err
+		}
+		path = joined
+	}
+
+	compression, err := sniffCompression(path)
+	if err != nil {
+		return err
+	}
+	a.Compression = compression
+
+	tarPath := path
+	if compression != CompressionNone {
+		tarPath = filepath.Join(a.workDir, "archive.tar")
+		if err := decompressFile(path, tarPath, compression); err != nil {
+			return fmt.Errorf("failed to decompress %s archive: %w", compression, err)
+		}
+	}
+
+	entries, repoTags, err := scanTar(tarPath)
+	if err != nil {
+		return fmt.Errorf("failed to read tar: %w", err)
+	}
+	a.RepoTags = repoTags
+
+	switch {
+	case entries["oci-layout"] && entries["index.json"]:
+		a.Format = ArchiveFormatOCI
+		return a.openOCI(tarPath)
+	case entries["manifest.json"]:
+		a.Format = ArchiveFormatDocker
+		return a.openDocker(tarPath)
+	default:
+		return fmt.Errorf("unrecognized archive: neither docker manifest.json nor OCI index.json found")
+	}
+}
+
+// openDocker loads every image of a docker save tarball. Tarballs holding
+// several images must tag each of them, since the images are selected by tag.
+func (a *Archive) openDocker(tarPath string) error {
+	opener := func() (io.ReadCloser, error) { return os.Open(tarPath) }
+	manifest, err := tarball.LoadManifest(opener)
+	if err != nil {
+		return err
+	}
+	if len(manifest) <= 1 {
+		img, err := tarball.Image(opener, nil)
+		if err != nil {
+			return err
+		}
+		add, err := imageAddendum(img, v1.Descriptor{})
+		if err != nil {
+			return err
+		}
+		a.Index = mutate.AppendManifests(empty.Index, add)
+		return nil
+	}
+
+	var adds []mutate.IndexAddendum
+	seen := map[v1.Hash]bool{}
+	for i, entry := range manifest {
+		if len(entry.RepoTags) == 0 {
+			return fmt.Errorf("docker archive holds %d images and image %d (config %s) has no tag: save untagged images to separate archives", len(manifest), i+1, entry.Config)
+		}
+		tag, err := name.NewTag(entry.RepoTags[0])
+		if err != nil {
+			return fmt.Errorf("invalid tag %q in docker archive: %w", entry.RepoTags[0], err)
+		}
+		img, err := tarball.Image(opener, &tag)
+		if err != nil {
+			return fmt.Errorf("failed to load %s from docker archive: %w", tag, err)
+		}
+		add, err := imageAddendum(img, v1.Descriptor{Annotations: map[string]string{annotationRefName: tag.String()}})
+		if err != nil {
+			return err
+		}
+		if seen[add.Descriptor.Digest] {
+			continue
+		}
+		seen[add.Descriptor.Digest] = true
+		adds = append(adds, add)
+	}
+	a.Index = mutate.AppendManifests(empty.Index, adds...)
+	return nil
+}
+
+func (a *Archive) openOCI(tarPath string) error {
+	layoutPath := filepath.Join(a.workDir, "layout")
+	if err := ExtractTar(tarPath, layoutPath); err != nil {
+		return fmt.Errorf("failed to extract OCI layout: %w", err)
+	}
+
+	l, err := layout.ImageIndexFromPath(layoutPath)
+	if err != nil {
+		return fmt.Errorf("failed to load OCI layout: %w", err)
+	}
+
+	// Skopeo and buildah record the tag in ref.name, containerd the full reference.
+	if m, err := l.IndexManifest(); err == nil && len(a.RepoTags) == 0 {
+		for _, d := range m.Manifests {
+			if n := d.Annotations[annotationContainerdName]; n != "" {
+				a.RepoTags = append(a.RepoTags, n)
+			} else if n := d.Annotations[annotationRefName]; n != "" {
+				a.RepoTags = append(a.RepoTags, n)
+			}
+		}
+	}
+
+	adds, err := flattenIndex(l)
+	if err != nil {
+		return err
+	}
+	if len(adds) == 0 {
+		return fmt.Errorf("OCI layout contains no usable images")
+	}
+	a.Index = mutate.AppendManifests(empty.Index, adds...)
+	return nil
+}
+
+// flattenIndex walks idx and any nested indexes and returns one addendum per
+// image. Attestation manifests are skipped; a child that cannot be read fails
+// the whole walk, so damaged archives are not imported partially.
+func flattenIndex(idx v1.ImageIndex) ([]mutate.IndexAddendum, error) {
+	m, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	var adds []mutate.IndexAddendum
+	seen := map[v1.Hash]bool{}
+	for _, desc := range m.Manifests {
+		if desc.Annotations[annotationReferenceType] == "attestation-manifest" {
+			continue
+		}
+		switch {
+		case desc.MediaType.IsIndex():
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read index %s: %w", desc.Digest, err)
+			}
+			childAdds, err := flattenIndex(child)
+			if err != nil {
+				return nil, err
+			}
+			for _, add := range childAdds {
+				if !seen[add.Descriptor.Digest] {
+					seen[add.Descriptor.Digest] = true
+					adds = append(adds, add)
+				}
+			}
+		case desc.MediaType.IsImage():
+			if seen[desc.Digest] {
+				continue
+			}
+			img, err := idx.Image(desc.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read image %s: %w", desc.Digest, err)
+			}
+			if _, err := img.RawManifest(); err != nil {
+				return nil, fmt.Errorf("failed to read image %s: %w", desc.Digest, err)
+			}
+			add, err := imageAddendum(img, desc)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read image %s: %w", desc.Digest, err)
+			}
+			seen[desc.Digest] = true
+			adds = append(adds, add)
+		}
+	}
+	return adds, nil
+}
+
+// imageAddendum builds an index entry for img from the descriptor it is
+// listed with, keeping its annotations and filling the platform fields it
+// lacks from the image config.
+func imageAddendum(img v1.Image, desc v1.Descriptor) (mutate.IndexAddendum, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return mutate.IndexAddendum{}, err
+	}
+	size, err := img.Size()
+	if err != nil {
+		return mutate.IndexAddendum{}, err
+	}
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return mutate.IndexAddendum{}, err
+	}
+	platform, err := imagePlatform(img, desc.Platform)
+	if err != nil {
+		return mutate.IndexAddendum{}, err
+	}
+
+	return mutate.IndexAddendum{
+		Add: img,
+		Descriptor: v1.Descriptor{
+			MediaType:   mediaType,
+			Size:        size,
+			Digest:      digest,
+			Platform:    platform,
+			Annotations: desc.Annotations,
+			URLs:        desc.URLs,
+		},
+	}, nil
+}
+
+// imagePlatform returns p completed with the platform fields of the image
+// config. The config is only read when p lacks the OS or architecture.
+func imagePlatform(img v1.Image, p *v1.Platform) (*v1.Platform, error) {
+	if p != nil && p.OS != "" && p.Architecture != "" {
+		return p, nil
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image config: %w", err)
+	}
+	var out v1.Platform
+	if p != nil {
+		out = *p
+	}
+	if out.OS == "" {
+		out.OS = cfg.OS
+	}
+	if out.Architecture == "" {
+		out.Architecture = cfg.Architecture
+	}
+	if out.Variant == "" {
+		out.Variant = cfg.Variant
+	}
+	if out.OSVersion == "" {
+		out.OSVersion = cfg.OSVersion
+	}
+	if len(out.OSFeatures) == 0 {
+		out.OSFeatures = cfg.OSFeatures
+	}
+	return &out, nil
+}
+
+func sniffCompression(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 4)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return CompressionGzip, nil
+	case bytes.HasPrefix(head, zstdMagic):
+		return CompressionZstd, nil
+	default:
+		return CompressionNone, nil
+	}
+}
+
+// joinVolumes reassembles the volume set of indexPath into dst.
+func joinVolumes(indexPath, dst string) error {
+	r, _, err := volume.Open(indexPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to join volumes: %w", err)
+	}
+	return out.Close()
+}
+
+func decompressFile(src, dst, compression string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var r io.Reader
+	switch compression {
+	case CompressionGzip:
+		gz, err := gzip.NewReader(bufio.NewReader(in))
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case CompressionZstd:
+		zr, err := zstd.NewReader(bufio.NewReader(in))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return fmt.Errorf("unsupported compression: %s", compression)
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// scanTar lists the top-level entries of a tar and extracts Docker RepoTags
+// from manifest.json when present.
+func scanTar(tarPath string) (map[string]bool, []string, error) {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	entries := map[string]bool{}
+	var repoTags []string
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		name := strings.TrimPrefix(filepath.ToSlash(filepath.Clean(hdr.Name)), "./")
+		entries[name] = true
+
+		if name == "manifest.json" {
+			var manifest []struct {
+				RepoTags []string `json:"RepoTags"`
+			}
+			if err := json.NewDecoder(tr).Decode(&manifest); err == nil {
+				for _, m := range manifest {
+					repoTags = append(repoTags, m.RepoTags...)
+				}
+			}
+		}
+	}
+	return entries, repoTags, nil
+}
+
+// ExtractTar unpacks the regular files and directories of a tar into dst,
+// rejecting entries that would escape it.
+func ExtractTar(tarPath, dst string) error {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return ExtractTarReader(f, dst)
+}
+
+// ExtractTarReader is ExtractTar for a tar stream.
+func ExtractTarReader(r io.Reader, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if name == "." {
+			continue
+		}
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("illegal path in archive: %s", hdr.Name)
+		}
+		target := filepath.Join(dst, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package engine
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/guoxudong/horcrux/internal/volume"
+	"github.com/klauspost/compress/zstd"
+)
+
+func randomPlatformImage(t *testing.T, arch string) v1.Image {
+	t.Helper()
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatalf("random image: %v", err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	cfg = cfg.DeepCopy()
+	cfg.OS = "linux"
+	cfg.Architecture = arch
+	img, err = mutate.ConfigFile(img, cfg)
+	if err != nil {
+		t.Fatalf("mutate config: %v", err)
+	}
+	return img
+}
+
+func writeDockerTar(t *testing.T, path string, img v1.Image) {
+	t.Helper()
+	tag, _ := name.NewTag("example.com/app:1.0")
+	if err := tarball.WriteToFile(path, tag, img); err != nil {
+		t.Fatalf("write docker tar: %v", err)
+	}
+}
+
+// tarDir packs a directory (an OCI layout) into a tar stream.
+func tarDir(t *testing.T, dir string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		if rel == "." {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("tar layout: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestOpenArchive_DockerTarball(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "image.tar")
+	writeDockerTar(t, path, randomPlatformImage(t, "amd64"))
+
+	arc, err := OpenArchive(path)
+	if err != nil {
+		t.Fatalf("open archive: %v", err)
+	}
+	defer arc.Close()
+
+	if arc.Format != ArchiveFormatDocker || arc.Compression != CompressionNone {
+		t.Fatalf("unexpected format=%s compression=%s", arc.Format, arc.Compression)
+	}
+	if len(arc.RepoTags) != 1 || arc.RepoTags[0] != "example.com/app:1.0" {
+		t.Fatalf("unexpected repo tags: %v", arc.RepoTags)
+	}
+	images, _ := arc.Images()
+	if len(images) != 1 || images[0].Platform == nil || images[0].Platform.Architecture != "amd64" {
+		t.Fatalf("unexpected images: %+v", images)
+	}
+}
+
+func TestOpenArchive_GzipDockerTarball(t *testing.T) {
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "image.tar")
+	writeDockerTar(t, raw, randomPlatformImage(t, "arm64"))
+	data, _ := os.ReadFile(raw)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(data)
+	gz.Close()
+	path := filepath.Join(dir, "image.tar.gz")
+	os.WriteFile(path, buf.Bytes(), 0644)
+
+	arc, err := OpenArchive(path)
+	if err != nil {
+		t.Fatalf("open archive: %v", err)
+	}
+	defer arc.Close()
+
+	if arc.Compression != CompressionGzip || arc.Format != ArchiveFormatDocker {
+		t.Fatalf("unexpected format=%s compression=%s", arc.Format, arc.Compression)
+	}
+	images, _ := arc.Images()
+	if len(images) != 1 || images[0].Platform.Architecture != "arm64" {
+		t.Fatalf("unexpected images: %+v", images)
+	}
+}
+
+func TestOpenArchive_ZstdOCIArchiveWithNestedIndex(t *testing.T) {
+	dir := t.TempDir()
+	amd := randomPlatformImage(t, "amd64")
+	arm := randomPlatformImage(t, "arm64")
+
+	// Child descriptors without platform to exercise config fallback
+	inner := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: amd},
+		mutate.IndexAddendum{Add: arm},
+	)
+	outer := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add: inner,
+		Descriptor: v1.Descriptor{
+			Annotations: map[string]string{annotationRefName: "2.0"},
+		},
+	})
+	layoutDir := filepath.Join(dir, "layout")
+	if _, err := layout.Write(layoutDir, outer); err != nil {
+		t.Fatalf("write layout: %v", err)
+	}
+
+	var buf bytes.Buffer
+	zw, _ := zstd.NewWriter(&buf)
+	zw.Write(tarDir(t, layoutDir))
+	zw.Close()
+	path := filepath.Join(dir, "image.tar.zst")
+	os.WriteFile(path, buf.Bytes(), 0644)
+
+	arc, err := OpenArchive(path)
+	if err != nil {
+		t.Fatalf("open archive: %v", err)
+	}
+	defer arc.Close()
+
+	if arc.Format != ArchiveFormatOCI || arc.Compression != CompressionZstd {
+		t.Fatalf("unexpected format=%s compression=%s", arc.Format, arc.Compression)
+	}
+	if len(arc.RepoTags) != 1 || arc.RepoTags[0] != "2.0" {
+		t.Fatalf("unexpected repo tags: %v", arc.RepoTags)
+	}
+	images, _ := arc.Images()
+	if len(images) != 2 {
+		t.Fatalf("expected 2 flattened images, got %d", len(images))
+	}
+	archs := map[string]bool{}
+	for _, d := range images {
+		if d.Platform == nil {
+			t.Fatalf("missing platform on %s", d.Digest)
+		}
+		archs[d.Platform.Architecture] = true
+	}
+	if !archs["amd64"] || !archs["arm64"] {
+		t.Fatalf("unexpected platforms: %v", archs)
+	}
+
+	// Images must still be readable after flattening
+	for _, d := range images {
+		img, err := arc.Index.Image(d.Digest)
+		if err != nil {
+			t.Fatalf("image %s: %v", d.Digest, err)
+		}
+		if _, err := img.Layers(); err != nil {
+			t.Fatalf("layers %s: %v", d.Digest, err)
+		}
+	}
+}
+
+func TestOpenArchive_MultiImageDockerTarball(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "images.tar")
+	app, _ := name.NewTag("example.com/app:1.0")
+	db, _ := name.NewTag("example.com/db:2.0")
+	err := tarball.MultiWriteToFile(path, map[name.Tag]v1.Image{
+		app: randomPlatformImage(t, "amd64"),
+		db:  randomPlatformImage(t, "arm64"),
+	})
+	if err != nil {
+		t.Fatalf("write docker tar: %v", err)
+	}
+
+	arc, err := OpenArchive(path)
+	if err != nil {
+		t.Fatalf("open archive: %v", err)
+	}
+	defer arc.Close()
+	images, _ := arc.Images()
+	if len(images) != 2 {
+		t.Fatalf("expected both images, got %+v", images)
+	}
+	refs := map[string]string{}
+	for _, d := range images {
+		refs[d.Annotations[annotationRefName]] = d.Platform.Architecture
+	}
+	if refs[app.String()] != "amd64" || refs[db.String()] != "arm64" {
+		t.Fatalf("unexpected images: %v", refs)
+	}
+}
+
+func TestOpenArchive_MissingChildFails(t *testing.T) {
+	dir := t.TempDir()
+	amd := randomPlatformImage(t, "amd64")
+	arm := randomPlatformImage(t, "arm64")
+	idx := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: amd},
+		mutate.IndexAddendum{Add: arm},
+	)
+	layoutDir := filepath.Join(dir, "layout")
+	if _, err := layout.Write(layoutDir, idx); err != nil {
+		t.Fatalf("write layout: %v", err)
+	}
+	armDigest, _ := arm.Digest()
+	os.Remove(filepath.Join(layoutDir, "blobs", armDigest.Algorithm, armDigest.Hex))
+
+	path := filepath.Join(dir, "image.tar")
+	os.WriteFile(path, tarDir(t, layoutDir), 0644)
+	if _, err := OpenArchive(path); err == nil {
+		t.Fatalf("an archive with a missing child manifest should be rejected")
+	}
+}
+
+func TestOpenArchive_Volumes(t *testing.T) {
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "raw.tar")
+	writeDockerTar(t, raw, randomPlatformImage(t, "amd64"))
+	data, _ := os.ReadFile(raw)
+
+	path := filepath.Join(dir, "image.tar")
+	w, err := volume.Create(path, int64(len(data)/3+1))
+	if err != nil {
+		t.Fatalf("create volumes: %v", err)
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatalf("close volumes: %v", err)
+	}
+
+	for _, p := range []string{volume.IndexPath(path), path + ".001", path} {
+		arc, err := OpenArchive(p)
+		if err != nil {
+			t.Fatalf("open %s: %v", filepath.Base(p), err)
+		}
+		images, _ := arc.Images()
+		arc.Close()
+		if arc.Format != ArchiveFormatDocker || len(images) != 1 {
+			t.Fatalf("%s: unexpected format=%s images=%d", filepath.Base(p), arc.Format, len(images))
+		}
+	}
+
+	os.Remove(path + ".002")
+	var cerr *volume.CheckError
+	if _, err := OpenArchive(volume.IndexPath(path)); !errors.As(err, &cerr) || len(cerr.Missing) != 1 {
+		t.Fatalf("expected the missing volume to be named, got %v", err)
+	}
+}
+
+func TestOpenArchive_RejectsUnknownTar(t *testing.T) {
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "hello.txt", Mode: 0644, Size: 2})
+	tw.Write([]byte("hi"))
+	tw.Close()
+	path := filepath.Join(dir, "junk.tar")
+	os.WriteFile(path, buf.Bytes(), 0644)
+
+	if _, err := OpenArchive(path); err == nil {
+		t.Fatalf("expected error for unrecognized archive")
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("expected work directory to be cleaned up, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,194 @@
+package engine
+
+import (
+	"sort"
+	"strings"
+)
+
+// ImageDiff describes how the image or index at Right differs from Left.
+type ImageDiff struct {
+	Left        string `json:"left"`
+	Right       string `json:"right"`
+	LeftDigest  string `json:"left_digest"`
+	RightDigest string `json:"right_digest"`
+	Identical   bool   `json:"identical"`
+	// Manifest lists differences of the top level manifest, e.g. an index
+	// compared to a single image.
+	Manifest  []FieldChange     `json:"manifest,omitempty"`
+	SizeDelta int64             `json:"size_delta"` // Right.Size - Left.Size
+	Platforms *PlatformSetDiff  `json:"platforms,omitempty"`
+	Images    []ImageChangeDiff `json:"images,omitempty"`
+}
+
+// PlatformSetDiff compares the platforms of two indexes.
+type PlatformSetDiff struct {
+	Common    []string `json:"common"`
+	OnlyLeft  []string `json:"only_left,omitempty"`
+	OnlyRight []string `json:"only_right,omitempty"`
+}
+
+// ImageChangeDiff compares the images of one platform on both sides.
+type ImageChangeDiff struct {
+	Platform        string            `json:"platform"`
+	LeftDigest      string            `json:"left_digest"`
+	RightDigest     string            `json:"right_digest"`
+	Identical       bool              `json:"identical"`
+	Changes         []FieldChange     `json:"changes,omitempty"`
+	SharedLayers    int               `json:"shared_layers"`
+	OnlyLeftLayers  []LayerInspection `json:"only_left_layers,omitempty"`
+	OnlyRightLayers []LayerInspection `json:"only_right_layers,omitempty"`
+	SizeDelta       int64             `json:"size_delta"`
+}
+
+// FieldChange is a manifest or config field with different values. Env
+// variables and labels are compared one by one, as env.NAME and label.KEY;
+// an empty side means the field is not set.
+type FieldChange struct {
+	Field string `json:"field"`
+	Left  string `json:"left"`
+	Right string `json:"right"`
+}
+
+// DiffInspections compares two inspections, see Inspect. A single image is
+// compared with the image of the same platform of an index; two single
+// images are compared whatever their platforms.
+func DiffInspections(left, right *Inspection) *ImageDiff {
+	d := &ImageDiff{
+		Left:        left.Ref,
+		Right:       right.Ref,
+		LeftDigest:  left.Digest,
+		RightDigest: right.Digest,
+		Identical:   left.Digest == right.Digest,
+		SizeDelta:   right.Size - left.Size,
+	}
+	d.Manifest = appendChange(d.Manifest, "media_type", left.MediaType, right.MediaType)
+
+	if left.Image != nil && right.Image != nil {
+		d.Images = append(d.Images, diffImages(left.Image.Platform, left.Image, right.Image))
+		return d
+	}
+
+	lp, rp := platformImages(left), platformImages(right)
+	d.Platforms = &PlatformSetDiff{Common: []string{}}
+	for _, p := range sortedKeys(lp) {
+		if _, ok := rp[p]; ok {
+			d.Platforms.Common = append(d.Platforms.Common, p)
+		} else {
+			d.Platforms.OnlyLeft = append(d.Platforms.OnlyLeft, p)
+		}
+	}
+	for _, p := range sortedKeys(rp) {
+		if _, ok := lp[p]; !ok {
+			d.Platforms.OnlyRight = append(d.Platforms.OnlyRight, p)
+		}
+	}
+	for _, p := range d.Platforms.Common {
+		d.Images = append(d.Images, diffImages(p, lp[p], rp[p]))
+	}
+	return d
+}
+
+// platformImages maps the runnable images of an inspection by platform.
+func platformImages(in *Inspection) map[string]*ImageInspection {
+	out := map[string]*ImageInspection{}
+	if in.Image != nil {
+		out[in.Image.Platform] = in.Image
+	}
+	for _, p := range in.Platforms {
+		if p.Image != nil {
+			if _, dup := out[p.Platform]; !dup {
+				out[p.Platform] = p.Image
+			}
+		}
+	}
+	return out
+}
+
+func diffImages(platform string, left, right *ImageInspection) ImageChangeDiff {
+	d := ImageChangeDiff{
+		Platform:    platform,
+		LeftDigest:  left.Digest,
+		RightDigest: right.Digest,
+		Identical:   left.Digest == right.Digest,
+		SizeDelta:   right.Size - left.Size,
+	}
+	lc, rc := left.Config, right.Config
+	d.Changes = appendChange(d.Changes, "media_type", left.MediaType, right.MediaType)
+	d.Changes = appendChange(d.Changes, "platform", left.Platform, right.Platform)
+	d.Changes = appendChange(d.Changes, "entrypoint", strings.Join(lc.Entrypoint, " "), strings.Join(rc.Entrypoint, " "))
+	d.Changes = appendChange(d.Changes, "cmd", strings.Join(lc.Cmd, " "), strings.Join(rc.Cmd, " "))
+	d.Changes = appendChange(d.Changes, "working_dir", lc.WorkingDir, rc.WorkingDir)
+	d.Changes = appendChange(d.Changes, "user", lc.User, rc.User)
+	d.Changes = appendChange(d.Changes, "exposed_ports", strings.Join(lc.ExposedPorts, ","), strings.Join(rc.ExposedPorts, ","))
+	if !lc.Created.Equal(rc.Created) {
+		d.Changes = append(d.Changes, FieldChange{"created", formatCreated(lc), formatCreated(rc)})
+	}
+	d.Changes = appendMapChanges(d.Changes, "env.", envMap(lc.Env), envMap(rc.Env))
+	d.Changes = appendMapChanges(d.Changes, "label.", lc.Labels, rc.Labels)
+
+	inRight := map[string]bool{}
+	for _, l := range right.Layers {
+		inRight[l.Digest] = true
+	}
+	inLeft := map[string]bool{}
+	for _, l := range left.Layers {
+		inLeft[l.Digest] = true
+		if inRight[l.Digest] {
+			d.SharedLayers++
+		} else {
+			d.OnlyLeftLayers = append(d.OnlyLeftLayers, l)
+		}
+	}
+	for _, l := range right.Layers {
+		if !inLeft[l.Digest] {
+			d.OnlyRightLayers = append(d.OnlyRightLayers, l)
+		}
+	}
+	return d
+}
+
+func appendChange(changes []FieldChange, field, left, right string) []FieldChange {
+	if left == right {
+		return changes
+	}
+	return append(changes, FieldChange{field, left, right})
+}
+
+func appendMapChanges(changes []FieldChange, prefix string, left, right map[string]string) []FieldChange {
+	keys := map[string]string{}
+	for k := range left {
+		keys[k] = ""
+	}
+	for k := range right {
+		keys[k] = ""
+	}
+	for _, k := range sortedKeys(keys) {
+		changes = appendChange(changes, prefix+k, left[k], right[k])
+	}
+	return changes
+}
+
+func envMap(env []string) map[string]string {
+	out := map[string]string{}
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		out[k] = v
+	}
+	return out
+}
+
+func formatCreated(c ImageConfigSummary) string {
+	if c.Created.IsZero() {
+		return ""
+	}
+	return c.Created.UTC().Format("2006-01-02T15:04:05Z")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func inspectIndexOf(t *testing.T, ref string, imgs ...v1.Image) *Inspection {
+	t.Helper()
+	var adds []mutate.IndexAddendum
+	for _, img := range imgs {
+		adds = append(adds, mutate.IndexAddendum{Add: img})
+	}
+	in, err := InspectIndex(ref, mutate.AppendManifests(empty.Index, adds...))
+	if err != nil {
+		t.Fatalf("inspect: %v", err)
+	}
+	return in
+}
+
+func TestDiffInspections_ConfigAndLayers(t *testing.T) {
+	base := randomPlatformImage(t, "amd64")
+	cfg, _ := base.ConfigFile()
+	cfg = cfg.DeepCopy()
+	cfg.Config.Env = []string{"PATH=/bin", "MODE=prod"}
+	cfg.Config.Labels = map[string]string{"team": "infra"}
+	left, err := mutate.ConfigFile(base, cfg)
+	if err != nil {
+		t.Fatalf("mutate: %v", err)
+	}
+
+	cfg = cfg.DeepCopy()
+	cfg.Config.Env = []string{"PATH=/bin", "MODE=debug"}
+	cfg.Config.Labels = nil
+	cfg.Config.Entrypoint = []string{"/app", "--debug"}
+	right, err := mutate.ConfigFile(base, cfg)
+	if err != nil {
+		t.Fatalf("mutate: %v", err)
+	}
+	extra, err := random.Layer(128, "application/vnd.oci.image.layer.v1.tar+gzip")
+	if err != nil {
+		t.Fatalf("layer: %v", err)
+	}
+	if right, err = mutate.AppendLayers(right, extra); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+
+	l, _ := InspectImage("src/app:1.0", left)
+	r, _ := InspectImage("dst/app:1.0", right)
+	d := DiffInspections(l, r)
+	if d.Identical || d.Platforms != nil || len(d.Images) != 1 {
+		t.Fatalf("unexpected diff: %+v", d)
+	}
+	img := d.Images[0]
+	changes := map[string]FieldChange{}
+	for _, c := range img.Changes {
+		changes[c.Field] = c
+	}
+	if c := changes["env.MODE"]; c.Left != "prod" || c.Right != "debug" {
+		t.Fatalf("expected env.MODE change, got %+v", img.Changes)
+	}
+	if c := changes["label.team"]; c.Left != "infra" || c.Right != "" {
+		t.Fatalf("expected removed label, got %+v", img.Changes)
+	}
+	if c := changes["entrypoint"]; c.Right != "/app --debug" {
+		t.Fatalf("expected entrypoint change, got %+v", img.Changes)
+	}
+	if _, ok := changes["env.PATH"]; ok {
+		t.Fatalf("unchanged env should not be reported")
+	}
+	if img.SharedLayers != 1 || len(img.OnlyLeftLayers) != 0 || len(img.OnlyRightLayers) != 1 {
+		t.Fatalf("unexpected layers: %+v", img)
+	}
+	if d.SizeDelta <= 0 || d.SizeDelta != r.Size-l.Size {
+		t.Fatalf("unexpected size delta %d", d.SizeDelta)
+	}
+}
+
+func TestDiffInspections_Platforms(t *testing.T) {
+	amd := randomPlatformImage(t, "amd64")
+	arm := randomPlatformImage(t, "arm64")
+	s390x := randomPlatformImage(t, "s390x")
+
+	d := DiffInspections(inspectIndexOf(t, "src", amd, arm), inspectIndexOf(t, "dst", amd, s390x))
+	p := d.Platforms
+	if p == nil || len(p.Common) != 1 || p.Common[0] != "linux/amd64" {
+		t.Fatalf("unexpected platforms: %+v", p)
+	}
+	if len(p.OnlyLeft) != 1 || p.OnlyLeft[0] != "linux/arm64" || len(p.OnlyRight) != 1 || p.OnlyRight[0] != "linux/s390x" {
+		t.Fatalf("unexpected platforms: %+v", p)
+	}
+	if len(d.Images) != 1 || !d.Images[0].Identical {
+		t.Fatalf("common platform should be identical: %+v", d.Images)
+	}
+
+	// A single image is compared to the matching platform of an index
+	single, _ := InspectImage("single", arm)
+	d = DiffInspections(inspectIndexOf(t, "src", amd, arm), single)
+	if len(d.Manifest) != 1 || d.Manifest[0].Field != "media_type" {
+		t.Fatalf("expected a media type change, got %+v", d.Manifest)
+	}
+	if len(d.Images) != 1 || d.Images[0].Platform != "linux/arm64" || !d.Images[0].Identical {
+		t.Fatalf("unexpected images: %+v", d.Images)
+	}
+
+	same := inspectIndexOf(t, "src", amd, arm)
+	if d = DiffInspections(same, same); !d.Identical {
+		t.Fatalf("expected identical indexes")
+	}
+}
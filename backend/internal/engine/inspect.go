@@ -0,0 +1,212 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Inspection describes an image or image index without pulling its layers.
+type Inspection struct {
+	Ref       string `json:"ref"`
+	MediaType string `json:"media_type"`
+	Digest    string `json:"digest"`
+	// Size is the compressed size of all blobs: manifests, configs and
+	// layers, counting layers shared by several platforms once.
+	Size      int64                `json:"size"`
+	Platforms []PlatformInspection `json:"platforms,omitempty"` // set for indexes
+	Image     *ImageInspection     `json:"image,omitempty"`     // set for single images
+}
+
+// PlatformInspection is an entry of an index. Image is nil for attestation
+// manifests and nested indexes.
+type PlatformInspection struct {
+	Platform  string           `json:"platform,omitempty"`
+	MediaType string           `json:"media_type"`
+	Digest    string           `json:"digest"`
+	Image     *ImageInspection `json:"image,omitempty"`
+}
+
+// ImageInspection describes a single image.
+type ImageInspection struct {
+	MediaType string             `json:"media_type"`
+	Digest    string             `json:"digest"`
+	Platform  string             `json:"platform,omitempty"`
+	Size      int64              `json:"size"` // manifest, config and compressed layers
+	Config    ImageConfigSummary `json:"config"`
+	Layers    []LayerInspection  `json:"layers"`
+	History   []v1.History       `json:"history,omitempty"`
+}
+
+// ImageConfigSummary holds the runtime settings of an image config.
+type ImageConfigSummary struct {
+	Created      time.Time         `json:"created,omitempty"`
+	Author       string            `json:"author,omitempty"`
+	Entrypoint   []string          `json:"entrypoint,omitempty"`
+	Cmd          []string          `json:"cmd,omitempty"`
+	Env          []string          `json:"env,omitempty"`
+	WorkingDir   string            `json:"working_dir,omitempty"`
+	User         string            `json:"user,omitempty"`
+	ExposedPorts []string          `json:"exposed_ports,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+}
+
+// LayerInspection is a layer of an image manifest.
+type LayerInspection struct {
+	Digest    string `json:"digest"`
+	MediaType string `json:"media_type"`
+	Size      int64  `json:"size"`
+}
+
+// Inspect describes the image or index at opts.SourceRef, or in the local
+// layout opts.SourceLayoutPath. Only manifests and configs are read.
+func (s *Syncer) Inspect(opts SyncOptions) (*Inspection, error) {
+	idx, img, err := s.loadSource(opts)
+	if err != nil {
+		return nil, err
+	}
+	if img != nil {
+		return InspectImage(opts.SourceRef, img)
+	}
+	return InspectIndex(opts.SourceRef, idx)
+}
+
+// loadSource reads the source of opts from its local layout or registry.
+func (s *Syncer) loadSource(opts SyncOptions) (v1.ImageIndex, v1.Image, error) {
+	if opts.SourceLayoutPath != "" {
+		return loadSourceLayout(opts)
+	}
+	return s.Fetch(opts.SourceRef, opts.SourceAuth)
+}
+
+// InspectImage describes a single image.
+func InspectImage(ref string, img v1.Image) (*Inspection, error) {
+	ii, err := inspectImage(img, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Inspection{
+		Ref:       ref,
+		MediaType: ii.MediaType,
+		Digest:    ii.Digest,
+		Size:      ii.Size,
+		Image:     ii,
+	}, nil
+}
+
+// InspectIndex describes an index and each of its platform images.
+func InspectIndex(ref string, idx v1.ImageIndex) (*Inspection, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	digest, err := idx.Digest()
+	if err != nil {
+		return nil, err
+	}
+	mediaType, err := idx.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := idx.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	out := &Inspection{
+		Ref:       ref,
+		MediaType: string(mediaType),
+		Digest:    digest.String(),
+		Size:      int64(len(raw)),
+	}
+	blobs := map[v1.Hash]int64{}
+	for _, d := range im.Manifests {
+		p := PlatformInspection{MediaType: string(d.MediaType), Digest: d.Digest.String()}
+		if d.Platform != nil {
+			p.Platform = d.Platform.String()
+		}
+		blobs[d.Digest] = d.Size
+		if d.MediaType.IsImage() && (d.Platform == nil || d.Platform.OS != "unknown") {
+			img, err := idx.Image(d.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", d.Digest, err)
+			}
+			if p.Image, err = inspectImage(img, blobs); err != nil {
+				return nil, err
+			}
+			if p.Platform == "" {
+				p.Platform = p.Image.Platform
+			}
+		}
+		out.Platforms = append(out.Platforms, p)
+	}
+	for _, size := range blobs {
+		out.Size += size
+	}
+	return out, nil
+}
+
+// inspectImage describes img, adding its blobs to blobs when not nil.
+func inspectImage(img v1.Image, blobs map[v1.Hash]int64) (*ImageInspection, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image config: %w", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := img.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	out := &ImageInspection{
+		MediaType: string(mediaType),
+		Digest:    digest.String(),
+		Size:      int64(len(raw)) + m.Config.Size,
+		Config: ImageConfigSummary{
+			Created:    cfg.Created.Time,
+			Author:     cfg.Author,
+			Entrypoint: cfg.Config.Entrypoint,
+			Cmd:        cfg.Config.Cmd,
+			Env:        cfg.Config.Env,
+			WorkingDir: cfg.Config.WorkingDir,
+			User:       cfg.Config.User,
+			Labels:     cfg.Config.Labels,
+		},
+		History: cfg.History,
+	}
+	if p := cfg.Platform(); p != nil && p.OS != "" {
+		out.Platform = p.String()
+	}
+	for port := range cfg.Config.ExposedPorts {
+		out.Config.ExposedPorts = append(out.Config.ExposedPorts, port)
+	}
+	sort.Strings(out.Config.ExposedPorts)
+	if blobs != nil {
+		blobs[m.Config.Digest] = m.Config.Size
+	}
+	for _, l := range m.Layers {
+		out.Layers = append(out.Layers, LayerInspection{
+			Digest:    l.Digest.String(),
+			MediaType: string(l.MediaType),
+			Size:      l.Size,
+		})
+		out.Size += l.Size
+		if blobs != nil {
+			blobs[l.Digest] = l.Size
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,88 @@
+package engine
+
+import (
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+func TestInspectImage_Config(t *testing.T) {
+	img := randomPlatformImage(t, "arm64")
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	cfg = cfg.DeepCopy()
+	cfg.Config.Entrypoint = []string{"/app"}
+	cfg.Config.Env = []string{"PATH=/bin"}
+	cfg.Config.Labels = map[string]string{"team": "infra"}
+	cfg.Config.ExposedPorts = map[string]struct{}{"8080/tcp": {}, "443/tcp": {}}
+	cfg.History = []v1.History{{CreatedBy: "COPY app /app"}}
+	if img, err = mutate.ConfigFile(img, cfg); err != nil {
+		t.Fatalf("mutate config: %v", err)
+	}
+
+	got, err := InspectImage("team/app:1.0", img)
+	if err != nil {
+		t.Fatalf("inspect: %v", err)
+	}
+	if got.Image == nil || got.Platforms != nil {
+		t.Fatalf("expected a single image, got %+v", got)
+	}
+	if got.Digest != digestOf(t, img) || got.Image.Platform != "linux/arm64" {
+		t.Fatalf("unexpected digest or platform: %+v", got.Image)
+	}
+	c := got.Image.Config
+	if len(c.Entrypoint) != 1 || c.Labels["team"] != "infra" || len(c.Env) != 1 {
+		t.Fatalf("unexpected config: %+v", c)
+	}
+	if len(c.ExposedPorts) != 2 || c.ExposedPorts[0] != "443/tcp" {
+		t.Fatalf("expected sorted ports, got %v", c.ExposedPorts)
+	}
+	if len(got.Image.History) != 1 || got.Image.History[0].CreatedBy != "COPY app /app" {
+		t.Fatalf("unexpected history: %+v", got.Image.History)
+	}
+
+	m, _ := img.Manifest()
+	raw, _ := img.RawManifest()
+	want := int64(len(raw)) + m.Config.Size
+	for _, l := range m.Layers {
+		want += l.Size
+	}
+	if got.Size != want || len(got.Image.Layers) != len(m.Layers) {
+		t.Fatalf("expected size %d with %d layers, got %d with %d", want, len(m.Layers), got.Size, len(got.Image.Layers))
+	}
+}
+
+func TestInspectIndex_Platforms(t *testing.T) {
+	amd := randomPlatformImage(t, "amd64")
+	arm := randomPlatformImage(t, "arm64")
+	attestation := randomPlatformImage(t, "amd64")
+	idx := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: amd},
+		mutate.IndexAddendum{Add: arm, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}}},
+		mutate.IndexAddendum{Add: attestation, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "unknown", Architecture: "unknown"}}},
+	)
+
+	got, err := InspectIndex("team/app:1.0", idx)
+	if err != nil {
+		t.Fatalf("inspect: %v", err)
+	}
+	if len(got.Platforms) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(got.Platforms))
+	}
+	if got.Platforms[0].Platform != "linux/amd64" || got.Platforms[0].Image == nil {
+		t.Fatalf("platform should come from the config: %+v", got.Platforms[0])
+	}
+	if got.Platforms[1].Platform != "linux/arm64/v8" {
+		t.Fatalf("descriptor platform should win: %+v", got.Platforms[1])
+	}
+	if got.Platforms[2].Image != nil {
+		t.Fatalf("attestations should not be described")
+	}
+	if got.Size <= got.Platforms[0].Image.Size+got.Platforms[1].Image.Size {
+		t.Fatalf("index size %d should cover both images", got.Size)
+	}
+}
@@ -0,0 +1,150 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/guoxudong/horcrux/internal/inventory"
+	"github.com/guoxudong/horcrux/internal/vault"
+)
+
+// InventoryOptions selects the images analyzed by Syncer.Inventory and the
+// document produced for each.
+type InventoryOptions struct {
+	Platform string // e.g. linux/amd64; empty analyzes every platform
+	Format   string // inventory.FormatCycloneDX (default) or FormatSPDX
+	// Attach pushes each document next to its image, as an OCI referrer
+	// in the repository of the source. Registry sources only.
+	Attach bool
+}
+
+// InventoryResult is the inventory of one image.
+type InventoryResult struct {
+	Platform  string               `json:"platform,omitempty"`
+	Digest    string               `json:"digest"`
+	Inventory *inventory.Inventory `json:"inventory"`
+	MediaType string               `json:"media_type"`
+	Document  json.RawMessage      `json:"document"`
+	Referrer  string               `json:"referrer,omitempty"` // digest of the attached document
+}
+
+// Inventory lists the OS packages and locked dependencies of the image at
+// src.SourceRef, or in the local layout src.SourceLayoutPath. Each selected
+// platform image of an index is analyzed on its own; its layers are read
+// but nothing is written locally.
+func (s *Syncer) Inventory(src SyncOptions, opts InventoryOptions) ([]InventoryResult, error) {
+	format, err := inventory.ParseFormat(opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Attach && src.SourceLayoutPath != "" {
+		return nil, errors.New("documents can only be attached to registry images")
+	}
+	var want *v1.Platform
+	if opts.Platform != "" {
+		if want, err = v1.ParsePlatform(opts.Platform); err != nil {
+			return nil, fmt.Errorf("invalid platform %q: %v", opts.Platform, err)
+		}
+	}
+
+	idx, img, err := s.loadSource(src)
+	if err != nil {
+		return nil, err
+	}
+	var adds []mutate.IndexAddendum
+	if img != nil {
+		add, err := imageAddendum(img, v1.Descriptor{})
+		if err != nil {
+			return nil, err
+		}
+		adds = append(adds, add)
+	} else if adds, err = flattenIndex(idx); err != nil {
+		return nil, err
+	}
+
+	var results []InventoryResult
+	for _, add := range adds {
+		desc := add.Descriptor
+		platform := ""
+		if desc.Platform != nil {
+			platform = desc.Platform.String()
+		}
+		if want != nil && (desc.Platform == nil || !desc.Platform.Satisfies(*want)) {
+			continue
+		}
+
+		s.logProgress("INFO", fmt.Sprintf("Analyzing %s %s...", platform, desc.Digest), "inventory", 0.1+0.8*float64(len(results))/float64(len(adds)))
+		inv, err := inventory.Analyze(add.Add.(v1.Image))
+		if err != nil {
+			return results, fmt.Errorf("failed to analyze %s: %w", desc.Digest, err)
+		}
+		doc, err := inventory.Document(format, inv, inventory.Subject{
+			Name:     src.SourceRef,
+			Digest:   desc.Digest.String(),
+			Platform: platform,
+		})
+		if err != nil {
+			return results, err
+		}
+		result := InventoryResult{
+			Platform:  platform,
+			Digest:    desc.Digest.String(),
+			Inventory: inv,
+			MediaType: inventory.MediaType(format),
+			Document:  doc,
+		}
+		s.log("INFO", fmt.Sprintf("%s: %d package(s)", desc.Digest, len(inv.Packages)))
+
+		if opts.Attach {
+			if result.Referrer, err = s.AttachReferrer(src.SourceRef, src.SourceAuth, desc, result.MediaType, doc); err != nil {
+				return results, err
+			}
+		}
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no image of %s matches platform %s", src.SourceRef, opts.Platform)
+	}
+	return results, nil
+}
+
+// AttachReferrer pushes data as an OCI artifact of artifactType whose
+// subject is the manifest subject, in the repository of ref. Registries
+// without the referrers API get the fallback tag updated. It returns the
+// digest of the artifact manifest.
+func (s *Syncer) AttachReferrer(ref string, auth *vault.Credential, subject v1.Descriptor, artifactType string, data []byte) (string, error) {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse reference: %v", err)
+	}
+	img, err := mutate.AppendLayers(empty.Image, static.NewLayer(data, types.MediaType(artifactType)))
+	if err != nil {
+		return "", err
+	}
+	img = mutate.MediaType(img, types.OCIManifestSchema1)
+	img = mutate.ConfigMediaType(img, types.MediaType(artifactType))
+	img = mutate.Subject(img, v1.Descriptor{
+		MediaType: subject.MediaType,
+		Digest:    subject.Digest,
+		Size:      subject.Size,
+	}).(v1.Image)
+
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+	dst := r.Context().Digest(digest.String())
+	if err := remote.Write(dst, img, s.remoteOptions(s.ctx, s.getAuth(auth))...); err != nil {
+		return "", fmt.Errorf("failed to attach %s to %s: %w", artifactType, subject.Digest, err)
+	}
+	s.log("INFO", fmt.Sprintf("Attached %s %s to %s", artifactType, digest, subject.Digest))
+	return digest.String(), nil
+}
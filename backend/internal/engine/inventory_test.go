@@ -0,0 +1,74 @@
+package engine
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/guoxudong/horcrux/internal/inventory"
+)
+
+func TestInventory_AttachesReferrer(t *testing.T) {
+	for _, referrersAPI := range []bool{true, false} {
+		srv := httptest.NewServer(registry.New(registry.WithReferrersSupport(referrersAPI)))
+		host := strings.TrimPrefix(srv.URL, "http://")
+
+		amd := randomPlatformImage(t, "amd64")
+		arm := randomPlatformImage(t, "arm64")
+		ref, err := name.ParseReference(host + "/team/app:1.0")
+		if err != nil {
+			t.Fatalf("ref: %v", err)
+		}
+		idx := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: amd}, mutate.IndexAddendum{Add: arm})
+		if err := remote.WriteIndex(ref, idx); err != nil {
+			t.Fatalf("push: %v", err)
+		}
+
+		results, err := NewSyncer(nil).Inventory(SyncOptions{SourceRef: ref.String()}, InventoryOptions{
+			Platform: "linux/arm64",
+			Format:   inventory.FormatSPDX,
+			Attach:   true,
+		})
+		if err != nil {
+			t.Fatalf("inventory: %v", err)
+		}
+		if len(results) != 1 || results[0].Platform != "linux/arm64" || results[0].Digest != digestOf(t, arm) {
+			t.Fatalf("unexpected results: %+v", results)
+		}
+		if results[0].MediaType != inventory.MediaTypeSPDX || results[0].Referrer == "" {
+			t.Fatalf("expected an attached spdx document: %+v", results[0])
+		}
+
+		referrers, err := remote.Referrers(ref.Context().Digest(results[0].Digest))
+		if err != nil {
+			t.Fatalf("referrers: %v", err)
+		}
+		im, err := referrers.IndexManifest()
+		if err != nil {
+			t.Fatalf("referrers manifest: %v", err)
+		}
+		if len(im.Manifests) != 1 || im.Manifests[0].Digest.String() != results[0].Referrer ||
+			im.Manifests[0].ArtifactType != inventory.MediaTypeSPDX {
+			t.Fatalf("referrers API %v: unexpected referrers %+v", referrersAPI, im.Manifests)
+		}
+		srv.Close()
+	}
+}
+
+func TestInventory_Errors(t *testing.T) {
+	s := NewSyncer(nil)
+	if _, err := s.Inventory(SyncOptions{SourceRef: "archive://x", SourceLayoutPath: t.TempDir()}, InventoryOptions{Attach: true}); err == nil {
+		t.Fatalf("attaching to a layout should fail")
+	}
+	if _, err := s.Inventory(SyncOptions{SourceRef: "team/app:1.0"}, InventoryOptions{Format: "xml"}); err == nil {
+		t.Fatalf("expected an unknown format error")
+	}
+	if _, err := s.Inventory(SyncOptions{SourceRef: "team/app:1.0"}, InventoryOptions{Platform: "linux/amd64/v1/x"}); err == nil {
+		t.Fatalf("expected an invalid platform error")
+	}
+}
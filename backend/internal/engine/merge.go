@@ -0,0 +1,237 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// Policies for a platform provided by several merge sources
+const (
+	PlatformPolicyError  = "error"  // reject the merge
+	PlatformPolicyFirst  = "first"  // keep the image of the first source
+	PlatformPolicyNewest = "newest" // keep the image created last
+)
+
+// ErrAmbiguousPlatform is returned by MergeIndex when an image of the merged
+// index would have an unknown platform, or several images the same one.
+var ErrAmbiguousPlatform = errors.New("ambiguous platform")
+
+// ParsePlatformPolicy validates a duplicate platform policy; empty selects
+// PlatformPolicyError.
+func ParsePlatformPolicy(p string) (string, error) {
+	switch p = strings.ToLower(strings.TrimSpace(p)); p {
+	case "":
+		return PlatformPolicyError, nil
+	case PlatformPolicyError, PlatformPolicyFirst, PlatformPolicyNewest:
+		return p, nil
+	}
+	return "", fmt.Errorf("platform policy must be %q, %q or %q", PlatformPolicyError, PlatformPolicyFirst, PlatformPolicyNewest)
+}
+
+// MergeInput is one source of MergeIndex, either an index or an image.
+type MergeInput struct {
+	Source string // shown in the report
+	Index  v1.ImageIndex
+	Image  v1.Image
+	// Nest keeps Index as a single nested entry instead of adding its
+	// platform images. An index sharing a platform with another input is
+	// flattened anyway, so the platform policy can pick one image.
+	Nest bool
+}
+
+// MergedPlatform is an entry of a merged index and the source it came from.
+type MergedPlatform struct {
+	Platform string `json:"platform"` // platforms of the index when nested
+	Source   string `json:"source"`
+	Digest   string `json:"digest"`
+	Nested   bool   `json:"nested,omitempty"`
+}
+
+// MergeReport lists each platform of a merged index with its source, and
+// the duplicates left out by the platform policy.
+type MergeReport struct {
+	Policy    string           `json:"policy"`
+	Digest    string           `json:"digest,omitempty"` // of the pushed index
+	Platforms []MergedPlatform `json:"platforms"`
+	Dropped   []MergedPlatform `json:"dropped,omitempty"`
+}
+
+type mergeCandidate struct {
+	add   mutate.IndexAddendum
+	entry MergedPlatform
+}
+
+// MergeIndex merges inputs into one index holding a single image per
+// platform. Indexes are flattened unless nested by MergeInput.Nest, and
+// platform fields missing from descriptors are taken from the image configs;
+// an image whose platform stays unknown is rejected, since runtimes could
+// not select it. The same image listed twice is added once.
+func MergeIndex(inputs []MergeInput, policy string) (v1.ImageIndex, *MergeReport, error) {
+	policy, err := ParsePlatformPolicy(policy)
+	if err != nil {
+		return nil, nil, err
+	}
+	report := &MergeReport{Policy: policy}
+	var entries []mergeCandidate
+	byPlatform := map[string]int{}
+
+	add := func(c mergeCandidate) error {
+		i, dup := byPlatform[c.entry.Platform]
+		if !dup {
+			byPlatform[c.entry.Platform] = len(entries)
+			entries = append(entries, c)
+			return nil
+		}
+		prev := entries[i]
+		if prev.entry.Digest == c.entry.Digest {
+			return nil
+		}
+		switch policy {
+		case PlatformPolicyFirst:
+			report.Dropped = append(report.Dropped, c.entry)
+		case PlatformPolicyNewest:
+			newer, err := createdAfter(c.add.Add.(v1.Image), prev.add.Add.(v1.Image))
+			if err != nil {
+				return err
+			}
+			if newer {
+				entries[i] = c
+				report.Dropped = append(report.Dropped, prev.entry)
+			} else {
+				report.Dropped = append(report.Dropped, c.entry)
+			}
+		default:
+			return fmt.Errorf("%w: %s is provided by both %s (%s) and %s (%s)", ErrAmbiguousPlatform,
+				c.entry.Platform, prev.entry.Source, prev.entry.Digest, c.entry.Source, c.entry.Digest)
+		}
+		return nil
+	}
+
+	// Nested indexes take part in duplicate detection: one that shares a
+	// platform with another input is added flattened, so the policy can
+	// pick a single image for that platform.
+	flat := make([][]mutate.IndexAddendum, len(inputs))
+	providers := map[string]map[int]bool{}
+	for i, in := range inputs {
+		if flat[i], err = inputAddenda(in); err != nil {
+			return nil, nil, err
+		}
+		for _, a := range flat[i] {
+			if p := a.Descriptor.Platform; p != nil {
+				if providers[p.String()] == nil {
+					providers[p.String()] = map[int]bool{}
+				}
+				providers[p.String()][i] = true
+			}
+		}
+	}
+	sharesPlatform := func(i int) bool {
+		for _, a := range flat[i] {
+			if p := a.Descriptor.Platform; p != nil && len(providers[p.String()]) > 1 {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i, in := range inputs {
+		if in.Nest && in.Image == nil && !sharesPlatform(i) {
+			entry, err := nestedEntry(in)
+			if err != nil {
+				return nil, nil, err
+			}
+			entries = append(entries, mergeCandidate{mutate.IndexAddendum{Add: in.Index}, entry})
+			continue
+		}
+
+		for _, a := range flat[i] {
+			p := a.Descriptor.Platform
+			if p == nil || p.OS == "" || p.Architecture == "" {
+				return nil, nil, fmt.Errorf("%w: cannot determine the platform of %s from %s", ErrAmbiguousPlatform, a.Descriptor.Digest, in.Source)
+			}
+			if err := add(mergeCandidate{a, MergedPlatform{
+				Platform: p.String(),
+				Source:   in.Source,
+				Digest:   a.Descriptor.Digest.String(),
+			}}); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	adds := make([]mutate.IndexAddendum, len(entries))
+	for i, c := range entries {
+		adds[i] = c.add
+		report.Platforms = append(report.Platforms, c.entry)
+	}
+	return mutate.AppendManifests(empty.Index, adds...), report, nil
+}
+
+// inputAddenda returns the images an input provides: the image itself, or
+// every image of the index and the indexes nested in it.
+func inputAddenda(in MergeInput) ([]mutate.IndexAddendum, error) {
+	if in.Image != nil {
+		a, err := imageAddendum(in.Image, v1.Descriptor{})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", in.Source, err)
+		}
+		return []mutate.IndexAddendum{a}, nil
+	}
+	adds, err := flattenIndex(in.Index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to flatten %s: %w", in.Source, err)
+	}
+	if len(adds) == 0 {
+		return nil, fmt.Errorf("%s holds no images", in.Source)
+	}
+	return adds, nil
+}
+
+func nestedEntry(in MergeInput) (MergedPlatform, error) {
+	digest, err := in.Index.Digest()
+	if err != nil {
+		return MergedPlatform{}, err
+	}
+	im, err := in.Index.IndexManifest()
+	if err != nil {
+		return MergedPlatform{}, err
+	}
+	var platforms []string
+	for _, d := range im.Manifests {
+		if d.Platform != nil && d.Platform.OS != "unknown" {
+			platforms = append(platforms, d.Platform.String())
+		}
+	}
+	return MergedPlatform{
+		Platform: strings.Join(platforms, ","),
+		Source:   in.Source,
+		Digest:   digest.String(),
+		Nested:   true,
+	}, nil
+}
+
+// createdAfter reports whether a was created after b, by image config.
+func createdAfter(a, b v1.Image) (bool, error) {
+	created := func(img v1.Image) (time.Time, error) {
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to read image config: %w", err)
+		}
+		return cfg.Created.Time, nil
+	}
+	ta, err := created(a)
+	if err != nil {
+		return false, err
+	}
+	tb, err := created(b)
+	if err != nil {
+		return false, err
+	}
+	return ta.After(tb), nil
+}
@@ -0,0 +1,172 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func createdImage(t *testing.T, arch string, created time.Time) v1.Image {
+	t.Helper()
+	img := randomPlatformImage(t, arch)
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	cfg = cfg.DeepCopy()
+	cfg.Created = v1.Time{Time: created}
+	img, err = mutate.ConfigFile(img, cfg)
+	if err != nil {
+		t.Fatalf("mutate config: %v", err)
+	}
+	return img
+}
+
+func digestOf(t *testing.T, img v1.Image) string {
+	t.Helper()
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatalf("digest: %v", err)
+	}
+	return d.String()
+}
+
+func TestMergeIndex_FillsPlatformsAndFlattens(t *testing.T) {
+	amd := randomPlatformImage(t, "amd64")
+	arm := randomPlatformImage(t, "arm64")
+	s390x := randomPlatformImage(t, "s390x")
+
+	// amd64 is listed without platform inside a nested index
+	nested := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: amd})
+	src := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: nested},
+		mutate.IndexAddendum{Add: arm, Descriptor: v1.Descriptor{
+			Platform:    &v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+			Annotations: map[string]string{"org.opencontainers.image.revision": "abc"},
+		}},
+	)
+
+	idx, report, err := MergeIndex([]MergeInput{
+		{Source: "multi", Index: src},
+		{Source: "single", Image: s390x},
+	}, "")
+	if err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if report.Policy != PlatformPolicyError {
+		t.Fatalf("expected default policy error, got %s", report.Policy)
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatalf("index manifest: %v", err)
+	}
+	want := []string{"linux/amd64", "linux/arm64/v8", "linux/s390x"}
+	if len(im.Manifests) != len(want) || len(report.Platforms) != len(want) {
+		t.Fatalf("expected %d manifests, got %d (report %d)", len(want), len(im.Manifests), len(report.Platforms))
+	}
+	for i, p := range want {
+		if got := im.Manifests[i].Platform.String(); got != p {
+			t.Fatalf("manifest %d: expected %s, got %s", i, p, got)
+		}
+		if report.Platforms[i].Platform != p {
+			t.Fatalf("report %d: expected %s, got %s", i, p, report.Platforms[i].Platform)
+		}
+	}
+	if report.Platforms[0].Source != "multi" || report.Platforms[2].Source != "single" {
+		t.Fatalf("unexpected sources: %+v", report.Platforms)
+	}
+	if im.Manifests[1].Annotations["org.opencontainers.image.revision"] != "abc" {
+		t.Fatalf("descriptor annotations were not kept: %v", im.Manifests[1].Annotations)
+	}
+}
+
+func TestMergeIndex_DuplicatePlatformPolicies(t *testing.T) {
+	older := createdImage(t, "amd64", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	newer := createdImage(t, "amd64", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	inputs := []MergeInput{
+		{Source: "old", Image: older},
+		{Source: "new", Image: newer},
+	}
+
+	if _, _, err := MergeIndex(inputs, PlatformPolicyError); !errors.Is(err, ErrAmbiguousPlatform) {
+		t.Fatalf("expected ErrAmbiguousPlatform, got %v", err)
+	}
+
+	for policy, keep := range map[string]v1.Image{PlatformPolicyFirst: older, PlatformPolicyNewest: newer} {
+		idx, report, err := MergeIndex(inputs, policy)
+		if err != nil {
+			t.Fatalf("%s: %v", policy, err)
+		}
+		im, _ := idx.IndexManifest()
+		if len(im.Manifests) != 1 || im.Manifests[0].Digest.String() != digestOf(t, keep) {
+			t.Fatalf("%s: kept the wrong image: %+v", policy, im.Manifests)
+		}
+		if len(report.Dropped) != 1 || report.Dropped[0].Digest == digestOf(t, keep) {
+			t.Fatalf("%s: unexpected dropped list: %+v", policy, report.Dropped)
+		}
+	}
+
+	// The same image from two sources is no conflict
+	_, report, err := MergeIndex([]MergeInput{{Source: "a", Image: older}, {Source: "b", Image: older}}, PlatformPolicyError)
+	if err != nil || len(report.Platforms) != 1 {
+		t.Fatalf("expected one entry for a repeated image, got %+v (%v)", report, err)
+	}
+
+	if _, err := ParsePlatformPolicy("last"); err == nil {
+		t.Fatalf("expected invalid policy error")
+	}
+}
+
+func TestMergeIndex_RejectsUnknownPlatform(t *testing.T) {
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatalf("random image: %v", err)
+	}
+	_, _, err = MergeIndex([]MergeInput{{Source: "noplatform", Image: img}}, PlatformPolicyFirst)
+	if !errors.Is(err, ErrAmbiguousPlatform) {
+		t.Fatalf("expected ErrAmbiguousPlatform, got %v", err)
+	}
+}
+
+func TestMergeIndex_NestedDuplicatePlatforms(t *testing.T) {
+	older := createdImage(t, "amd64", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	newer := createdImage(t, "amd64", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	arm := randomPlatformImage(t, "arm64")
+	s390x := randomPlatformImage(t, "s390x")
+	multi := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: older, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}},
+		mutate.IndexAddendum{Add: arm, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}}},
+	)
+	inputs := []MergeInput{
+		{Source: "multi", Index: multi, Nest: true},
+		{Source: "single", Image: newer},
+	}
+
+	if _, _, err := MergeIndex(inputs, PlatformPolicyError); !errors.Is(err, ErrAmbiguousPlatform) {
+		t.Fatalf("expected ErrAmbiguousPlatform for a platform inside a nested index, got %v", err)
+	}
+
+	// The overlapping index is flattened so the policy can pick an image
+	idx, report, err := MergeIndex(inputs, PlatformPolicyNewest)
+	if err != nil {
+		t.Fatalf("newest: %v", err)
+	}
+	im, _ := idx.IndexManifest()
+	if len(im.Manifests) != 2 || im.Manifests[0].Digest.String() != digestOf(t, newer) || im.Manifests[1].Digest.String() != digestOf(t, arm) {
+		t.Fatalf("unexpected manifests: %+v", im.Manifests)
+	}
+	if len(report.Dropped) != 1 || report.Dropped[0].Digest != digestOf(t, older) || report.Platforms[0].Nested {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	// Without overlap the index stays nested
+	_, report, err = MergeIndex([]MergeInput{inputs[0], {Source: "single", Image: s390x}}, PlatformPolicyError)
+	if err != nil || len(report.Platforms) != 2 || !report.Platforms[0].Nested {
+		t.Fatalf("expected the index to stay nested: %+v (%v)", report, err)
+	}
+}
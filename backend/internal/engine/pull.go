@@ -0,0 +1,187 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/guoxudong/horcrux/internal/vault"
+)
+
+// Fetch resolves ref in its registry and returns the image index or image it
+// points to. Exactly one of the returned values is non-nil on success.
+func (s *Syncer) Fetch(ref string, auth *vault.Credential) (v1.ImageIndex, v1.Image, error) {
+	src, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse source reference: %v", err)
+	}
+
+	desc, err := remote.Get(src, s.remoteOptions(s.ctx, s.getAuth(auth))...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch %s: %w", ref, err)
+	}
+	if desc.MediaType.IsIndex() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return nil, nil, err
+		}
+		return idx, nil, nil
+	}
+	img, err := desc.Image()
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, img, nil
+}
+
+// PullToLayout fetches ref with all its platforms and appends it to the OCI
+// layout at l. Blobs already in the layout are not downloaded again, nor are
+// layers for which skip returns true; skip may be nil. The new index.json
+// entry carries annotations and is returned.
+func (s *Syncer) PullToLayout(ref string, auth *vault.Credential, l layout.Path, annotations map[string]string, skip func(v1.Hash) bool) (v1.Descriptor, error) {
+	s.logProgress("SYNC", fmt.Sprintf("Fetching %s...", ref), "fetch_source", 0.1)
+	idx, img, err := s.Fetch(ref, auth)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	var desc *v1.Descriptor
+	s.logProgress("SYNC", fmt.Sprintf("Writing %s to layout...", ref), "write_layout", 0.5)
+	if idx != nil {
+		if skip == nil {
+			err = l.WriteIndex(idx)
+		} else {
+			err = writeIndexBlobs(l, idx, skip)
+		}
+		if err != nil {
+			return v1.Descriptor{}, fmt.Errorf("failed to write %s: %w", ref, err)
+		}
+		desc, err = partial.Descriptor(idx)
+	} else {
+		if skip == nil {
+			err = l.WriteImage(img)
+		} else {
+			err = writeImageBlobs(l, img, skip)
+		}
+		if err != nil {
+			return v1.Descriptor{}, fmt.Errorf("failed to write %s: %w", ref, err)
+		}
+		desc, err = partial.Descriptor(img)
+	}
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	desc.Annotations = annotations
+	if err := l.AppendDescriptor(*desc); err != nil {
+		return v1.Descriptor{}, err
+	}
+	s.logProgress("SUCCESS", fmt.Sprintf("Pulled %s (%s)", ref, desc.Digest), "done", 1)
+	return *desc, nil
+}
+
+// BlobExists reports whether the repository repo of a registry already holds
+// the blob h.
+func (s *Syncer) BlobExists(repo string, h v1.Hash, auth *vault.Credential) (bool, error) {
+	ref, err := name.NewDigest(repo + "@" + h.String())
+	if err != nil {
+		return false, err
+	}
+	layer, err := remote.Layer(ref, s.remoteOptions(s.ctx, s.getAuth(auth))...)
+	if err != nil {
+		return false, err
+	}
+	if e, ok := layer.(interface{ Exists() (bool, error) }); ok {
+		return e.Exists()
+	}
+	return false, fmt.Errorf("cannot check blob existence in %s", repo)
+}
+
+// writeIndexBlobs writes the blobs of idx and its children to l like
+// layout.WriteIndex, leaving out layers for which skip returns true.
+func writeIndexBlobs(l layout.Path, idx v1.ImageIndex, skip func(v1.Hash) bool) error {
+	m, err := idx.IndexManifest()
+	if err != nil {
+		return err
+	}
+	for _, d := range m.Manifests {
+		switch {
+		case d.MediaType.IsIndex():
+			child, err := idx.ImageIndex(d.Digest)
+			if err != nil {
+				return err
+			}
+			if err := writeIndexBlobs(l, child, skip); err != nil {
+				return err
+			}
+		case d.MediaType.IsImage():
+			img, err := idx.Image(d.Digest)
+			if err != nil {
+				return err
+			}
+			if err := writeImageBlobs(l, img, skip); err != nil {
+				return err
+			}
+		}
+	}
+
+	raw, err := idx.RawManifest()
+	if err != nil {
+		return err
+	}
+	h, err := idx.Digest()
+	if err != nil {
+		return err
+	}
+	return l.WriteBlob(h, io.NopCloser(bytes.NewReader(raw)))
+}
+
+func writeImageBlobs(l layout.Path, img v1.Image, skip func(v1.Hash) bool) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		h, err := layer.Digest()
+		if err != nil {
+			return err
+		}
+		if skip(h) {
+			continue
+		}
+		rc, err := layer.Compressed()
+		if err != nil {
+			return err
+		}
+		if err := l.WriteBlob(h, rc); err != nil {
+			return err
+		}
+	}
+
+	cfgName, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+	cfg, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	if err := l.WriteBlob(cfgName, io.NopCloser(bytes.NewReader(cfg))); err != nil {
+		return err
+	}
+
+	raw, err := img.RawManifest()
+	if err != nil {
+		return err
+	}
+	h, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	return l.WriteBlob(h, io.NopCloser(bytes.NewReader(raw)))
+}
@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// DefaultSplitTemplate names each platform tag after the source tag and the
+// architecture, e.g. 1.0-amd64. Indexes holding several variants of one
+// architecture (arm/v6, arm/v7) need {variant} in the template.
+const DefaultSplitTemplate = "{tag}-{arch}"
+
+// SplitResult is a platform image pushed by SplitManifestList.
+type SplitResult struct {
+	Platform string
+	Ref      string
+	Digest   string
+}
+
+// SplitTag renders a split template for platform p. Placeholders: {tag},
+// {os}, {arch}, {variant} and {platform} (os-arch[-variant]). The result
+// must be a valid tag.
+func SplitTag(template, tag string, p v1.Platform) (string, error) {
+	platform := p.OS + "-" + p.Architecture
+	if p.Variant != "" {
+		platform += "-" + p.Variant
+	}
+	out := strings.NewReplacer(
+		"{tag}", tag,
+		"{os}", p.OS,
+		"{arch}", p.Architecture,
+		"{variant}", p.Variant,
+		"{platform}", platform,
+	).Replace(template)
+	if _, err := name.NewTag("example.com/split:" + out); err != nil {
+		return "", fmt.Errorf("template %q renders invalid tag %q for %s", template, out, p.String())
+	}
+	return out, nil
+}
+
+// SplitManifestList pushes every platform image of the index at
+// opts.SourceRef (or opts.SourceLayoutPath) as its own tag, for runtimes and
+// scanners that cannot handle indexes. opts.TargetRef names the target
+// repository, defaulting to the source one; its tag, or else the source tag,
+// fills {tag}. Attestation manifests are skipped. All tags are rendered and
+// checked for collisions before anything is pushed.
+func (s *Syncer) SplitManifestList(opts SyncOptions, template string) ([]SplitResult, error) {
+	if template == "" {
+		template = DefaultSplitTemplate
+	}
+	target := opts.TargetRef
+	if target == "" {
+		target = opts.SourceRef
+	}
+	dst, err := name.ParseReference(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse target reference: %v", err)
+	}
+	tag := explicitTag(opts.TargetRef)
+	if tag == "" && opts.SourceLayoutPath == "" {
+		tag = explicitTag(opts.SourceRef)
+	}
+	if tag == "" {
+		tag = "latest"
+	}
+
+	s.logProgress("SYNC", fmt.Sprintf("Splitting %s into per-platform tags of %s...", opts.SourceRef, dst.Context()), "start", 0.15)
+
+	var idx v1.ImageIndex
+	if opts.SourceLayoutPath != "" {
+		s.logProgress("SYNC", "Loading source from local layout...", "fetch_source", 0.35)
+		l, img, err := loadSourceLayout(opts)
+		if err != nil {
+			return nil, err
+		}
+		if img != nil {
+			return nil, fmt.Errorf("%s is a single image, not a manifest list", opts.SourceRef)
+		}
+		idx = l
+	} else {
+		s.logProgress("SYNC", "Fetching source manifest list...", "fetch_source", 0.35)
+		var img v1.Image
+		idx, img, err = s.Fetch(opts.SourceRef, opts.SourceAuth)
+		if err != nil {
+			return nil, err
+		}
+		if img != nil {
+			return nil, fmt.Errorf("%s is a single image, not a manifest list", opts.SourceRef)
+		}
+	}
+
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest list: %w", err)
+	}
+	var results []SplitResult
+	var children []v1.Hash
+	seen := map[string]string{}
+	for _, d := range im.Manifests {
+		if !d.MediaType.IsImage() || d.Platform == nil || d.Platform.OS == "unknown" {
+			continue
+		}
+		t, err := SplitTag(template, tag, *d.Platform)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := seen[t]; ok {
+			return nil, fmt.Errorf("%s and %s both map to tag %q, add {variant} to the template", other, d.Platform.String(), t)
+		}
+		seen[t] = d.Platform.String()
+		results = append(results, SplitResult{
+			Platform: d.Platform.String(),
+			Ref:      dst.Context().Tag(t).String(),
+			Digest:   d.Digest.String(),
+		})
+		children = append(children, d.Digest)
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("%s holds no platform images", opts.SourceRef)
+	}
+
+	auth := s.getAuth(opts.TargetAuth)
+	for i, r := range results {
+		img, err := idx.Image(children[i])
+		if err != nil {
+			return results[:i], fmt.Errorf("failed to load %s image: %w", r.Platform, err)
+		}
+		ref, err := name.NewTag(r.Ref)
+		if err != nil {
+			return results[:i], err
+		}
+		base := 0.4 + 0.55*float64(i)/float64(len(results))
+		s.logProgress("SYNC", fmt.Sprintf("Pushing %s as %s...", r.Platform, r.Ref), "push_target", base)
+		uploadOpt, closeUpload := s.uploadProgressOption("push_target", base, 0.55/float64(len(results)))
+		err = remote.Write(ref, img, append(s.remoteOptions(s.ctx, auth), uploadOpt)...)
+		closeUpload()
+		if err != nil {
+			return results[:i], fmt.Errorf("failed to push %s: %w", r.Ref, err)
+		}
+	}
+
+	s.logProgress("SUCCESS", fmt.Sprintf("Split %s into %d tag(s)", opts.SourceRef, len(results)), "done", 1)
+	return results, nil
+}
+
+// explicitTag returns the tag written in ref, without the latest default.
+func explicitTag(ref string) string {
+	ref, _, _ = strings.Cut(ref, "@")
+	i := strings.LastIndex(ref, ":")
+	if i < 0 || strings.Contains(ref[i:], "/") {
+		return ""
+	}
+	return ref[i+1:]
+}
@@ -0,0 +1,111 @@
+package engine
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func pushSplitIndex(t *testing.T, platforms ...v1.Platform) (string, v1.ImageIndex) {
+	t.Helper()
+	srv := httptest.NewServer(registry.New())
+	t.Cleanup(srv.Close)
+
+	var adds []mutate.IndexAddendum
+	for _, p := range platforms {
+		p := p
+		adds = append(adds, mutate.IndexAddendum{
+			Add:        randomPlatformImage(t, p.Architecture),
+			Descriptor: v1.Descriptor{Platform: &p},
+		})
+	}
+	idx := mutate.AppendManifests(empty.Index, adds...)
+	ref := strings.TrimPrefix(srv.URL, "http://") + "/team/app:1.0"
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		t.Fatalf("parse ref: %v", err)
+	}
+	if err := remote.WriteIndex(r, idx); err != nil {
+		t.Fatalf("push index: %v", err)
+	}
+	return ref, idx
+}
+
+func TestSplitManifestList(t *testing.T) {
+	ref, idx := pushSplitIndex(t,
+		v1.Platform{OS: "linux", Architecture: "amd64"},
+		v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+	)
+	repo := strings.TrimSuffix(ref, ":1.0")
+
+	results, err := NewSyncer(nil).SplitManifestList(SyncOptions{SourceRef: ref}, "")
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+
+	im, _ := idx.IndexManifest()
+	for i, want := range []string{repo + ":1.0-amd64", repo + ":1.0-arm64"} {
+		if results[i].Ref != want {
+			t.Fatalf("result %d: expected %s, got %s", i, want, results[i].Ref)
+		}
+		r, _ := name.ParseReference(want)
+		desc, err := remote.Get(r)
+		if err != nil {
+			t.Fatalf("get %s: %v", want, err)
+		}
+		if !desc.MediaType.IsImage() {
+			t.Fatalf("%s should be an image, got %s", want, desc.MediaType)
+		}
+		if desc.Digest != im.Manifests[i].Digest {
+			t.Fatalf("%s: digest changed from %s to %s", want, im.Manifests[i].Digest, desc.Digest)
+		}
+	}
+}
+
+func TestSplitManifestList_TemplateAndTarget(t *testing.T) {
+	ref, _ := pushSplitIndex(t,
+		v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"},
+		v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+	)
+	host := strings.SplitN(ref, "/", 2)[0]
+
+	// Both platforms map to 1.0-arm
+	if _, err := NewSyncer(nil).SplitManifestList(SyncOptions{SourceRef: ref}, ""); err == nil || !strings.Contains(err.Error(), "{variant}") {
+		t.Fatalf("expected collision error, got %v", err)
+	}
+
+	results, err := NewSyncer(nil).SplitManifestList(SyncOptions{SourceRef: ref, TargetRef: host + "/legacy/app:2.0"}, "{os}-{arch}{variant}-{tag}")
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	want := []string{host + "/legacy/app:linux-armv6-2.0", host + "/legacy/app:linux-armv7-2.0"}
+	for i, r := range results {
+		if r.Ref != want[i] {
+			t.Fatalf("result %d: expected %s, got %s", i, want[i], r.Ref)
+		}
+	}
+
+	if _, err := NewSyncer(nil).SplitManifestList(SyncOptions{SourceRef: ref}, "{tag}/{arch}"); err == nil {
+		t.Fatalf("expected invalid tag error")
+	}
+}
+
+func TestSplitTag(t *testing.T) {
+	got, err := SplitTag("{tag}_{platform}", "1.0", v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"})
+	if err != nil || got != "1.0_linux-arm64-v8" {
+		t.Fatalf("unexpected tag %q (%v)", got, err)
+	}
+	if explicitTag("localhost:5000/app") != "" || explicitTag("localhost:5000/app:2@sha256:abc") != "2" {
+		t.Fatalf("explicitTag mismatch")
+	}
+}
@@ -13,11 +13,9 @@ import (
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
-	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/guoxudong/horcrux/internal/vault"
 )
 
@@ -30,6 +28,24 @@ type SyncOptions struct {
 	Incremental      bool
 	Concurrency      int
 	SourceLayoutPath string // Path to local OCI layout if SourceRef is archive://
+	// SourceLayoutDigest selects an image index inside SourceLayoutPath.
+	// When empty the layout's root index is used.
+	SourceLayoutDigest string
+	// ExpectedDigest pins the source manifest: the sync fails before
+	// anything is pushed when the source resolves to another digest.
+	ExpectedDigest string
+}
+
+// ErrDigestMismatch is returned when a source does not resolve to
+// SyncOptions.ExpectedDigest, e.g. because its tag was moved.
+var ErrDigestMismatch = errors.New("source digest mismatch")
+
+// checkSourceDigest compares the resolved source digest with the pinned one.
+func checkSourceDigest(opts SyncOptions, got v1.Hash) error {
+	if opts.ExpectedDigest == "" || opts.ExpectedDigest == got.String() {
+		return nil
+	}
+	return fmt.Errorf("%w: %s resolved to %s, expected %s", ErrDigestMismatch, opts.SourceRef, got, opts.ExpectedDigest)
 }
 
 // Progress defines a progress update from the syncer
@@ -262,26 +278,26 @@ func formatBytes(v int64) string {
 
 // getAuth returns an authn.Authenticator for a given vault credential
 func (s *Syncer) getAuth(cred *vault.Credential) authn.Authenticator {
-	if cred == nil || cred.Username == "" {
+	switch cred.AuthKind() {
+	case vault.AuthAnonymous:
 		s.log("INFO", "Using anonymous authentication")
-		return authn.Anonymous
-	}
-
-	// 特殊处理 Docker Hub: 如果 registry 为空或者为 docker.io，则视为 Docker Hub
-	// authn.Basic 对于 docker.io 是有效的，但 go-containerregistry
-	// 在处理 docker.io 时，内部会自动将其映射到 index.docker.io/v1/
-	s.log("INFO", fmt.Sprintf("Using basic authentication for user: %s", cred.Username))
-	return &authn.Basic{
-		Username: cred.Username,
-		Password: cred.Password,
+	case vault.AuthBasic:
+		// 特殊处理 Docker Hub: 如果 registry 为空或者为 docker.io，则视为 Docker Hub
+		// authn.Basic 对于 docker.io 是有效的，但 go-containerregistry
+		// 在处理 docker.io 时，内部会自动将其映射到 index.docker.io/v1/
+		s.log("INFO", fmt.Sprintf("Using basic authentication for user: %s", cred.Username))
+	default:
+		s.log("INFO", fmt.Sprintf("Using %s authentication", cred.AuthKind()))
 	}
+	return cred.Authenticator()
 }
 
-// SyncImage synchronizes an image from source to target
-func (s *Syncer) SyncImage(opts SyncOptions) error {
+// SyncImage synchronizes an image from source to target and returns the
+// digest of the pushed manifest.
+func (s *Syncer) SyncImage(opts SyncOptions) (string, error) {
 	dst, err := name.ParseReference(opts.TargetRef)
 	if err != nil {
-		return fmt.Errorf("failed to parse target reference: %v", err)
+		return "", fmt.Errorf("failed to parse target reference: %v", err)
 	}
 
 	s.logProgress("SYNC", fmt.Sprintf("Syncing %s to %s...", opts.SourceRef, opts.TargetRef), "start", 0.15)
@@ -289,61 +305,91 @@ func (s *Syncer) SyncImage(opts SyncOptions) error {
 	var img v1.Image
 	if opts.SourceLayoutPath != "" {
 		s.logProgress("SYNC", "Loading source from local layout...", "fetch_source", 0.35)
-		l, err := layout.ImageIndexFromPath(opts.SourceLayoutPath)
+		l, layoutImg, err := loadSourceLayout(opts)
 		if err != nil {
-			return fmt.Errorf("failed to load local layout from %s: %w", opts.SourceLayoutPath, err)
-		}
-		// Try to find the image in the layout
-		idx, err := l.IndexManifest()
-		if err != nil || len(idx.Manifests) == 0 {
-			return fmt.Errorf("empty layout or invalid index manifest")
+			return "", err
 		}
-		// Just take the first image if it's a single image sync fallback
-		img, err = l.Image(idx.Manifests[0].Digest)
-		if err != nil {
-			return fmt.Errorf("failed to get image from layout: %w", err)
+		if layoutImg != nil {
+			img = layoutImg
+		} else {
+			// Try to find the image in the layout
+			idx, err := l.IndexManifest()
+			if err != nil || len(idx.Manifests) == 0 {
+				return "", fmt.Errorf("empty layout or invalid index manifest")
+			}
+			// Just take the first image if it's a single image sync fallback
+			img, err = l.Image(idx.Manifests[0].Digest)
+			if err != nil {
+				return "", fmt.Errorf("failed to get image from layout: %w", err)
+			}
 		}
 	} else {
 		src, err := name.ParseReference(opts.SourceRef)
 		if err != nil {
-			return fmt.Errorf("failed to parse source reference: %v", err)
+			return "", fmt.Errorf("failed to parse source reference: %v", err)
 		}
 
 		// Fetch the source image
 		s.logProgress("SYNC", "Fetching source image...", "fetch_source", 0.35)
 		img, err = remote.Image(src, s.remoteOptions(s.ctx, s.getAuth(opts.SourceAuth))...)
 		if err != nil {
-			return fmt.Errorf("failed to fetch source image: %w", err)
+			return "", fmt.Errorf("failed to fetch source image: %w", err)
 		}
 	}
 
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+	if err := checkSourceDigest(opts, digest); err != nil {
+		return "", err
+	}
+
 	// Push the image to the target
 	s.logProgress("SYNC", "Pushing image to target...", "push_target", 0.75)
 	uploadOpt, closeUpload := s.uploadProgressOption("push_target", 0.75, 0.2)
 	err = remote.Write(dst, img, append(s.remoteOptions(s.ctx, s.getAuth(opts.TargetAuth)), uploadOpt)...)
 	closeUpload()
 	if err != nil {
-		return fmt.Errorf("failed to push image to target: %w", err)
+		return "", fmt.Errorf("failed to push image to target: %w", err)
 	}
 
-	s.logProgress("SUCCESS", fmt.Sprintf("Successfully synced %s to %s", opts.SourceRef, opts.TargetRef), "done", 1)
-	return nil
+	s.logProgress("SUCCESS", fmt.Sprintf("Successfully synced %s to %s (%s)", opts.SourceRef, opts.TargetRef, digest), "done", 1)
+	return digest.String(), nil
 }
 
-// SyncTarball pushes a local docker tarball to a remote registry
+// SyncTarball pushes a local image archive to a remote registry.
+// Docker tarballs, OCI archives and their gzip/zstd compressed variants are
+// accepted; archives holding several platforms are pushed as a manifest list.
 func (s *Syncer) SyncTarball(tarPath string, targetRef string, targetAuth *vault.Credential) error {
 	dst, err := name.ParseReference(targetRef)
 	if err != nil {
 		return fmt.Errorf("failed to parse target reference: %v", err)
 	}
 
-	img, err := tarball.ImageFromPath(tarPath, nil)
+	s.logProgress("SYNC", fmt.Sprintf("Loading archive %s...", tarPath), "fetch_source", 0.35)
+	arc, err := OpenArchive(tarPath)
 	if err != nil {
-		return fmt.Errorf("failed to load image from tarball %s: %v", tarPath, err)
+		return fmt.Errorf("failed to load image from archive %s: %v", tarPath, err)
 	}
+	defer arc.Close()
+
+	images, err := arc.Images()
+	if err != nil {
+		return fmt.Errorf("failed to read archive index: %v", err)
+	}
+	s.log("INFO", fmt.Sprintf("Detected %s archive (compression: %s) with %d image(s)", arc.Format, compressionName(arc.Compression), len(images)))
 
 	uploadOpt, closeUpload := s.uploadProgressOption("push_target", 0.75, 0.2)
-	err = remote.Write(dst, img, append(s.remoteOptions(s.ctx, s.getAuth(targetAuth)), uploadOpt)...)
+	if len(images) == 1 {
+		var img v1.Image
+		img, err = arc.Index.Image(images[0].Digest)
+		if err == nil {
+			err = remote.Write(dst, img, append(s.remoteOptions(s.ctx, s.getAuth(targetAuth)), uploadOpt)...)
+		}
+	} else {
+		err = remote.WriteIndex(dst, arc.Index, append(s.remoteOptions(s.ctx, s.getAuth(targetAuth)), uploadOpt)...)
+	}
 	closeUpload()
 	if err != nil {
 		return fmt.Errorf("failed to push tarball image to target: %v", err)
@@ -352,59 +398,173 @@ func (s *Syncer) SyncTarball(tarPath string, targetRef string, targetAuth *vault
 	return nil
 }
 
-// MergeManifests merges multiple source images into a single multi-arch manifest
-func (s *Syncer) MergeManifests(sourceRefs []string, targetRef string, srcAuths []*vault.Credential, targetAuth *vault.Credential) error {
-	dst, err := name.ParseReference(targetRef)
-	if err != nil {
-		return fmt.Errorf("failed to parse target reference: %v", err)
+func compressionName(c string) string {
+	if c == CompressionNone {
+		return "none"
 	}
+	return c
+}
 
-	var adds []mutate.IndexAddendum
-
-	for i, refStr := range sourceRefs {
-		ref, parseErr := name.ParseReference(refStr)
-		if parseErr != nil {
-			return fmt.Errorf("failed to parse source reference %s: %w", refStr, parseErr)
-		}
+// MergeSource is one source of MergeManifests. With LayoutPath set the
+// source is read from that local OCI layout (narrowed to LayoutDigest)
+// instead of the registry; Ref is then only used in messages.
+type MergeSource struct {
+	Ref          string
+	Auth         *vault.Credential
+	LayoutPath   string
+	LayoutDigest string
+}
 
-		var auth authn.Authenticator = authn.Anonymous
-		if i < len(srcAuths) && srcAuths[i] != nil {
-			auth = s.getAuth(srcAuths[i])
-		}
+// MergeOptions defines a merge of several sources into one manifest list
+type MergeOptions struct {
+	Sources     []MergeSource
+	TargetRef   string
+	TargetAuth  *vault.Credential
+	Annotations map[string]string // set on the merged index
+	// Flatten adds the platform images of sources that are indexes
+	// themselves, instead of nesting those indexes in the merged one.
+	Flatten bool
+	// PlatformPolicy resolves a platform provided by several sources,
+	// see ParsePlatformPolicy.
+	PlatformPolicy string
+}
 
-		img, fetchErr := remote.Image(ref, s.remoteOptions(s.ctx, auth)...)
-		if fetchErr != nil {
-			return fmt.Errorf("failed to fetch image %s: %w", refStr, fetchErr)
-		}
+// MergeManifests merges multiple source images into a single multi-arch
+// manifest and reports the source of each platform.
+func (s *Syncer) MergeManifests(opts MergeOptions) (*MergeReport, error) {
+	dst, err := name.ParseReference(opts.TargetRef)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse target reference: %v", err)
+	}
+	if len(opts.Sources) == 0 {
+		return nil, fmt.Errorf("no sources to merge")
+	}
 
-		descriptor, descErr := remote.Get(ref, s.remoteOptions(s.ctx, auth)...)
-		if descErr != nil {
-			return fmt.Errorf("failed to get descriptor for %s: %w", refStr, descErr)
+	inputs := make([]MergeInput, 0, len(opts.Sources))
+	for i, src := range opts.Sources {
+		s.logProgress("SYNC", fmt.Sprintf("Fetching source %d/%d %s...", i+1, len(opts.Sources), src.Ref), "fetch_source", 0.15+0.5*float64(i)/float64(len(opts.Sources)))
+		idx, img, err := s.loadMergeSource(src)
+		if err != nil {
+			return nil, err
 		}
-
-		adds = append(adds, mutate.IndexAddendum{
-			Add:        img,
-			Descriptor: descriptor.Descriptor,
-		})
+		inputs = append(inputs, MergeInput{Source: src.Ref, Index: idx, Image: img, Nest: !opts.Flatten})
 	}
 
-	idx := mutate.AppendManifests(empty.Index, adds...)
+	idx, report, err := MergeIndex(inputs, opts.PlatformPolicy)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range report.Platforms {
+		s.log("INFO", fmt.Sprintf("%s <- %s (%s)", p.Platform, p.Source, p.Digest))
+	}
+	for _, p := range report.Dropped {
+		s.log("INFO", fmt.Sprintf("%s from %s left out by platform policy %q", p.Platform, p.Source, report.Policy))
+	}
+	if len(opts.Annotations) > 0 {
+		idx = mutate.Annotations(idx, opts.Annotations).(v1.ImageIndex)
+	}
 
+	s.logProgress("SYNC", fmt.Sprintf("Pushing merged manifest list with %d manifest(s)...", len(report.Platforms)), "push_target", 0.75)
 	uploadOpt, closeUpload := s.uploadProgressOption("push_target", 0.75, 0.2)
-	err = remote.WriteIndex(dst, idx, append(s.remoteOptions(s.ctx, s.getAuth(targetAuth)), uploadOpt)...)
+	err = remote.WriteIndex(dst, idx, append(s.remoteOptions(s.ctx, s.getAuth(opts.TargetAuth)), uploadOpt)...)
 	closeUpload()
 	if err != nil {
-		return fmt.Errorf("failed to push merged manifest: %w", err)
+		return nil, fmt.Errorf("failed to push merged manifest: %w", err)
+	}
+	if digest, err := idx.Digest(); err == nil {
+		report.Digest = digest.String()
 	}
 
-	return nil
+	s.logProgress("SUCCESS", fmt.Sprintf("Merged %d source(s) into %s", len(opts.Sources), opts.TargetRef), "done", 1)
+	return report, nil
+}
+
+// loadMergeSource returns the index or image a merge source points to.
+func (s *Syncer) loadMergeSource(src MergeSource) (v1.ImageIndex, v1.Image, error) {
+	if src.LayoutPath == "" {
+		return s.Fetch(src.Ref, src.Auth)
+	}
+	return loadSourceLayout(SyncOptions{
+		SourceLayoutPath:   src.LayoutPath,
+		SourceLayoutDigest: src.LayoutDigest,
+	})
+}
+
+// loadSourceLayout opens the local layout a sync reads from, narrowed to
+// SourceLayoutDigest when the layout is shared by several archives or
+// bundle images. The digest may name a root of the layout or a manifest
+// one level below it, such as the image an archive store root wraps. A
+// digest naming a single image returns that image instead of an index.
+func loadSourceLayout(opts SyncOptions) (v1.ImageIndex, v1.Image, error) {
+	l, err := layout.ImageIndexFromPath(opts.SourceLayoutPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load local layout from %s: %w", opts.SourceLayoutPath, err)
+	}
+	if opts.SourceLayoutDigest == "" {
+		return l, nil, nil
+	}
+	h, err := v1.NewHash(opts.SourceLayoutDigest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid layout digest %q: %w", opts.SourceLayoutDigest, err)
+	}
+
+	parent, desc, ok := findLayoutManifest(l, h)
+	if ok && desc.MediaType.IsImage() {
+		img, err := parent.Image(h)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load image %s from %s: %w", opts.SourceLayoutDigest, opts.SourceLayoutPath, err)
+		}
+		return nil, img, nil
+	}
+	if !ok {
+		parent = l
+	}
+	idx, err := parent.ImageIndex(h)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load index %s from %s: %w", opts.SourceLayoutDigest, opts.SourceLayoutPath, err)
+	}
+	return idx, nil, nil
+}
+
+// findLayoutManifest returns the descriptor of h among the roots of l or
+// the manifests of a root index, along with the index listing it.
+func findLayoutManifest(l v1.ImageIndex, h v1.Hash) (v1.ImageIndex, v1.Descriptor, bool) {
+	m, err := l.IndexManifest()
+	if err != nil {
+		return nil, v1.Descriptor{}, false
+	}
+	for _, desc := range m.Manifests {
+		if desc.Digest == h {
+			return l, desc, true
+		}
+	}
+	for _, root := range m.Manifests {
+		if !root.MediaType.IsIndex() {
+			continue
+		}
+		idx, err := l.ImageIndex(root.Digest)
+		if err != nil {
+			continue
+		}
+		im, err := idx.IndexManifest()
+		if err != nil {
+			continue
+		}
+		for _, desc := range im.Manifests {
+			if desc.Digest == h {
+				return idx, desc, true
+			}
+		}
+	}
+	return nil, v1.Descriptor{}, false
 }
 
-// SyncManifestList synchronizes a manifest list (multi-arch image)
-func (s *Syncer) SyncManifestList(opts SyncOptions) error {
+// SyncManifestList synchronizes a manifest list (multi-arch image), or a
+// single image, and returns the digest of the pushed manifest.
+func (s *Syncer) SyncManifestList(opts SyncOptions) (string, error) {
 	dst, err := name.ParseReference(opts.TargetRef)
 	if err != nil {
-		return fmt.Errorf("failed to parse target reference: %v", err)
+		return "", fmt.Errorf("failed to parse target reference: %v", err)
 	}
 
 	s.logProgress("SYNC", fmt.Sprintf("Syncing manifest list %s to %s...", opts.SourceRef, opts.TargetRef), "start", 0.15)
@@ -412,15 +572,18 @@ func (s *Syncer) SyncManifestList(opts SyncOptions) error {
 	var idx v1.ImageIndex
 	if opts.SourceLayoutPath != "" {
 		s.logProgress("SYNC", "Loading source from local layout...", "fetch_source", 0.35)
-		l, err := layout.ImageIndexFromPath(opts.SourceLayoutPath)
+		l, img, err := loadSourceLayout(opts)
 		if err != nil {
-			return fmt.Errorf("failed to load local layout from %s: %w", opts.SourceLayoutPath, err)
+			return "", err
+		}
+		if img != nil {
+			return s.SyncImage(opts)
 		}
 		idx = l
 	} else {
 		src, err := name.ParseReference(opts.SourceRef)
 		if err != nil {
-			return fmt.Errorf("failed to parse source reference: %v", err)
+			return "", fmt.Errorf("failed to parse source reference: %v", err)
 		}
 
 		s.logProgress("SYNC", "Fetching source manifest list...", "fetch_source", 0.35)
@@ -431,16 +594,24 @@ func (s *Syncer) SyncManifestList(opts SyncOptions) error {
 		}
 	}
 
+	digest, err := idx.Digest()
+	if err != nil {
+		return "", err
+	}
+	if err := checkSourceDigest(opts, digest); err != nil {
+		return "", err
+	}
+
 	s.logProgress("SYNC", "Pushing manifest list to target...", "push_target", 0.75)
 	uploadOpt, closeUpload := s.uploadProgressOption("push_target", 0.75, 0.2)
 	err = remote.WriteIndex(dst, idx, append(s.remoteOptions(s.ctx, s.getAuth(opts.TargetAuth)), uploadOpt)...)
 	closeUpload()
 	if err != nil {
-		return fmt.Errorf("failed to push manifest list to target: %w", err)
+		return "", fmt.Errorf("failed to push manifest list to target: %w", err)
 	}
 
-	s.logProgress("SUCCESS", "Manifest list synced successfully", "done", 1)
-	return nil
+	s.logProgress("SUCCESS", fmt.Sprintf("Manifest list synced successfully (%s)", digest), "done", 1)
+	return digest.String(), nil
 }
 
 // VerifyAuth checks if the provided credentials are valid for the registry
@@ -459,6 +630,10 @@ func (s *Syncer) VerifyAuth(registry string, cred *vault.Credential) error {
 	}
 
 	auth := s.getAuth(cred)
+	authCfg, err := cred.ResolveAuth(ctx)
+	if err != nil {
+		return fmt.Errorf("authentication failed: %v", err)
+	}
 
 	// 方法 1: 使用标准的 /v2/ 接口进行 Ping 测试
 	scheme := "https"
@@ -466,7 +641,7 @@ func (s *Syncer) VerifyAuth(registry string, cred *vault.Credential) error {
 	log.Printf("[DEBUG] Verifying auth for registry: %s, URL: %s", registry, url)
 
 	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
-	req.SetBasicAuth(cred.Username, cred.Password)
+	vault.SetRequestAuth(req, authCfg)
 	// 阿里云 ACR 必须明确设置 User-Agent 和 Accept，否则可能直接 401
 	req.Header.Set("User-Agent", "docker/27.0.3 go/go1.24.2 git-commit/7d424b3 kernel/6.10.4-linuxkit os/linux arch/arm64 UpstreamClient(Docker-Client/27.0.3 (linux))")
 	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json, application/vnd.docker.distribution.manifest.list.v2+json, application/json")
@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestSyncManifestList_PinnedDigest(t *testing.T) {
+	srv := httptest.NewServer(registry.New())
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	src, err := name.ParseReference(host + "/team/app:1.0")
+	if err != nil {
+		t.Fatalf("ref: %v", err)
+	}
+	idx := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: randomPlatformImage(t, "amd64")},
+		mutate.IndexAddendum{Add: randomPlatformImage(t, "arm64")})
+	if err := remote.WriteIndex(src, idx); err != nil {
+		t.Fatalf("push index: %v", err)
+	}
+	idxDigest, err := idx.Digest()
+	if err != nil {
+		t.Fatalf("digest: %v", err)
+	}
+	single := randomPlatformImage(t, "amd64")
+	tool, err := name.ParseReference(host + "/team/tool:1.0")
+	if err != nil {
+		t.Fatalf("ref: %v", err)
+	}
+	if err := remote.Write(tool, single); err != nil {
+		t.Fatalf("push image: %v", err)
+	}
+
+	s := NewSyncer(nil)
+	// A moved tag is refused before anything is pushed
+	_, err = s.SyncManifestList(SyncOptions{
+		SourceRef:      src.String(),
+		TargetRef:      host + "/prod/app:1.0",
+		ExpectedDigest: digestOf(t, single),
+	})
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected a digest mismatch, got %v", err)
+	}
+	if _, err := remote.Head(mustParse(t, host+"/prod/app:1.0")); err == nil {
+		t.Fatalf("nothing should be pushed on a mismatch")
+	}
+	_, err = s.SyncManifestList(SyncOptions{
+		SourceRef:      tool.String(),
+		TargetRef:      host + "/prod/tool:1.0",
+		ExpectedDigest: idxDigest.String(),
+	})
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected a digest mismatch for a single image, got %v", err)
+	}
+
+	// Promotion by digest pushes exactly the pinned manifest
+	got, err := s.SyncManifestList(SyncOptions{
+		SourceRef:      src.Context().Digest(idxDigest.String()).String(),
+		TargetRef:      host + "/prod/app:1.0",
+		ExpectedDigest: idxDigest.String(),
+	})
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if got != idxDigest.String() {
+		t.Fatalf("expected %s, got %s", idxDigest, got)
+	}
+	desc, err := remote.Head(mustParse(t, host+"/prod/app:1.0"))
+	if err != nil || desc.Digest != idxDigest {
+		t.Fatalf("unexpected target %v: %v", desc, err)
+	}
+
+	got, err = s.SyncManifestList(SyncOptions{SourceRef: tool.String(), TargetRef: host + "/prod/tool:1.0"})
+	if err != nil || got != digestOf(t, single) {
+		t.Fatalf("expected the image digest, got %s: %v", got, err)
+	}
+}
+
+func mustParse(t *testing.T, ref string) name.Reference {
+	t.Helper()
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		t.Fatalf("ref %s: %v", ref, err)
+	}
+	return r
+}
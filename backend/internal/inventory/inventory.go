@@ -0,0 +1,186 @@
+// Package inventory lists the contents of an image without running it: the
+// distribution from os-release, the packages of the dpkg, apk and rpm
+// databases and the dependencies pinned by language lockfiles. Inventories
+// are rendered as CycloneDX or SPDX documents.
+package inventory
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// maxFileSize bounds the size of a package database or lockfile read into
+// memory; larger files are skipped with a note.
+const maxFileSize = 64 << 20
+
+// Inventory is the content of an image filesystem.
+type Inventory struct {
+	OS       *OSRelease `json:"os,omitempty"`
+	Packages []Package  `json:"packages"`
+	// Notes lists databases that were found but could not be read.
+	Notes []string `json:"notes,omitempty"`
+}
+
+// OSRelease holds the fields of /etc/os-release.
+type OSRelease struct {
+	ID         string `json:"id"`
+	VersionID  string `json:"version_id,omitempty"`
+	Codename   string `json:"codename,omitempty"`
+	PrettyName string `json:"pretty_name,omitempty"`
+}
+
+// Package is an installed OS package or a locked dependency.
+type Package struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// Type is the package URL type: deb, apk, rpm, npm, golang, cargo,
+	// pypi, composer or gem.
+	Type     string `json:"type"`
+	Arch     string `json:"arch,omitempty"`
+	Epoch    string `json:"epoch,omitempty"` // rpm only
+	Location string `json:"location"`        // file the package was read from
+	PURL     string `json:"purl"`
+}
+
+// Analyze reads the flattened filesystem of img and lists its content.
+// Every layer is downloaded, but only the files of interest are kept.
+func Analyze(img v1.Image) (*Inventory, error) {
+	rc := mutate.Extract(img)
+	defer rc.Close()
+
+	inv := &Inventory{}
+	files := map[string][]byte{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read image filesystem: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		p := path.Clean("/" + hdr.Name)
+		if note := rpmDatabaseNote(p); note != "" {
+			inv.Notes = append(inv.Notes, note)
+			continue
+		}
+		if !interesting(p) {
+			continue
+		}
+		if hdr.Size > maxFileSize {
+			inv.Notes = append(inv.Notes, fmt.Sprintf("%s skipped: %d bytes", p, hdr.Size))
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", p, err)
+		}
+		files[p] = data
+	}
+
+	inv.analyze(files)
+	return inv, nil
+}
+
+// interesting reports whether the file at p is parsed by analyze.
+func interesting(p string) bool {
+	switch p {
+	case "/etc/os-release", "/usr/lib/os-release", dpkgStatus, apkInstalled:
+		return true
+	}
+	if strings.HasPrefix(p, dpkgStatusDir) || isRPMDatabase(p) {
+		return true
+	}
+	return lockfileParsers[path.Base(p)] != nil && !strings.Contains(p, "/node_modules/")
+}
+
+// analyze fills inv from the files kept by Analyze, keyed by absolute path.
+func (inv *Inventory) analyze(files map[string][]byte) {
+	if data, ok := files["/etc/os-release"]; ok {
+		inv.OS = parseOSRelease(data)
+	} else if data, ok := files["/usr/lib/os-release"]; ok {
+		inv.OS = parseOSRelease(data)
+	}
+
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		data := files[p]
+		var pkgs []Package
+		var err error
+		switch {
+		case p == dpkgStatus, strings.HasPrefix(p, dpkgStatusDir):
+			pkgs = parseDpkgStatus(data)
+		case p == apkInstalled:
+			pkgs = parseApkInstalled(data)
+		case isRPMDatabase(p):
+			pkgs, err = parseNDB(data)
+		default:
+			if parse := lockfileParsers[path.Base(p)]; parse != nil {
+				pkgs, err = parse(data)
+			}
+		}
+		if err != nil {
+			inv.Notes = append(inv.Notes, fmt.Sprintf("%s: %v", p, err))
+			continue
+		}
+		seen := map[Package]bool{}
+		for _, pkg := range pkgs {
+			if seen[pkg] {
+				continue
+			}
+			seen[pkg] = true
+			pkg.Location = p
+			pkg.PURL = inv.purl(pkg)
+			inv.Packages = append(inv.Packages, pkg)
+		}
+	}
+
+	sort.SliceStable(inv.Packages, func(i, j int) bool {
+		a, b := inv.Packages[i], inv.Packages[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Version < b.Version
+	})
+	if inv.Packages == nil {
+		inv.Packages = []Package{}
+	}
+}
+
+func parseOSRelease(data []byte) *OSRelease {
+	fields := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || strings.HasPrefix(k, "#") {
+			continue
+		}
+		fields[k] = strings.Trim(v, `"'`)
+	}
+	if fields["ID"] == "" {
+		return nil
+	}
+	return &OSRelease{
+		ID:         fields["ID"],
+		VersionID:  fields["VERSION_ID"],
+		Codename:   fields["VERSION_CODENAME"],
+		PrettyName: fields["PRETTY_NAME"],
+	}
+}
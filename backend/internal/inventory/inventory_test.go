@@ -0,0 +1,134 @@
+package inventory
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// fileLayer builds a layer holding files, keyed by path without leading '/'.
+func fileLayer(t *testing.T, files map[string]string) v1.Layer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("tar header: %v", err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("tar write: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar close: %v", err)
+	}
+	data := buf.Bytes()
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+	if err != nil {
+		t.Fatalf("layer: %v", err)
+	}
+	return layer
+}
+
+const dpkgStatusFixture = `Package: libc6
+Status: install ok installed
+Architecture: amd64
+Version: 2.36-9+deb12u4
+Description: GNU C Library
+ multi-line description
+
+Package: removed
+Status: deinstall ok config-files
+Version: 1.0
+
+Package: bash
+Status: install ok installed
+Architecture: amd64
+Version: 5.2.15-2+b2
+`
+
+func TestAnalyze_DebianImageWithLockfiles(t *testing.T) {
+	base := fileLayer(t, map[string]string{
+		"etc/os-release":                       "PRETTY_NAME=\"Debian GNU/Linux 12 (bookworm)\"\nID=debian\nVERSION_ID=\"12\"\nVERSION_CODENAME=bookworm\n",
+		"var/lib/dpkg/status":                  dpkgStatusFixture,
+		"app/package-lock.json":                `{"lockfileVersion":3,"packages":{"":{"name":"app"},"node_modules/@scope/util":{"version":"1.2.0"},"node_modules/left-pad":{"version":"1.3.0"}}}`,
+		"app/node_modules/x/package-lock.json": `{"packages":{"node_modules/ignored":{"version":"9.9.9"}}}`,
+		"src/go.mod":                           "module example.com/app\n",
+	})
+	// The second layer deletes go.mod and adds a pinned requirement
+	top := fileLayer(t, map[string]string{
+		"src/.wh.go.mod":       "",
+		"srv/requirements.txt": "Flask_Cors==4.0.0 ; python_version > '3'\nrequests>=2\n",
+	})
+	img, err := mutate.AppendLayers(empty.Image, base, top)
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+
+	inv, err := Analyze(img)
+	if err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	if inv.OS == nil || inv.OS.ID != "debian" || inv.OS.VersionID != "12" || inv.OS.Codename != "bookworm" {
+		t.Fatalf("unexpected os: %+v", inv.OS)
+	}
+
+	purls := map[string]Package{}
+	for _, p := range inv.Packages {
+		purls[p.PURL] = p
+	}
+	want := []string{
+		"pkg:deb/debian/bash@5.2.15-2+b2?arch=amd64&distro=debian-12",
+		"pkg:deb/debian/libc6@2.36-9+deb12u4?arch=amd64&distro=debian-12",
+		"pkg:npm/%40scope/util@1.2.0",
+		"pkg:npm/left-pad@1.3.0",
+		"pkg:pypi/flask-cors@4.0.0",
+	}
+	if len(inv.Packages) != len(want) {
+		t.Fatalf("expected %d packages, got %+v", len(want), inv.Packages)
+	}
+	for _, purl := range want {
+		if _, ok := purls[purl]; !ok {
+			t.Fatalf("missing %s in %+v", purl, inv.Packages)
+		}
+	}
+	if loc := purls["pkg:npm/left-pad@1.3.0"].Location; loc != "/app/package-lock.json" {
+		t.Fatalf("unexpected location %s", loc)
+	}
+}
+
+func TestAnalyze_AlpineAndUnsupportedRPM(t *testing.T) {
+	img, err := mutate.AppendLayers(empty.Image, fileLayer(t, map[string]string{
+		"usr/lib/os-release":        "ID=alpine\nVERSION_ID=3.20.1\n",
+		"lib/apk/db/installed":      "C:Q1abc=\nP:musl\nV:1.2.5-r0\nA:x86_64\n\nP:busybox\nV:1.36.1-r29\nA:x86_64\n",
+		"var/lib/rpm/rpmdb.sqlite":  "SQLite format 3",
+		"var/lib/dpkg/status.d/tzd": "Package: tzdata\nVersion: 2024a-0+deb12u1\nArchitecture: all\n",
+	}))
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	inv, err := Analyze(img)
+	if err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	if inv.OS == nil || inv.OS.ID != "alpine" {
+		t.Fatalf("os-release should fall back to /usr/lib: %+v", inv.OS)
+	}
+	if len(inv.Packages) != 3 || inv.Packages[0].PURL != "pkg:apk/alpine/busybox@1.36.1-r29?arch=x86_64&distro=alpine-3.20.1" {
+		t.Fatalf("unexpected packages: %+v", inv.Packages)
+	}
+	if inv.Packages[2].Name != "tzdata" {
+		t.Fatalf("distroless status.d entries should be listed: %+v", inv.Packages)
+	}
+	if len(inv.Notes) != 1 {
+		t.Fatalf("expected a note for the sqlite rpm database, got %v", inv.Notes)
+	}
+}
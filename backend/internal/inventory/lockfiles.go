@@ -0,0 +1,244 @@
+package inventory
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// lockfileParsers reads the dependencies pinned by a lockfile, by file name.
+var lockfileParsers = map[string]func([]byte) ([]Package, error){
+	"package-lock.json": parsePackageLock,
+	"yarn.lock":         parseYarnLock,
+	"go.mod":            parseGoMod,
+	"Cargo.lock":        func(data []byte) ([]Package, error) { return parseTOMLPackages(data, "cargo"), nil },
+	"poetry.lock":       func(data []byte) ([]Package, error) { return parseTOMLPackages(data, "pypi"), nil },
+	"requirements.txt":  parseRequirements,
+	"Pipfile.lock":      parsePipfileLock,
+	"composer.lock":     parseComposerLock,
+	"Gemfile.lock":      parseGemfileLock,
+}
+
+type npmLockDependency struct {
+	Version      string                       `json:"version"`
+	Link         bool                         `json:"link"`
+	Dependencies map[string]npmLockDependency `json:"dependencies"`
+}
+
+// parsePackageLock reads the "packages" of lockfile v2 and v3, or the
+// nested "dependencies" of v1.
+func parsePackageLock(data []byte) ([]Package, error) {
+	var lock struct {
+		Packages     map[string]npmLockDependency `json:"packages"`
+		Dependencies map[string]npmLockDependency `json:"dependencies"`
+	}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, err
+	}
+	var out []Package
+	if len(lock.Packages) > 0 {
+		for key, dep := range lock.Packages {
+			i := strings.LastIndex(key, "node_modules/")
+			if i < 0 || dep.Link || dep.Version == "" {
+				continue // the root project or a workspace link
+			}
+			out = append(out, Package{Name: key[i+len("node_modules/"):], Version: dep.Version, Type: "npm"})
+		}
+		return out, nil
+	}
+	var walk func(map[string]npmLockDependency)
+	walk = func(deps map[string]npmLockDependency) {
+		for name, dep := range deps {
+			if dep.Version != "" && !dep.Link {
+				out = append(out, Package{Name: name, Version: dep.Version, Type: "npm"})
+			}
+			walk(dep.Dependencies)
+		}
+	}
+	walk(lock.Dependencies)
+	return out, nil
+}
+
+// parseYarnLock reads yarn v1 and berry lockfiles: unindented entry keys
+// such as `lodash@^4.17.0, lodash@^4.17.21:` followed by a version field.
+func parseYarnLock(data []byte) ([]Package, error) {
+	var out []Package
+	name := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") {
+			spec, _, _ := strings.Cut(strings.TrimSuffix(line, ":"), ",")
+			spec = strings.Trim(strings.TrimSpace(spec), `"`)
+			name = ""
+			if i := strings.LastIndex(spec, "@"); i > 0 {
+				name = spec[:i]
+			}
+			continue
+		}
+		field := strings.TrimSpace(line)
+		if name == "" || !strings.HasPrefix(field, "version") {
+			continue
+		}
+		version := strings.Trim(strings.TrimSpace(strings.TrimLeft(field[len("version"):], ": ")), `"`)
+		if version != "" {
+			out = append(out, Package{Name: name, Version: version, Type: "npm"})
+		}
+		name = ""
+	}
+	return out, nil
+}
+
+// parseGoMod reads the require directives of a go.mod file.
+func parseGoMod(data []byte) ([]Package, error) {
+	var out []Package
+	inBlock := false
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "//")
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			continue
+		case inBlock && fields[0] == ")":
+			inBlock = false
+			continue
+		case fields[0] == "require" && len(fields) == 2 && fields[1] == "(":
+			inBlock = true
+			continue
+		case fields[0] == "require":
+			fields = fields[1:]
+		case !inBlock:
+			continue
+		}
+		if len(fields) >= 2 {
+			out = append(out, Package{Name: fields[0], Version: fields[1], Type: "golang"})
+		}
+	}
+	return out, nil
+}
+
+// parseTOMLPackages reads the name and version of the [[package]] tables
+// of Cargo.lock and poetry.lock.
+func parseTOMLPackages(data []byte, typ string) []Package {
+	var out []Package
+	var cur *Package
+	flush := func() {
+		if cur != nil && cur.Name != "" && cur.Version != "" {
+			out = append(out, *cur)
+		}
+		cur = nil
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			flush()
+			if line == "[[package]]" {
+				cur = &Package{Type: typ}
+			}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		v = strings.Trim(strings.TrimSpace(v), `"`)
+		switch strings.TrimSpace(k) {
+		case "name":
+			cur.Name = v
+		case "version":
+			cur.Version = v
+		}
+	}
+	flush()
+	return out
+}
+
+// parseRequirements reads the pinned (==) requirements of a pip file.
+func parseRequirements(data []byte) ([]Package, error) {
+	var out []Package
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		line, _, _ = strings.Cut(line, ";")
+		name, version, ok := strings.Cut(strings.TrimSpace(line), "==")
+		if !ok || strings.HasPrefix(name, "-") {
+			continue
+		}
+		name, _, _ = strings.Cut(name, "[")
+		version = strings.TrimSpace(strings.Fields(version + " ")[0])
+		if name = strings.TrimSpace(name); name != "" && version != "" {
+			out = append(out, Package{Name: name, Version: version, Type: "pypi"})
+		}
+	}
+	return out, nil
+}
+
+func parsePipfileLock(data []byte) ([]Package, error) {
+	var lock map[string]json.RawMessage
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, err
+	}
+	var out []Package
+	for _, section := range []string{"default", "develop"} {
+		var deps map[string]struct {
+			Version string `json:"version"`
+		}
+		if raw, ok := lock[section]; ok {
+			if err := json.Unmarshal(raw, &deps); err != nil {
+				return nil, err
+			}
+		}
+		for name, dep := range deps {
+			if version := strings.TrimPrefix(dep.Version, "=="); version != "" {
+				out = append(out, Package{Name: name, Version: version, Type: "pypi"})
+			}
+		}
+	}
+	return out, nil
+}
+
+func parseComposerLock(data []byte) ([]Package, error) {
+	type composerPackage struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	var lock struct {
+		Packages    []composerPackage `json:"packages"`
+		PackagesDev []composerPackage `json:"packages-dev"`
+	}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, err
+	}
+	var out []Package
+	for _, p := range append(lock.Packages, lock.PackagesDev...) {
+		if p.Name != "" && p.Version != "" {
+			out = append(out, Package{Name: p.Name, Version: p.Version, Type: "composer"})
+		}
+	}
+	return out, nil
+}
+
+// parseGemfileLock reads the specs of the GEM section: gems are indented
+// by four spaces, their own dependencies by six.
+func parseGemfileLock(data []byte) ([]Package, error) {
+	var out []Package
+	inSpecs := false
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case !strings.HasPrefix(line, " "):
+			inSpecs = false
+		case strings.TrimSpace(line) == "specs:":
+			inSpecs = true
+		case inSpecs && strings.HasPrefix(line, "    ") && !strings.HasPrefix(line, "     "):
+			name, version, ok := strings.Cut(strings.TrimSpace(line), " (")
+			if ok {
+				out = append(out, Package{Name: name, Version: strings.TrimSuffix(version, ")"), Type: "gem"})
+			}
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,46 @@
+package inventory
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestLockfileParsers(t *testing.T) {
+	cases := []struct {
+		file string
+		data string
+		want []string // name@version
+	}{
+		{"package-lock.json", `{"lockfileVersion":1,"dependencies":{"a":{"version":"1.0.0","dependencies":{"b":{"version":"2.0.0"}}}}}`,
+			[]string{"a@1.0.0", "b@2.0.0"}},
+		{"yarn.lock", "# yarn lockfile v1\n\n\"@babel/core@^7.0.0\", \"@babel/core@^7.1.0\":\n  version \"7.24.0\"\n  resolved \"https://x\"\n\nlodash@^4.17.21:\n  version \"4.17.21\"\n",
+			[]string{"@babel/core@7.24.0", "lodash@4.17.21"}},
+		{"yarn.lock", "__metadata:\n  version: 8\n\n\"lodash@npm:^4.17.21\":\n  version: 4.17.21\n",
+			[]string{"lodash@4.17.21"}},
+		{"go.mod", "module x\n\ngo 1.22\n\nrequire github.com/a/b v1.0.0\n\nrequire (\n\tgolang.org/x/sys v0.20.0 // indirect\n\tgithub.com/c/d v0.1.0\n)\n",
+			[]string{"github.com/a/b@v1.0.0", "github.com/c/d@v0.1.0", "golang.org/x/sys@v0.20.0"}},
+		{"Cargo.lock", "version = 3\n\n[[package]]\nname = \"serde\"\nversion = \"1.0.200\"\n\n[[package]]\nname = \"app\"\nversion = \"0.1.0\"\ndependencies = [\n \"serde\",\n]\n\n[metadata]\n",
+			[]string{"app@0.1.0", "serde@1.0.200"}},
+		{"Pipfile.lock", `{"_meta":{},"default":{"requests":{"version":"==2.31.0"}},"develop":{"pytest":{"version":"==8.0.0"}}}`,
+			[]string{"pytest@8.0.0", "requests@2.31.0"}},
+		{"composer.lock", `{"packages":[{"name":"monolog/monolog","version":"3.5.0"}],"packages-dev":[{"name":"phpunit/phpunit","version":"10.5.0"}]}`,
+			[]string{"monolog/monolog@3.5.0", "phpunit/phpunit@10.5.0"}},
+		{"Gemfile.lock", "GEM\n  remote: https://rubygems.org/\n  specs:\n    rack (3.0.9)\n    rails (7.1.3)\n      rack (>= 2.2.4)\n\nPLATFORMS\n  ruby\n",
+			[]string{"rack@3.0.9", "rails@7.1.3"}},
+	}
+	for _, tc := range cases {
+		pkgs, err := lockfileParsers[tc.file]([]byte(tc.data))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.file, err)
+		}
+		var got []string
+		for _, p := range pkgs {
+			got = append(got, p.Name+"@"+p.Version)
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != strings.Join(tc.want, " ") {
+			t.Fatalf("%s: expected %v, got %v", tc.file, tc.want, got)
+		}
+	}
+}
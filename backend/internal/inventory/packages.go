@@ -0,0 +1,153 @@
+package inventory
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	dpkgStatus = "/var/lib/dpkg/status"
+	// dpkgStatusDir holds one file per package on distroless images.
+	dpkgStatusDir = "/var/lib/dpkg/status.d/"
+	apkInstalled  = "/lib/apk/db/installed"
+)
+
+// parseDpkgStatus lists the installed packages of a dpkg status file.
+func parseDpkgStatus(data []byte) []Package {
+	var out []Package
+	for _, para := range paragraphs(string(data)) {
+		fields := map[string]string{}
+		for _, line := range para {
+			if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+				continue // continuation of a multi-line field
+			}
+			if k, v, ok := strings.Cut(line, ":"); ok {
+				fields[k] = strings.TrimSpace(v)
+			}
+		}
+		// Files of status.d have no Status field
+		if status, ok := fields["Status"]; ok && !strings.HasSuffix(status, " installed") {
+			continue
+		}
+		if fields["Package"] == "" || fields["Version"] == "" {
+			continue
+		}
+		out = append(out, Package{
+			Name:    fields["Package"],
+			Version: fields["Version"],
+			Type:    "deb",
+			Arch:    fields["Architecture"],
+		})
+	}
+	return out
+}
+
+// parseApkInstalled lists the packages of the apk database.
+func parseApkInstalled(data []byte) []Package {
+	var out []Package
+	for _, para := range paragraphs(string(data)) {
+		var pkg Package
+		for _, line := range para {
+			k, v, ok := strings.Cut(line, ":")
+			if !ok {
+				continue
+			}
+			switch k {
+			case "P":
+				pkg.Name = v
+			case "V":
+				pkg.Version = v
+			case "A":
+				pkg.Arch = v
+			}
+		}
+		if pkg.Name != "" && pkg.Version != "" {
+			pkg.Type = "apk"
+			out = append(out, pkg)
+		}
+	}
+	return out
+}
+
+// paragraphs splits data into blocks of lines separated by blank lines.
+func paragraphs(data string) [][]string {
+	var out [][]string
+	var cur []string
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			if len(cur) > 0 {
+				out = append(out, cur)
+				cur = nil
+			}
+			continue
+		}
+		cur = append(cur, line)
+	}
+	if len(cur) > 0 {
+		out = append(out, cur)
+	}
+	return out
+}
+
+// purl returns the package URL of pkg. OS packages are namespaced by the
+// distribution of the image.
+func (inv *Inventory) purl(pkg Package) string {
+	namespace, name := "", pkg.Name
+	qualifiers := map[string]string{}
+	switch pkg.Type {
+	case "deb", "apk", "rpm":
+		if inv.OS != nil {
+			namespace = inv.OS.ID
+			if inv.OS.VersionID != "" {
+				qualifiers["distro"] = inv.OS.ID + "-" + inv.OS.VersionID
+			}
+		}
+		if pkg.Arch != "" {
+			qualifiers["arch"] = pkg.Arch
+		}
+		if pkg.Epoch != "" {
+			qualifiers["epoch"] = pkg.Epoch
+		}
+	case "npm", "golang", "composer":
+		if i := strings.LastIndex(name, "/"); i > 0 {
+			namespace, name = name[:i], name[i+1:]
+		}
+	case "pypi":
+		name = strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+	}
+
+	var b strings.Builder
+	b.WriteString("pkg:" + pkg.Type + "/")
+	if namespace != "" {
+		for _, seg := range strings.Split(namespace, "/") {
+			b.WriteString(purlEscape(seg) + "/")
+		}
+	}
+	b.WriteString(purlEscape(name))
+	if pkg.Version != "" {
+		b.WriteString("@" + purlEscape(pkg.Version))
+	}
+	if len(qualifiers) > 0 {
+		keys := make([]string, 0, len(qualifiers))
+		for k := range qualifiers {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for i, k := range keys {
+			sep := "&"
+			if i == 0 {
+				sep = "?"
+			}
+			b.WriteString(sep + k + "=" + url.QueryEscape(qualifiers[k]))
+		}
+	}
+	return b.String()
+}
+
+// purlEscape percent-encodes a package URL segment; ':' and '@' are
+// encoded as well since they delimit the version and npm scopes.
+func purlEscape(s string) string {
+	return strings.NewReplacer(":", "%3A", "@", "%40").Replace(url.PathEscape(s))
+}
@@ -0,0 +1,152 @@
+package inventory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// rpm databases in the ndb format used by SUSE. The sqlite format of
+// Fedora and RHEL 9 and the Berkeley DB format of older releases need
+// drivers horcrux does not ship; they are reported in Inventory.Notes.
+var rpmNDBPaths = map[string]bool{
+	"/var/lib/rpm/Packages.db":          true,
+	"/usr/lib/sysimage/rpm/Packages.db": true,
+}
+
+var rpmUnsupportedPaths = map[string]string{
+	"/var/lib/rpm/rpmdb.sqlite":          "sqlite",
+	"/usr/lib/sysimage/rpm/rpmdb.sqlite": "sqlite",
+	"/var/lib/rpm/Packages":              "Berkeley DB",
+}
+
+func isRPMDatabase(p string) bool {
+	return rpmNDBPaths[p]
+}
+
+// rpmDatabaseNote describes an rpm database found at p that cannot be read,
+// or returns "".
+func rpmDatabaseNote(p string) string {
+	if format, ok := rpmUnsupportedPaths[p]; ok {
+		return fmt.Sprintf("%s: rpm %s database found, its packages are not listed", p, format)
+	}
+	return ""
+}
+
+const (
+	ndbHeaderMagic = 'R' | 'p'<<8 | 'm'<<16 | 'P'<<24
+	ndbSlotMagic   = 'S' | 'l'<<8 | 'o'<<16 | 't'<<24
+	ndbBlobMagic   = 'B' | 'l'<<8 | 'b'<<16 | 'S'<<24
+	ndbPageSize    = 4096
+	ndbSlotSize    = 16
+	ndbBlockSize   = 16
+)
+
+// parseNDB lists the packages of an rpm ndb database: slot pages holding
+// the block offset of each package header blob.
+func parseNDB(data []byte) ([]Package, error) {
+	le := binary.LittleEndian
+	if len(data) < 16 || le.Uint32(data) != ndbHeaderMagic {
+		return nil, errors.New("not an rpm ndb database")
+	}
+	end := int(le.Uint32(data[12:])) * ndbPageSize
+	if end > len(data) {
+		end = len(data)
+	}
+
+	var out []Package
+	// The database header takes the first two slots
+	for off := 2 * ndbSlotSize; off+ndbSlotSize <= end; off += ndbSlotSize {
+		slot := data[off : off+ndbSlotSize]
+		if le.Uint32(slot) != ndbSlotMagic || le.Uint32(slot[4:]) == 0 {
+			continue
+		}
+		start := int(le.Uint32(slot[8:])) * ndbBlockSize
+		if start+16 > len(data) || le.Uint32(data[start:]) != ndbBlobMagic {
+			return nil, fmt.Errorf("corrupt blob for package %d", le.Uint32(slot[4:]))
+		}
+		blobLen := int(le.Uint32(data[start+12:]))
+		if start+16+blobLen > len(data) {
+			return nil, fmt.Errorf("truncated blob for package %d", le.Uint32(slot[4:]))
+		}
+		pkg, err := parseRPMHeader(data[start+16 : start+16+blobLen])
+		if err != nil {
+			return nil, err
+		}
+		if pkg.Name != "gpg-pubkey" {
+			out = append(out, pkg)
+		}
+	}
+	return out, nil
+}
+
+// rpm header tags and types
+const (
+	rpmTagName    = 1000
+	rpmTagVersion = 1001
+	rpmTagRelease = 1002
+	rpmTagEpoch   = 1003
+	rpmTagArch    = 1022
+
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeStringArray = 8
+	rpmTypeI18NString  = 9
+)
+
+// parseRPMHeader reads the package fields of an rpm header blob: an index
+// of (tag, type, offset, count) entries followed by their data.
+func parseRPMHeader(blob []byte) (Package, error) {
+	be := binary.BigEndian
+	if len(blob) < 8 {
+		return Package{}, errors.New("truncated rpm header")
+	}
+	il, dl := int(be.Uint32(blob)), int(be.Uint32(blob[4:]))
+	dataStart := 8 + il*16
+	if dataStart+dl > len(blob) {
+		return Package{}, errors.New("truncated rpm header")
+	}
+	store := blob[dataStart : dataStart+dl]
+
+	var name, version, release, epoch, arch string
+	for i := 0; i < il; i++ {
+		e := blob[8+i*16:]
+		tag, typ, off := be.Uint32(e), be.Uint32(e[4:]), int(be.Uint32(e[8:]))
+		if off < 0 || off >= len(store) {
+			continue
+		}
+		var value string
+		switch typ {
+		case rpmTypeString, rpmTypeStringArray, rpmTypeI18NString:
+			value = string(store[off:])
+			if n := bytes.IndexByte(store[off:], 0); n >= 0 {
+				value = string(store[off : off+n])
+			}
+		case rpmTypeInt32:
+			if off+4 <= len(store) {
+				value = strconv.FormatUint(uint64(be.Uint32(store[off:])), 10)
+			}
+		}
+		switch tag {
+		case rpmTagName:
+			name = value
+		case rpmTagVersion:
+			version = value
+		case rpmTagRelease:
+			release = value
+		case rpmTagEpoch:
+			epoch = value
+		case rpmTagArch:
+			arch = value
+		}
+	}
+	if name == "" || version == "" {
+		return Package{}, errors.New("rpm header without name or version")
+	}
+	if release != "" {
+		version += "-" + release
+	}
+	return Package{Name: name, Version: version, Type: "rpm", Arch: arch, Epoch: epoch}, nil
+}
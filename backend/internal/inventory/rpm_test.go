@@ -0,0 +1,85 @@
+package inventory
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// rpmHeader builds a header blob with string tags and an int32 epoch.
+func rpmHeader(tags map[uint32]string, epoch uint32) []byte {
+	be := binary.BigEndian
+	var index, store []byte
+	entry := func(tag, typ uint32, data []byte) {
+		e := make([]byte, 16)
+		be.PutUint32(e, tag)
+		be.PutUint32(e[4:], typ)
+		be.PutUint32(e[8:], uint32(len(store)))
+		be.PutUint32(e[12:], 1)
+		index = append(index, e...)
+		store = append(store, data...)
+	}
+	entry(rpmTagEpoch, rpmTypeInt32, be.AppendUint32(nil, epoch))
+	for _, tag := range []uint32{rpmTagName, rpmTagVersion, rpmTagRelease, rpmTagArch} {
+		if v, ok := tags[tag]; ok {
+			entry(tag, rpmTypeString, append([]byte(v), 0))
+		}
+	}
+	blob := be.AppendUint32(nil, uint32(len(index)/16))
+	blob = be.AppendUint32(blob, uint32(len(store)))
+	return append(append(blob, index...), store...)
+}
+
+// ndbDatabase lays out blobs after a single slot page.
+func ndbDatabase(blobs ...[]byte) []byte {
+	le := binary.LittleEndian
+	db := make([]byte, ndbPageSize)
+	le.PutUint32(db, ndbHeaderMagic)
+	le.PutUint32(db[12:], 1)
+	for i, blob := range blobs {
+		slot := db[(i+2)*ndbSlotSize:]
+		le.PutUint32(slot, ndbSlotMagic)
+		le.PutUint32(slot[4:], uint32(i+1))
+		le.PutUint32(slot[8:], uint32(len(db)/ndbBlockSize))
+		le.PutUint32(slot[12:], uint32((16+len(blob)+ndbBlockSize-1)/ndbBlockSize))
+
+		head := le.AppendUint32(nil, ndbBlobMagic)
+		head = le.AppendUint32(head, uint32(i+1))
+		head = le.AppendUint32(head, 0)
+		head = le.AppendUint32(head, uint32(len(blob)))
+		db = append(append(db, head...), blob...)
+		for len(db)%ndbBlockSize != 0 {
+			db = append(db, 0)
+		}
+	}
+	return db
+}
+
+func TestParseNDB(t *testing.T) {
+	db := ndbDatabase(
+		rpmHeader(map[uint32]string{rpmTagName: "zypper", rpmTagVersion: "1.14.68", rpmTagRelease: "150400.3.40.1", rpmTagArch: "x86_64"}, 0),
+		rpmHeader(map[uint32]string{rpmTagName: "gpg-pubkey", rpmTagVersion: "39db7c82"}, 0),
+		rpmHeader(map[uint32]string{rpmTagName: "openssl", rpmTagVersion: "3.1.4", rpmTagRelease: "1"}, 1),
+	)
+	pkgs, err := parseNDB(db)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(pkgs) != 2 {
+		t.Fatalf("expected 2 packages without the gpg key, got %+v", pkgs)
+	}
+	if p := pkgs[0]; p.Name != "zypper" || p.Version != "1.14.68-150400.3.40.1" || p.Arch != "x86_64" {
+		t.Fatalf("unexpected package: %+v", p)
+	}
+	if pkgs[1].Epoch != "1" {
+		t.Fatalf("expected epoch 1, got %+v", pkgs[1])
+	}
+
+	inv := &Inventory{OS: &OSRelease{ID: "sles", VersionID: "15.6"}}
+	if got := inv.purl(pkgs[1]); got != "pkg:rpm/sles/openssl@3.1.4-1?distro=sles-15.6&epoch=1" {
+		t.Fatalf("unexpected purl %s", got)
+	}
+
+	if _, err := parseNDB([]byte("not a database")); err == nil {
+		t.Fatalf("expected an error for a non-ndb file")
+	}
+}
@@ -0,0 +1,203 @@
+package inventory
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Document formats
+const (
+	FormatCycloneDX = "cyclonedx"
+	FormatSPDX      = "spdx"
+)
+
+// Media types of the documents, also used as OCI artifact types.
+const (
+	MediaTypeCycloneDX = "application/vnd.cyclonedx+json"
+	MediaTypeSPDX      = "application/spdx+json"
+)
+
+// Subject identifies the image an inventory was taken from.
+type Subject struct {
+	Name     string // image reference
+	Digest   string // manifest digest
+	Platform string
+}
+
+// ParseFormat validates a document format; empty selects CycloneDX.
+func ParseFormat(format string) (string, error) {
+	switch f := strings.ToLower(strings.TrimSpace(format)); f {
+	case "":
+		return FormatCycloneDX, nil
+	case FormatCycloneDX, FormatSPDX:
+		return f, nil
+	}
+	return "", fmt.Errorf("format must be %q or %q", FormatCycloneDX, FormatSPDX)
+}
+
+// MediaType returns the media type of documents in format.
+func MediaType(format string) string {
+	if format == FormatSPDX {
+		return MediaTypeSPDX
+	}
+	return MediaTypeCycloneDX
+}
+
+// Document renders inv as a CycloneDX 1.5 or SPDX 2.3 JSON document.
+func Document(format string, inv *Inventory, subject Subject) ([]byte, error) {
+	format, err := ParseFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	if format == FormatSPDX {
+		return json.MarshalIndent(spdxDocument(inv, subject, id, now), "", "  ")
+	}
+	return json.MarshalIndent(cycloneDXDocument(inv, subject, id, now), "", "  ")
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cdxComponent struct {
+	Type        string        `json:"type"`
+	BOMRef      string        `json:"bom-ref,omitempty"`
+	Name        string        `json:"name"`
+	Version     string        `json:"version,omitempty"`
+	Description string        `json:"description,omitempty"`
+	PURL        string        `json:"purl,omitempty"`
+	Properties  []cdxProperty `json:"properties,omitempty"`
+}
+
+func cycloneDXDocument(inv *Inventory, subject Subject, id, now string) map[string]any {
+	image := cdxComponent{Type: "container", BOMRef: subject.Digest, Name: subject.Name, Version: subject.Digest}
+	if subject.Platform != "" {
+		image.Properties = []cdxProperty{{"horcrux:platform", subject.Platform}}
+	}
+	components := []cdxComponent{}
+	if inv.OS != nil {
+		components = append(components, cdxComponent{
+			Type:        "operating-system",
+			BOMRef:      "os:" + inv.OS.ID,
+			Name:        inv.OS.ID,
+			Version:     inv.OS.VersionID,
+			Description: inv.OS.PrettyName,
+		})
+	}
+	for _, pkg := range inv.Packages {
+		components = append(components, cdxComponent{
+			Type:       "library",
+			BOMRef:     pkg.PURL + "#" + pkg.Location,
+			Name:       pkg.Name,
+			Version:    pkg.Version,
+			PURL:       pkg.PURL,
+			Properties: []cdxProperty{{"horcrux:location", pkg.Location}},
+		})
+	}
+	return map[string]any{
+		"bomFormat":    "CycloneDX",
+		"specVersion":  "1.5",
+		"serialNumber": "urn:uuid:" + id,
+		"version":      1,
+		"metadata": map[string]any{
+			"timestamp": now,
+			"tools": map[string]any{
+				"components": []cdxComponent{{Type: "application", Name: "horcrux"}},
+			},
+			"component": image,
+		},
+		"components": components,
+	}
+}
+
+type spdxExternalRef struct {
+	Category string `json:"referenceCategory"`
+	Type     string `json:"referenceType"`
+	Locator  string `json:"referenceLocator"`
+}
+
+type spdxPackage struct {
+	SPDXID           string            `json:"SPDXID"`
+	Name             string            `json:"name"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	SourceInfo       string            `json:"sourceInfo,omitempty"`
+	Purpose          string            `json:"primaryPackagePurpose,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxRelationship struct {
+	Element string `json:"spdxElementId"`
+	Type    string `json:"relationshipType"`
+	Related string `json:"relatedSpdxElement"`
+}
+
+func spdxDocument(inv *Inventory, subject Subject, id, now string) map[string]any {
+	packages := []spdxPackage{{
+		SPDXID:           "SPDXRef-Image",
+		Name:             subject.Name,
+		VersionInfo:      subject.Digest,
+		DownloadLocation: "NOASSERTION",
+		Purpose:          "CONTAINER",
+	}}
+	relationships := []spdxRelationship{{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Image"}}
+	add := func(p spdxPackage) {
+		packages = append(packages, p)
+		relationships = append(relationships, spdxRelationship{"SPDXRef-Image", "CONTAINS", p.SPDXID})
+	}
+	if inv.OS != nil {
+		add(spdxPackage{
+			SPDXID:           "SPDXRef-OperatingSystem",
+			Name:             inv.OS.ID,
+			VersionInfo:      inv.OS.VersionID,
+			DownloadLocation: "NOASSERTION",
+			SourceInfo:       inv.OS.PrettyName,
+			Purpose:          "OPERATING-SYSTEM",
+		})
+	}
+	for i, pkg := range inv.Packages {
+		add(spdxPackage{
+			SPDXID:           fmt.Sprintf("SPDXRef-Package-%d", i+1),
+			Name:             pkg.Name,
+			VersionInfo:      pkg.Version,
+			DownloadLocation: "NOASSERTION",
+			SourceInfo:       "found in " + pkg.Location,
+			Purpose:          "LIBRARY",
+			ExternalRefs:     []spdxExternalRef{{"PACKAGE-MANAGER", "purl", pkg.PURL}},
+		})
+	}
+	return map[string]any{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              subject.Name,
+		"documentNamespace": "urn:uuid:" + id,
+		"creationInfo": map[string]any{
+			"created":  now,
+			"creators": []string{"Tool: horcrux"},
+		},
+		"packages":      packages,
+		"relationships": relationships,
+	}
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
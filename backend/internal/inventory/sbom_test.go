@@ -0,0 +1,72 @@
+package inventory
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDocument_Formats(t *testing.T) {
+	inv := &Inventory{
+		OS: &OSRelease{ID: "alpine", VersionID: "3.20.1", PrettyName: "Alpine Linux v3.20"},
+		Packages: []Package{
+			{Name: "musl", Version: "1.2.5-r0", Type: "apk", Location: "/lib/apk/db/installed", PURL: "pkg:apk/alpine/musl@1.2.5-r0"},
+		},
+	}
+	subject := Subject{Name: "registry.local/team/app:1.0", Digest: "sha256:abc", Platform: "linux/amd64"}
+
+	data, err := Document("", inv, subject)
+	if err != nil {
+		t.Fatalf("cyclonedx: %v", err)
+	}
+	var cdx struct {
+		BOMFormat   string `json:"bomFormat"`
+		SpecVersion string `json:"specVersion"`
+		Metadata    struct {
+			Component struct {
+				Type, Name, Version string
+			} `json:"component"`
+		} `json:"metadata"`
+		Components []struct {
+			Type, Name, PURL string
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(data, &cdx); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if cdx.BOMFormat != "CycloneDX" || cdx.Metadata.Component.Type != "container" || cdx.Metadata.Component.Version != "sha256:abc" {
+		t.Fatalf("unexpected document: %s", data)
+	}
+	if len(cdx.Components) != 2 || cdx.Components[0].Type != "operating-system" || cdx.Components[1].PURL != "pkg:apk/alpine/musl@1.2.5-r0" {
+		t.Fatalf("unexpected components: %+v", cdx.Components)
+	}
+
+	data, err = Document(FormatSPDX, inv, subject)
+	if err != nil {
+		t.Fatalf("spdx: %v", err)
+	}
+	var spdx struct {
+		SPDXVersion string `json:"spdxVersion"`
+		Packages    []struct {
+			SPDXID       string `json:"SPDXID"`
+			ExternalRefs []struct {
+				Locator string `json:"referenceLocator"`
+			} `json:"externalRefs"`
+		} `json:"packages"`
+		Relationships []struct {
+			Type string `json:"relationshipType"`
+		} `json:"relationships"`
+	}
+	if err := json.Unmarshal(data, &spdx); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if spdx.SPDXVersion != "SPDX-2.3" || len(spdx.Packages) != 3 || len(spdx.Relationships) != 3 {
+		t.Fatalf("unexpected document: %s", data)
+	}
+	if refs := spdx.Packages[2].ExternalRefs; len(refs) != 1 || refs[0].Locator != "pkg:apk/alpine/musl@1.2.5-r0" {
+		t.Fatalf("unexpected external refs: %+v", refs)
+	}
+
+	if _, err := Document("syft", inv, subject); err == nil {
+		t.Fatalf("expected an unknown format error")
+	}
+}
@@ -0,0 +1,113 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/guoxudong/horcrux/internal/credhelper"
+)
+
+// Auth types of a Credential.
+const (
+	// AuthBasic sends Username and Password.
+	AuthBasic = "basic"
+	// AuthBearer sends Token as a static registry bearer token.
+	AuthBearer = "bearer"
+	// AuthIdentityToken exchanges Token, an OAuth2 refresh token, for
+	// access tokens at the registry's token endpoint.
+	AuthIdentityToken = "identity_token"
+	// AuthHelper runs an external credential helper, see package credhelper.
+	AuthHelper = "helper"
+	// AuthAnonymous sends no credentials.
+	AuthAnonymous = "anonymous"
+)
+
+// AuthKind returns the effective auth type. Credentials saved before auth
+// types existed are basic when they have a username and anonymous otherwise.
+func (c *Credential) AuthKind() string {
+	if c == nil {
+		return AuthAnonymous
+	}
+	if t := strings.ToLower(strings.TrimSpace(c.AuthType)); t != "" {
+		return t
+	}
+	if c.Username == "" {
+		return AuthAnonymous
+	}
+	return AuthBasic
+}
+
+// Validate checks that the fields required by the auth type are set.
+func (c *Credential) Validate() error {
+	switch c.AuthKind() {
+	case AuthBasic:
+		if c.Username == "" {
+			return fmt.Errorf("username is required for %s auth", AuthBasic)
+		}
+	case AuthBearer, AuthIdentityToken:
+		if c.Token == "" {
+			return fmt.Errorf("token is required for %s auth", c.AuthKind())
+		}
+	case AuthHelper:
+		return c.helperSpec().Validate()
+	case AuthAnonymous:
+	default:
+		return fmt.Errorf("unknown auth type %q, expected %s, %s, %s, %s or %s", c.AuthType, AuthBasic, AuthBearer, AuthIdentityToken, AuthHelper, AuthAnonymous)
+	}
+	return nil
+}
+
+func (c *Credential) helperSpec() credhelper.Spec {
+	return credhelper.Spec{Helper: c.Helper, Protocol: c.HelperProtocol, Args: c.HelperArgs, Registry: c.Registry}
+}
+
+// AuthConfig maps the credential to the matching authn.AuthConfig fields.
+// Helper credentials are only known once resolved, see ResolveAuth.
+func (c *Credential) AuthConfig() authn.AuthConfig {
+	switch c.AuthKind() {
+	case AuthBasic:
+		return authn.AuthConfig{Username: c.Username, Password: c.Password}
+	case AuthBearer:
+		return authn.AuthConfig{RegistryToken: c.Token}
+	case AuthIdentityToken:
+		return authn.AuthConfig{Username: c.Username, IdentityToken: c.Token}
+	}
+	return authn.AuthConfig{}
+}
+
+// ResolveAuth returns the auth config of the credential, running the
+// credential helper of helper credentials unless its output is cached.
+func (c *Credential) ResolveAuth(ctx context.Context) (authn.AuthConfig, error) {
+	if c.AuthKind() == AuthHelper {
+		return credhelper.Default.Get(ctx, c.helperSpec())
+	}
+	return c.AuthConfig(), nil
+}
+
+// Authenticator returns the authn.Authenticator for the credential.
+func (c *Credential) Authenticator() authn.Authenticator {
+	if c.AuthKind() == AuthHelper {
+		return &credhelper.Authenticator{Spec: c.helperSpec()}
+	}
+	cfg := c.AuthConfig()
+	if cfg == (authn.AuthConfig{}) {
+		return authn.Anonymous
+	}
+	return authn.FromConfig(cfg)
+}
+
+// SetRequestAuth sets the Authorization header sent to a registry before
+// any token exchange: basic auth, or the static bearer token. Identity
+// tokens are only accepted by the token endpoint and leave req unchanged.
+func SetRequestAuth(req *http.Request, cfg authn.AuthConfig) {
+	switch {
+	case cfg.RegistryToken != "":
+		req.Header.Set("Authorization", "Bearer "+cfg.RegistryToken)
+	case cfg.IdentityToken != "":
+	case cfg.Username != "" || cfg.Password != "":
+		req.SetBasicAuth(cfg.Username, cfg.Password)
+	}
+}
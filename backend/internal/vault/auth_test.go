@@ -0,0 +1,65 @@
+package vault
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+func TestCredentialAuthConfig(t *testing.T) {
+	cases := []struct {
+		cred Credential
+		kind string
+		want authn.AuthConfig
+	}{
+		{Credential{Username: "u", Password: "p"}, AuthBasic, authn.AuthConfig{Username: "u", Password: "p"}},
+		{Credential{}, AuthAnonymous, authn.AuthConfig{}},
+		{Credential{Username: "u", Password: "p", AuthType: "Anonymous"}, AuthAnonymous, authn.AuthConfig{}},
+		{Credential{AuthType: AuthBearer, Token: "t"}, AuthBearer, authn.AuthConfig{RegistryToken: "t"}},
+		{Credential{Username: "<token>", AuthType: AuthIdentityToken, Token: "r"}, AuthIdentityToken, authn.AuthConfig{Username: "<token>", IdentityToken: "r"}},
+	}
+	for _, tc := range cases {
+		if got := tc.cred.AuthKind(); got != tc.kind {
+			t.Fatalf("%+v: expected kind %s, got %s", tc.cred, tc.kind, got)
+		}
+		if err := tc.cred.Validate(); err != nil {
+			t.Fatalf("%+v: %v", tc.cred, err)
+		}
+		if got := tc.cred.AuthConfig(); got != tc.want {
+			t.Fatalf("%+v: expected %+v, got %+v", tc.cred, tc.want, got)
+		}
+	}
+	if (*Credential)(nil).Authenticator() != authn.Anonymous {
+		t.Fatalf("a nil credential should be anonymous")
+	}
+
+	for _, cred := range []Credential{
+		{AuthType: AuthBasic},
+		{AuthType: AuthBearer},
+		{AuthType: AuthIdentityToken, Username: "u"},
+		{AuthType: "oauth", Token: "t"},
+	} {
+		if err := cred.Validate(); err == nil {
+			t.Fatalf("%+v: expected a validation error", cred)
+		}
+	}
+}
+
+func TestCredentialSetRequestAuth(t *testing.T) {
+	for _, tc := range []struct {
+		cred Credential
+		want string
+	}{
+		{Credential{Username: "u", Password: "p"}, "Basic dTpw"},
+		{Credential{AuthType: AuthBearer, Token: "t"}, "Bearer t"},
+		{Credential{AuthType: AuthIdentityToken, Token: "r"}, ""},
+		{Credential{AuthType: AuthAnonymous, Username: "u"}, ""},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "https://registry.local/v2/", nil)
+		SetRequestAuth(req, tc.cred.AuthConfig())
+		if got := req.Header.Get("Authorization"); got != tc.want {
+			t.Fatalf("%+v: expected %q, got %q", tc.cred, tc.want, got)
+		}
+	}
+}
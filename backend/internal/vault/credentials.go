@@ -0,0 +1,95 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrConflict is returned by Modify and the credential methods when
+	// the vault changed since the revision the caller read.
+	ErrConflict = errors.New("vault was modified concurrently")
+	// ErrCredentialNotFound is returned for unknown credential IDs.
+	ErrCredentialNotFound = errors.New("credential not found")
+	// ErrCredentialExists is returned when adding a credential whose ID is
+	// taken.
+	ErrCredentialExists = errors.New("credential already exists")
+)
+
+// GetCredential returns the credential with the given ID.
+func (v *Vault) GetCredential(id string) (Credential, error) {
+	creds, err := v.LoadCredentials()
+	if err != nil {
+		return Credential{}, err
+	}
+	for _, c := range creds {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	return Credential{}, ErrCredentialNotFound
+}
+
+// AddCredential appends cred, assigning it a new ID if it has none, and
+// returns it as saved.
+func (v *Vault) AddCredential(cred Credential) (Credential, error) {
+	_, err := v.Modify(AnyRevision, func(creds []Credential) ([]Credential, error) {
+		if cred.ID == "" {
+			cred.ID = NewCredentialID(creds)
+		}
+		for _, c := range creds {
+			if c.ID == cred.ID {
+				return nil, fmt.Errorf("%w: %s", ErrCredentialExists, cred.ID)
+			}
+		}
+		return append(creds, cred), nil
+	})
+	if err != nil {
+		return Credential{}, err
+	}
+	return cred, nil
+}
+
+// UpdateCredential applies fn to the credential with the given ID and
+// saves the result, keeping the ID. ifRevision is checked as by Modify.
+func (v *Vault) UpdateCredential(id string, ifRevision uint64, fn func(c *Credential) error) (Credential, error) {
+	var updated Credential
+	_, err := v.Modify(ifRevision, func(creds []Credential) ([]Credential, error) {
+		for i := range creds {
+			if creds[i].ID != id {
+				continue
+			}
+			c := creds[i]
+			if err := fn(&c); err != nil {
+				return nil, err
+			}
+			c.ID = id
+			creds[i], updated = c, c
+			return creds, nil
+		}
+		return nil, ErrCredentialNotFound
+	})
+	if err != nil {
+		return Credential{}, err
+	}
+	return updated, nil
+}
+
+// DeleteCredential removes the credential with the given ID and returns
+// it. ifRevision is checked as by Modify.
+func (v *Vault) DeleteCredential(id string, ifRevision uint64) (Credential, error) {
+	var deleted Credential
+	_, err := v.Modify(ifRevision, func(creds []Credential) ([]Credential, error) {
+		for i := range creds {
+			if creds[i].ID == id {
+				deleted = creds[i]
+				return append(creds[:i:i], creds[i+1:]...), nil
+			}
+		}
+		return nil, ErrCredentialNotFound
+	})
+	if err != nil {
+		return Credential{}, err
+	}
+	return deleted, nil
+}
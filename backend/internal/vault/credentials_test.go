@@ -0,0 +1,133 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVault_CredentialMethods(t *testing.T) {
+	v, _ := NewVault(filepath.Join(t.TempDir(), "vault.enc"), "passphrase")
+	if _, rev, err := v.Snapshot(); err != nil || rev != 0 {
+		t.Fatalf("empty vault: rev %d, %v", rev, err)
+	}
+
+	hub, err := v.AddCredential(Credential{Name: "hub", Registry: "docker.io", Username: "alice"})
+	if err != nil || hub.ID == "" {
+		t.Fatalf("add: %+v, %v", hub, err)
+	}
+	if _, err := v.AddCredential(Credential{ID: hub.ID}); !errors.Is(err, ErrCredentialExists) {
+		t.Fatalf("expected a duplicate ID error, got %v", err)
+	}
+	ghcr, _ := v.AddCredential(Credential{Name: "ghcr", Registry: "ghcr.io"})
+	_, rev, _ := v.Snapshot()
+	if rev != 2 {
+		t.Fatalf("rev = %d after two adds", rev)
+	}
+
+	updated, err := v.UpdateCredential(hub.ID, rev, func(c *Credential) error {
+		c.ID, c.Username = "renamed", "bob"
+		return nil
+	})
+	if err != nil || updated.ID != hub.ID || updated.Username != "bob" {
+		t.Fatalf("update: %+v, %v", updated, err)
+	}
+	if got, err := v.GetCredential(hub.ID); err != nil || got.Username != "bob" {
+		t.Fatalf("get: %+v, %v", got, err)
+	}
+
+	// rev is stale now
+	if _, err := v.DeleteCredential(ghcr.ID, rev); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+	if _, err := v.UpdateCredential("missing", AnyRevision, func(*Credential) error { return nil }); !errors.Is(err, ErrCredentialNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if deleted, err := v.DeleteCredential(ghcr.ID, AnyRevision); err != nil || deleted.Name != "ghcr" {
+		t.Fatalf("delete: %+v, %v", deleted, err)
+	}
+	creds, rev, _ := v.Snapshot()
+	if len(creds) != 1 || rev != 4 {
+		t.Fatalf("after delete: %+v at rev %d", creds, rev)
+	}
+}
+
+func TestVault_ModifyChecksRevisionZero(t *testing.T) {
+	v, _ := NewVault(filepath.Join(t.TempDir(), "vault.enc"), "passphrase")
+	_, rev, err := v.Snapshot()
+	if err != nil || rev != 0 {
+		t.Fatalf("empty vault: rev %d, %v", rev, err)
+	}
+	if _, err := v.AddCredential(Credential{Name: "hub", Registry: "docker.io"}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	// The vault changed since it was read at revision zero
+	_, err = v.Modify(rev, func(creds []Credential) ([]Credential, error) { return nil, nil })
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+	if creds, _ := v.LoadCredentials(); len(creds) != 1 {
+		t.Fatalf("the credential should be kept, got %+v", creds)
+	}
+}
+
+func TestVault_ConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.enc")
+	seed, _ := NewVault(path, "passphrase")
+	if err := seed.SaveCredentials([]Credential{}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	// Separate Vault values share only the file lock, like processes do
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, _ := NewVault(path, "passphrase")
+			for j := 0; j < 3; j++ {
+				if _, err := v.AddCredential(Credential{Name: fmt.Sprintf("cred-%d-%d", i, j)}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("add: %v", err)
+	}
+
+	creds, rev, err := seed.Snapshot()
+	if err != nil || len(creds) != 24 || rev != 25 {
+		t.Fatalf("expected 24 credentials at rev 25, got %d at rev %d: %v", len(creds), rev, err)
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	old := lockTimeout
+	lockTimeout = 50 * time.Millisecond
+	defer func() { lockTimeout = old }()
+
+	path := filepath.Join(t.TempDir(), "vault.enc.lock")
+	l, err := lockFile(path)
+	if err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	if _, err := lockFile(path); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected the lock to be held, got %v", err)
+	}
+	if err := l.unlock(); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+	l, err = lockFile(path)
+	if err != nil {
+		t.Fatalf("relock: %v", err)
+	}
+	l.unlock()
+}
@@ -0,0 +1,337 @@
+package vault
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/guoxudong/horcrux/internal/credhelper"
+)
+
+// dockerHubKey is the auths key docker uses for Docker Hub.
+const dockerHubKey = "https://index.docker.io/v1/"
+
+// DockerConfig is the credential part of a docker config.json.
+type DockerConfig struct {
+	Auths       map[string]DockerAuth `json:"auths"`
+	CredHelpers map[string]string     `json:"credHelpers,omitempty"`
+	CredsStore  string                `json:"credsStore,omitempty"`
+}
+
+// DockerAuth is an auths entry of a docker config.json.
+type DockerAuth struct {
+	Auth          string `json:"auth,omitempty"` // base64 of username:password
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	RegistryToken string `json:"registrytoken,omitempty"`
+}
+
+// ParseDockerConfig parses a docker config.json.
+func ParseDockerConfig(data []byte) (*DockerConfig, error) {
+	var cfg DockerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid docker config: %v", err)
+	}
+	return &cfg, nil
+}
+
+// DockerImportOptions controls ImportDockerConfig.
+type DockerImportOptions struct {
+	// LinkHelpers stores credHelpers and credsStore entries as helper
+	// credentials instead of the secrets they return today.
+	LinkHelpers bool
+}
+
+// DockerImportSkip is a config entry that was not imported.
+type DockerImportSkip struct {
+	Registry string `json:"registry"`
+	Username string `json:"username,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+// DockerImportResult lists the credentials added by ImportDockerConfig and
+// the entries it skipped.
+type DockerImportResult struct {
+	Added   []Credential       `json:"added"`
+	Skipped []DockerImportSkip `json:"skipped"`
+}
+
+// ImportDockerConfig converts the auths, credHelpers and credsStore of cfg
+// to credentials and appends those not already in existing. Auths entries
+// without secrets belong to the credsStore and are resolved through it.
+// Helpers are run with the docker credential helper protocol; helper
+// values that are not bare names are skipped.
+func ImportDockerConfig(ctx context.Context, cfg *DockerConfig, existing []Credential, opts DockerImportOptions) ([]Credential, DockerImportResult) {
+	imported, res := convertDockerConfig(ctx, cfg, opts)
+	return addImported(existing, imported, res)
+}
+
+// ImportDockerConfig imports cfg like the package function and saves the
+// result. Helpers run before the vault is locked; the duplicate check runs
+// under the lock against the stored credentials, so concurrent changes are
+// kept.
+func (v *Vault) ImportDockerConfig(ctx context.Context, cfg *DockerConfig, opts DockerImportOptions) (DockerImportResult, error) {
+	imported, res := convertDockerConfig(ctx, cfg, opts)
+	if len(imported) == 0 {
+		return res, nil
+	}
+	var out DockerImportResult
+	_, err := v.Modify(AnyRevision, func(creds []Credential) ([]Credential, error) {
+		var added []Credential
+		added, out = addImported(creds, imported, res)
+		if len(out.Added) == 0 {
+			return nil, errNothingImported
+		}
+		return added, nil
+	})
+	if errors.Is(err, errNothingImported) {
+		return out, nil
+	}
+	if err != nil {
+		return DockerImportResult{}, err
+	}
+	return out, nil
+}
+
+// errNothingImported skips saving an import that only found duplicates.
+var errNothingImported = errors.New("nothing imported")
+
+// convertDockerConfig converts the entries of cfg, running helpers unless
+// they are linked.
+func convertDockerConfig(ctx context.Context, cfg *DockerConfig, opts DockerImportOptions) ([]Credential, DockerImportResult) {
+	res := DockerImportResult{Added: []Credential{}, Skipped: []DockerImportSkip{}}
+	helpers := map[string]string{}
+	for key, helper := range cfg.CredHelpers {
+		helpers[dockerRegistry(key)] = helper
+	}
+
+	var imported []Credential
+	for _, key := range sortedKeys(cfg.Auths) {
+		registry := dockerRegistry(key)
+		if _, ok := helpers[registry]; ok {
+			continue // credHelpers take precedence, as in docker
+		}
+		cred, ok, err := dockerAuthCredential(cfg.Auths[key])
+		if err != nil {
+			res.Skipped = append(res.Skipped, DockerImportSkip{Registry: registry, Reason: err.Error()})
+			continue
+		}
+		if !ok {
+			if cfg.CredsStore == "" {
+				res.Skipped = append(res.Skipped, DockerImportSkip{Registry: registry, Reason: "no credentials in entry"})
+				continue
+			}
+			helpers[registry] = cfg.CredsStore
+			continue
+		}
+		cred.Registry = registry
+		imported = append(imported, cred)
+	}
+
+	for _, registry := range sortedKeys(helpers) {
+		// The config may come from a client; only named helpers are run
+		// or linked, never paths.
+		if err := credhelper.ValidateHelperName(helpers[registry]); err != nil {
+			res.Skipped = append(res.Skipped, DockerImportSkip{Registry: registry, Reason: err.Error()})
+			continue
+		}
+		cred := Credential{Registry: registry, AuthType: AuthHelper, Helper: helpers[registry]}
+		if !opts.LinkHelpers {
+			var err error
+			if cred, err = resolveHelperCredential(ctx, cred); err != nil {
+				res.Skipped = append(res.Skipped, DockerImportSkip{Registry: registry, Reason: err.Error()})
+				continue
+			}
+		}
+		imported = append(imported, cred)
+	}
+	return imported, res
+}
+
+// addImported appends the imported credentials not already in existing,
+// giving them IDs and names, and records the rest in res as skipped.
+func addImported(existing, imported []Credential, res DockerImportResult) ([]Credential, DockerImportResult) {
+	res.Added = []Credential{}
+	res.Skipped = append([]DockerImportSkip(nil), res.Skipped...)
+	out := append([]Credential(nil), existing...)
+	now := time.Now().UnixNano()
+	for _, cred := range imported {
+		if dup := findDuplicate(out, cred); dup != nil {
+			res.Skipped = append(res.Skipped, DockerImportSkip{
+				Registry: cred.Registry,
+				Username: cred.Username,
+				Reason:   fmt.Sprintf("duplicate of %s", dup.Name),
+			})
+			continue
+		}
+		cred.ID = fmt.Sprintf("cred_%d_%d", now, len(res.Added))
+		cred.Name = uniqueName(out, cred.Registry)
+		out = append(out, cred)
+		res.Added = append(res.Added, cred)
+	}
+	return out, res
+}
+
+// dockerAuthCredential converts an auths entry. ok is false for entries
+// without secrets, which docker writes for registries of a credsStore.
+func dockerAuthCredential(a DockerAuth) (cred Credential, ok bool, err error) {
+	user, pass := a.Username, a.Password
+	if a.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return Credential{}, false, fmt.Errorf("invalid auth field: %v", err)
+		}
+		var found bool
+		user, pass, found = strings.Cut(string(decoded), ":")
+		if !found {
+			return Credential{}, false, fmt.Errorf("invalid auth field: expected username:password")
+		}
+	}
+	switch {
+	case a.RegistryToken != "":
+		return Credential{AuthType: AuthBearer, Token: a.RegistryToken}, true, nil
+	case a.IdentityToken != "":
+		return Credential{AuthType: AuthIdentityToken, Username: user, Token: a.IdentityToken}, true, nil
+	case user != "" || pass != "":
+		return Credential{AuthType: AuthBasic, Username: user, Password: pass}, true, nil
+	}
+	return Credential{}, false, nil
+}
+
+// resolveHelperCredential runs the helper of cred and returns a credential
+// holding its current secret.
+func resolveHelperCredential(ctx context.Context, cred Credential) (Credential, error) {
+	cfg, err := credhelper.NewProvider().Get(ctx, cred.helperSpec())
+	if err != nil {
+		return Credential{}, err
+	}
+	out := Credential{Registry: cred.Registry}
+	switch {
+	case cfg.RegistryToken != "":
+		out.AuthType, out.Token = AuthBearer, cfg.RegistryToken
+	case cfg.IdentityToken != "":
+		out.AuthType, out.Username, out.Token = AuthIdentityToken, cfg.Username, cfg.IdentityToken
+	default:
+		out.AuthType, out.Username, out.Password = AuthBasic, cfg.Username, cfg.Password
+	}
+	return out, nil
+}
+
+// findDuplicate returns the credential of existing for the same registry
+// and identity as cred.
+func findDuplicate(existing []Credential, cred Credential) *Credential {
+	for i := range existing {
+		e := &existing[i]
+		if dockerRegistry(e.Registry) != cred.Registry || e.AuthKind() != cred.AuthKind() {
+			continue
+		}
+		switch cred.AuthKind() {
+		case AuthHelper:
+			if e.Helper == cred.Helper {
+				return e
+			}
+		case AuthBearer:
+			if e.Token == cred.Token {
+				return e
+			}
+		default:
+			if e.Username == cred.Username {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// uniqueName returns base, or base with a numeric suffix if it is taken.
+func uniqueName(existing []Credential, base string) string {
+	taken := map[string]bool{}
+	for _, c := range existing {
+		taken[c.Name] = true
+	}
+	name := base
+	for i := 2; taken[name]; i++ {
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+	return name
+}
+
+// dockerRegistry normalizes an auths or credHelpers key to a registry host,
+// e.g. https://index.docker.io/v1/ to docker.io.
+func dockerRegistry(key string) string {
+	r := strings.TrimSpace(key)
+	r = strings.TrimPrefix(r, "https://")
+	r = strings.TrimPrefix(r, "http://")
+	if idx := strings.IndexByte(r, '/'); idx >= 0 {
+		r = r[:idx]
+	}
+	r = strings.ToLower(r)
+	switch r {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+	return r
+}
+
+// ExportDockerConfig builds a docker config.json holding creds, e.g. for CI.
+// Helper credentials become credHelpers entries; anonymous credentials,
+// kubelet plugins and further credentials of an exported registry are
+// returned as skipped.
+func ExportDockerConfig(creds []Credential) (*DockerConfig, []DockerImportSkip) {
+	cfg := &DockerConfig{Auths: map[string]DockerAuth{}}
+	skipped := []DockerImportSkip{}
+	seen := map[string]string{}
+	for _, c := range creds {
+		registry := dockerRegistry(c.Registry)
+		if registry == "" {
+			skipped = append(skipped, DockerImportSkip{Registry: c.Registry, Username: c.Username, Reason: "no registry"})
+			continue
+		}
+		if name, ok := seen[registry]; ok {
+			skipped = append(skipped, DockerImportSkip{Registry: registry, Username: c.Username, Reason: fmt.Sprintf("registry already exported from %s", name)})
+			continue
+		}
+		key := registry
+		if registry == "docker.io" {
+			key = dockerHubKey
+		}
+		switch c.AuthKind() {
+		case AuthBasic:
+			cfg.Auths[key] = DockerAuth{Auth: base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password))}
+		case AuthBearer:
+			cfg.Auths[key] = DockerAuth{RegistryToken: c.Token}
+		case AuthIdentityToken:
+			cfg.Auths[key] = DockerAuth{Username: c.Username, IdentityToken: c.Token}
+		case AuthHelper:
+			if p, _ := credhelper.ParseProtocol(c.HelperProtocol); p != credhelper.ProtocolDocker {
+				skipped = append(skipped, DockerImportSkip{Registry: registry, Reason: "kubelet credential providers cannot be exported"})
+				continue
+			}
+			if cfg.CredHelpers == nil {
+				cfg.CredHelpers = map[string]string{}
+			}
+			cfg.CredHelpers[registry] = strings.TrimPrefix(filepath.Base(c.Helper), "docker-credential-")
+		default:
+			skipped = append(skipped, DockerImportSkip{Registry: registry, Username: c.Username, Reason: "anonymous credential"})
+			continue
+		}
+		seen[registry] = c.Name
+	}
+	return cfg, skipped
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
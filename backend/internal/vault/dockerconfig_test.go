@@ -0,0 +1,203 @@
+package vault
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// stubDockerHelper puts docker-credential-stub on PATH, printing secrets
+// for registry.local and failing for other servers.
+func stubDockerHelper(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("stub helpers are shell scripts")
+	}
+	dir := t.TempDir()
+	script := `#!/bin/sh
+server=$(cat)
+if [ "$server" = "registry.local" ]; then
+  echo '{"ServerURL":"registry.local","Username":"robot","Secret":"from-store"}'
+  exit 0
+fi
+echo "credentials not found in native keychain"
+exit 1
+`
+	if err := os.WriteFile(filepath.Join(dir, "docker-credential-stub"), []byte(script), 0755); err != nil {
+		t.Fatalf("write helper: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+const dockerConfigFixture = `{
+	"auths": {
+		"https://index.docker.io/v1/": {"auth": "%s"},
+		"ghcr.io": {"username": "octo", "identitytoken": "refresh"},
+		"quay.io": {"registrytoken": "static"},
+		"registry.local": {},
+		"missing.local": {},
+		"gcr.io": {"auth": "ignored"},
+		"broken.local": {"auth": "!!"}
+	},
+	"credHelpers": {"gcr.io": "gcloud"},
+	"credsStore": "stub"
+}`
+
+func TestImportDockerConfig(t *testing.T) {
+	stubDockerHelper(t)
+	auth := base64.StdEncoding.EncodeToString([]byte("alice:pa:ss"))
+	cfg, err := ParseDockerConfig([]byte(strings.Replace(dockerConfigFixture, "%s", auth, 1)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	existing := []Credential{{ID: "cred_1", Name: "quay.io", Registry: "https://quay.io", AuthType: AuthBearer, Token: "static"}}
+
+	creds, res := ImportDockerConfig(context.Background(), cfg, existing, DockerImportOptions{})
+	got := map[string]Credential{}
+	for _, c := range res.Added {
+		got[c.Registry] = c
+	}
+	if len(res.Added) != 3 || len(creds) != 4 {
+		t.Fatalf("unexpected import: %+v", res)
+	}
+	if c := got["docker.io"]; c.AuthKind() != AuthBasic || c.Username != "alice" || c.Password != "pa:ss" || c.Name != "docker.io" || c.ID == "" {
+		t.Fatalf("unexpected docker hub credential %+v", c)
+	}
+	if c := got["ghcr.io"]; c.AuthKind() != AuthIdentityToken || c.Token != "refresh" {
+		t.Fatalf("unexpected ghcr credential %+v", c)
+	}
+	if c := got["registry.local"]; c.AuthKind() != AuthBasic || c.Password != "from-store" {
+		t.Fatalf("credsStore entries should be resolved: %+v", c)
+	}
+
+	// quay.io duplicates an existing credential, gcr.io has no gcloud helper
+	reasons := map[string]string{}
+	for _, s := range res.Skipped {
+		reasons[s.Registry] = s.Reason
+	}
+	if len(reasons) != 4 || reasons["quay.io"] != "duplicate of quay.io" || !strings.Contains(reasons["missing.local"], "credentials not found") ||
+		!strings.Contains(reasons["broken.local"], "invalid auth") || !strings.Contains(reasons["gcr.io"], "gcloud") {
+		t.Fatalf("unexpected skipped entries %+v", res.Skipped)
+	}
+
+	// A second import only finds duplicates
+	again, res := ImportDockerConfig(context.Background(), cfg, creds, DockerImportOptions{})
+	if len(res.Added) != 0 || len(again) != len(creds) {
+		t.Fatalf("expected no new credentials, got %+v", res.Added)
+	}
+
+	// Linked helpers are stored without running them
+	_, res = ImportDockerConfig(context.Background(), cfg, nil, DockerImportOptions{LinkHelpers: true})
+	linked := map[string]string{}
+	for _, c := range res.Added {
+		if c.AuthKind() == AuthHelper {
+			linked[c.Registry] = c.Helper
+		}
+	}
+	if len(linked) != 3 || linked["gcr.io"] != "gcloud" || linked["missing.local"] != "stub" {
+		t.Fatalf("unexpected linked helpers %v", linked)
+	}
+}
+
+func TestVault_ImportDockerConfigKeepsConcurrentChanges(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub helpers are shell scripts")
+	}
+	dir := t.TempDir()
+	release := filepath.Join(dir, "release")
+	script := "#!/bin/sh\ncat >/dev/null\nwhile [ ! -f " + release + " ]; do sleep 0.01; done\n" +
+		`echo '{"Username":"robot","Secret":"from-store"}'` + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "docker-credential-slow"), []byte(script), 0755); err != nil {
+		t.Fatalf("write helper: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	v, _ := NewVault(filepath.Join(t.TempDir(), "vault.enc"), "passphrase")
+	cfg := &DockerConfig{CredHelpers: map[string]string{"registry.local": "slow"}}
+	done := make(chan error, 1)
+	go func() {
+		_, err := v.ImportDockerConfig(context.Background(), cfg, DockerImportOptions{})
+		done <- err
+	}()
+
+	// A credential added while the helper runs is kept
+	if _, err := v.AddCredential(Credential{Name: "hub", Registry: "docker.io", Username: "alice"}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := os.WriteFile(release, nil, 0644); err != nil {
+		t.Fatalf("release helper: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	creds, err := v.LoadCredentials()
+	if err != nil || len(creds) != 2 {
+		t.Fatalf("expected both credentials, got %+v: %v", creds, err)
+	}
+}
+
+func TestImportDockerConfig_RejectsHelperPaths(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub helpers are shell scripts")
+	}
+	dir := t.TempDir()
+	ran := filepath.Join(dir, "ran")
+	helper := filepath.Join(dir, "docker-credential-evil")
+	if err := os.WriteFile(helper, []byte("#!/bin/sh\ntouch "+ran+"\n"), 0755); err != nil {
+		t.Fatalf("write helper: %v", err)
+	}
+	cfg := &DockerConfig{
+		Auths:       map[string]DockerAuth{"registry.local": {}},
+		CredHelpers: map[string]string{"gcr.io": helper, "quay.io": `..\evil`},
+		CredsStore:  "../" + filepath.Base(dir) + "/evil",
+	}
+
+	for _, opts := range []DockerImportOptions{{}, {LinkHelpers: true}} {
+		_, res := ImportDockerConfig(context.Background(), cfg, nil, opts)
+		if len(res.Added) != 0 || len(res.Skipped) != 3 {
+			t.Fatalf("helper paths should be skipped: %+v", res)
+		}
+		for _, s := range res.Skipped {
+			if !strings.Contains(s.Reason, "not a path") {
+				t.Fatalf("unexpected reason for %s: %s", s.Registry, s.Reason)
+			}
+		}
+	}
+	if _, err := os.Stat(ran); err == nil {
+		t.Fatalf("the helper path should never run")
+	}
+}
+
+func TestExportDockerConfig(t *testing.T) {
+	creds := []Credential{
+		{Name: "hub", Registry: "docker.io", Username: "alice", Password: "secret"},
+		{Name: "hub-2", Registry: "index.docker.io", Username: "bob", Password: "other"},
+		{Name: "ghcr", Registry: "https://ghcr.io", AuthType: AuthIdentityToken, Token: "refresh"},
+		{Name: "ecr", Registry: "123.dkr.ecr.us-east-1.amazonaws.com", AuthType: AuthHelper, Helper: "/usr/local/bin/docker-credential-ecr-login"},
+		{Name: "eks", Registry: "456.dkr.ecr.us-east-1.amazonaws.com", AuthType: AuthHelper, Helper: "ecr-credential-provider", HelperProtocol: "kubelet"},
+		{Name: "public", Registry: "quay.io"},
+	}
+	cfg, skipped := ExportDockerConfig(creds)
+	if len(skipped) != 3 {
+		t.Fatalf("expected 3 skipped credentials, got %+v", skipped)
+	}
+	if a := cfg.Auths[dockerHubKey]; a.Auth != base64.StdEncoding.EncodeToString([]byte("alice:secret")) {
+		t.Fatalf("unexpected docker hub entry %+v", a)
+	}
+	if a := cfg.Auths["ghcr.io"]; a.IdentityToken != "refresh" {
+		t.Fatalf("unexpected ghcr entry %+v", a)
+	}
+	if cfg.CredHelpers["123.dkr.ecr.us-east-1.amazonaws.com"] != "ecr-login" {
+		t.Fatalf("unexpected cred helpers %v", cfg.CredHelpers)
+	}
+
+	// The export imports back into an empty vault
+	_, res := ImportDockerConfig(context.Background(), cfg, nil, DockerImportOptions{LinkHelpers: true})
+	if len(res.Added) != 3 || len(res.Skipped) != 0 {
+		t.Fatalf("unexpected round trip %+v", res)
+	}
+}
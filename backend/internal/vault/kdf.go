@@ -0,0 +1,111 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// DefaultPassphrase is the built-in passphrase used when HORCRUX_SECRET is
+// unset. Vaults encrypted with it are effectively unencrypted.
+const DefaultPassphrase = "12345678901234567890123456789012"
+
+// ErrWrongPassphrase is returned when the vault cannot be decrypted.
+var ErrWrongPassphrase = errors.New("vault cannot be decrypted: wrong passphrase or corrupted file")
+
+const (
+	vaultFormat  = "horcrux-vault"
+	vaultVersion = 2
+	kdfScrypt    = "scrypt"
+
+	// legacyKeySize is the raw AES-256 key length of unversioned vaults.
+	legacyKeySize = 32
+)
+
+// KDFParams describes how the vault key is derived from the passphrase.
+type KDFParams struct {
+	Name string `json:"name"` // scrypt
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+}
+
+// DefaultKDF holds the scrypt cost of new vaults, see scrypt.Key.
+var DefaultKDF = KDFParams{Name: kdfScrypt, N: 1 << 15, R: 8, P: 1}
+
+func newKDFParams() (KDFParams, error) {
+	params := DefaultKDF
+	params.Salt = make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, params.Salt); err != nil {
+		return KDFParams{}, err
+	}
+	return params, nil
+}
+
+func (p KDFParams) equal(o KDFParams) bool {
+	return p.Name == o.Name && p.N == o.N && p.R == o.R && p.P == o.P && bytes.Equal(p.Salt, o.Salt)
+}
+
+// header is the authenticated, unencrypted part of a vault file.
+type header struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	KDF     KDFParams `json:"kdf"`
+	// Revision counts saves, see Vault.Snapshot. Files written before it
+	// existed are at revision zero.
+	Revision uint64 `json:"revision,omitempty"`
+}
+
+// envelope is a vault file: the header and the sealed credential list.
+type envelope struct {
+	header
+	Ciphertext []byte `json:"ciphertext"` // nonce followed by the AES-256-GCM output
+}
+
+// parseEnvelope reports whether raw is a versioned vault file. Unversioned
+// files are the bare AES-GCM output and never parse.
+func parseEnvelope(raw []byte) (envelope, bool) {
+	var env envelope
+	if err := json.Unmarshal(raw, &env); err != nil || env.Format != vaultFormat {
+		return envelope{}, false
+	}
+	return env, true
+}
+
+func (e envelope) check() error {
+	if e.Version != vaultVersion {
+		return fmt.Errorf("unsupported vault version %d", e.Version)
+	}
+	if e.KDF.Name != kdfScrypt {
+		return fmt.Errorf("unsupported vault key derivation %q", e.KDF.Name)
+	}
+	return nil
+}
+
+// additionalData binds the ciphertext to the header, so KDF parameters
+// cannot be swapped without failing decryption.
+func (e envelope) additionalData() []byte {
+	data, _ := json.Marshal(e.header)
+	return data
+}
+
+// deriveKey returns the key for params, reusing the last derived key.
+func (v *Vault) deriveKey(params KDFParams) ([]byte, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.key != nil && v.kdf.equal(params) {
+		return v.key, nil
+	}
+	key, err := scrypt.Key(v.passphrase, params.Salt, params.N, params.R, params.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("vault key derivation failed: %v", err)
+	}
+	v.kdf, v.key = params, key
+	return key, nil
+}
@@ -0,0 +1,53 @@
+package vault
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// ErrLocked is returned when another process holds the vault lock for
+// longer than lockTimeout.
+var ErrLocked = errors.New("vault is locked by another process")
+
+// lockTimeout bounds how long an operation waits for the vault lock.
+var lockTimeout = 10 * time.Second
+
+// fileLock is an advisory lock on the lock file next to the vault, held by
+// every read and read-modify-write of the vault file. It excludes other
+// processes, such as the CLI while the server runs; fileMu excludes
+// goroutines of this process.
+type fileLock struct {
+	f *os.File
+}
+
+func lockFile(path string) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		ok, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if ok {
+			return &fileLock{f: f}, nil
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, ErrLocked
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func (l *fileLock) unlock() error {
+	err := unlockFile(l.f)
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
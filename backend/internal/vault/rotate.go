@@ -0,0 +1,85 @@
+package vault
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrInvalidPassphrase is returned by RotatePassphrase for a new passphrase
+// that cannot be used.
+var ErrInvalidPassphrase = errors.New("invalid new passphrase")
+
+// RotatePassphrase re-encrypts the vault with a key derived from
+// newPassphrase under a fresh salt. oldPassphrase must be the current
+// passphrase. The previous file is kept next to the vault and its path is
+// returned; it is empty when the vault has not been written yet. The vault
+// is left unchanged on any error.
+func (v *Vault) RotatePassphrase(oldPassphrase, newPassphrase string) (string, error) {
+	switch {
+	case newPassphrase == "":
+		return "", fmt.Errorf("%w: must not be empty", ErrInvalidPassphrase)
+	case newPassphrase == DefaultPassphrase:
+		return "", fmt.Errorf("%w: must not be the built-in default", ErrInvalidPassphrase)
+	case newPassphrase == oldPassphrase:
+		return "", fmt.Errorf("%w: must differ from the old one", ErrInvalidPassphrase)
+	}
+
+	var backup string
+	err := v.locked(func() (err error) {
+		backup, err = v.rotate(oldPassphrase, newPassphrase)
+		return err
+	})
+	return backup, err
+}
+
+func (v *Vault) rotate(oldPassphrase, newPassphrase string) (string, error) {
+	v.mu.Lock()
+	current := v.passphrase
+	v.mu.Unlock()
+	if subtle.ConstantTimeCompare(current, []byte(oldPassphrase)) != 1 {
+		return "", ErrWrongPassphrase
+	}
+
+	// Loading first proves the old passphrase decrypts the file and
+	// migrates unversioned vaults before they are backed up.
+	creds, _, err := v.load()
+	if err != nil {
+		return "", err
+	}
+	raw, err := os.ReadFile(v.storagePath)
+	if os.IsNotExist(err) {
+		v.setPassphrase(&Vault{passphrase: []byte(newPassphrase)})
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	backup := fmt.Sprintf("%s.bak-%s", v.storagePath, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	if err := writeFileAtomic(backup, raw, 0600); err != nil {
+		return "", fmt.Errorf("failed to back up vault: %w", err)
+	}
+
+	next := &Vault{storagePath: v.storagePath, passphrase: []byte(newPassphrase)}
+	if _, err := next.save(creds); err != nil {
+		return "", fmt.Errorf("failed to re-encrypt vault: %w", err)
+	}
+	if _, _, err := next.load(); err != nil {
+		if restoreErr := writeFileAtomic(v.storagePath, raw, 0600); restoreErr != nil {
+			return "", fmt.Errorf("re-encrypted vault is unreadable (%v) and restoring %s failed: %w", err, backup, restoreErr)
+		}
+		return "", fmt.Errorf("re-encrypted vault is unreadable, restored the previous key: %w", err)
+	}
+	v.setPassphrase(next)
+	return backup, nil
+}
+
+// setPassphrase switches v to the passphrase and derived key of next.
+func (v *Vault) setPassphrase(next *Vault) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.passphrase, v.kdf, v.key = next.passphrase, next.kdf, next.key
+}
@@ -0,0 +1,73 @@
+package vault
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVault_RotatePassphrase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.enc")
+	v, _ := NewVault(path, "old passphrase")
+	creds := []Credential{{ID: "cred_1", Name: "hub", Registry: "docker.io", Username: "alice", Password: "s3cret"}}
+	if err := v.SaveCredentials(creds); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	before, _ := os.ReadFile(path)
+
+	for _, tc := range []struct{ old, new string }{
+		{"wrong", "new passphrase"},
+		{"old passphrase", ""},
+		{"old passphrase", "old passphrase"},
+		{"old passphrase", DefaultPassphrase},
+	} {
+		if _, err := v.RotatePassphrase(tc.old, tc.new); err == nil {
+			t.Fatalf("rotating from %q to %q should fail", tc.old, tc.new)
+		}
+	}
+	if _, err := v.RotatePassphrase("wrong", "new passphrase"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("expected a wrong passphrase error, got %v", err)
+	}
+	if after, _ := os.ReadFile(path); string(after) != string(before) {
+		t.Fatalf("failed rotations should leave the vault unchanged")
+	}
+
+	backup, err := v.RotatePassphrase("old passphrase", "new passphrase")
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if raw, err := os.ReadFile(backup); err != nil || string(raw) != string(before) {
+		t.Fatalf("backup should hold the previous vault: %v", err)
+	}
+	if info, _ := os.Stat(backup); info.Mode().Perm() != 0600 {
+		t.Fatalf("backup mode = %v", info.Mode().Perm())
+	}
+
+	// The open vault keeps working with the new key
+	if got, err := v.LoadCredentials(); err != nil || len(got) != 1 || got[0].Password != "s3cret" {
+		t.Fatalf("load after rotate: %+v, %v", got, err)
+	}
+	if old, _ := NewVault(path, "old passphrase"); old != nil {
+		if _, err := old.LoadCredentials(); !errors.Is(err, ErrWrongPassphrase) {
+			t.Fatalf("the old passphrase should no longer decrypt the vault, got %v", err)
+		}
+	}
+	reopened, _ := NewVault(path, "new passphrase")
+	if got, err := reopened.LoadCredentials(); err != nil || len(got) != 1 {
+		t.Fatalf("reopen with new passphrase: %+v, %v", got, err)
+	}
+	oldBackup, _ := NewVault(backup, "old passphrase")
+	if got, err := oldBackup.LoadCredentials(); err != nil || len(got) != 1 {
+		t.Fatalf("the backup should open with the old passphrase: %+v, %v", got, err)
+	}
+
+	// A vault that was never written only switches passphrase
+	empty, _ := NewVault(filepath.Join(t.TempDir(), "vault.enc"), "old passphrase")
+	if backup, err := empty.RotatePassphrase("old passphrase", "new passphrase"); err != nil || backup != "" {
+		t.Fatalf("rotate empty vault: %q, %v", backup, err)
+	}
+	if _, err := empty.RotatePassphrase("old passphrase", "other"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("the empty vault should use the new passphrase, got %v", err)
+	}
+}
@@ -6,9 +6,12 @@ import (
 	"crypto/rand"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 )
 
 // Credential represents a registry credential
@@ -19,21 +22,65 @@ type Credential struct {
 	Username string `json:"username"`
 	Password string `json:"password"` // This will be encrypted in storage
 	Type     string `json:"type"`     // e.g., "dockerhub", "ghcr", "acr", "private"
+	// AuthType selects how the credential authenticates, see AuthConfig
+	AuthType string `json:"auth_type,omitempty"` // basic, bearer, identity_token, helper, anonymous
+	Token    string `json:"token,omitempty"`     // bearer or identity token, encrypted like Password
+	// Helper credentials run an external credential helper for Registry
+	Helper         string   `json:"helper,omitempty"`          // helper name, e.g. "ecr-login"
+	HelperProtocol string   `json:"helper_protocol,omitempty"` // docker (default) or kubelet
+	HelperArgs     []string `json:"helper_args,omitempty"`
+}
+
+// MaskedSecret replaces passwords and tokens in credentials shown to users.
+const MaskedSecret = "********"
+
+// Redacted returns c with its password and token masked.
+func (c Credential) Redacted() Credential {
+	c.Password = MaskedSecret
+	if c.Token != "" {
+		c.Token = MaskedSecret
+	}
+	return c
+}
+
+// NewCredentialID returns an ID not used by existing. IDs are based on the
+// time, so they do not repeat after a credential is deleted.
+func NewCredentialID(existing []Credential) string {
+	taken := map[string]bool{}
+	for _, c := range existing {
+		taken[c.ID] = true
+	}
+	now := time.Now().UnixNano()
+	id := fmt.Sprintf("cred_%d", now)
+	for i := 1; taken[id]; i++ {
+		id = fmt.Sprintf("cred_%d_%d", now, i)
+	}
+	return id
 }
 
 // Vault manages encrypted storage of credentials
 type Vault struct {
 	storagePath string
-	key         []byte // 32 bytes for AES-256
+	passphrase  []byte
+
+	// fileMu serializes reads and writes of the vault file within the
+	// process, the file lock across processes, see locked.
+	fileMu sync.Mutex
+
+	mu  sync.Mutex
+	kdf KDFParams // parameters of key, reused when saving
+	key []byte    // 32 bytes for AES-256, derived from passphrase
 }
 
 func (v *Vault) StorageDir() string {
 	return filepath.Dir(v.storagePath)
 }
 
-func NewVault(storagePath string, key string) (*Vault, error) {
-	if len(key) != 32 {
-		return nil, errors.New("key must be exactly 32 bytes for AES-256")
+// NewVault opens the vault at storagePath. Its key is derived from
+// passphrase, which may have any length.
+func NewVault(storagePath string, passphrase string) (*Vault, error) {
+	if passphrase == "" {
+		return nil, errors.New("vault passphrase must not be empty")
 	}
 
 	// Ensure directory exists
@@ -44,13 +91,13 @@ func NewVault(storagePath string, key string) (*Vault, error) {
 
 	return &Vault{
 		storagePath: storagePath,
-		key:         []byte(key),
+		passphrase:  []byte(passphrase),
 	}, nil
 }
 
 // Encrypt encrypts plaintext using AES-GCM
-func (v *Vault) encrypt(plaintext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(v.key)
+func encrypt(key, plaintext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
@@ -65,12 +112,12 @@ func (v *Vault) encrypt(plaintext []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
 }
 
 // Decrypt decrypts ciphertext using AES-GCM
-func (v *Vault) decrypt(ciphertext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(v.key)
+func decrypt(key, ciphertext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
@@ -86,44 +133,200 @@ func (v *Vault) decrypt(ciphertext []byte) ([]byte, error) {
 	}
 
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	return gcm.Open(nil, nonce, ciphertext, nil)
+	return gcm.Open(nil, nonce, ciphertext, additionalData)
 }
 
-// SaveCredentials encrypts and saves the credential list to disk
+// SaveCredentials encrypts and saves the credential list to disk,
+// replacing the stored one whatever its revision. Prefer Modify or the
+// credential methods, which do not lose concurrent changes.
 func (v *Vault) SaveCredentials(creds []Credential) error {
-	data, err := json.Marshal(creds)
+	return v.locked(func() error {
+		_, err := v.save(creds)
+		return err
+	})
+}
+
+// LoadCredentials loads and decrypts the credential list from disk.
+// Vaults written before the versioned format, encrypted with the raw
+// 32-byte secret, are rewritten in the current format.
+func (v *Vault) LoadCredentials() ([]Credential, error) {
+	creds, _, err := v.Snapshot()
+	return creds, err
+}
+
+// Snapshot loads the credential list like LoadCredentials, along with the
+// revision it was read at. The revision grows with every save and can be
+// passed to Modify to detect concurrent changes.
+func (v *Vault) Snapshot() ([]Credential, uint64, error) {
+	var creds []Credential
+	var rev uint64
+	err := v.locked(func() (err error) {
+		creds, rev, err = v.load()
+		return err
+	})
+	return creds, rev, err
+}
+
+// AnyRevision passed to Modify and the credential methods skips the
+// revision check. Zero is a real revision, that of a vault not saved yet.
+const AnyRevision = ^uint64(0)
+
+// Modify replaces the credential list with the one fn returns for the
+// current list, holding the vault lock so concurrent changes are not lost.
+// When ifRevision is not AnyRevision and the vault is at another revision,
+// it returns ErrConflict without calling fn. It returns the new revision.
+func (v *Vault) Modify(ifRevision uint64, fn func(creds []Credential) ([]Credential, error)) (uint64, error) {
+	var rev uint64
+	err := v.locked(func() error {
+		creds, current, err := v.load()
+		if err != nil {
+			return err
+		}
+		if ifRevision != AnyRevision && ifRevision != current {
+			return fmt.Errorf("%w: at revision %d, expected %d", ErrConflict, current, ifRevision)
+		}
+		if creds, err = fn(creds); err != nil {
+			return err
+		}
+		rev, err = v.save(creds)
+		return err
+	})
+	return rev, err
+}
+
+// locked runs fn holding fileMu and the lock file next to the vault.
+func (v *Vault) locked(fn func() error) error {
+	v.fileMu.Lock()
+	defer v.fileMu.Unlock()
+	l, err := lockFile(v.storagePath + ".lock")
 	if err != nil {
 		return err
 	}
+	defer l.unlock()
+	return fn()
+}
 
-	encrypted, err := v.encrypt(data)
+// save writes creds at the revision after the stored one and returns it.
+func (v *Vault) save(creds []Credential) (uint64, error) {
+	data, err := json.Marshal(creds)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	v.mu.Lock()
+	params := v.kdf
+	v.mu.Unlock()
+	if params.Name == "" {
+		if params, err = newKDFParams(); err != nil {
+			return 0, err
+		}
+	}
+	key, err := v.deriveKey(params)
+	if err != nil {
+		return 0, err
 	}
 
-	return os.WriteFile(v.storagePath, encrypted, 0600)
+	rev, err := v.storedRevision()
+	if err != nil {
+		return 0, err
+	}
+	env := envelope{header: header{Format: vaultFormat, Version: vaultVersion, KDF: params, Revision: rev + 1}}
+	if env.Ciphertext, err = encrypt(key, data, env.additionalData()); err != nil {
+		return 0, err
+	}
+	out, err := json.Marshal(env)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeFileAtomic(v.storagePath, out, 0600); err != nil {
+		return 0, err
+	}
+	return env.Revision, nil
 }
 
-// LoadCredentials loads and decrypts the credential list from disk
-func (v *Vault) LoadCredentials() ([]Credential, error) {
+// storedRevision returns the revision in the header of the vault file,
+// zero if there is none.
+func (v *Vault) storedRevision() (uint64, error) {
+	raw, err := os.ReadFile(v.storagePath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	env, _ := parseEnvelope(raw)
+	return env.Revision, nil
+}
+
+func (v *Vault) load() ([]Credential, uint64, error) {
 	if _, err := os.Stat(v.storagePath); os.IsNotExist(err) {
-		return []Credential{}, nil
+		return []Credential{}, 0, nil
 	}
 
-	encrypted, err := os.ReadFile(v.storagePath)
+	raw, err := os.ReadFile(v.storagePath)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	data, err := v.decrypt(encrypted)
-	if err != nil {
-		return nil, err
+	env, ok := parseEnvelope(raw)
+	var data []byte
+	if ok {
+		if err := env.check(); err != nil {
+			return nil, 0, err
+		}
+		key, err := v.deriveKey(env.KDF)
+		if err != nil {
+			return nil, 0, err
+		}
+		if data, err = decrypt(key, env.Ciphertext, env.additionalData()); err != nil {
+			return nil, 0, ErrWrongPassphrase
+		}
+	} else {
+		if len(v.passphrase) != legacyKeySize {
+			return nil, 0, ErrWrongPassphrase
+		}
+		if data, err = decrypt(v.passphrase, raw, nil); err != nil {
+			return nil, 0, ErrWrongPassphrase
+		}
 	}
 
 	var creds []Credential
 	if err := json.Unmarshal(data, &creds); err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+
+	if !ok {
+		rev, err := v.save(creds)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to migrate vault: %w", err)
+		}
+		return creds, rev, nil
 	}
+	return creds, env.Revision, nil
+}
 
-	return creds, nil
+// writeFileAtomic replaces path with data through a temporary file, so a
+// crash never leaves a partially written vault.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
 }
@@ -0,0 +1,117 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVault_PassphraseRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.enc")
+	if _, err := NewVault(path, ""); err == nil {
+		t.Fatalf("an empty passphrase should be rejected")
+	}
+	v, err := NewVault(path, "correct horse battery staple")
+	if err != nil {
+		t.Fatalf("new vault: %v", err)
+	}
+	creds := []Credential{{ID: "cred_1", Name: "hub", Registry: "docker.io", Username: "alice", Password: "s3cret"}}
+	if err := v.SaveCredentials(creds); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	env, ok := parseEnvelope(raw)
+	if !ok || env.Version != vaultVersion || env.KDF.Name != kdfScrypt || len(env.KDF.Salt) != 16 || env.KDF.N != DefaultKDF.N {
+		t.Fatalf("unexpected vault header: %s", raw)
+	}
+	if bytes.Contains(raw, []byte("s3cret")) {
+		t.Fatalf("credentials should be encrypted")
+	}
+
+	// A second save keeps the salt and the derived key
+	if err := v.SaveCredentials(creds); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	raw2, _ := os.ReadFile(path)
+	if env2, _ := parseEnvelope(raw2); !env2.KDF.equal(env.KDF) {
+		t.Fatalf("the salt should be reused")
+	}
+
+	reopened, _ := NewVault(path, "correct horse battery staple")
+	got, err := reopened.LoadCredentials()
+	if err != nil || len(got) != 1 || got[0].Password != "s3cret" {
+		t.Fatalf("load: %+v, %v", got, err)
+	}
+
+	wrong, _ := NewVault(path, "Tr0ub4dor&3")
+	if _, err := wrong.LoadCredentials(); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("expected a wrong passphrase error, got %v", err)
+	}
+
+	// The header is authenticated
+	env.KDF.N = 1 << 10
+	tampered, _ := json.Marshal(env)
+	if err := os.WriteFile(path, tampered, 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	reopened, _ = NewVault(path, "correct horse battery staple")
+	if _, err := reopened.LoadCredentials(); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("expected tampered KDF parameters to fail, got %v", err)
+	}
+}
+
+func TestVault_MigratesLegacyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.enc")
+	data, _ := json.Marshal([]Credential{{ID: "cred_1", Name: "legacy", Username: "bob", Password: "old"}})
+	legacy, err := encrypt([]byte(DefaultPassphrase), data, nil)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if err := os.WriteFile(path, legacy, 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	short, _ := NewVault(path, "not the legacy key")
+	if _, err := short.LoadCredentials(); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("expected a wrong passphrase error, got %v", err)
+	}
+
+	v, _ := NewVault(path, DefaultPassphrase)
+	creds, err := v.LoadCredentials()
+	if err != nil || len(creds) != 1 || creds[0].Password != "old" {
+		t.Fatalf("load legacy: %+v, %v", creds, err)
+	}
+	raw, _ := os.ReadFile(path)
+	if _, ok := parseEnvelope(raw); !ok {
+		t.Fatalf("the legacy vault should be rewritten in the versioned format")
+	}
+	reopened, _ := NewVault(path, DefaultPassphrase)
+	if creds, err := reopened.LoadCredentials(); err != nil || creds[0].Name != "legacy" {
+		t.Fatalf("reload: %+v, %v", creds, err)
+	}
+}
+
+func TestNewCredentialID(t *testing.T) {
+	var creds []Credential
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		id := NewCredentialID(creds)
+		if seen[id] {
+			t.Fatalf("duplicate ID %s", id)
+		}
+		seen[id] = true
+		creds = append(creds, Credential{ID: id})
+	}
+
+	c := Credential{ID: "cred_1", Password: "s3cret"}
+	if r := c.Redacted(); r.Password != MaskedSecret || r.Token != "" || c.Password != "s3cret" {
+		t.Fatalf("unexpected redaction: %+v", r)
+	}
+}
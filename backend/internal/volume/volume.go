@@ -0,0 +1,371 @@
+// Package volume splits a file into numbered, fixed-size volumes for
+// removable media and reassembles them.
+//
+// Writing images.tar with 4GB volumes produces
+//
+//	images.tar.001, images.tar.002, ...   the volumes
+//	images.tar.volumes.json               the Index: size and sha256 of every volume
+//
+// The index travels with any volume set, so a reader can tell exactly which
+// volumes are missing or damaged before reading any of them.
+package volume
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// IndexSuffix is appended to the file name to name its volume index.
+const IndexSuffix = ".volumes.json"
+
+const formatVersion = 1
+
+// Index describes a volume set.
+type Index struct {
+	Version    int      `json:"version"`
+	Name       string   `json:"name"`        // file name the volumes reassemble to
+	Size       int64    `json:"size"`        // total size
+	SHA256     string   `json:"sha256"`      // of the reassembled file
+	VolumeSize int64    `json:"volume_size"` // maximum size of one volume
+	Volumes    []Volume `json:"volumes"`
+}
+
+// Volume is one file of a volume set.
+type Volume struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// IndexPath returns the index path of the volume set for path.
+func IndexPath(path string) string {
+	return path + IndexSuffix
+}
+
+// IsIndex reports whether path names a volume index.
+func IsIndex(path string) bool {
+	return strings.HasSuffix(path, IndexSuffix)
+}
+
+// Exists reports whether a volume set for path exists.
+func Exists(path string) bool {
+	_, err := os.Stat(IndexPath(path))
+	return err == nil
+}
+
+// IndexFor returns the index of the volume set path belongs to: path itself
+// if it is an index, the set whose first volume it is, or the set that
+// reassembles to it when no such file exists.
+func IndexFor(path string) (string, bool) {
+	if IsIndex(path) {
+		return path, true
+	}
+	if name, ok := strings.CutSuffix(path, volumeName("", 1)); ok && Exists(name) {
+		return IndexPath(name), true
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) && Exists(path) {
+		return IndexPath(path), true
+	}
+	return "", false
+}
+
+// ParseSize parses a volume size such as "4GB", "700M" or "4GiB".
+// K, M, G and T (optionally followed by B) are decimal units as used for
+// media capacities; KiB, MiB, GiB and TiB are binary.
+func ParseSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	units := []struct {
+		suffix string
+		mult   int64
+	}{
+		{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+		{"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+		{"B", 1},
+	}
+	mult := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(str, u.suffix) {
+			str, mult = strings.TrimSuffix(str, u.suffix), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid volume size %q", s)
+	}
+	size := int64(n * float64(mult))
+	if size < 1<<20 {
+		return 0, fmt.Errorf("volume size %q is below 1MiB", s)
+	}
+	return size, nil
+}
+
+// Writer writes a stream into consecutive volumes. Close writes the index.
+type Writer struct {
+	path       string
+	volumeSize int64
+
+	index   Index
+	total   hash.Hash
+	cur     *os.File
+	curHash hash.Hash
+	curSize int64
+}
+
+// Create starts a volume set for path; volumes are created next to it.
+func Create(path string, volumeSize int64) (*Writer, error) {
+	if volumeSize <= 0 {
+		return nil, fmt.Errorf("invalid volume size %d", volumeSize)
+	}
+	if Exists(path) {
+		return nil, fmt.Errorf("%s already exists", IndexPath(path))
+	}
+	return &Writer{
+		path:       path,
+		volumeSize: volumeSize,
+		index:      Index{Version: formatVersion, Name: filepath.Base(path), VolumeSize: volumeSize, Volumes: []Volume{}},
+		total:      sha256.New(),
+	}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if w.cur == nil {
+			if err := w.next(); err != nil {
+				return written, err
+			}
+		}
+		chunk := p
+		if room := w.volumeSize - w.curSize; int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		n, err := w.cur.Write(chunk)
+		w.curHash.Write(chunk[:n])
+		w.total.Write(chunk[:n])
+		w.curSize += int64(n)
+		w.index.Size += int64(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+		if w.curSize == w.volumeSize {
+			if err := w.finish(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *Writer) next() error {
+	name := volumeName(w.index.Name, len(w.index.Volumes)+1)
+	f, err := os.OpenFile(filepath.Join(filepath.Dir(w.path), name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w.cur, w.curHash, w.curSize = f, sha256.New(), 0
+	w.index.Volumes = append(w.index.Volumes, Volume{Name: name})
+	return nil
+}
+
+func (w *Writer) finish() error {
+	v := &w.index.Volumes[len(w.index.Volumes)-1]
+	v.Size = w.curSize
+	v.SHA256 = hex.EncodeToString(w.curHash.Sum(nil))
+	err := w.cur.Close()
+	w.cur = nil
+	return err
+}
+
+// Close finishes the last volume and writes the index.
+func (w *Writer) Close() error {
+	if w.cur == nil && len(w.index.Volumes) == 0 {
+		// An empty stream still yields one (empty) volume
+		if err := w.next(); err != nil {
+			return err
+		}
+	}
+	if w.cur != nil {
+		if err := w.finish(); err != nil {
+			return err
+		}
+	}
+	w.index.SHA256 = hex.EncodeToString(w.total.Sum(nil))
+
+	data, err := json.MarshalIndent(w.index, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := IndexPath(w.path) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, IndexPath(w.path))
+}
+
+// Index returns the index of the volumes written so far.
+func (w *Writer) Index() Index {
+	return w.index
+}
+
+// Abort closes the writer and removes every volume written.
+func (w *Writer) Abort() {
+	if w.cur != nil {
+		w.cur.Close()
+		w.cur = nil
+	}
+	dir := filepath.Dir(w.path)
+	for _, v := range w.index.Volumes {
+		os.Remove(filepath.Join(dir, v.Name))
+	}
+	os.Remove(IndexPath(w.path))
+}
+
+func volumeName(name string, n int) string {
+	return fmt.Sprintf("%s.%03d", name, n)
+}
+
+// ReadIndex loads a volume index.
+func ReadIndex(indexPath string) (*Index, error) {
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read volume index: %w", err)
+	}
+	return ParseIndex(data)
+}
+
+// ParseIndex decodes and validates a volume index.
+func ParseIndex(data []byte) (*Index, error) {
+	var ix Index
+	if err := json.Unmarshal(data, &ix); err != nil {
+		return nil, fmt.Errorf("invalid volume index: %w", err)
+	}
+	if ix.Version != formatVersion {
+		return nil, fmt.Errorf("unsupported volume index version %d", ix.Version)
+	}
+	for _, v := range ix.Volumes {
+		if v.Name != filepath.Base(v.Name) || v.Name == "." || v.Name == ".." {
+			return nil, fmt.Errorf("invalid volume name %q", v.Name)
+		}
+	}
+	return &ix, nil
+}
+
+// CheckError lists the volumes that must be (re)supplied.
+type CheckError struct {
+	Missing []string
+	Corrupt []string
+}
+
+func (e *CheckError) Error() string {
+	var parts []string
+	for _, v := range e.Missing {
+		parts = append(parts, v+" (missing)")
+	}
+	for _, v := range e.Corrupt {
+		parts = append(parts, v+" (corrupt)")
+	}
+	return fmt.Sprintf("%d volume(s) needed: %s", len(parts), strings.Join(parts, ", "))
+}
+
+// Check verifies every volume next to the index against its size and
+// checksum. It returns a *CheckError naming each missing or corrupt volume.
+func Check(indexPath string) (*Index, error) {
+	ix, err := ReadIndex(indexPath)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(indexPath)
+	cerr := &CheckError{}
+	for _, v := range ix.Volumes {
+		p := filepath.Join(dir, v.Name)
+		info, err := os.Stat(p)
+		if errors.Is(err, os.ErrNotExist) {
+			cerr.Missing = append(cerr.Missing, v.Name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() != v.Size {
+			cerr.Corrupt = append(cerr.Corrupt, v.Name)
+			continue
+		}
+		sum, err := SHA256File(p)
+		if err != nil {
+			return nil, err
+		}
+		if sum != v.SHA256 {
+			cerr.Corrupt = append(cerr.Corrupt, v.Name)
+		}
+	}
+	if len(cerr.Missing) > 0 || len(cerr.Corrupt) > 0 {
+		return ix, cerr
+	}
+	return ix, nil
+}
+
+// Open checks a volume set and returns a reader over the reassembled file.
+func Open(indexPath string) (io.ReadCloser, *Index, error) {
+	ix, err := Check(indexPath)
+	if err != nil {
+		return nil, ix, err
+	}
+
+	dir := filepath.Dir(indexPath)
+	r := &reader{}
+	for _, v := range ix.Volumes {
+		f, err := os.Open(filepath.Join(dir, v.Name))
+		if err != nil {
+			r.Close()
+			return nil, ix, err
+		}
+		r.files = append(r.files, f)
+	}
+	readers := make([]io.Reader, len(r.files))
+	for i, f := range r.files {
+		readers[i] = f
+	}
+	r.Reader = io.MultiReader(readers...)
+	return r, ix, nil
+}
+
+type reader struct {
+	io.Reader
+	files []*os.File
+}
+
+func (r *reader) Close() error {
+	for _, f := range r.files {
+		f.Close()
+	}
+	return nil
+}
+
+// SHA256File returns the hex-encoded sha256 digest of the file at path.
+func SHA256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,147 @@
+package volume
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeVolumes(t *testing.T, path string, data []byte, size int64) *Index {
+	t.Helper()
+	w, err := Create(path, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Uneven writes to cross volume boundaries mid-buffer
+	for off := 0; off < len(data); off += 700 {
+		end := min(off+700, len(data))
+		if _, err := w.Write(data[off:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ix := w.Index()
+	return &ix
+}
+
+func TestSplitAndReassemble(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "images.tar")
+	data := make([]byte, 10000)
+	rand.Read(data)
+
+	ix := writeVolumes(t, path, data, 4096)
+	if len(ix.Volumes) != 3 || ix.Volumes[0].Name != "images.tar.001" || ix.Volumes[2].Size != 10000-2*4096 {
+		t.Fatalf("unexpected volumes: %+v", ix.Volumes)
+	}
+
+	r, got, err := Open(IndexPath(path))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer r.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatal("reassembled data differs")
+	}
+	if got.Size != int64(len(data)) || got.SHA256 != ix.SHA256 {
+		t.Errorf("index mismatch: %+v", got)
+	}
+
+	if _, err := Create(path, 4096); err == nil {
+		t.Error("expected Create to refuse an existing volume set")
+	}
+}
+
+func TestCheckReportsNeededVolumes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "images.tar")
+	data := make([]byte, 5*1024)
+	rand.Read(data)
+	writeVolumes(t, path, data, 1024)
+
+	if err := os.Remove(filepath.Join(dir, "images.tar.002")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "images.tar.004"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("x"), 10)
+	f.Close()
+	if err := os.Truncate(filepath.Join(dir, "images.tar.005"), 100); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Check(IndexPath(path))
+	var cerr *CheckError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("expected a CheckError, got %v", err)
+	}
+	if !reflect.DeepEqual(cerr.Missing, []string{"images.tar.002"}) {
+		t.Errorf("missing = %v", cerr.Missing)
+	}
+	if !reflect.DeepEqual(cerr.Corrupt, []string{"images.tar.004", "images.tar.005"}) {
+		t.Errorf("corrupt = %v", cerr.Corrupt)
+	}
+	if _, _, err := Open(IndexPath(path)); err == nil {
+		t.Error("expected Open to fail")
+	}
+}
+
+func TestIndexFor(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "images.tar")
+	writeVolumes(t, path, make([]byte, 3000), 1024)
+	other := filepath.Join(dir, "other.tar")
+	os.WriteFile(other, []byte("x"), 0644)
+	os.WriteFile(other+".001", []byte("x"), 0644)
+
+	for p, want := range map[string]string{
+		IndexPath(path): IndexPath(path),
+		path + ".001":   IndexPath(path),
+		path:            IndexPath(path),
+		path + ".002":   "",
+		other:           "",
+		other + ".001":  "",
+	} {
+		got, ok := IndexFor(p)
+		if got != want || ok != (want != "") {
+			t.Errorf("IndexFor(%s) = %q, %v", filepath.Base(p), got, ok)
+		}
+	}
+
+	if _, err := ParseIndex([]byte(`{"version":1,"volumes":[{"name":".."}]}`)); err == nil {
+		t.Error("expected a volume named .. to be rejected")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"4GB":   4e9,
+		"4g":    4e9,
+		"700MB": 700e6,
+		"2GiB":  2 << 30,
+		"1.5G":  1.5e9,
+	}
+	for in, want := range tests {
+		got, err := ParseSize(in)
+		if err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "abc", "-1G", "10KB"} {
+		if _, err := ParseSize(in); err == nil {
+			t.Errorf("ParseSize(%q): expected an error", in)
+		}
+	}
+}
@@ -1,3 +1,114 @@
+use std::fs;
+use std::io::Write;
+use std::path::Path;
+
+use tauri::Manager;
+use tauri_plugin_shell::ShellExt;
+
+/// Returns the passphrase of the desktop vault: HORCRUX_SECRET when it is
+/// set, else a random secret generated once per install and kept in the app
+/// data dir. A vault still encrypted with the built-in passphrase is rotated
+/// to the new secret before it is saved.
+#[tauri::command]
+async fn vault_secret(app: tauri::AppHandle) -> Result<String, String> {
+  if let Ok(secret) = std::env::var("HORCRUX_SECRET") {
+    if !secret.is_empty() {
+      return Ok(secret);
+    }
+  }
+
+  let dir = app.path().app_data_dir().map_err(|e| e.to_string())?;
+  let path = dir.join("vault.secret");
+  if let Ok(secret) = fs::read_to_string(&path) {
+    return Ok(secret.trim_end().to_string());
+  }
+  fs::create_dir_all(&dir).map_err(|e| format!("failed to create {}: {e}", dir.display()))?;
+
+  // The pending secret is kept until the vault uses it, so a crash between
+  // rotating the vault and saving the secret does not lose the key.
+  let pending = dir.join("vault.secret.new");
+  let secret = match fs::read_to_string(&pending) {
+    Ok(s) if !s.trim_end().is_empty() => s.trim_end().to_string(),
+    _ => {
+      let s = random_secret()?;
+      write_private(&pending, &s)?;
+      s
+    }
+  };
+
+  if dir.join("vault.enc").exists() && !vault_opens(&app, &dir, &secret).await? {
+    rotate_vault(&app, &dir, &pending).await?;
+  }
+  fs::rename(&pending, &path).map_err(|e| format!("failed to save {}: {e}", path.display()))?;
+  Ok(secret)
+}
+
+/// Returns 32 random bytes as hex.
+fn random_secret() -> Result<String, String> {
+  let mut buf = [0u8; 32];
+  getrandom::fill(&mut buf).map_err(|e| format!("failed to generate vault secret: {e}"))?;
+  Ok(buf.iter().map(|b| format!("{b:02x}")).collect())
+}
+
+/// Writes a file only the current user can read.
+fn write_private(path: &Path, contents: &str) -> Result<(), String> {
+  let mut opts = fs::OpenOptions::new();
+  opts.write(true).create(true).truncate(true);
+  #[cfg(unix)]
+  {
+    use std::os::unix::fs::OpenOptionsExt;
+    opts.mode(0o600);
+  }
+  let mut f = opts.open(path).map_err(|e| format!("failed to write {}: {e}", path.display()))?;
+  f.write_all(contents.as_bytes())
+    .and_then(|_| f.sync_all())
+    .map_err(|e| format!("failed to write {}: {e}", path.display()))
+}
+
+/// Reports whether secret decrypts the vault of dir.
+async fn vault_opens(app: &tauri::AppHandle, dir: &Path, secret: &str) -> Result<bool, String> {
+  let dir = dir.to_string_lossy();
+  let output = app
+    .shell()
+    .sidecar("horcrux-backend")
+    .map_err(|e| e.to_string())?
+    .args(["vault", "list", "--data-dir", dir.as_ref(), "-o", "json"])
+    .env("HORCRUX_SECRET", secret)
+    .output()
+    .await
+    .map_err(|e| e.to_string())?;
+  Ok(output.status.success())
+}
+
+/// Re-encrypts the vault of dir from the built-in passphrase to the secret
+/// in secret_file.
+async fn rotate_vault(app: &tauri::AppHandle, dir: &Path, secret_file: &Path) -> Result<(), String> {
+  let (dir, secret_file) = (dir.to_string_lossy(), secret_file.to_string_lossy());
+  let output = app
+    .shell()
+    .sidecar("horcrux-backend")
+    .map_err(|e| e.to_string())?
+    .args([
+      "vault",
+      "rotate-key",
+      "--data-dir",
+      dir.as_ref(),
+      "--new-secret-file",
+      secret_file.as_ref(),
+    ])
+    .env("HORCRUX_SECRET", "")
+    .output()
+    .await
+    .map_err(|e| e.to_string())?;
+  if !output.status.success() {
+    return Err(format!(
+      "failed to move the vault to a per-install secret: {}",
+      String::from_utf8_lossy(&output.stderr).trim()
+    ));
+  }
+  Ok(())
+}
+
 #[cfg_attr(mobile, tauri::mobile_entry_point)]
 pub fn run() {
   tauri::Builder::default()
@@ -12,6 +123,7 @@ pub fn run() {
       app.handle().plugin(tauri_plugin_shell::init())?;
       Ok(())
     })
+    .invoke_handler(tauri::generate_handler![vault_secret])
     .run(tauri::generate_context!())
     .expect("error while running tauri application");
 }
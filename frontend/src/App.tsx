@@ -1,6 +1,7 @@
 import { useState, useEffect } from 'react';
 import { Command } from '@tauri-apps/plugin-shell';
 import { appDataDir } from '@tauri-apps/api/path';
+import { invoke } from '@tauri-apps/api/core';
 import { Navbar } from './components/Navbar';
 import Vault from './components/Vault';
 import Designer from './components/Designer';
@@ -48,7 +49,12 @@ function App() {
           try {
             const dataDir = await appDataDir();
             console.log('App Data Dir:', dataDir);
-            const command = Command.sidecar('horcrux-backend', ['serve', '--port', '7626', '--data-dir', dataDir]);
+            // The desktop vault uses HORCRUX_SECRET, or a random secret generated once per install
+            setInitStatus('Unlocking vault...');
+            const secret = await invoke<string>('vault_secret');
+            const command = Command.sidecar('horcrux-backend', ['serve', '--port', '7626', '--data-dir', dataDir], {
+              env: { HORCRUX_SECRET: secret },
+            });
             console.log('[DEBUG] Created sidecar command:', command);
 
             command.on('close', data => {
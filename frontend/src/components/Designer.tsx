@@ -659,8 +659,10 @@ const Designer: React.FC = () => {
 
   const executeSync = async () => {
     // Simple logic: find path connecting source and target from edges
-    // Currently simplified: directly find sourceNode and targetNode in the graph
-    const sourceNode = nodes.find(n => n.type === 'sourceNode');
+    // Currently simplified: directly find sourceNode and targetNode in the graph.
+    // Several source nodes are merged into one multi-arch manifest list.
+    const sourceNodes = nodes.filter(n => n.type === 'sourceNode');
+    const sourceNode = sourceNodes[0];
     const targetNodes = nodes.filter(n => n.type === 'targetNode');
 
     if (!sourceNode || targetNodes.length === 0) {
@@ -668,10 +670,11 @@ const Designer: React.FC = () => {
       return;
     }
 
+    const missingSource = sourceNodes.find((n) => !n.data?.image);
     const missingTarget = targetNodes.find((n) => !n.data?.image);
-    if (!sourceNode.data.image || missingTarget) {
+    if (missingSource || missingTarget) {
       alert('Please configure source image and target image first');
-      setSelectedNode(sourceNode.data.image ? missingTarget || targetNodes[0] : sourceNode);
+      setSelectedNode(missingSource || missingTarget || targetNodes[0]);
       return;
     }
 
@@ -683,12 +686,18 @@ const Designer: React.FC = () => {
     
     try {
       // Use archiveRef if available for source
-      const sourceData = sourceNode.data as Record<string, string | undefined>;
-      const sourceRef = sourceData.archiveRef || sourceNode.data.image;
-      
+      const sources = sourceNodes.map((n) => {
+        const sourceData = n.data as Record<string, string | undefined>;
+        return {
+          source_ref: sourceData.archiveRef || n.data.image,
+          source_id: n.data.credId,
+        };
+      });
+
       const response = await api.post('/tasks/sync', {
-        source_ref: sourceRef,
-        source_id: sourceNode.data.credId,
+        ...(sources.length > 1
+          ? { sources, flatten: true }
+          : { source_ref: sources[0].source_ref, source_id: sources[0].source_id }),
         targets: targetNodes
           .map((n) => ({
             target_ref: n.data.image,
@@ -295,14 +295,13 @@ export const ImageArchiveLoader: React.FC<ImageArchiveLoaderProps> = ({ open, on
                     onChange={(e) => e.target.files && handleFiles(Array.from(e.target.files))}
                     multiple
                     className="hidden"
-                    accept=".tar,.tar.gz,.tgz,.zip"
                   />
                   <Upload className={`w-12 h-12 mb-4 ${isDragging ? 'text-primary' : 'text-textMain/40'}`} />
                   <div className="text-xs uppercase font-bold text-textMain/60 mb-2">
                     Click or Drag archive files here
                   </div>
                   <div className="text-[10px] text-textMain/40">
-                    Supports .tar, .tar.gz, .zip
+                    Supports .tar, .tar.gz, .zip, or a .volumes.json index together with its volumes
                   </div>
                 </div>
 